@@ -0,0 +1,192 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// usernameGroups groups the queries read from the input by username, in the
+// order each username first appears, so that the passwords of a username are
+// sent together and share the fetch of its bucket
+type usernameGroups struct {
+	order  []string
+	groups map[string][]*query
+	// failed holds the queries that could not be read
+	failed []*query
+}
+
+func newUsernameGroups() *usernameGroups {
+	return &usernameGroups{groups: make(map[string][]*query)}
+}
+
+// add adds a query to the group of its username. Passwords repeated for the
+// same username are only queried once.
+func (g *usernameGroups) add(q *query) {
+	if q.err != nil {
+		g.failed = append(g.failed, q)
+		return
+	}
+	key := string(q.username)
+	group, ok := g.groups[key]
+	if !ok {
+		g.order = append(g.order, key)
+	}
+	for _, other := range group {
+		if string(other.password) == string(q.password) {
+			return
+		}
+	}
+	g.groups[key] = append(group, q)
+}
+
+// jobs returns a job for the queries of each username, split into jobs of at
+// most size queries, after a job reporting the queries that could not be read
+func (g *usernameGroups) jobs(size int) []*job {
+	var jobs []*job
+	if len(g.failed) > 0 {
+		jobs = append(jobs, &job{queries: g.failed})
+	}
+	for _, key := range g.order {
+		group := g.groups[key]
+		for len(group) > size {
+			jobs = append(jobs, &job{queries: group[:size]})
+			group = group[size:]
+		}
+		jobs = append(jobs, &job{queries: group})
+	}
+	return jobs
+}
+
+// statusRank orders breach statuses from the least to the most severe
+func statusRank(status migp.BreachStatus) int {
+	switch status {
+	case migp.InBreachExact:
+		return 3
+	case migp.InBreachSimilar:
+		return 2
+	case migp.UsernameInBreach:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// usernameSummary aggregates the results of the passwords queried for a
+// username
+type usernameSummary struct {
+	username []byte
+	// status and metadata are those of the most severe result
+	status   migp.BreachStatus
+	metadata []byte
+	// passwords counts the passwords queried, breached those found in a
+	// breach or similar to a breached password, and failed those whose
+	// query failed
+	passwords, breached, failed int
+	breachedPasswords           [][]byte
+}
+
+// usernameSummaries aggregates query results per username, in the order each
+// username was first recorded
+type usernameSummaries struct {
+	order     []*usernameSummary
+	summaries map[string]*usernameSummary
+}
+
+func newUsernameSummaries() *usernameSummaries {
+	return &usernameSummaries{summaries: make(map[string]*usernameSummary)}
+}
+
+// record adds the outcome of a query to the summary of its username
+func (s *usernameSummaries) record(q *query) {
+	summary, ok := s.summaries[string(q.username)]
+	if !ok {
+		summary = &usernameSummary{username: q.username}
+		s.summaries[string(q.username)] = summary
+		s.order = append(s.order, summary)
+	}
+	summary.passwords++
+	if q.err != nil {
+		summary.failed++
+		return
+	}
+	status := q.result.Status
+	if status == migp.InBreachExact || status == migp.InBreachSimilar {
+		summary.breached++
+		summary.breachedPasswords = append(summary.breachedPasswords, q.password)
+	}
+	if statusRank(status) > statusRank(summary.status) {
+		summary.status, summary.metadata = status, q.result.Metadata
+	}
+}
+
+// breached reports whether any username has a password in a breach, or is
+// itself in a breach
+func (s *usernameSummaries) breached() bool {
+	for _, summary := range s.order {
+		if summary.status != migp.NotInBreach {
+			return true
+		}
+	}
+	return false
+}
+
+// write writes each summary to w as a line of JSON, listing the breached
+// passwords if showPassword is set
+func (s *usernameSummaries) write(w io.Writer, showPassword bool) error {
+	writer := bufio.NewWriter(w)
+	for _, summary := range s.order {
+		out, err := summary.marshal(showPassword)
+		if err != nil {
+			return err
+		}
+		writer.Write(out)
+		writer.WriteByte('\n')
+	}
+	return writer.Flush()
+}
+
+// marshal encodes the summary as JSON, with the metadata of the most severe
+// result encoded as marshalResult does
+func (s *usernameSummary) marshal(showPassword bool) ([]byte, error) {
+	metadata := s.metadata
+	count := migp.MetadataCount(metadata)
+	var breach *migp.BreachMetadata
+	if m, err := migp.ParseBreachMetadata(metadata); err == nil {
+		breach, metadata = &m, nil
+	}
+	var breachedPasswords []string
+	if showPassword {
+		for _, password := range s.breachedPasswords {
+			breachedPasswords = append(breachedPasswords, string(password))
+		}
+	}
+	return json.Marshal(struct {
+		Username          string               `json:"username"`
+		Status            string               `json:"status"`
+		Match             string               `json:"match"`
+		Passwords         int                  `json:"passwords"`
+		Breached          int                  `json:"breached"`
+		Failed            int                  `json:"failed,omitempty"`
+		BreachedPasswords []string             `json:"breachedPasswords,omitempty"`
+		Count             int64                `json:"count,omitempty"`
+		Metadata          string               `json:"metadata,omitempty"`
+		Breach            *migp.BreachMetadata `json:"breach,omitempty"`
+	}{
+		Username:          string(s.username),
+		Status:            s.status.String(),
+		Match:             s.status.Match(),
+		Passwords:         s.passwords,
+		Breached:          s.breached,
+		Failed:            s.failed,
+		BreachedPasswords: breachedPasswords,
+		Count:             count,
+		Metadata:          string(metadata),
+		Breach:            breach,
+	})
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// TestUsernameGroups tests that queries are grouped by username in input
+// order, without repeated passwords, and split into jobs of the given size
+func TestUsernameGroups(t *testing.T) {
+	groups := newUsernameGroups()
+	for i, credential := range []string{"alice:1", "bob:1", "alice:2", "alice:1", "alice:3", "bob:2"} {
+		fields := strings.SplitN(credential, ":", 2)
+		groups.add(&query{line: i + 1, username: []byte(fields[0]), password: []byte(fields[1])})
+	}
+	groups.add(&query{line: 7, err: errors.New("unreadable")})
+
+	want := []string{"7", "alice:1 alice:2", "alice:3", "bob:1 bob:2"}
+	jobs := groups.jobs(2)
+	if len(jobs) != len(want) {
+		t.Fatalf("want %d jobs, got %d", len(want), len(jobs))
+	}
+	for i, job := range jobs {
+		var got []string
+		for _, q := range job.queries {
+			if q.err != nil {
+				got = append(got, "7")
+			} else {
+				got = append(got, string(q.username)+":"+string(q.password))
+			}
+		}
+		if strings.Join(got, " ") != want[i] {
+			t.Errorf("failed test %d: want %q, got %q", i, want[i], strings.Join(got, " "))
+		}
+	}
+}
+
+// TestUsernameSummaries tests that the summary of a username reports its
+// most severe result and counts the breached and failed passwords
+func TestUsernameSummaries(t *testing.T) {
+	summaries := newUsernameSummaries()
+	record := func(username, password string, status migp.BreachStatus, metadata string, err error) {
+		summaries.record(&query{
+			username: []byte(username),
+			password: []byte(password),
+			result:   migp.QueryResult{Status: status, Metadata: []byte(metadata)},
+			err:      err,
+		})
+	}
+	record("alice", "1", migp.NotInBreach, "", nil)
+	record("alice", "2", migp.InBreachSimilar, "similar", nil)
+	record("bob", "1", migp.NotInBreach, "", nil)
+	record("alice", "3", migp.InBreachExact, "exact", nil)
+	record("alice", "4", migp.NotInBreach, "", errors.New("failed"))
+	record("bob", "2", migp.UsernameInBreach, "username", nil)
+
+	testCases := []struct {
+		showPassword bool
+		want         string
+	}{
+		{false, `{"username":"alice","status":"password in breach","match":"exact","passwords":4,"breached":2,"failed":1,"metadata":"exact"}
+{"username":"bob","status":"username in breach","match":"username","passwords":2,"breached":0,"metadata":"username"}
+`},
+		{true, `{"username":"alice","status":"password in breach","match":"exact","passwords":4,"breached":2,"failed":1,"breachedPasswords":["2","3"],"metadata":"exact"}
+{"username":"bob","status":"username in breach","match":"username","passwords":2,"breached":0,"metadata":"username"}
+`},
+	}
+	for i, test := range testCases {
+		var out bytes.Buffer
+		if err := summaries.write(&out, test.showPassword); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("failed test %d: want %s, got %s", i, test.want, out.String())
+		}
+	}
+	if !summaries.breached() {
+		t.Error("want breached summaries")
+	}
+}
+
+// mapGetter serves buckets from a map. Implements migp.Getter
+type mapGetter map[string][]byte
+
+func (g mapGetter) Get(id string) ([]byte, error) {
+	return g[id], nil
+}
+
+// TestUsernameSummariesKeyRotation tests that a username whose breached
+// password was ingested before a key rotation is summarized as breached when
+// its passwords are queried together
+func TestUsernameSummariesKeyRotation(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	cfg.SlowHasherID = migp.SlowHasherNull
+	oldServer, err := migp.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := mapGetter{}
+	entry, err := oldServer.EncryptBucketEntry([]byte("alice"), []byte("2"), migp.MetadataBreachedPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv[migp.BucketIDToHex(oldServer.BucketID([]byte("alice")))] = entry
+	if err := cfg.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	server, err := migp.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var request migp.BatchClientRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, err := server.HandleBatchRequest(request, kv)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer httpServer.Close()
+
+	client, err := migp.NewClient(server.Config().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usernames := [][]byte{[]byte("alice"), []byte("alice"), []byte("alice")}
+	passwords := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
+	results, err := client.QueryBatch(context.Background(), httpServer.URL, usernames, passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaries := newUsernameSummaries()
+	for i, result := range results {
+		summaries.record(&query{username: usernames[i], password: passwords[i], result: result, err: result.Err})
+	}
+	summary := summaries.summaries["alice"]
+	if summary.status != migp.InBreach || summary.breached != 1 || summary.passwords != 3 {
+		t.Errorf("want %s with 1 of 3 passwords breached, got %s with %d of %d", migp.InBreach, summary.status, summary.breached, summary.passwords)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// benchOptions controls a load test against the target server
+type benchOptions struct {
+	// queries is the number of queries to send, 0 for no limit
+	queries int
+	// qps is the rate at which queries are started, 0 for as fast as the
+	// workers allow
+	qps float64
+	// duration stops the load test after this long, 0 for no limit
+	duration time.Duration
+	// concurrency is the number of queries in flight at once
+	concurrency int
+}
+
+// benchReport summarizes the latencies and throughput of a load test
+type benchReport struct {
+	queries, failures int
+	elapsed           time.Duration
+	// latencies of the successful queries, sorted
+	latencies []time.Duration
+}
+
+// runBench calls query at the configured rate from opts.concurrency workers
+// until opts.queries have been sent or opts.duration has passed. If the
+// workers cannot keep up, queries are started as soon as one is free, so the
+// achieved rate may fall short of opts.qps.
+func runBench(opts benchOptions, query func() error) benchReport {
+	if opts.concurrency < 1 {
+		opts.concurrency = 1
+	}
+	start := time.Now()
+	var deadline time.Time
+	if opts.duration > 0 {
+		deadline = start.Add(opts.duration)
+	}
+
+	ticks := make(chan struct{})
+	go func() {
+		defer close(ticks)
+		for i := 0; opts.queries == 0 || i < opts.queries; i++ {
+			if opts.qps > 0 {
+				next := start.Add(time.Duration(float64(i) / opts.qps * float64(time.Second)))
+				time.Sleep(time.Until(next))
+			}
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				return
+			}
+			ticks <- struct{}{}
+		}
+	}()
+
+	var report benchReport
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < opts.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range ticks {
+				began := time.Now()
+				err := query()
+				latency := time.Since(began)
+				lock.Lock()
+				report.queries++
+				if err != nil {
+					report.failures++
+				} else {
+					report.latencies = append(report.latencies, latency)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	report.elapsed = time.Since(start)
+	sort.Slice(report.latencies, func(i, j int) bool { return report.latencies[i] < report.latencies[j] })
+	return report
+}
+
+// percentile returns the latency below which p percent of the successful
+// queries completed, using the nearest-rank method
+func (r benchReport) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(r.latencies)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return r.latencies[rank]
+}
+
+// write writes the report to w
+func (r benchReport) write(w io.Writer) {
+	fmt.Fprintf(w, "Query count: %d\n", r.queries)
+	fmt.Fprintf(w, "Failure count: %d\n", r.failures)
+	fmt.Fprintf(w, "Duration %s\n", r.elapsed)
+	fmt.Fprintf(w, "Throughput %.2f queries/s\n", float64(r.queries)/r.elapsed.Seconds())
+	fmt.Fprintf(w, "P50 %s\n", r.percentile(50))
+	fmt.Fprintf(w, "P95 %s\n", r.percentile(95))
+	fmt.Fprintf(w, "P99 %s\n", r.percentile(99))
+}
+
+// randomCredential returns a random username and password, which are almost
+// certainly not in any breach but still cost the server a bucket lookup
+func randomCredential() (username, password []byte, err error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, nil, err
+	}
+	return []byte(hex.EncodeToString(buf[:8])), []byte(hex.EncodeToString(buf[8:])), nil
+}
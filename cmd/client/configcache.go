@@ -0,0 +1,114 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// cachedConfig is the configuration a server last sent, along with the
+// validators to revalidate it with
+type cachedConfig struct {
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"lastModified,omitempty"`
+	Config       json.RawMessage `json:"config"`
+}
+
+// configCache keeps the configuration of each target server across runs, so
+// that an unchanged configuration is not downloaded again
+type configCache map[string]cachedConfig
+
+// defaultConfigCacheFile returns the file configurations are cached in unless
+// -config-cache is given, or an empty string if there is no user cache
+// directory
+func defaultConfigCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "migp", "config-cache.json")
+}
+
+// loadConfigCache reads the configurations cached in the named file,
+// returning an empty cache if the file does not exist yet
+func loadConfigCache(name string) (configCache, error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return configCache{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cache := configCache{}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("invalid config cache %s: %w", name, err)
+	}
+	return cache, nil
+}
+
+// save writes the cached configurations to the named file
+func (c configCache) save(name string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(name, append(data, '\n'))
+}
+
+// fetch retrieves the MIGP configuration of the target server. If the cache
+// holds a configuration of the target, the request is conditional and the
+// cached configuration is returned if the server answers that it has not
+// changed. Configurations sent with an ETag or Last-Modified time are cached,
+// while one sent without either drops the cached configuration of the target.
+// fetch reports whether the cache was updated.
+func (c configCache) fetch(httpClient *http.Client, targetURL string) (migp.Config, bool, error) {
+	var cfg migp.Config
+	req, err := http.NewRequest(http.MethodGet, targetURL+"/config", nil)
+	if err != nil {
+		return cfg, false, err
+	}
+	cached, ok := c[targetURL]
+	if ok {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return cfg, false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && ok:
+		err = json.Unmarshal(cached.Config, &cfg)
+		return cfg, false, err
+	case resp.StatusCode != http.StatusOK:
+		return cfg, false, fmt.Errorf("Unable to retrieve MIGP config from target %q: status code %d", targetURL, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return cfg, false, err
+	}
+	if err := json.Unmarshal(body, &cfg); err != nil {
+		return cfg, false, err
+	}
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		delete(c, targetURL)
+		return cfg, ok, nil
+	}
+	c[targetURL] = cachedConfig{ETag: etag, LastModified: lastModified, Config: body}
+	return cfg, true, nil
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// TestConfigCacheFetch tests that cached configurations are revalidated with
+// conditional requests and reused on 304, replaced on 200, and that
+// configurations without an ETag or Last-Modified time are not cached
+func TestConfigCacheFetch(t *testing.T) {
+	// the server sends the configuration with the current key ID and
+	// validators, or 304 if the request matches a validator
+	var etag, lastModified string
+	var keyID uint32
+	var ifNoneMatch, ifModifiedSince string
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/config" {
+			http.NotFound(w, req)
+			return
+		}
+		ifNoneMatch, ifModifiedSince = req.Header.Get("If-None-Match"), req.Header.Get("If-Modified-Since")
+		if (etag != "" && ifNoneMatch == etag) || (lastModified != "" && ifModifiedSince == lastModified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if lastModified != "" {
+			w.Header().Set("Last-Modified", lastModified)
+		}
+		cfg := migp.DefaultConfig()
+		cfg.KeyID = keyID
+		json.NewEncoder(w).Encode(cfg)
+	}))
+	defer httpServer.Close()
+
+	const modified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	testCases := []struct {
+		etag, lastModified  string
+		keyID               uint32
+		wantIfNoneMatch     string
+		wantIfModifiedSince string
+		wantKeyID           uint32
+		wantUpdated         bool
+		wantCached          bool
+	}{
+		// first fetch
+		{`"v1"`, "", 1, "", "", 1, true, true},
+		// 304 reuses the cached configuration
+		{`"v1"`, "", 2, `"v1"`, "", 1, false, true},
+		// 200 replaces it
+		{`"v2"`, "", 2, `"v1"`, "", 2, true, true},
+		{"", modified, 3, `"v2"`, "", 3, true, true},
+		{"", modified, 4, "", modified, 3, false, true},
+		// no validators
+		{"", "", 5, "", modified, 5, true, false},
+		{"", "", 6, "", "", 6, false, false},
+	}
+
+	cache := configCache{}
+	for i, test := range testCases {
+		etag, lastModified, keyID = test.etag, test.lastModified, test.keyID
+		cfg, updated, err := cache.fetch(httpServer.Client(), httpServer.URL)
+		if err != nil {
+			t.Fatalf("failed test %d: %v", i, err)
+		}
+		if ifNoneMatch != test.wantIfNoneMatch || ifModifiedSince != test.wantIfModifiedSince {
+			t.Errorf("failed test %d: want If-None-Match %q and If-Modified-Since %q, got %q and %q", i, test.wantIfNoneMatch, test.wantIfModifiedSince, ifNoneMatch, ifModifiedSince)
+		}
+		if cfg.KeyID != test.wantKeyID || updated != test.wantUpdated {
+			t.Errorf("failed test %d: want key ID %d and updated %v, got %d and %v", i, test.wantKeyID, test.wantUpdated, cfg.KeyID, updated)
+		}
+		if _, cached := cache[httpServer.URL]; cached != test.wantCached {
+			t.Errorf("failed test %d: want cached %v, got %v", i, test.wantCached, cached)
+		}
+	}
+
+	// an error status is not mistaken for a configuration
+	if _, _, err := cache.fetch(httpServer.Client(), httpServer.URL+"/missing"); err == nil {
+		t.Error("want error for status 404")
+	}
+}
+
+// TestConfigCacheSave tests that a saved cache is loaded back unchanged
+func TestConfigCacheSave(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "migp", "config-cache.json")
+	cache, err := loadConfigCache(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache) != 0 {
+		t.Errorf("want empty cache, got %v", cache)
+	}
+	cache["https://migp.example"] = cachedConfig{ETag: `"v1"`, Config: json.RawMessage(`{"keyID":1}`)}
+	if err := cache.save(name); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadConfigCache(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the configuration is indented in the file
+	got, want := loaded["https://migp.example"], cache["https://migp.example"]
+	var config bytes.Buffer
+	if err := json.Compact(&config, got.Config); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 || got.ETag != want.ETag || got.LastModified != want.LastModified || !bytes.Equal(config.Bytes(), want.Config) {
+		t.Errorf("want %v, got %v", cache, loaded)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+const (
+	// formatText reads <username>:<password> lines and writes JSON lines
+	formatText = "text"
+	// formatCSV reads CSV records with a header row and writes CSV records
+	formatCSV = "csv"
+)
+
+// credentialReader reads the credential pairs to query
+type credentialReader interface {
+	// Read returns the next credential pair and the input line it was read
+	// from, or io.EOF at the end of the input. The returned slices are only
+	// valid until the next call.
+	Read() (line int, username, password []byte, err error)
+}
+
+// textReader reads credential pairs from lines in the format
+// <username><delimiter><password>, skipping lines without a delimiter. Lines
+// are split at the first delimiter, so passwords may contain it.
+type textReader struct {
+	scanner   *bufio.Scanner
+	delimiter []byte
+	line      int
+}
+
+func newTextReader(r io.Reader, delimiter string) *textReader {
+	return &textReader{scanner: bufio.NewScanner(r), delimiter: []byte(delimiter)}
+}
+
+func (r *textReader) Read() (int, []byte, []byte, error) {
+	for r.scanner.Scan() {
+		r.line += 1
+		fields := bytes.SplitN(r.scanner.Bytes(), r.delimiter, 2)
+		if len(fields) < 2 {
+			continue
+		}
+		return r.line, fields[0], fields[1], nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return r.line, nil, nil, err
+	}
+	return r.line, nil, nil, io.EOF
+}
+
+// passwordReader reads a password from each line, for queries of passwords
+// alone. The returned username is always nil.
+type passwordReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newPasswordReader(r io.Reader) *passwordReader {
+	return &passwordReader{scanner: bufio.NewScanner(r)}
+}
+
+func (r *passwordReader) Read() (int, []byte, []byte, error) {
+	if r.scanner.Scan() {
+		r.line += 1
+		return r.line, nil, r.scanner.Bytes(), nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return r.line, nil, nil, err
+	}
+	return r.line, nil, nil, io.EOF
+}
+
+// singleReader returns a single credential pair given on the command line,
+// as line 1
+type singleReader struct {
+	username, password []byte
+	read               bool
+}
+
+func (r *singleReader) Read() (int, []byte, []byte, error) {
+	if r.read {
+		return 1, nil, nil, io.EOF
+	}
+	r.read = true
+	return 1, r.username, r.password, nil
+}
+
+// csvReader reads credential pairs from the columns of CSV records named in
+// the header row
+type csvReader struct {
+	reader                         *csv.Reader
+	usernameColumn, passwordColumn int
+}
+
+// newCSVReader reads the header row of r and returns a reader of the columns
+// with the given names
+func newCSVReader(r io.Reader, usernameHeader, passwordHeader string) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	c := &csvReader{reader: reader, usernameColumn: -1, passwordColumn: -1}
+	for i, name := range header {
+		switch name {
+		case usernameHeader:
+			c.usernameColumn = i
+		case passwordHeader:
+			c.passwordColumn = i
+		}
+	}
+	if c.usernameColumn < 0 {
+		return nil, fmt.Errorf("no %q column in CSV header", usernameHeader)
+	}
+	if c.passwordColumn < 0 {
+		return nil, fmt.Errorf("no %q column in CSV header", passwordHeader)
+	}
+	return c, nil
+}
+
+func (c *csvReader) Read() (int, []byte, []byte, error) {
+	record, err := c.reader.Read()
+	if err == io.EOF {
+		return 0, nil, nil, io.EOF
+	}
+	line, _ := c.reader.FieldPos(0)
+	if err != nil {
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			line = parseErr.StartLine
+		}
+		return line, nil, nil, err
+	}
+	if c.usernameColumn >= len(record) || c.passwordColumn >= len(record) {
+		return line, nil, nil, fmt.Errorf("record has %d fields, missing username or password", len(record))
+	}
+	return line, []byte(record[c.usernameColumn]), []byte(record[c.passwordColumn]), nil
+}
+
+// resultWriter writes query results
+type resultWriter interface {
+	Write(username, password []byte, status migp.BreachStatus, metadata []byte) error
+	// Flush writes any buffered results
+	Flush() error
+}
+
+// jsonWriter writes each result as a line of JSON, see marshalResult. Every
+// line is flushed as soon as it is written, so that results can be consumed
+// as they arrive.
+type jsonWriter struct {
+	writer       *bufio.Writer
+	showPassword bool
+}
+
+func newJSONWriter(w io.Writer, showPassword bool) *jsonWriter {
+	return &jsonWriter{writer: bufio.NewWriter(w), showPassword: showPassword}
+}
+
+func (w *jsonWriter) Write(username, password []byte, status migp.BreachStatus, metadata []byte) error {
+	out, err := marshalResult(username, password, status, metadata, w.showPassword)
+	if err != nil {
+		return err
+	}
+	w.writer.Write(out)
+	w.writer.WriteByte('\n')
+	return w.writer.Flush()
+}
+
+func (w *jsonWriter) Flush() error {
+	return w.writer.Flush()
+}
+
+// csvWriter writes results as CSV records username,status,metadata, with the
+// password after the username if it is shown
+type csvWriter struct {
+	writer       *csv.Writer
+	showPassword bool
+}
+
+// newCSVWriter returns a writer of results to w, after writing the header row
+func newCSVWriter(w io.Writer, showPassword bool) (*csvWriter, error) {
+	c := &csvWriter{writer: csv.NewWriter(w), showPassword: showPassword}
+	header := []string{"username", "status", "metadata"}
+	if showPassword {
+		header = []string{"username", "password", "status", "metadata"}
+	}
+	if err := c.writer.Write(header); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *csvWriter) Write(username, password []byte, status migp.BreachStatus, metadata []byte) error {
+	record := []string{string(username), status.String(), string(metadata)}
+	if c.showPassword {
+		record = []string{string(username), string(password), status.String(), string(metadata)}
+	}
+	return c.writer.Write(record)
+}
+
+func (c *csvWriter) Flush() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// formatTestResults are written by the result writer tests, with fields that
+// need quoting in CSV
+var formatTestResults = []struct {
+	username, password string
+	status             migp.BreachStatus
+	metadata           string
+}{
+	{"alice@example.com", "pass,word", migp.InBreachExact, `{"count":3}`},
+	{`bob "the builder"`, "pw", migp.NotInBreach, ""},
+	{"carol", "line\nbreak", migp.UsernameInBreach, "raw"},
+}
+
+// TestCSVWriter tests the header row, columns and quoting of CSV results
+func TestCSVWriter(t *testing.T) {
+	testCases := []struct {
+		showPassword bool
+		want         string
+	}{
+		{false, `username,status,metadata
+alice@example.com,password in breach,"{""count"":3}"
+"bob ""the builder""",password not in breach,
+carol,username in breach,raw
+`},
+		{true, `username,password,status,metadata
+alice@example.com,"pass,word",password in breach,"{""count"":3}"
+"bob ""the builder""",pw,password not in breach,
+carol,"line
+break",username in breach,raw
+`},
+	}
+	for i, test := range testCases {
+		var out bytes.Buffer
+		w, err := newCSVWriter(&out, test.showPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, result := range formatTestResults {
+			if err := w.Write([]byte(result.username), []byte(result.password), result.status, []byte(result.metadata)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("failed test %d: want %s, got %s", i, test.want, out.String())
+		}
+	}
+}
+
+// TestJSONWriter tests that each result is written as a line of JSON as soon
+// as it is written
+func TestJSONWriter(t *testing.T) {
+	testCases := []struct {
+		showPassword bool
+		want         []string
+	}{
+		{false, []string{
+			`{"username":"alice@example.com","status":"password in breach","match":"exact","count":3,"breach":{"count":3}}`,
+			`{"username":"bob \"the builder\"","status":"password not in breach","match":"none"}`,
+			`{"username":"carol","status":"username in breach","match":"username","metadata":"raw"}`,
+		}},
+		{true, []string{
+			`{"username":"alice@example.com","password":"pass,word","status":"password in breach","match":"exact","count":3,"breach":{"count":3}}`,
+			`{"username":"bob \"the builder\"","password":"pw","status":"password not in breach","match":"none"}`,
+			`{"username":"carol","password":"line\nbreak","status":"username in breach","match":"username","metadata":"raw"}`,
+		}},
+	}
+	for i, test := range testCases {
+		var out bytes.Buffer
+		w := newJSONWriter(&out, test.showPassword)
+		for j, result := range formatTestResults {
+			if err := w.Write([]byte(result.username), []byte(result.password), result.status, []byte(result.metadata)); err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Join(test.want[:j+1], "\n") + "\n"; out.String() != want {
+				t.Errorf("failed test %d: want %s, got %s", i, want, out.String())
+			}
+		}
+	}
+}
+
+// TestCSVReader tests that credentials are read from the named columns, with
+// quoted fields and the line each record starts on
+func TestCSVReader(t *testing.T) {
+	input := `id,password,email
+1,"pass,word",alice@example.com
+2,"line
+break","bob ""the builder"""
+3,short
+`
+	r, err := newCSVReader(strings.NewReader(input), "email", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		line               int
+		username, password string
+		wantErr            bool
+	}{
+		{2, "alice@example.com", "pass,word", false},
+		{3, `bob "the builder"`, "line\nbreak", false},
+		{5, "", "", true},
+	}
+	for i, test := range testCases {
+		line, username, password, err := r.Read()
+		if (err != nil) != test.wantErr {
+			t.Fatalf("failed test %d: want error %v, got %v", i, test.wantErr, err)
+		}
+		if line != test.line || string(username) != test.username || string(password) != test.password {
+			t.Errorf("failed test %d: want %d %q %q, got %d %q %q", i, test.line, test.username, test.password, line, username, password)
+		}
+	}
+	if _, _, _, err := r.Read(); err != io.EOF {
+		t.Errorf("want EOF, got %v", err)
+	}
+
+	if _, err := newCSVReader(strings.NewReader("email,pass\n"), "email", "password"); err == nil {
+		t.Error("want error for a missing password column")
+	}
+}
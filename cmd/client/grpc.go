@@ -0,0 +1,75 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+	"github.com/cloudflare/migp-go/pkg/migppb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// grpcTransport queries a MIGP server over gRPC instead of HTTP, sending the
+// API key in the authorization metadata of each call
+type grpcTransport struct {
+	conn    *grpc.ClientConn
+	client  migppb.MIGPClient
+	apiKey  string
+	timeout time.Duration
+}
+
+// dialGRPC returns a transport to the gRPC server at target, over TLS unless
+// plaintext is set. Calls time out after timeout, unless it is zero.
+func dialGRPC(target string, plaintext bool, apiKey string, timeout time.Duration) (*grpcTransport, error) {
+	creds := credentials.NewTLS(nil)
+	if plaintext {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcTransport{conn: conn, client: migppb.NewMIGPClient(conn), apiKey: apiKey, timeout: timeout}, nil
+}
+
+// Close closes the connection to the server
+func (t *grpcTransport) Close() error {
+	return t.conn.Close()
+}
+
+// context returns the context of a call, carrying the API key and timeout
+func (t *grpcTransport) context() (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if t.apiKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+t.apiKey)
+	}
+	if t.timeout > 0 {
+		return context.WithTimeout(ctx, t.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// getConfig retrieves the configuration of the server
+func (t *grpcTransport) getConfig() (migp.Config, error) {
+	ctx, cancel := t.context()
+	defer cancel()
+	m, err := t.client.GetConfig(ctx, &migppb.GetConfigRequest{})
+	if err != nil {
+		return migp.Config{}, err
+	}
+	return m.Config(), nil
+}
+
+// query looks up a credential pair, with an Evaluate call for each request
+// of the key epochs and overflow buckets queried
+func (t *grpcTransport) query(client *migp.Client, username, password []byte) (migp.QueryResult, error) {
+	ctx, cancel := t.context()
+	defer cancel()
+	return client.QueryEvaluator(ctx, migppb.Evaluator{Client: t.client}, username, password)
+}
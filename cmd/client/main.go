@@ -6,12 +6,13 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"time"
@@ -20,125 +21,624 @@ import (
 )
 
 func main() {
-	var targetURL, configFile, inputFilename string
-	var dumpConfig, showPassword bool
+	var targetURL, configFile, initConfigFile, inputFilename, username, password, apiKey, tag, format, delimiter, csvUsernameColumn, csvPasswordColumn, logLevel, logFormat, pinFile, configCacheFile, grpcTarget string
+	var dumpConfig, showPassword, failFast, hibp, passwordOnly, quiet, exitCode, allowConfigMismatch, printVersion, benchMode, repin, gzipStdin, groupByUsername, grpcPlaintext bool
+	var cacheTTL, timeout, retryBaseDelay time.Duration
+	var bench benchOptions
+	var batchSize, concurrency, maxRetries int
+	var bucketCacheSize int64
 	var err error
 
 	flag.StringVar(&configFile, "config", "", "Client configuration file (default: retrieve from server)")
+	flag.BoolVar(&printVersion, "version", false, "print the build version and MIGP protocol version, and exit")
+	flag.StringVar(&initConfigFile, "init-config", "", "write a default client configuration to this file, which must not exist, and exit")
 	flag.BoolVar(&dumpConfig, "dump-config", false, "Dump the client configuration to stdout and exit")
+	flag.BoolVar(&allowConfigMismatch, "allow-config-mismatch", false, "only warn when the -config file disagrees with the server's config on bucket IDs, hashing, encryption or the OPRF suite")
+	flag.StringVar(&pinFile, "pin-file", defaultPinFile(), "file pinning the OPRF public keys of each target across runs, warning when a server's key changes (empty disables pinning)")
+	flag.BoolVar(&repin, "repin", false, "accept changed OPRF public keys of the target, replacing those pinned")
+	flag.StringVar(&configCacheFile, "config-cache", defaultConfigCacheFile(), "file caching the config of each target across runs, revalidated with a conditional request instead of downloaded again (empty disables caching)")
 	flag.BoolVar(&showPassword, "show-password", false, "Show the password in the output")
 	flag.StringVar(&inputFilename, "infile", "-", "input file of credentials to query in the format <username>:<password> ('-' for stdin)")
+	flag.BoolVar(&gzipStdin, "gzip-stdin", false, "decompress input read from stdin with gzip (input files with a .gz extension or gzip header are always decompressed)")
+	flag.StringVar(&username, "username", "", "query this username alone instead of reading -infile, together with -password")
+	flag.StringVar(&password, "password", "", "query this password alone instead of reading -infile (visible to other local users in the process list)")
+	flag.StringVar(&format, "format", formatText, fmt.Sprintf("input and output format: %q reads <username>:<password> lines and writes JSON lines, %q reads CSV with a header row and writes username,status,metadata rows", formatText, formatCSV))
+	flag.StringVar(&delimiter, "delimiter", ":", "delimiter between username and password of text input lines")
+	flag.StringVar(&csvUsernameColumn, "csv-username-column", "username", "header of the username column of CSV input")
+	flag.StringVar(&csvPasswordColumn, "csv-password-column", "password", "header of the password column of CSV input")
+	flag.BoolVar(&hibp, "hibp", false, "query each input line as a password alone, against passwords ingested from SHA-1 hashes in the HIBP format")
+	flag.BoolVar(&passwordOnly, "password-only", false, "query each input line as a password alone, against password-only entries ingested with the server's -password-only")
 	flag.StringVar(&targetURL, "target", "http://localhost:8080", "target MIGP server")
+	flag.StringVar(&grpcTarget, "grpc-target", "", "query the MIGP server at this gRPC address (host:port) instead of -target")
+	flag.BoolVar(&grpcPlaintext, "grpc-plaintext", false, "connect to -grpc-target without TLS")
+	flag.StringVar(&apiKey, "api-key", os.Getenv("MIGP_API_KEY"), "API key to authenticate to the server with (default: $MIGP_API_KEY)")
+	flag.StringVar(&tag, "tag", "", "query the breach namespace with this tag (default: from config)")
+	flag.BoolVar(&quiet, "quiet", false, "do not write the query count and timing summary to stderr")
+	flag.BoolVar(&exitCode, "exit-code", false, "exit with 1 if any credential was found in a breach, 0 if none was, and 2 on errors")
+	flag.BoolVar(&failFast, "fail-fast", false, "exit on the first failed query instead of continuing with the next one")
+	flag.BoolVar(&groupByUsername, "group-by-username", false, "write a summary per username of whether any of its passwords is in a breach instead of a result per credential, sending the passwords of a username together (reads the whole input first)")
+	flag.IntVar(&batchSize, "batch-size", 1, fmt.Sprintf("number of credentials to send per request (at most %d)", migp.MaxBatchSize))
+	flag.IntVar(&concurrency, "concurrency", 1, "number of requests to the server in flight at once; results are still written in input order")
+	flag.IntVar(&maxRetries, "max-retries", -1, fmt.Sprintf("number of retries for queries failing with network errors, 429 or 5xx, at most %d (default: from config)", migp.MaxRetryLimit))
+	flag.DurationVar(&retryBaseDelay, "retry-base-delay", 0, fmt.Sprintf("delay before the first retry, doubled on each retry up to %s (default: from config)", migp.MaxRetryDelay))
+	flag.DurationVar(&timeout, "timeout", 0, "timeout for each request to the server (0 means no timeout)")
+	flag.Int64Var(&bucketCacheSize, "bucket-cache-size", 0, "keep up to this many bytes of fetched buckets for the run, so that queries for other passwords of a username are answered without downloading its bucket again (0 disables)")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "reuse results for repeated credentials within this duration (0 disables caching)")
+	flag.BoolVar(&benchMode, "bench", false, "load test the target with random credentials instead of reading -infile, writing the throughput and latency percentiles to stdout, and exit")
+	flag.IntVar(&bench.queries, "bench-queries", 1000, "number of queries to send with -bench (0 for no limit)")
+	flag.Float64Var(&bench.qps, "bench-qps", 0, "queries per second to send with -bench (0 for as fast as -concurrency allows)")
+	flag.DurationVar(&bench.duration, "bench-duration", 0, "stop -bench after this long (0 for no limit)")
+	flag.StringVar(&logLevel, "log-level", "info", "minimum level of log records, one of debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", logFormatText, fmt.Sprintf("format of log records, %q or %q", logFormatText, logFormatJSON))
 
 	flag.Parse()
 
-	var cfg migp.Config
+	// with -exit-code, errors exit with 2 so that they are not mistaken for
+	// a breach
+	errorCode := 1
+	if exitCode {
+		errorCode = 2
+	}
+	// fatal logs msg and its attributes at the error level, and exits
+	fatal := func(msg string, args ...any) {
+		slog.Error(msg, args...)
+		os.Exit(errorCode)
+	}
+
+	logger, err := newLogger(os.Stderr, logLevel, logFormat)
+	if err != nil {
+		fatal("invalid logging options", "err", err)
+	}
+	slog.SetDefault(logger)
+
+	if printVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if initConfigFile != "" {
+		cfg := migp.DefaultConfig()
+		data, err := json.MarshalIndent(&cfg, "", "  ")
+		if err != nil {
+			fatal("encoding the configuration failed", "err", err)
+		}
+		f, err := os.OpenFile(initConfigFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			fatal("writing the configuration failed", "file", initConfigFile, "err", err)
+		}
+		if _, err := f.Write(append(data, '\n')); err != nil {
+			fatal("writing the configuration failed", "file", initConfigFile, "err", err)
+		}
+		if err := f.Close(); err != nil {
+			fatal("writing the configuration failed", "file", initConfigFile, "err", err)
+		}
+		return
+	}
+
+	if format != formatText && format != formatCSV {
+		fatal("unknown format", "format", format)
+	}
+	if delimiter == "" {
+		fatal("-delimiter must not be empty")
+	}
+	if hibp && passwordOnly {
+		fatal("-hibp cannot be combined with -password-only")
+	}
+	// passwordsAlone queries passwords without usernames
+	passwordsAlone := hibp || passwordOnly
+	if passwordsAlone && (format != formatText || batchSize > 1 || cacheTTL > 0) {
+		fatal("-hibp and -password-only cannot be combined with -format, -batch-size or -cache-ttl")
+	}
+	if concurrency < 1 {
+		fatal("-concurrency must be at least 1")
+	}
+	// a single credential is given with -username and -password, or as
+	// a <username>:<password> argument (<password> alone with -hibp or
+	// -password-only)
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var single *singleReader
+	if set["username"] || set["password"] || flag.NArg() > 0 {
+		if set["infile"] {
+			fatal("a credential on the command line cannot be combined with -infile")
+		}
+		if flag.NArg() > 1 || (flag.NArg() == 1 && (set["username"] || set["password"])) {
+			fatal("give a single credential, either as an argument or with -username and -password")
+		}
+		single = &singleReader{username: []byte(username), password: []byte(password)}
+		if flag.NArg() == 1 {
+			arg := []byte(flag.Arg(0))
+			if passwordsAlone {
+				single.password = arg
+			} else if fields := bytes.SplitN(arg, []byte(delimiter), 2); len(fields) == 2 {
+				single.username, single.password = fields[0], fields[1]
+			} else {
+				fatal("credential argument is not in the format <username><delimiter><password>", "delimiter", delimiter)
+			}
+		} else if !set["password"] {
+			fatal("-username requires -password")
+		} else if passwordsAlone && set["username"] {
+			fatal("-hibp and -password-only query a password alone, without -username")
+		}
+		if passwordsAlone {
+			single.username = nil
+		}
+	}
+	if benchMode {
+		if single != nil || set["infile"] || batchSize > 1 || cacheTTL > 0 {
+			fatal("-bench cannot be combined with credentials to query, -batch-size or -cache-ttl")
+		}
+		if bench.queries <= 0 && bench.duration <= 0 {
+			fatal("-bench requires -bench-queries or -bench-duration")
+		}
+		if bench.qps < 0 {
+			fatal("-bench-qps must not be negative")
+		}
+		bench.concurrency = concurrency
+	}
+	if groupByUsername && (passwordsAlone || format == formatCSV) {
+		fatal("-group-by-username cannot be combined with -hibp, -password-only or -format csv")
+	}
+	if grpcTarget != "" && (passwordsAlone || batchSize > 1 || groupByUsername || bucketCacheSize > 0) {
+		fatal("-grpc-target cannot be combined with -hibp, -password-only, -batch-size, -group-by-username or -bucket-cache-size")
+	}
+	if batchSize > migp.MaxBatchSize {
+		fatal("batch size exceeds the maximum", "batch_size", batchSize, "max", migp.MaxBatchSize)
+	}
+
+	httpClient := &http.Client{Timeout: timeout}
+
+	// target names the queried server in logs, pinned keys and cached
+	// results
+	target := targetURL
+	var grpcConn *grpcTransport
+	if grpcTarget != "" {
+		target = "grpc://" + grpcTarget
+		if grpcConn, err = dialGRPC(grpcTarget, grpcPlaintext, apiKey, timeout); err != nil {
+			fatal("connecting to the gRPC server failed", "target", grpcTarget, "err", err)
+		}
+		defer grpcConn.Close()
+	}
+
+	// fetchConfig retrieves the config of the target server, revalidating
+	// the one cached by an earlier run if any
+	fetchConfig := func() (migp.Config, error) {
+		if grpcConn != nil {
+			return grpcConn.getConfig()
+		}
+		cache := configCache{}
+		if configCacheFile != "" {
+			if loaded, err := loadConfigCache(configCacheFile); err != nil {
+				slog.Warn("loading the config cache failed", "file", configCacheFile, "err", err)
+			} else {
+				cache = loaded
+			}
+		}
+		cfg, updated, err := cache.fetch(httpClient, targetURL)
+		if err != nil {
+			return cfg, err
+		}
+		if updated && configCacheFile != "" {
+			if err := cache.save(configCacheFile); err != nil {
+				slog.Warn("saving the config cache failed", "file", configCacheFile, "err", err)
+			}
+		}
+		return cfg, nil
+	}
+
+	// serverCfg is the configuration published by the server, whose keys
+	// are pinned
+	var cfg, serverCfg migp.Config
 	if configFile != "" {
 		// use the provided config file
 		data, err := os.ReadFile(configFile)
 		if err != nil {
-			log.Fatal(err)
+			fatal("reading the configuration failed", "err", err)
 		}
 		err = json.Unmarshal(data, &cfg)
 		if err != nil {
-			log.Fatal(err)
+			fatal("invalid config", "file", configFile, "err", err)
 		}
 	} else {
 		// retrieve the config from the server
-		resp, err := http.Get(targetURL + "/config")
-		if err != nil {
-			log.Fatal(err)
-		}
-		if resp.StatusCode != http.StatusOK {
-			log.Fatalf("Unable to retrieve MIGP config from target %q: status code %d", targetURL, resp.StatusCode)
-		}
-		decoder := json.NewDecoder(resp.Body)
-		if err := decoder.Decode(&cfg); err != nil {
-			log.Fatal(err)
+		if cfg, err = fetchConfig(); err != nil {
+			fatal("fetching the configuration failed", "target", target, "err", err)
 		}
+		serverCfg = cfg
+	}
+	if err := cfg.Validate(); err != nil {
+		fatal("invalid config", "err", err)
+	}
+
+	if maxRetries >= 0 {
+		cfg.MaxRetries = maxRetries
+	}
+	if retryBaseDelay > 0 {
+		cfg.RetryBaseDelay = retryBaseDelay
+	}
+	if tag != "" {
+		cfg.Tag = tag
 	}
 
 	if dumpConfig {
 		data, err := json.Marshal(&cfg)
 		if err != nil {
-			log.Fatal(err)
+			fatal("encoding the configuration failed", "err", err)
 		}
 		_, err = os.Stdout.Write(data)
 		if err != nil {
-			log.Fatal(err)
+			fatal("writing the configuration failed", "err", err)
 		}
 		return
 	}
 
 	if cfg.Version != migp.DefaultMIGPVersion {
-		log.Printf("WARN: Your MIGP library version (%d) does not match the version specified in the config (%d) and may not be compatible.", migp.DefaultMIGPVersion, cfg.Version)
+		slog.Warn("the MIGP library version does not match the version of the config and may not be compatible", "library_version", migp.DefaultMIGPVersion, "config_version", cfg.Version)
+	}
+
+	if configFile != "" {
+		// a config file that disagrees with the server on how buckets are
+		// derived or encrypted silently reports every credential as not
+		// in breach
+		if serverCfg, err = fetchConfig(); err != nil {
+			fatal("checking the config against the server failed", "target", target, "err", err)
+		}
+		if mismatches := cfg.Mismatches(serverCfg); len(mismatches) > 0 {
+			for _, mismatch := range mismatches {
+				slog.Warn("config mismatch with the server", "mismatch", mismatch)
+			}
+			if !allowConfigMismatch {
+				fatal("refusing to query with a config that does not match the server's (override with -allow-config-mismatch)")
+			}
+		}
+	}
+
+	if pinFile != "" {
+		pins, err := loadKeyPins(pinFile)
+		if err != nil {
+			fatal("loading pinned keys failed", "file", pinFile, "err", err)
+		}
+		changes, updated := pins.check(target, serverCfg, repin)
+		for _, change := range changes {
+			slog.Warn("the server's OPRF parameters changed since they were pinned", "target", target, "change", change)
+		}
+		if updated {
+			if err := pins.save(pinFile); err != nil {
+				slog.Warn("saving pinned keys failed", "file", pinFile, "err", err)
+			}
+		}
+	}
+
+	if benchMode {
+		client, err := migp.NewClient(cfg, migp.WithHTTPClient(httpClient), migp.WithAPIKey(apiKey))
+		if err != nil {
+			fatal("creating the client failed", "err", err)
+		}
+		report := runBench(bench, func() error {
+			username, password, err := randomCredential()
+			if err != nil {
+				return err
+			}
+			switch {
+			case grpcConn != nil:
+				_, err = grpcConn.query(client, username, password)
+			case hibp:
+				_, err = client.QuerySHA1Password(context.Background(), targetURL+"/evaluate", password)
+			case passwordOnly:
+				_, err = client.QueryPassword(context.Background(), targetURL+"/evaluate", password)
+			default:
+				_, err = client.QueryOne(targetURL+"/evaluate", username, password)
+			}
+			if err != nil {
+				slog.Debug("query failed", "err", err)
+			}
+			return err
+		})
+		report.write(os.Stdout)
+		if exitCode && report.failures > 0 {
+			os.Exit(errorCode)
+		}
+		return
 	}
 
-	inputFile := os.Stdin
-	if inputFilename != "-" {
-		if inputFile, err = os.Open(inputFilename); err != nil {
-			log.Fatal(err)
+	var inputFile io.ReadCloser
+	if single == nil {
+		if inputFile, err = openInput(inputFilename, gzipStdin); err != nil {
+			fatal("opening input failed", "file", inputFilename, "err", err)
 		}
 		defer inputFile.Close()
 	}
 
-	scanner := bufio.NewScanner(inputFile)
+	clientOpts := []migp.ClientOption{migp.WithHTTPClient(httpClient), migp.WithAPIKey(apiKey)}
+	if bucketCacheSize > 0 {
+		// the server publishes whether it can leave out the buckets
+		// the client already holds, even with a -config file
+		if serverCfg.OmitBucketRequests {
+			cfg.OmitBucketRequests = true
+			clientOpts = append(clientOpts, migp.WithBucketCache(migp.NewMemoryBucketCache(bucketCacheSize)))
+		} else {
+			slog.Warn("the server does not accept requests omitting the bucket, ignoring -bucket-cache-size", "target", targetURL)
+		}
+	}
+	client, err := migp.NewClient(cfg, clientOpts...)
+	if err != nil {
+		fatal("creating the client failed", "err", err)
+	}
+
+	var cache migp.ResultCache
+	if cacheTTL > 0 {
+		cache = migp.NewMemoryResultCache(cacheTTL)
+	}
+
+	var reader credentialReader
+	var writer resultWriter
+	// the summary goes to stderr, so that stdout only holds results
+	var summary io.Writer = os.Stderr
+	if quiet {
+		summary = io.Discard
+	}
+	if format == formatCSV {
+		// the header row is read right away
+		if single == nil {
+			if reader, err = newCSVReader(inputFile, csvUsernameColumn, csvPasswordColumn); err != nil {
+				fatal("reading CSV input failed", "file", inputFilename, "err", err)
+			}
+		}
+		if writer, err = newCSVWriter(os.Stdout, showPassword); err != nil {
+			fatal("writing CSV output failed", "err", err)
+		}
+	} else if passwordsAlone {
+		reader = newPasswordReader(inputFile)
+		writer = newJSONWriter(os.Stdout, showPassword)
+	} else {
+		reader = newTextReader(inputFile, delimiter)
+		writer = newJSONWriter(os.Stdout, showPassword)
+	}
+	if single != nil {
+		reader = single
+	}
+	// breached records whether any credential was found in a breach, for
+	// -exit-code
+	breached := false
+	// summaries aggregates the results per username with -group-by-username,
+	// to be written once every query is done
+	var summaries *usernameSummaries
+	if groupByUsername {
+		summaries = newUsernameSummaries()
+	}
+	output := func(q *query) {
+		if summaries != nil {
+			summaries.record(q)
+			return
+		}
+		if q.result.Status != migp.NotInBreach {
+			breached = true
+		}
+		if err := writer.Write(q.username, q.password, q.result.Status, q.result.Metadata); err != nil {
+			fatal("writing output failed", "err", err)
+		}
+	}
 
 	query_count := int64(0)
+	failure_count := int64(0)
 	bw := float64(0)
 	query_prep := time.Duration(0)
 	api_call := time.Duration(0)
 	finalize := time.Duration(0)
 	total := time.Duration(0)
 
-	for scanner.Scan() {
-		fields := bytes.SplitN(scanner.Bytes(), []byte(":"), 2)
-		if len(fields) < 2 {
-			continue
+	// fail reports a failed query for the given input line and continues,
+	// unless -fail-fast is set
+	fail := func(line int, err error) {
+		slog.Error("query failed", "line", line, "err", err)
+		if failFast {
+			os.Exit(errorCode)
 		}
-		username, password := fields[0], fields[1]
-		if status, metadata, err, duration, b := migp.Query(cfg, targetURL+"/evaluate", username, password); err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		} else {
+		failure_count += 1
+	}
+
+	// run sends the pending queries of a job, on a worker of the pool
+	run := func(j *job) {
+		pending := j.pending()
+		// the passwords of a username grouped in a job share its bucket,
+		// which the server loads once per batch
+		if batchSize > 1 || (groupByUsername && len(pending) > 1) {
+			usernames := make([][]byte, len(pending))
+			passwords := make([][]byte, len(pending))
+			for i, q := range pending {
+				usernames[i], passwords[i] = q.username, q.password
+			}
+			start := time.Now()
+			results, err := client.QueryBatch(context.Background(), targetURL+"/evaluate-batch", usernames, passwords)
+			j.elapsed = time.Now().Sub(start)
+			for i, q := range pending {
+				if err != nil {
+					q.err = err
+				} else {
+					q.result, q.err = results[i], results[i].Err
+				}
+			}
+			return
+		}
+		for _, q := range pending {
+			if grpcConn != nil {
+				q.result, q.err = grpcConn.query(client, q.username, q.password)
+			} else if hibp {
+				q.result, q.err = client.QuerySHA1Password(context.Background(), targetURL+"/evaluate", q.password)
+			} else if passwordOnly {
+				q.result, q.err = client.QueryPassword(context.Background(), targetURL+"/evaluate", q.password)
+			} else {
+				q.result, q.err = client.QueryOne(targetURL+"/evaluate", q.username, q.password)
+			}
+		}
+	}
+	pool := newOrderedPool(concurrency, run)
+
+	// newQuery returns the query of a credential read from the input,
+	// answered right away if it could not be read or its result is cached
+	newQuery := func(line int, username, password []byte, err error) *query {
+		// the reader may reuse its buffer, so take a copy
+		q := &query{
+			line:     line,
+			username: append([]byte(nil), username...),
+			password: append([]byte(nil), password...),
+		}
+		if err != nil {
+			q.done, q.err = true, err
+			return q
+		}
+		if cache != nil {
+			if q.cacheKey, err = migp.ResultCacheKey(cfg, target, username, password); err != nil {
+				q.done, q.err = true, err
+				return q
+			}
+			if result, ok := cache.Get(q.cacheKey); ok {
+				q.done, q.result = true, result
+			}
+		}
+		return q
+	}
+
+	// read credentials and submit them to the pool, grouping batchSize of
+	// them per job. Cached results and read errors join the current job, so
+	// that they are reported in input order. With -group-by-username, the
+	// whole input is read first and each job holds passwords of a single
+	// username instead.
+	go func() {
+		defer pool.close()
+		if groupByUsername {
+			groups := newUsernameGroups()
+			for {
+				line, username, password, err := reader.Read()
+				if err == io.EOF {
+					break
+				}
+				groups.add(newQuery(line, username, password, err))
+			}
+			for _, j := range groups.jobs(migp.MaxBatchSize) {
+				pool.submit(j)
+			}
+			return
+		}
+		current := &job{}
+		submit := func() {
+			if len(current.queries) > 0 {
+				pool.submit(current)
+				current = &job{}
+			}
+		}
+		for {
+			line, username, password, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			current.queries = append(current.queries, newQuery(line, username, password, err))
+			if len(current.pending()) >= batchSize {
+				submit()
+			}
+		}
+		submit()
+	}()
+
+	for j := range pool.results() {
+		total += j.elapsed
+		for _, q := range j.queries {
+			if q.err != nil {
+				fail(q.line, q.err)
+				// credentials that could not be read have no username
+				if summaries != nil && !q.done {
+					summaries.record(q)
+				}
+				continue
+			}
+			if q.done {
+				// answered from the cache
+				slog.Debug("query answered from the cache", "line", q.line)
+				output(q)
+				continue
+			}
+			slog.Debug("query finished", "line", q.line, "status", q.result.Status.String(), "duration", q.result.Timings["total"])
 			query_count += 1
-			bw += b
-			query_prep += duration["query_prep"]
-			api_call += duration["api_call"]
-			finalize += duration["finalize"]
-			total += duration["total"]
-
-			if !showPassword {
-				password = nil
-			}
-			out, err := json.Marshal(struct {
-				Username string `json:"username"`
-				Password string `json:"password,omitempty"`
-				Status   string `json:"status"`
-				Metadata string `json:"metadata,omitempty"`
-			}{
-				Username: string(username),
-				Password: string(password),
-				Status:   status.String(),
-				Metadata: string(metadata),
-			})
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				os.Exit(1)
+			bw += q.result.BandwidthMB
+			query_prep += q.result.Timings["query_prep"]
+			api_call += q.result.Timings["api_call"]
+			finalize += q.result.Timings["finalize"]
+			total += q.result.Timings["total"]
+			if cache != nil {
+				cache.Set(q.cacheKey, q.result)
 			}
-			fmt.Println(string(out))
+			output(q)
+		}
+	}
+	if summaries != nil {
+		breached = summaries.breached()
+		if err := summaries.write(os.Stdout, showPassword); err != nil {
+			fatal("writing output failed", "err", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		fatal("writing output failed", "err", err)
+	}
+	fmt.Fprintf(summary, "Query count: %d\n", query_count)
+	fmt.Fprintf(summary, "Failure count: %d\n", failure_count)
+	if query_count == 0 {
+		fmt.Fprintln(summary, "No queries processed")
+	} else {
+		printTimings(summary, query_count, query_prep, api_call, finalize, total, bw)
+	}
+	if exitCode {
+		switch {
+		case failure_count > 0:
+			os.Exit(errorCode)
+		case breached:
+			os.Exit(1)
 		}
 	}
-	fmt.Printf("Query count: %d\n", query_count)
+}
+
+// printTimings writes the average bandwidth and timings of the queries to w
+func printTimings(w io.Writer, query_count int64, query_prep, api_call, finalize, total time.Duration, bw float64) {
 	query_prep = time.Duration(query_prep.Nanoseconds() / query_count)
 	api_call = time.Duration(api_call.Nanoseconds() / query_count)
 	finalize = time.Duration(finalize.Nanoseconds() / query_count)
 	total = time.Duration(total.Nanoseconds() / query_count)
 	bw = bw / float64(query_count)
 	//fmt.Println("------------AVG------------")
-	fmt.Printf("Query Prep. %s\n", query_prep)
-	fmt.Printf("API call %s\n", api_call)
-	fmt.Printf("Finalize %s\n", finalize)
-	fmt.Printf("Total %s\n", total)
-	fmt.Printf("B/w (MB) %.2f\n", bw)
+	fmt.Fprintf(w, "Query Prep. %s\n", query_prep)
+	fmt.Fprintf(w, "API call %s\n", api_call)
+	fmt.Fprintf(w, "Finalize %s\n", finalize)
+	fmt.Fprintf(w, "Total %s\n", total)
+	fmt.Fprintf(w, "B/w (MB) %.2f\n", bw)
+}
+
+// marshalResult encodes the result of a query as JSON. Structured breach
+// metadata is encoded as an object, other metadata as a string.
+func marshalResult(username, password []byte, status migp.BreachStatus, metadata []byte, showPassword bool) ([]byte, error) {
+	if !showPassword {
+		password = nil
+	}
+	// the occurrence count is reported for HIBP entries too, whose
+	// metadata is the count alone
+	count := migp.MetadataCount(metadata)
+	var breach *migp.BreachMetadata
+	if m, err := migp.ParseBreachMetadata(metadata); err == nil {
+		breach, metadata = &m, nil
+	}
+	return json.Marshal(struct {
+		Username string               `json:"username"`
+		Password string               `json:"password,omitempty"`
+		Status   string               `json:"status"`
+		Match    string               `json:"match"`
+		Count    int64                `json:"count,omitempty"`
+		Metadata string               `json:"metadata,omitempty"`
+		Breach   *migp.BreachMetadata `json:"breach,omitempty"`
+	}{
+		Username: string(username),
+		Password: string(password),
+		Status:   status.String(),
+		Match:    status.Match(),
+		Count:    count,
+		Metadata: string(metadata),
+		Breach:   breach,
+	})
 }
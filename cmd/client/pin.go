@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// pinnedServer is the OPRF suite and the public key of each key epoch first
+// seen for a server
+type pinnedServer struct {
+	OPRFSuite uint16            `json:"oprfSuite"`
+	Keys      map[uint32][]byte `json:"keys"`
+}
+
+// keyPins records the OPRF parameters seen for each target server across
+// runs, so that a server silently swapping its key is noticed
+type keyPins map[string]pinnedServer
+
+// defaultPinFile returns the file pins are kept in unless -pin-file is given,
+// or an empty string if there is no user configuration directory
+func defaultPinFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "migp", "pinned-keys.json")
+}
+
+// loadKeyPins reads the pins saved in the named file, returning no pins if the
+// file does not exist yet
+func loadKeyPins(name string) (keyPins, error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return keyPins{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	pins := keyPins{}
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return nil, fmt.Errorf("invalid pin file %s: %w", name, err)
+	}
+	return pins, nil
+}
+
+// save writes the pins to the named file, readable only by the user
+func (p keyPins) save(name string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(name, append(data, '\n'))
+}
+
+// writePrivateFile replaces the named file with data, readable only by the
+// user, creating its directory if needed
+func writePrivateFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	// write to a temporary file first, so that an interrupted write does
+	// not lose the previous contents
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// check compares the OPRF suite and public keys of the configuration the
+// target server published with those pinned for it, returning a description
+// of each change. Key epochs seen for the first time are pinned, and so are
+// changed ones if repin is set. check reports whether the pins were updated.
+func (p keyPins) check(target string, cfg migp.Config, repin bool) (changes []string, updated bool) {
+	pinned, ok := p[target]
+	if !ok {
+		pinned = pinnedServer{OPRFSuite: uint16(cfg.OPRFSuite)}
+		updated = true
+	}
+	if pinned.Keys == nil {
+		pinned.Keys = make(map[uint32][]byte)
+	}
+	if pinned.OPRFSuite != uint16(cfg.OPRFSuite) {
+		changes = append(changes, fmt.Sprintf("oprfSuite: pinned %#04x, server has %#04x", pinned.OPRFSuite, cfg.OPRFSuite))
+		if repin {
+			pinned.OPRFSuite, updated = uint16(cfg.OPRFSuite), true
+		}
+	}
+	epochs := append([]migp.KeyEpoch{{KeyID: cfg.KeyID, PublicKey: cfg.PublicKey}}, cfg.PreviousKeys...)
+	for _, epoch := range epochs {
+		// servers predating published keys have nothing to pin
+		if len(epoch.PublicKey) == 0 {
+			continue
+		}
+		key, ok := pinned.Keys[epoch.KeyID]
+		if ok && bytes.Equal(key, epoch.PublicKey) {
+			continue
+		}
+		if ok {
+			changes = append(changes, fmt.Sprintf("public key of key ID %d: pinned %s, server has %s", epoch.KeyID, keyFingerprint(key), keyFingerprint(epoch.PublicKey)))
+			if !repin {
+				continue
+			}
+		}
+		pinned.Keys[epoch.KeyID], updated = epoch.PublicKey, true
+	}
+	p[target] = pinned
+	return changes, updated
+}
+
+// keyFingerprint returns a short hex digest identifying a public key
+func keyFingerprint(key []byte) string {
+	digest := sha256.Sum256(key)
+	return hex.EncodeToString(digest[:8])
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// TestKeyPinsCheck tests that keys are pinned on first use and when new epochs
+// appear, and that changed keys and suites are reported and only pinned again
+// with repin
+func TestKeyPinsCheck(t *testing.T) {
+	const target = "https://migp.example/evaluate"
+	config := func(changedSuite bool, keyID uint32, publicKey string, previousKeys ...migp.KeyEpoch) migp.Config {
+		cfg := migp.DefaultConfig()
+		if changedSuite {
+			cfg.OPRFSuite++
+		}
+		cfg.KeyID, cfg.PublicKey, cfg.PreviousKeys = keyID, []byte(publicKey), previousKeys
+		return cfg
+	}
+	suite := uint16(migp.DefaultConfig().OPRFSuite)
+	key1 := migp.KeyEpoch{KeyID: 1, PublicKey: []byte("key1")}
+
+	testCases := []struct {
+		cfg        migp.Config
+		repin      bool
+		changes    int
+		updated    bool
+		wantSuite  uint16
+		wantPinned map[uint32]string
+	}{
+		// first use
+		{config(false, 1, "key1"), false, 0, true, suite, map[uint32]string{1: "key1"}},
+		{config(false, 1, "key1"), false, 0, false, suite, map[uint32]string{1: "key1"}},
+		// changed key for a known key ID
+		{config(false, 1, "other"), false, 1, false, suite, map[uint32]string{1: "key1"}},
+		// new epoch after a rotation
+		{config(false, 2, "key2", key1), false, 0, true, suite, map[uint32]string{1: "key1", 2: "key2"}},
+		// servers without published keys
+		{config(false, 3, ""), false, 0, false, suite, map[uint32]string{1: "key1", 2: "key2"}},
+		// changed key, pinned again with repin
+		{config(false, 2, "other", key1), true, 1, true, suite, map[uint32]string{1: "key1", 2: "other"}},
+		// changed suite
+		{config(true, 1, "key1"), false, 1, false, suite, map[uint32]string{1: "key1", 2: "other"}},
+		{config(true, 1, "key1"), true, 1, true, suite + 1, map[uint32]string{1: "key1", 2: "other"}},
+	}
+
+	pins := keyPins{}
+	for i, test := range testCases {
+		changes, updated := pins.check(target, test.cfg, test.repin)
+		if len(changes) != test.changes || updated != test.updated {
+			t.Errorf("failed test %d: want %d changes and updated %v, got %q and %v", i, test.changes, test.updated, changes, updated)
+		}
+		pinned := pins[target]
+		got := make(map[uint32]string, len(pinned.Keys))
+		for keyID, key := range pinned.Keys {
+			got[keyID] = string(key)
+		}
+		if pinned.OPRFSuite != test.wantSuite || !reflect.DeepEqual(got, test.wantPinned) {
+			t.Errorf("failed test %d: want suite %#04x and keys %v, got %#04x and %v", i, test.wantSuite, test.wantPinned, pinned.OPRFSuite, got)
+		}
+	}
+}
+
+// TestKeyPinsSave tests that saved pins are loaded back unchanged, and that a
+// missing pin file holds no pins
+func TestKeyPinsSave(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "migp", "pinned-keys.json")
+	pins, err := loadKeyPins(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 0 {
+		t.Errorf("want no pins, got %v", pins)
+	}
+
+	cfg := migp.DefaultConfig()
+	cfg.KeyID, cfg.PublicKey = 2, []byte("key2")
+	cfg.PreviousKeys = []migp.KeyEpoch{{KeyID: 1, PublicKey: []byte("key1")}}
+	pins.check("https://a.example/evaluate", cfg, false)
+	pins.check("https://b.example/evaluate", migp.DefaultConfig(), false)
+	if err := pins.save(name); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("want mode 0600, got %v", info.Mode().Perm())
+	}
+	loaded, err := loadKeyPins(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, pins) {
+		t.Errorf("want %v, got %v", pins, loaded)
+	}
+
+	if err := os.WriteFile(name, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKeyPins(name); err == nil {
+		t.Error("want error for an invalid pin file")
+	}
+}
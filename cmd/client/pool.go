@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// query is a credential read from the input, along with the outcome of
+// querying it. Queries answered from the cache, or failing before they could
+// be sent, are done as soon as they are read.
+type query struct {
+	line               int
+	username, password []byte
+	cacheKey           string
+	done               bool
+	result             migp.QueryResult
+	err                error
+}
+
+// job is a group of queries sent to the server in a single request, i.e., a
+// single query unless batching
+type job struct {
+	queries []*query
+	// elapsed is the time taken by a batch request
+	elapsed time.Duration
+	// finished is closed once the queries are done
+	finished chan struct{}
+}
+
+// pending returns the queries of the job that still need to be sent
+func (j *job) pending() []*query {
+	var pending []*query
+	for _, q := range j.queries {
+		if !q.done {
+			pending = append(pending, q)
+		}
+	}
+	return pending
+}
+
+// orderedPool runs jobs on a fixed number of workers and hands them back in
+// the order they were submitted, so that results are written in input order
+// however long each request takes
+type orderedPool struct {
+	jobs    chan *job
+	ordered chan *job
+	wg      sync.WaitGroup
+}
+
+// newOrderedPool starts workers goroutines calling run on submitted jobs
+func newOrderedPool(workers int, run func(*job)) *orderedPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &orderedPool{
+		jobs:    make(chan *job),
+		ordered: make(chan *job, workers),
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for j := range p.jobs {
+				run(j)
+				close(j.finished)
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues a job, blocking while too many jobs are waiting to be handed
+// back. Jobs with nothing left to send skip the workers.
+func (p *orderedPool) submit(j *job) {
+	j.finished = make(chan struct{})
+	p.ordered <- j
+	if len(j.pending()) == 0 {
+		close(j.finished)
+		return
+	}
+	p.jobs <- j
+}
+
+// close stops the workers once the submitted jobs have run. It must be called
+// after the last submit.
+func (p *orderedPool) close() {
+	close(p.jobs)
+	p.wg.Wait()
+	close(p.ordered)
+}
+
+// results returns the submitted jobs in submission order, each once it has
+// finished
+func (p *orderedPool) results() <-chan *job {
+	results := make(chan *job)
+	go func() {
+		defer close(results)
+		for j := range p.ordered {
+			<-j.finished
+			results <- j
+		}
+	}()
+	return results
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestOrderedPool tests that jobs are handed back in submission order with
+// several workers, even when later jobs finish first, and that jobs with
+// nothing left to send skip the workers
+func TestOrderedPool(t *testing.T) {
+	const n = 50
+	// the first job only finishes after the second one, so that the
+	// workers run concurrently and complete jobs out of order
+	secondDone := make(chan struct{})
+	var mu sync.Mutex
+	var ran []int
+	run := func(j *job) {
+		q := j.queries[0]
+		switch q.line {
+		case 0:
+			<-secondDone
+		case 1:
+			defer close(secondDone)
+		default:
+			time.Sleep(time.Duration(n-q.line) * 100 * time.Microsecond)
+		}
+		mu.Lock()
+		ran = append(ran, q.line)
+		mu.Unlock()
+		q.done = true
+	}
+
+	for _, workers := range []int{2, 4, 16} {
+		ran = nil
+		secondDone = make(chan struct{})
+		pool := newOrderedPool(workers, run)
+		go func() {
+			defer pool.close()
+			for i := 0; i < n; i++ {
+				// every fifth query is already done, as if answered
+				// from the cache
+				pool.submit(&job{queries: []*query{{line: i, done: i%5 == 4}}})
+			}
+		}()
+
+		var got []int
+		for j := range pool.results() {
+			if !j.queries[0].done {
+				t.Errorf("workers %d: job %d handed back before it finished", workers, j.queries[0].line)
+			}
+			got = append(got, j.queries[0].line)
+		}
+		if len(got) != n {
+			t.Fatalf("workers %d: want %d jobs, got %d", workers, n, len(got))
+		}
+		for i, line := range got {
+			if line != i {
+				t.Errorf("workers %d: want job %d at position %d, got %d", workers, i, i, line)
+			}
+		}
+		if want := n - n/5; len(ran) != want {
+			t.Errorf("workers %d: want %d jobs run, got %d", workers, want, len(ran))
+		}
+		if ran[0] == 0 {
+			t.Errorf("workers %d: want jobs to finish out of order, got %v", workers, ran)
+		}
+	}
+}
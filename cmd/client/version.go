@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// version and commit identify the build, as for the server. When not set with
+// -ldflags "-X main.version=... -X main.commit=...", they are read from the
+// build info embedded by the go tool.
+var version, commit string
+
+// versionString describes the client build, including the protocol version
+// compared against the one in the server configuration
+func versionString() string {
+	v, c, dirty := version, commit, false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if c == "" {
+					c = setting.Value
+				}
+			case "vcs.modified":
+				dirty = setting.Value == "true" && commit == ""
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+	if c == "" {
+		c = "unknown"
+	} else if dirty {
+		c += "-dirty"
+	}
+	return fmt.Sprintf("migp client %s (commit %s, protocol version %d)", v, c, migp.DefaultMIGPVersion)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// archiveMagic starts every store archive, followed by the archive version
+var archiveMagic = []byte("MIGPSTORE")
+
+// archiveVersion is the version of the store archive format
+const archiveVersion = 1
+
+// errInvalidArchive is returned when reading a file that is not a store
+// archive, or is truncated
+var errInvalidArchive = errors.New("invalid store archive")
+
+// Export writes every bucket of the store to w as a single archive. After a
+// header, each bucket is written as a 2-byte big-endian length and the bucket
+// ID, followed by a 4-byte big-endian length and the bucket contents. Buckets
+// are loaded one at a time, so the store need not fit in memory. Export
+// returns the number of buckets written.
+func (kv *kvStore) Export(w io.Writer) (int, error) {
+	ids, err := kv.bucketIDs()
+	if err != nil {
+		return 0, err
+	}
+	// buckets both saved and held in memory are listed twice
+	sort.Strings(ids)
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(append(archiveMagic, archiveVersion)); err != nil {
+		return 0, err
+	}
+	count := 0
+	for i, id := range ids {
+		if i > 0 && id == ids[i-1] {
+			continue
+		}
+		bucket, err := kv.Get(id)
+		if err != nil {
+			return count, fmt.Errorf("loading bucket %s: %w", id, err)
+		}
+		if len(id) > math.MaxUint16 || uint64(len(bucket)) > math.MaxUint32 {
+			return count, fmt.Errorf("bucket %s too large to export", id)
+		}
+		var header [6]byte
+		binary.BigEndian.PutUint16(header[:2], uint16(len(id)))
+		binary.BigEndian.PutUint32(header[2:], uint32(len(bucket)))
+		if _, err := bw.Write(header[:2]); err != nil {
+			return count, err
+		}
+		if _, err := bw.WriteString(id); err != nil {
+			return count, err
+		}
+		if _, err := bw.Write(header[2:]); err != nil {
+			return count, err
+		}
+		if _, err := bw.Write(bucket); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, bw.Flush()
+}
+
+// Import saves every bucket of an archive written by Export under the store
+// directory, appending to buckets already saved there. Buckets are read one at
+// a time, and must have hex IDs. Import returns the number of buckets saved.
+func (kv *kvStore) Import(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(archiveMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil || !bytes.Equal(header[:len(archiveMagic)], archiveMagic) {
+		return 0, errInvalidArchive
+	}
+	if header[len(archiveMagic)] != archiveVersion {
+		return 0, fmt.Errorf("unsupported store archive version %d", header[len(archiveMagic)])
+	}
+
+	count := 0
+	for {
+		var idLen [2]byte
+		if _, err := io.ReadFull(br, idLen[:]); err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, errInvalidArchive
+		}
+		id := make([]byte, binary.BigEndian.Uint16(idLen[:]))
+		if _, err := io.ReadFull(br, id); err != nil {
+			return count, errInvalidArchive
+		}
+		// bucket IDs are hex, which also keeps them from naming paths
+		// outside the store directory
+		if _, err := hex.DecodeString(string(id)); err != nil || len(id) == 0 {
+			return count, fmt.Errorf("invalid bucket ID %q in store archive", id)
+		}
+		var bucketLen [4]byte
+		if _, err := io.ReadFull(br, bucketLen[:]); err != nil {
+			return count, errInvalidArchive
+		}
+		bucket := make([]byte, binary.BigEndian.Uint32(bucketLen[:]))
+		if _, err := io.ReadFull(br, bucket); err != nil {
+			return count, errInvalidArchive
+		}
+		if err := kv.SaveBucket(kv.root, string(id), bucket, kv.fileFormat); err != nil {
+			return count, fmt.Errorf("saving bucket %s: %w", id, err)
+		}
+		count++
+	}
+}
+
+// exportStore writes the store to the archive file name, or to stdout if name
+// is "-"
+func exportStore(kv *kvStore, name string) (int, error) {
+	if name == "-" {
+		return kv.Export(os.Stdout)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	count, err := kv.Export(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return count, err
+}
+
+// importStore saves the buckets of the archive file name, or of stdin if name
+// is "-", to the store
+func importStore(kv *kvStore, name string) (int, error) {
+	if name == "-" {
+		return kv.Import(os.Stdin)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return kv.Import(f)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestExportImport checks that importing an exported store reproduces its
+// buckets, whether saved or still in memory
+func TestExportImport(t *testing.T) {
+	src, err := newKVStore(t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.fileFormat = Zstd
+	buckets := map[string]string{"0a": "saved", "0b": "saved and in memory", "1c": "in memory"}
+	if err := src.SaveBucket(src.root, "0a", []byte("saved"), src.fileFormat); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SaveBucket(src.root, "0b", []byte("saved"), src.fileFormat); err != nil {
+		t.Fatal(err)
+	}
+	src.Append("0b", []byte(" and in memory"))
+	src.Append("1c", []byte("in memory"))
+
+	var archive bytes.Buffer
+	count, err := src.Export(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(buckets) {
+		t.Errorf("exported buckets: want %d, got %d", len(buckets), count)
+	}
+
+	dst, err := newKVStore(t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err = dst.Import(&archive); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(buckets) {
+		t.Errorf("imported buckets: want %d, got %d", len(buckets), count)
+	}
+	for id, want := range buckets {
+		got, err := dst.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("bucket %s: want %q, got %q", id, want, got)
+		}
+	}
+}
+
+// TestImportInvalid checks that malformed archives are rejected
+func TestImportInvalid(t *testing.T) {
+	header := append(append([]byte{}, archiveMagic...), archiveVersion)
+	testCases := [][]byte{
+		nil,
+		[]byte("not an archive"),
+		append(append([]byte{}, archiveMagic...), archiveVersion+1),
+		append(header, 0, 2, '0'),
+		append(header, 0, 2, '0', 'a', 0, 0, 0, 5, 'a'),
+		append(header, 0, 2, '.', '.', 0, 0, 0, 0),
+		append(header, 0, 0, 0, 0, 0, 0),
+	}
+	for i, archive := range testCases {
+		kv, err := newKVStore(t.TempDir(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := kv.Import(bytes.NewReader(archive)); err == nil {
+			t.Errorf("failed test %d: want error, got nil", i)
+		}
+	}
+}
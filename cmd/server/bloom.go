@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"io/fs"
+	"math"
+	"path/filepath"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// defaultBloomFalsePositiveRate is the false-positive rate of the bucket
+// filter if none is configured
+const defaultBloomFalsePositiveRate = 0.01
+
+// bloomFilter is a Bloom filter of bucket IDs. It never reports an added ID as
+// absent, but may report an absent ID as present with the configured
+// false-positive rate.
+type bloomFilter struct {
+	bits []uint64
+	// numBits is the size of the filter in bits
+	numBits uint64
+	// numHashes is the number of bits set per ID
+	numHashes int
+}
+
+// newBloomFilter returns a filter sized for capacity IDs with the given
+// false-positive rate
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = defaultBloomFalsePositiveRate
+	}
+	n := float64(capacity)
+	numBits := uint64(math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	numHashes := int(math.Round(float64(numBits) / n * math.Ln2))
+	if numHashes < 1 {
+		numHashes = 1
+	}
+	return &bloomFilter{
+		bits:      make([]uint64, (numBits+63)/64),
+		numBits:   numBits,
+		numHashes: numHashes,
+	}
+}
+
+// positions returns the bits of id, derived from two hashes by double hashing
+func (f *bloomFilter) positions(id string) []uint64 {
+	h1, h2 := fnv.New64a(), fnv.New64()
+	h1.Write([]byte(id))
+	h2.Write([]byte(id))
+	a, b := h1.Sum64(), h2.Sum64()|1
+	positions := make([]uint64, f.numHashes)
+	for i := range positions {
+		positions[i] = (a + uint64(i)*b) % f.numBits
+	}
+	return positions
+}
+
+// add adds id to the filter
+func (f *bloomFilter) add(id string) {
+	for _, p := range f.positions(id) {
+		f.bits[p/64] |= 1 << (p % 64)
+	}
+}
+
+// mayContain returns false if id was definitely not added to the filter
+func (f *bloomFilter) mayContain(id string) bool {
+	for _, p := range f.positions(id) {
+		if f.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomGetter skips loading buckets the filter reports as absent, returning
+// them as empty. Implements migp.Getter
+type bloomGetter struct {
+	store  migp.Getter
+	filter *bloomFilter
+}
+
+// Get returns the value in the key identified by id.
+func (g *bloomGetter) Get(id string) ([]byte, error) {
+	if !g.filter.mayContain(id) {
+		bloomSkippedBuckets.Inc()
+		return nil, nil
+	}
+	return g.store.Get(id)
+}
+
+// bucketIDs returns the IDs of the buckets saved under the store directory
+// and of those held in memory
+func (kv *kvStore) bucketIDs() ([]string, error) {
+	var ids []string
+	err := filepath.WalkDir(kv.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name()[0:1] != "." {
+			ids = append(ids, d.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	for id := range kv.store {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// enableBloomFilter builds a filter of the populated buckets of the file
+// backend, used by the evaluate handlers to skip loading absent buckets. The
+// filter is not updated by later inserts, so it must be enabled after
+// ingestion. A capacity of 0 sizes the filter for the buckets found.
+func (s *server) enableBloomFilter(capacity int, falsePositiveRate float64) error {
+	if s.kv == nil {
+		return errors.New("the bloom filter requires the file store backend")
+	}
+	ids, err := s.kv.bucketIDs()
+	if err != nil {
+		return err
+	}
+	if capacity == 0 {
+		capacity = len(ids)
+	}
+	filter := newBloomFilter(capacity, falsePositiveRate)
+	for _, id := range ids {
+		filter.add(id)
+	}
+	s.bloom = filter
+	return nil
+}
+
+// getter returns the bucket store, behind the bloom filter if enabled
+func (s *server) getter() migp.Getter {
+	if s.bloom != nil {
+		return &bloomGetter{store: s.store, filter: s.bloom}
+	}
+	return s.store
+}
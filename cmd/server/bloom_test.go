@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+func TestBloomFilter(t *testing.T) {
+	testCases := []struct {
+		capacity          int
+		falsePositiveRate float64
+	}{
+		{1000, 0.01},
+		{1000, 0.001},
+		{10, 0.1},
+		{0, 0},
+	}
+
+	for i, test := range testCases {
+		filter := newBloomFilter(test.capacity, test.falsePositiveRate)
+		if filter.mayContain("00") {
+			t.Errorf("failed test %d: empty filter contains an ID", i)
+		}
+		n := test.capacity
+		for j := 0; j < n; j++ {
+			filter.add(fmt.Sprintf("%05x", j))
+		}
+		for j := 0; j < n; j++ {
+			if !filter.mayContain(fmt.Sprintf("%05x", j)) {
+				t.Errorf("failed test %d: want %05x in filter", i, j)
+			}
+		}
+		rate := test.falsePositiveRate
+		if rate == 0 {
+			rate = defaultBloomFalsePositiveRate
+		}
+		falsePositives := 0
+		for j := n; j < n+10000; j++ {
+			if filter.mayContain(fmt.Sprintf("%05x", j)) {
+				falsePositives++
+			}
+		}
+		if got := float64(falsePositives) / 10000; got > 2*rate+0.005 {
+			t.Errorf("failed test %d: want false-positive rate around %v, got %v", i, rate, got)
+		}
+	}
+}
+
+// TestBloomFilterServer tests that queries are answered correctly with the
+// bloom filter enabled
+func TestBloomFilterServer(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	cfg.SlowHasherID = migp.SlowHasherNull
+	s, err := newServer(cfg, storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.insert([]byte("username1"), []byte("password1"), nil, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.enableBloomFilter(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	testCases := []struct {
+		username, password string
+		status             migp.BreachStatus
+	}{
+		{"username1", "password1", migp.InBreach},
+		{"username1", "password2", migp.NotInBreach},
+		{"username2", "password1", migp.NotInBreach},
+	}
+	for i, test := range testCases {
+		result, err := migp.Query(cfg.Config, httpServer.URL+"/evaluate", []byte(test.username), []byte(test.password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != test.status {
+			t.Errorf("failed test %d: want %s, got %s", i, test.status, result.Status)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucketName is the bbolt bucket that MIGP buckets are stored in
+var boltBucketName = []byte("buckets")
+
+// boltStore keeps buckets in a single bbolt database file, keyed by bucket ID.
+// Implements migp.Getter
+type boltStore struct {
+	db *bolt.DB
+}
+
+// newBoltStore opens or creates the bbolt database at path.
+func newBoltStore(path string) (*boltStore, error) {
+	if path == "" {
+		return nil, errors.New("missing bolt database path")
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// Get returns the value in the key identified by id. A missing bucket is
+// returned as an empty value.
+func (b *boltStore) Get(id string) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// values are only valid for the life of the transaction
+		value = append([]byte(nil), tx.Bucket(boltBucketName).Get([]byte(id))...)
+		return nil
+	})
+	if len(value) == 0 {
+		value = nil
+	}
+	return value, err
+}
+
+// Put a value at key id and replace any existing value.
+func (b *boltStore) Put(id string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketName).Put([]byte(id), value)
+	})
+}
+
+// Append a value to any existing value at key id.
+func (b *boltStore) Append(id string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucketName)
+		existing := bucket.Get([]byte(id))
+		updated := make([]byte, 0, len(existing)+len(value))
+		updated = append(append(updated, existing...), value...)
+		return bucket.Put([]byte(id), updated)
+	})
+}
+
+// AppendWriter returns a writer that appends everything written to it to the
+// value at key id, in a single append when it is closed.
+func (b *boltStore) AppendWriter(id string) (io.WriteCloser, error) {
+	return &bucketWriter{store: b, id: id}, nil
+}
+
+// Ready checks that a bucket can be read from the database.
+func (b *boltStore) Ready() error {
+	_, err := b.Get(readyBucketID)
+	return err
+}
+
+// Close closes the database.
+func (b *boltStore) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// TestBoltStore checks that buckets survive reopening the database
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buckets.db")
+	store, err := newBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := store.Get("missing"); err != nil || got != nil {
+		t.Errorf("missing bucket: want nil, got %q (err %v)", got, err)
+	}
+	if err := store.Put("0a", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append("0a", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append("0b", []byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = newBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	testCases := []struct {
+		id   string
+		want []byte
+	}{
+		{"0a", []byte("firstsecond")},
+		{"0b", []byte("third")},
+	}
+	for i, tc := range testCases {
+		got, err := store.Get(tc.id)
+		if err != nil {
+			t.Errorf("failed test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("failed test %d: want %q, got %q", i, tc.want, got)
+		}
+	}
+}
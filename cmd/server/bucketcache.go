@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// bucketCacheOverhead is added to the size of each cached bucket, so that
+// empty buckets still count towards the capacity
+const bucketCacheOverhead = 64
+
+// bucketCache keeps the most recently loaded buckets of the file backend in
+// memory, up to a total size in bytes, evicting the least recently used
+// buckets first. It is safe for concurrent use.
+type bucketCache struct {
+	lock     sync.Mutex
+	capacity int64
+	size     int64
+	// order lists the cached buckets from the most to the least recently
+	// used
+	order   *list.List
+	buckets map[string]*list.Element
+}
+
+// cachedBucket is a bucket held by a bucketCache
+type cachedBucket struct {
+	id     string
+	bucket []byte
+}
+
+// newBucketCache returns a cache holding up to capacity bytes of buckets
+func newBucketCache(capacity int64) *bucketCache {
+	return &bucketCache{
+		capacity: capacity,
+		order:    list.New(),
+		buckets:  make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached bucket with the given ID, and whether it was cached.
+// The bucket must not be modified.
+func (c *bucketCache) get(id string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.buckets[id]
+	if !ok {
+		bucketCacheMisses.Inc()
+		return nil, false
+	}
+	bucketCacheHits.Inc()
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedBucket).bucket, true
+}
+
+// add caches the bucket with the given ID, evicting the least recently used
+// buckets to make room. Buckets larger than the capacity are not cached. The
+// bucket must not be modified afterwards.
+func (c *bucketCache) add(id string, bucket []byte) {
+	size := cachedSize(id, bucket)
+	if size > c.capacity {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeLocked(id)
+	// the capacity is clipped, so that appending to the bucket copies it
+	// rather than writing past its end
+	c.buckets[id] = c.order.PushFront(&cachedBucket{id: id, bucket: bucket[:len(bucket):len(bucket)]})
+	c.size += size
+	for c.size > c.capacity {
+		c.removeLocked(c.order.Back().Value.(*cachedBucket).id)
+	}
+}
+
+// remove evicts the bucket with the given ID, if cached
+func (c *bucketCache) remove(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeLocked(id)
+}
+
+// removeLocked evicts the bucket with the given ID, with c.lock held
+func (c *bucketCache) removeLocked(id string) {
+	e, ok := c.buckets[id]
+	if !ok {
+		return
+	}
+	cached := c.order.Remove(e).(*cachedBucket)
+	delete(c.buckets, id)
+	c.size -= cachedSize(cached.id, cached.bucket)
+}
+
+// cachedSize returns the size a bucket counts for in the cache
+func cachedSize(id string, bucket []byte) int64 {
+	return int64(len(id)+len(bucket)) + bucketCacheOverhead
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBucketCache(t *testing.T) {
+	bucket := bytes.Repeat([]byte{1}, 100)
+	// room for two buckets
+	c := newBucketCache(2 * cachedSize("00", bucket))
+	c.add("00", bucket)
+	c.add("01", bucket)
+	// 00 becomes the most recently used, so 01 is evicted
+	c.get("00")
+	c.add("02", bucket)
+	c.add("03", make([]byte, 1000))
+	c.remove("02")
+
+	testCases := []struct {
+		id     string
+		cached bool
+	}{
+		{"00", true},
+		{"01", false},
+		{"02", false},
+		// larger than the capacity
+		{"03", false},
+	}
+	for i, test := range testCases {
+		if _, cached := c.get(test.id); cached != test.cached {
+			t.Errorf("failed test %d: want %v, got %v", i, test.cached, cached)
+		}
+	}
+	if want := cachedSize("00", bucket); c.size != want {
+		t.Errorf("size: want %d, got %d", want, c.size)
+	}
+}
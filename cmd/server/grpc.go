@@ -0,0 +1,96 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+	"github.com/cloudflare/migp-go/pkg/migppb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcService serves the MIGP protocol over gRPC, applying the API keys and
+// rate limits of the HTTP evaluate endpoint
+type grpcService struct {
+	migppb.UnimplementedMIGPServer
+	s *server
+}
+
+// GetConfig returns the MIGP configuration
+func (g grpcService) GetConfig(ctx context.Context, _ *migppb.GetConfigRequest) (*migppb.Config, error) {
+	cfg := g.s.migpServer.Config().Config
+	cfg.OmitBucketRequests = true
+	return migppb.NewConfig(cfg), nil
+}
+
+// Evaluate serves a request from a MIGP client, recording the metrics of
+// the HTTP evaluate endpoint
+func (g grpcService) Evaluate(ctx context.Context, req *migppb.EvaluateRequest) (*migppb.EvaluateResponse, error) {
+	response, err := g.evaluate(ctx, req)
+	observeGRPCEvaluate(response, err)
+	return response, err
+}
+
+// evaluate serves an Evaluate call
+func (g grpcService) evaluate(ctx context.Context, req *migppb.EvaluateRequest) (*migppb.EvaluateResponse, error) {
+	if err := g.authorize(ctx); err != nil {
+		return nil, err
+	}
+	request := req.ClientRequest()
+	logger := slog.With("bucket", request.BucketID, "key_id", request.KeyID)
+
+	start := time.Now()
+	getter := &timedGetter{store: g.s.getter()}
+	migpResponse, err := g.s.migpServer.HandleRequest(request, getter)
+	oprfEvaluateDuration.Observe((time.Now().Sub(start) - getter.elapsed).Seconds())
+	if errors.Is(err, migp.ErrUnsupportedVersion) {
+		logger.Info("rejecting request for unsupported version", "version", request.Version)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if errors.Is(err, migp.ErrUnknownKeyID) || errors.Is(err, migp.ErrInvalidRequest) {
+		logger.Info("rejecting request", "err", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		logger.Error("handling request failed", "err", err)
+		return nil, status.Error(codes.Internal, "handling request failed")
+	}
+	logger.Debug("served request", "duration", time.Since(start))
+	return migppb.NewEvaluateResponse(migpResponse), nil
+}
+
+// authorize checks the Bearer API key in the authorization metadata of a
+// call, if the server is configured with API keys, and the rate limit of its
+// peer
+func (g grpcService) authorize(ctx context.Context) error {
+	if g.s.migpServer.RequiresAPIKey() {
+		var token string
+		var bearer bool
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get("authorization"); len(values) > 0 {
+				token, bearer = strings.CutPrefix(values[0], "Bearer ")
+			}
+		}
+		if !bearer || !g.s.migpServer.CheckAPIKey(token) {
+			return status.Error(codes.Unauthenticated, "missing or invalid API key")
+		}
+	}
+	if g.s.rateLimiter != nil {
+		if p, ok := peer.FromContext(ctx); ok {
+			if addr, ok := p.Addr.(*net.TCPAddr); ok && !g.s.rateLimiter.allow(addr.IP, 1) {
+				return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+	"github.com/cloudflare/migp-go/pkg/migppb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialGRPC serves the gRPC service of s in memory, returning a client
+// connected to it
+func dialGRPC(t *testing.T, s *server) migppb.MIGPClient {
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	migppb.RegisterMIGPServer(grpcServer, grpcService{s: s})
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return migppb.NewMIGPClient(conn)
+}
+
+// TestGRPC checks that clients configured through GetConfig find inserted
+// credentials with Evaluate
+func TestGRPC(t *testing.T) {
+	testUsername := []byte("username1")
+	testPassword := []byte("password1")
+	testMetadata := []byte("test metadata")
+
+	s, err := newServer(migp.DefaultServerConfig(), storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc := dialGRPC(t, s)
+	ctx := context.Background()
+
+	cfg, err := rpc.GetConfig(ctx, &migppb.GetConfigRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := migp.NewClient(cfg.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.insert(testUsername, testPassword, testMetadata, 9, true); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		username, password []byte
+		status             migp.BreachStatus
+		metadata           []byte
+	}{
+		{testUsername, testPassword, migp.InBreach, testMetadata},
+		{testUsername, []byte("password2"), migp.NotInBreach, nil},
+		{[]byte("username2"), testPassword, migp.NotInBreach, nil},
+	}
+	for i, tc := range testCases {
+		status, metadata, err := migppb.Query(ctx, client, rpc, tc.username, tc.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tc.status {
+			t.Errorf("failed test %d: want %s, got %s", i, tc.status, status)
+		}
+		if !bytes.Equal(metadata, tc.metadata) {
+			t.Errorf("failed test %d: want metadata %q, got %q", i, tc.metadata, metadata)
+		}
+	}
+}
+
+// evaluateRequestCount returns the number of evaluate requests counted under
+// the given HTTP status code
+func evaluateRequestCount(t *testing.T, code string) float64 {
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "migp_evaluate_requests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "code" && label.GetValue() == code {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// TestGRPCErrors checks the status codes of rejected Evaluate calls, and
+// that calls are counted under the HTTP status code of /evaluate
+func TestGRPCErrors(t *testing.T) {
+	serverCfg := migp.DefaultServerConfig()
+	serverCfg.APIKeys = []string{"secret1"}
+	s, err := newServer(serverCfg, storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc := dialGRPC(t, s)
+	client, err := migp.NewClient(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request([]byte("username1"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsupported := request
+	unsupported.Version = 0xffff
+
+	testCases := []struct {
+		authorization string
+		request       migp.ClientRequest
+		code          codes.Code
+		metric        string
+	}{
+		{"", request, codes.Unauthenticated, "401"},
+		{"Bearer wrong", request, codes.Unauthenticated, "401"},
+		{"secret1", request, codes.Unauthenticated, "401"},
+		{"Bearer secret1", request, codes.OK, "200"},
+		{"Bearer secret1", unsupported, codes.InvalidArgument, "400"},
+		{"Bearer secret1", migp.ClientRequest{Version: request.Version}, codes.InvalidArgument, "400"},
+	}
+	for i, tc := range testCases {
+		ctx := context.Background()
+		if tc.authorization != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", tc.authorization)
+		}
+		count := evaluateRequestCount(t, tc.metric)
+		_, err := rpc.Evaluate(ctx, migppb.NewEvaluateRequest(tc.request))
+		if code := status.Code(err); code != tc.code {
+			t.Errorf("failed test %d: want %s, got %s", i, tc.code, code)
+		}
+		if got := evaluateRequestCount(t, tc.metric) - count; got != 1 {
+			t.Errorf("failed test %d: want 1 request counted under %s, got %g", i, tc.metric, got)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	testCases := []struct {
+		header string
+		out    bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"identity", false},
+	}
+
+	for i, test := range testCases {
+		req := httptest.NewRequest("POST", "/evaluate", nil)
+		if test.header != "" {
+			req.Header.Set("Accept-Encoding", test.header)
+		}
+		if out := acceptsGzip(req); out != test.out {
+			t.Errorf("failed test %d: want %v, got %v", i, test.out, out)
+		}
+	}
+}
+
+// TestGzipResponses tests that large evaluate responses are compressed and
+// transparently decompressed by the client
+func TestGzipResponses(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	cfg.SlowHasherID = migp.SlowHasherNull
+	s, err := newServer(cfg, storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lastEncoding string
+	handler := s.handler()
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req)
+		lastEncoding = w.Header().Get("Content-Encoding")
+	}))
+	defer httpServer.Close()
+
+	username, password := []byte("username1"), []byte("password1")
+	if err := s.insert(username, password, nil, 9, true); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		gzipMinSize int
+		encoding    string
+	}{
+		{-1, ""},
+		{0, "gzip"},
+		{1 << 20, ""},
+	}
+	for i, test := range testCases {
+		s.gzipMinSize = test.gzipMinSize
+		result, err := migp.Query(cfg.Config, httpServer.URL+"/evaluate", username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != migp.InBreach || lastEncoding != test.encoding {
+			t.Errorf("failed test %d: want (%s, %q), got (%s, %q)", i, migp.InBreach, test.encoding, result.Status, lastEncoding)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// inputDirFile is a file of an input directory to ingest
+type inputDirFile struct {
+	path string
+	// name is the path relative to the directory, under which the file is
+	// recorded in the manifest so that the directory can be moved
+	name string
+	info os.FileInfo
+}
+
+// listInputDir returns the files under dir, skipping hidden files
+func listInputDir(dir string) ([]inputDirFile, error) {
+	var files []inputDirFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name()[0:1] == "." {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			name = path
+		}
+		files = append(files, inputDirFile{path: path, name: name, info: info})
+		return nil
+	})
+	return files, err
+}
+
+// dirIngestOptions controls the ingestion of an input directory
+type dirIngestOptions struct {
+	// workers is the number of files ingested at once. With more than
+	// one, each file is buffered in a store of its own, see
+	// withBufferedStore.
+	workers int
+	// flushInterval periodically saves the store of each file while it is
+	// ingested, if workers is more than one
+	flushInterval time.Duration
+	// manifest, if set, records the files ingested and saved
+	manifest *ingestManifest
+	// force ingests files the manifest records as ingested
+	force bool
+}
+
+// ingestDir inserts the credentials of the files under dir, see
+// processCredentials, and saves the buckets of each file as it is done. It
+// returns the time spent ingesting and saving, summed across files, and the
+// files some buckets of which could not be saved, which are left in memory
+// for the caller to flush.
+func (s *server) ingestDir(dir string, ingest ingestOptions, opts dirIngestOptions) (encryption, saving time.Duration, unsaved []inputDirFile, err error) {
+	files, err := listInputDir(dir)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if opts.workers < 1 {
+		opts.workers = 1
+	}
+
+	var lock sync.Mutex
+	jobs := make(chan inputDirFile)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				ingester, stopFlusher := s, func() {}
+				if opts.workers > 1 {
+					ingester = s.withBufferedStore()
+					if opts.flushInterval > 0 {
+						stopFlusher = ingester.kv.startFlusher(opts.flushInterval)
+					}
+				}
+				slog.Info("ingesting file", "file", file.path)
+				start := time.Now()
+				ingester.processCredentials(file.path, ingest)
+				elapsed := time.Since(start)
+				stopFlusher()
+
+				start = time.Now()
+				// failed buckets stay in the memory of s, and are
+				// retried with its next flush
+				var err error
+				if ingester == s {
+					err = s.flush()
+				} else {
+					err = s.flushBuffered(ingester)
+				}
+				lock.Lock()
+				encryption += elapsed
+				saving += time.Since(start)
+				if err != nil {
+					slog.Warn("flushing buckets failed", "file", file.path, "err", err)
+					unsaved = append(unsaved, file)
+				}
+				lock.Unlock()
+				if err == nil {
+					recordIngested(opts.manifest, file)
+				}
+			}
+		}()
+	}
+	for _, file := range files {
+		if opts.manifest != nil && !opts.force && opts.manifest.done(file.name, file.info) {
+			slog.Info("skipping file already ingested", "file", file.path)
+			continue
+		}
+		jobs <- file
+	}
+	close(jobs)
+	wg.Wait()
+	return encryption, saving, unsaved, nil
+}
+
+// recordIngested records files whose buckets were all saved in the manifest,
+// if any
+func recordIngested(manifest *ingestManifest, files ...inputDirFile) {
+	if manifest == nil || len(files) == 0 {
+		return
+	}
+	for _, file := range files {
+		manifest.add(file.name, file.info)
+	}
+	if err := manifest.save(); err != nil {
+		slog.Warn("saving the manifest failed", "file", manifest.path, "err", err)
+	}
+}
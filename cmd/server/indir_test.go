@@ -0,0 +1,89 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// TestIngestDir ingests a directory with several workers, checking that the
+// credentials of every file are found and that ingesting the directory again
+// skips the files the manifest records
+func TestIngestDir(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	cfg.SlowHasherID = migp.SlowHasherNull
+	// with one-bit bucket IDs, files ingested at once share buckets
+	cfg.BucketIDBitSize = 1
+	s, err := newServer(cfg, storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	var usernames []string
+	for i := 0; i < 4; i++ {
+		var contents string
+		for j := 0; j < 3; j++ {
+			username := fmt.Sprintf("user%d-%d", i, j)
+			usernames = append(usernames, username)
+			contents += username + ":password1\n"
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.txt", i)), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest, err := loadIngestManifest(filepath.Join(s.kv.root, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest := ingestOptions{delimiter: ":", maxLineSize: 1024, format: inputFormatCredentials}
+	opts := dirIngestOptions{workers: 3, manifest: manifest}
+
+	bucketIDs := make(map[string]bool)
+	for _, username := range usernames {
+		bucketIDs[migp.BucketIDToHex(s.migpServer.BucketID([]byte(username)))] = true
+	}
+	countEntries := func() int {
+		total := 0
+		for id := range bucketIDs {
+			bucket, err := s.store.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			count, err := migp.CountBucketEntries(bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += count
+		}
+		return total
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, unsaved, err := s.ingestDir(dir, ingest, opts); err != nil || len(unsaved) > 0 {
+			t.Fatalf("ingestion %d: want (no unsaved files, nil), got (%d, %v)", i, len(unsaved), err)
+		}
+		if count := countEntries(); count != len(usernames) {
+			t.Errorf("ingestion %d: want %d entries, got %d", i, len(usernames), count)
+		}
+	}
+
+	client, err := migp.NewClient(cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, username := range usernames {
+		result, err := client.QueryLocal(s.migpServer, s.getter(), []byte(username), []byte("password1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != migp.InBreach {
+			t.Errorf("failed test %d: want %s, got %s", i, migp.InBreach, result.Status)
+		}
+	}
+}
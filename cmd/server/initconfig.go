@@ -0,0 +1,32 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// initConfig writes a default server configuration with a fresh OPRF private
+// key to path, as indented JSON readable only by the owner. An existing file
+// is never overwritten.
+func initConfig(path string) error {
+	cfg := migp.DefaultServerConfig()
+	data, err := json.MarshalIndent(&cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// TestInitConfig checks that the written configuration loads into a working
+// server, and that an existing file is not overwritten
+func TestInitConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := initConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg migp.ServerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Config, migp.DefaultConfig()) {
+		t.Errorf("want %+v, got %+v", migp.DefaultConfig(), cfg.Config)
+	}
+	if _, err := migp.NewServer(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initConfig(path); !os.IsExist(err) {
+		t.Errorf("want an existing file error, got %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// openInput opens the named input file, or stdin for "-". Files with a .gz
+// extension or starting with the gzip header are decompressed as they are
+// read, and so is stdin if gzipStdin is set.
+func openInput(name string, gzipStdin bool) (io.ReadCloser, error) {
+	if name == "-" {
+		if !gzipStdin {
+			return io.NopCloser(os.Stdin), nil
+		}
+		gz, err := gzip.NewReader(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing stdin: %w", err)
+		}
+		return gz, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	// a short or empty file is not compressed
+	magic, _ := br.Peek(len(gzipMagic))
+	if !strings.HasSuffix(name, ".gz") && !bytes.Equal(magic, gzipMagic) {
+		return &inputFile{Reader: br, file: f}, nil
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("decompressing %s: %w", name, err)
+	}
+	return &inputFile{Reader: gz, file: f}, nil
+}
+
+// inputFile reads an input file through a buffer, possibly decompressing it
+type inputFile struct {
+	io.Reader
+	file *os.File
+}
+
+// Close closes the underlying file
+func (f *inputFile) Close() error {
+	return f.file.Close()
+}
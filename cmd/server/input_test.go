@@ -0,0 +1,58 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenInput(t *testing.T) {
+	contents := []byte("user1:pass1\nuser2:pass2\n")
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	testCases := []struct {
+		name      string
+		data, out []byte
+		valid     bool
+	}{
+		{"plain.txt", contents, contents, true},
+		{"compressed.txt.gz", compressed.Bytes(), contents, true},
+		// compressed files are recognized by their header too
+		{"compressed.txt", compressed.Bytes(), contents, true},
+		{"empty.txt", nil, nil, true},
+		{"corrupt.txt.gz", contents, nil, false},
+	}
+	for i, test := range testCases {
+		name := filepath.Join(dir, test.name)
+		if err := os.WriteFile(name, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := openInput(name, false)
+		if (err == nil) != test.valid {
+			t.Errorf("failed test %d: want valid %v, got error %v", i, test.valid, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		out, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || !bytes.Equal(out, test.out) {
+			t.Errorf("failed test %d: want %q, got (%q, %v)", i, test.out, out, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// loadOrCreateKeyFile sets the OPRF private key of cfg to the key saved at
+// path. If there is no file at path, the key already in cfg is saved there
+// instead, readable only by the owner, so that later runs reuse it.
+func loadOrCreateKeyFile(path string, cfg *migp.ServerConfig) error {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		privateKey := new(oprf.PrivateKey)
+		if err := privateKey.Deserialize(cfg.OPRFSuite, data); err != nil {
+			return fmt.Errorf("invalid key file %s: %w", path, err)
+		}
+		cfg.PrivateKey = privateKey
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	data, err = cfg.PrivateKey.Serialize()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// TestLoadOrCreateKeyFile tests that a missing key file is created with the
+// configured key and that later runs load the same key from it
+func TestLoadOrCreateKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oprf.key")
+
+	first := migp.DefaultServerConfig()
+	if err := loadOrCreateKeyFile(path, &first); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("want permissions 0600, got %o", perm)
+	}
+
+	second := migp.DefaultServerConfig()
+	if err := loadOrCreateKeyFile(path, &second); err != nil {
+		t.Fatal(err)
+	}
+	want, err := first.PrivateKey.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := second.PrivateKey.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Error("want the key saved by the first run")
+	}
+}
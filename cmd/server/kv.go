@@ -6,35 +6,108 @@ package main
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
-	"strings"
+	"path/filepath"
 	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 import "encoding/json"
 
+// defaultStoreDir is the directory buckets are saved to by default
+const defaultStoreDir = "store_test"
+
 // kvStore is a wrapper for a KV store. For now just use a simple dynamically
 // allocated in-memory go map This won't scale properly, but ok for testing.
+// Buckets are saved to and loaded from a directory on disk.
 // Implements migp.Getter
 type kvStore struct {
 	store map[string][]byte
 	lock  sync.RWMutex
+	// root is the directory buckets are saved to and loaded from
+	root string
+	// loadFromDisk makes Get include the buckets saved under root in
+	// addition to those still in memory
+	loadFromDisk bool
+	// fsync forces each saved bucket to stable storage before SaveBucket
+	// returns. This trades ingestion throughput for durability.
+	fsync bool
+	// fileFormat is the format buckets are saved in
+	fileFormat FileFormat
+	// fanOutDepth and fanOutWidth lay out bucket files under fanOutDepth
+	// levels of directories named after fanOutWidth characters of the
+	// bucket ID each. If fanOutDepth is 0, every character but the last gets
+	// its own level.
+	fanOutDepth, fanOutWidth int
+	// bucketLocks serializes saves of the same bucket file
+	bucketLocks stripedLocks
+	// cache, if set, holds recently loaded buckets saved under root, so
+	// that Get reads hot buckets from memory. It assumes kv is the only
+	// writer of the directory.
+	cache *bucketCache
+	// shared, if set, is the store kv buffers entries separately from,
+	// whose bucket locks serialize the saves of both, see buffer
+	shared *kvStore
+}
+
+// bucketLock returns the lock guarding saves of the bucket with the given ID
+func (kv *kvStore) bucketLock(bucketID string) *sync.Mutex {
+	if kv.shared != nil {
+		return kv.shared.bucketLock(bucketID)
+	}
+	return kv.bucketLocks.get(bucketID)
+}
+
+// buffer returns a store saving buckets to the same directory as kv, in the
+// same layout and format, but buffering appended entries in memory apart
+// from kv. Entries buffered by one store are not seen by Get of the other
+// until they are saved.
+func (kv *kvStore) buffer() *kvStore {
+	shared := kv
+	if kv.shared != nil {
+		shared = kv.shared
+	}
+	return &kvStore{
+		store:        make(map[string][]byte),
+		root:         kv.root,
+		loadFromDisk: kv.loadFromDisk,
+		fsync:        kv.fsync,
+		fileFormat:   kv.fileFormat,
+		fanOutDepth:  kv.fanOutDepth,
+		fanOutWidth:  kv.fanOutWidth,
+		cache:        kv.cache,
+		shared:       shared,
+	}
 }
 
-// newKVStore initializes a new bucket store. Just using a simple map for now.
-func newKVStore() (*kvStore, error) {
+// newKVStore initializes a new bucket store saving buckets under root. Just
+// using a simple map for now.
+func newKVStore(root string, loadFromDisk bool) (*kvStore, error) {
 	return &kvStore{
-		store: make(map[string][]byte),
+		store:        make(map[string][]byte),
+		root:         root,
+		loadFromDisk: loadFromDisk,
+		fileFormat:   Bytes,
 	}, nil
 }
 
-// Put a value at key id and replace any existing value.
+// Put a value at key id and replace any existing value. If the store is
+// configured to load from disk, the bucket saved on disk is replaced, along
+// with any entries appended in memory.
 func (kv *kvStore) Put(id string, value []byte) error {
 	kv.lock.Lock()
-	defer kv.lock.Unlock()
-	kv.store[id] = value
-	return nil
+	if !kv.loadFromDisk {
+		kv.store[id] = value
+		kv.lock.Unlock()
+		return nil
+	}
+	delete(kv.store, id)
+	kv.lock.Unlock()
+	return kv.ReplaceBucket(kv.root, id, value, kv.fileFormat)
 }
 
 // Append a value to any existing value at key id.
@@ -45,21 +118,74 @@ func (kv *kvStore) Append(id string, value []byte) error {
 	return nil
 }
 
-// Get returns the value in the key identified by id.
+// AppendWriter returns a writer that appends everything written to it to the
+// value at key id when closed. Like Append, it adds to the entries buffered in
+// memory, which saveCredentials writes to the bucket file at once.
+func (kv *kvStore) AppendWriter(id string) (io.WriteCloser, error) {
+	return &bucketWriter{store: kv, id: id}, nil
+}
+
+// Get returns the value in the key identified by id. If the store is
+// configured to load from disk, the value is the bucket saved on disk followed
+// by any entries appended in memory since it was last saved. A missing bucket
+// is returned as an empty value.
 func (kv *kvStore) Get(id string) ([]byte, error) {
-	var path = strings.Join(strings.Split(id, ""), "/")
-	path = path[:len(path)-1]
-	bucket, err := kv.LoadBucket("./store_test/"+path+id, Bytes)
-	if err != nil {
-		return nil, nil
+	var bucket []byte
+	if kv.loadFromDisk {
+		var err error
+		bucket, err = kv.loadCached(id)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return bucket, nil
-	/*kv.lock.RLock()
+
+	kv.lock.RLock()
 	defer kv.lock.RUnlock()
-	return kv.store[id], nil*/
+	return append(bucket, kv.store[id]...), nil
 }
 
-var lock sync.Mutex
+// loadCached returns the bucket with the given ID saved under root, from the
+// cache if it holds it. A missing bucket is returned, and cached, as an empty
+// bucket. Since the cache only holds saved buckets, entries appended in
+// memory need no invalidation.
+func (kv *kvStore) loadCached(id string) ([]byte, error) {
+	if kv.cache == nil {
+		bucket, err := kv.LoadBucket(kv.root, id, kv.fileFormat)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return bucket, nil
+	}
+	if bucket, ok := kv.cache.get(id); ok {
+		return bucket, nil
+	}
+	// loading under the bucket lock keeps a concurrent save from being
+	// overwritten in the cache by the bucket it replaced
+	bucketLock := kv.bucketLock(id)
+	bucketLock.Lock()
+	defer bucketLock.Unlock()
+	bucket, err := kv.LoadBucket(kv.root, id, kv.fileFormat)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	kv.cache.add(id, bucket)
+	return bucket[:len(bucket):len(bucket)], nil
+}
+
+// Ready checks that the store directory exists and a bucket can be read.
+func (kv *kvStore) Ready() error {
+	if kv.loadFromDisk {
+		info, err := os.Stat(kv.root)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", kv.root)
+		}
+	}
+	_, err := kv.Get(readyBucketID)
+	return err
+}
 
 // Marshal is a function that marshals the object into an
 // io.Reader.
@@ -72,79 +198,268 @@ var Marshal = func(v interface{}) (io.Reader, error) {
 	return bytes.NewReader(b), nil
 }
 
-func (kv *kvStore) saveCredentials() {
+// saveCredentials drains the in-memory store and appends its buckets to disk.
+// Buckets that fail to save are logged and kept in memory, so that the next
+// call retries them, and an error reporting the number of failures is
+// returned.
+func (kv *kvStore) saveCredentials() error {
 	//start := time.Now()
-	if _, err := os.Stat("store_test"); errors.Is(err, os.ErrNotExist) {
-		err := os.Mkdir("store_test", os.ModePerm)
+	pending := kv.drain()
+
+	if _, err := os.Stat(kv.root); errors.Is(err, os.ErrNotExist) {
+		err := os.MkdirAll(kv.root, os.ModePerm)
 		if err != nil {
-			log.Println(err)
+			kv.requeue(pending)
+			return err
 		}
 	}
-	for k, v := range kv.store {
-		if err := kv.SaveBucket("./store_test/", k, v, Bytes); err != nil {
-			log.Fatalln(err)
+	failed := make(map[string][]byte)
+	var firstErr error
+	for k, v := range pending {
+		if err := kv.SaveBucket(kv.root+string(filepath.Separator), k, v, kv.fileFormat); err != nil {
+			slog.Warn("saving bucket failed", "bucket", k, "err", err)
+			failed[k] = v
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
+	if len(failed) > 0 {
+		kv.requeue(failed)
+		return fmt.Errorf("saving %d of %d buckets failed: %w", len(failed), len(pending), firstErr)
+	}
+	return nil
 	//fmt.Printf("\r") ++++++++
 	/*t := time.Now()
 	elapsed := t.Sub(start)
 	fmt.Printf("\rSaving took %s\n", elapsed)*/
 }
 
+// drain empties the in-memory store, returning the buckets it held
+func (kv *kvStore) drain() map[string][]byte {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	pending := kv.store
+	kv.store = make(map[string][]byte)
+	return pending
+}
+
+// requeue puts buckets that could not be saved back in the in-memory store,
+// ahead of any entries appended since they were drained
+func (kv *kvStore) requeue(buckets map[string][]byte) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	for k, v := range buckets {
+		kv.store[k] = append(v, kv.store[k]...)
+	}
+}
+
+// Merge appends the buckets saved by src to those of kv, copying buckets
+// only src holds. Since buckets are append-only, the result holds the entries
+// of both stores. Both stores must use the same directory fan-out, but may
+// save buckets in different file formats. Merging the same store twice
+// duplicates its entries.
+func (kv *kvStore) Merge(src *kvStore) error {
+	ids, err := src.bucketIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		bucket, err := src.Get(id)
+		if err != nil {
+			return fmt.Errorf("loading bucket %s: %w", id, err)
+		}
+		if err := kv.SaveBucket(kv.root, id, bucket, kv.fileFormat); err != nil {
+			return fmt.Errorf("saving bucket %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// startFlusher periodically saves the in-memory store to disk from a
+// background goroutine. The returned function stops the flusher and waits for
+// an in-progress flush to complete.
+func (kv *kvStore) startFlusher(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := kv.saveCredentials(); err != nil {
+					slog.Warn("periodic flush failed", "err", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
 type FileFormat int8
 
 const (
 	JSON FileFormat = iota
 	Bytes
+	// Zstd buckets are compressed with zstd. Since buckets are compressed
+	// as a whole, appending to a bucket rewrites it.
+	Zstd
+)
+
+// parseFileFormat returns the file format with the given name, "bytes" (the
+// default) or "zstd"
+func parseFileFormat(name string) (FileFormat, error) {
+	switch name {
+	case "", "bytes":
+		return Bytes, nil
+	case "zstd":
+		return Zstd, nil
+	default:
+		return 0, fmt.Errorf("unknown bucket format %q", name)
+	}
+}
+
+// zstdEncoder and zstdDecoder compress and decompress Zstd buckets. Both are
+// safe for concurrent use through EncodeAll and DecodeAll.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
 )
 
+// zstdMagic starts every zstd frame
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// errEmptyBucketID is returned for an empty bucket ID, which has no file
+var errEmptyBucketID = errors.New("empty bucket ID")
+
+// bucketPath returns the path of the file the bucket with the given ID is
+// saved to under root: root/<dir>/.../<id>, where the directories are named
+// after the leading characters of the ID according to the configured fan-out.
+// Without a fan-out depth, each character but the last names a directory, so
+// a one-character ID is saved directly under root.
+func (kv *kvStore) bucketPath(root, id string) (string, error) {
+	if id == "" {
+		return "", errEmptyBucketID
+	}
+	depth, width := kv.fanOutDepth, kv.fanOutWidth
+	if depth == 0 {
+		depth, width = len(id)-1, 1
+	}
+	elems := []string{root}
+	for i := 0; i < depth && (i+1)*width <= len(id); i++ {
+		elems = append(elems, id[i*width:(i+1)*width])
+	}
+	return filepath.Join(append(elems, id)...), nil
+}
+
+// SaveBucket appends bucket to the bucket with the given ID saved under root.
+// The bucket file is replaced atomically, so a crash mid-write leaves either
+// the old or the new contents in place.
 func (kv *kvStore) SaveBucket(root string, bucketID string, bucket []byte, fileFormat FileFormat) error {
-	//lock.Lock()
-	//defer lock.Unlock()
+	bucketLock := kv.bucketLock(bucketID)
+	bucketLock.Lock()
+	defer bucketLock.Unlock()
+	kv.invalidate(bucketID)
 	//fmt.Printf("\rSaving bucket %s", bucketID) ++++++++
-	var path = strings.Join(strings.Split(bucketID, ""), "/")
-	path = path[:len(path)-1]
+	name, err := kv.bucketPath(root, bucketID)
+	if err != nil {
+		return err
+	}
 
-	if _, err := os.Stat(root + path + bucketID); os.IsNotExist(err) {
+	if _, err := os.Stat(name); os.IsNotExist(err) {
 		//fmt.Printf("File does not exist\n")
-		err := os.MkdirAll(root+path, os.ModePerm)
+		err := os.MkdirAll(filepath.Dir(name), os.ModePerm)
 		if err != nil {
 			return err
 			//log.Fatalln(err)
 		}
-	} else if fileFormat == JSON {
-		//fmt.Printf("\rFile exists: %s", root+path+bucketID)
-		existingBucket, _ := kv.LoadBucket(root+path+bucketID, fileFormat)
+	} else {
+		//fmt.Printf("\rFile exists: %s", name)
+		existingBucket, err := kv.LoadBucket(root, bucketID, fileFormat)
+		if err != nil {
+			return err
+		}
 		bucket = append(existingBucket, bucket...)
 	}
+	return kv.writeBucket(name, bucket, fileFormat)
+}
+
+// invalidate evicts the bucket with the given ID from the cache, if any, as
+// it is about to be saved
+func (kv *kvStore) invalidate(bucketID string) {
+	if kv.cache != nil {
+		kv.cache.remove(bucketID)
+	}
+}
 
+// ReplaceBucket saves bucket as the bucket with the given ID under root,
+// replacing any bucket saved there. Like SaveBucket, the bucket file is
+// replaced atomically.
+func (kv *kvStore) ReplaceBucket(root string, bucketID string, bucket []byte, fileFormat FileFormat) error {
+	bucketLock := kv.bucketLock(bucketID)
+	bucketLock.Lock()
+	defer bucketLock.Unlock()
+	kv.invalidate(bucketID)
+	name, err := kv.bucketPath(root, bucketID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+	return kv.writeBucket(name, bucket, fileFormat)
+}
+
+// writeBucket atomically writes bucket to the file name in the given format
+func (kv *kvStore) writeBucket(name string, bucket []byte, fileFormat FileFormat) error {
 	switch fileFormat {
 	case Bytes:
-		f, err := os.OpenFile(root+path+bucketID,
-			os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return err
-			//log.Println(err)
-		}
-		defer f.Close()
-		if _, err := f.Write(bucket); err != nil {
-			return err
-			//log.Println(err)
-		}
+		return kv.writeFileAtomic(name, bytes.NewReader(bucket))
+	case Zstd:
+		return kv.writeFileAtomic(name, bytes.NewReader(zstdEncoder.EncodeAll(bucket, nil)))
 	case JSON:
-		f, err := os.Create(root + path + bucketID)
+		r, err := Marshal(bucket)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-		r, err := Marshal(bucket)
-		if err != nil {
+		return kv.writeFileAtomic(name, r)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the contents of r to a temporary file in the same
+// directory as name and renames it into place.
+func (kv *kvStore) writeFileAtomic(name string, r io.Reader) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if kv.fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
 			return err
 		}
-		_, err = io.Copy(f, r)
+	}
+	if err := f.Close(); err != nil {
 		return err
 	}
-	return nil
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
 }
 
 // Unmarshal is a function that unmarshals the data from the
@@ -154,20 +469,37 @@ var Unmarshal = func(r io.Reader, v interface{}) error {
 	return json.NewDecoder(r).Decode(v)
 }
 
-func (kv *kvStore) LoadBucket(bucketID string, fileFormat FileFormat) ([]byte, error) {
-	lock.Lock()
-	defer lock.Unlock()
-
+// LoadBucket reads the bucket with the given ID saved under root. No lock is
+// needed, as SaveBucket replaces bucket files atomically.
+func (kv *kvStore) LoadBucket(root string, bucketID string, fileFormat FileFormat) ([]byte, error) {
+	name, err := kv.bucketPath(root, bucketID)
+	if err != nil {
+		return nil, err
+	}
 	switch fileFormat {
 	case Bytes:
-		bucket, error := os.ReadFile(bucketID)
+		bucket, error := os.ReadFile(name)
 		if error != nil {
 			//print("error loading bucket bytes")
 			return nil, error
 		}
 		return bucket, nil
+	case Zstd:
+		bucket, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		// buckets saved before compression was enabled are read as is. As
+		// an uncompressed bucket can start with the zstd magic by chance,
+		// it is only taken as compressed if it decodes.
+		if bytes.HasPrefix(bucket, zstdMagic) {
+			if decoded, err := zstdDecoder.DecodeAll(bucket, nil); err == nil {
+				return decoded, nil
+			}
+		}
+		return bucket, nil
 	case JSON:
-		f, err := os.Open(bucketID)
+		f, err := os.Open(name)
 		if err != nil {
 			//log.Fatalln(err)
 			return nil, err
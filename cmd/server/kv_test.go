@@ -0,0 +1,414 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestKVStoreGet checks that Get returns saved and unsaved bucket entries
+func TestKVStoreGet(t *testing.T) {
+	root := t.TempDir()
+	id := "0a1b2c"
+
+	kv, err := newKVStore(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kv.Append(id, []byte("saved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.saveCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Append(id, []byte("pending")); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		loadFromDisk bool
+		id           string
+		want         []byte
+	}{
+		{true, id, []byte("savedpending")},
+		{false, id, []byte("pending")},
+		{true, "ffffff", nil},
+	}
+
+	for i, tc := range testCases {
+		kv.loadFromDisk = tc.loadFromDisk
+		got, err := kv.Get(tc.id)
+		if err != nil {
+			t.Errorf("failed test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("failed test %d: want %q, got %q", i, tc.want, got)
+		}
+	}
+}
+
+// TestKVStoreCache checks that Get returns saved buckets from the cache, and
+// that saves invalidate them
+func TestKVStoreCache(t *testing.T) {
+	id := "0a1b2c"
+	kv, err := newKVStore(t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.cache = newBucketCache(1 << 20)
+
+	steps := []struct {
+		update func() error
+		want   []byte
+	}{
+		{func() error { return nil }, nil},
+		{func() error { return kv.SaveBucket(kv.root, id, []byte("saved"), kv.fileFormat) }, []byte("saved")},
+		// entries appended in memory follow the cached bucket
+		{func() error { return kv.Append(id, []byte("pending")) }, []byte("savedpending")},
+		{kv.saveCredentials, []byte("savedpending")},
+		{func() error { return kv.Put(id, []byte("replaced")) }, []byte("replaced")},
+	}
+	for i, step := range steps {
+		if err := step.update(); err != nil {
+			t.Fatal(err)
+		}
+		// the second Get is served from the cache
+		for j := 0; j < 2; j++ {
+			got, err := kv.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, step.want) {
+				t.Errorf("failed test %d: want %q, got %q", i, step.want, got)
+			}
+		}
+		if _, cached := kv.cache.get(id); !cached {
+			t.Errorf("failed test %d: want bucket cached", i)
+		}
+	}
+}
+
+func TestBucketPath(t *testing.T) {
+	root := filepath.Join("store", "root")
+	testCases := []struct {
+		depth, width int
+		id           string
+		path         []string
+		valid        bool
+	}{
+		{0, 0, "", nil, false},
+		{0, 0, "a", []string{"a"}, true},
+		{0, 0, "ab", []string{"a", "ab"}, true},
+		{0, 0, "0a1b", []string{"0", "a", "1", "0a1b"}, true},
+		{2, 2, "a", []string{"a"}, true},
+		{2, 2, "ab", []string{"ab", "ab"}, true},
+		{2, 2, "0a1b2c", []string{"0a", "1b", "0a1b2c"}, true},
+	}
+
+	for i, test := range testCases {
+		kv := &kvStore{fanOutDepth: test.depth, fanOutWidth: test.width}
+		path, err := kv.bucketPath(root, test.id)
+		if (err == nil) != test.valid {
+			t.Errorf("failed test %d: want valid %v, got %v", i, test.valid, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if want := filepath.Join(append([]string{root}, test.path...)...); path != want {
+			t.Errorf("failed test %d: want %s, got %s", i, want, path)
+		}
+	}
+
+	// buckets with IDs of any length round-trip through a store. IDs of a
+	// store all have the same length, as set by the bucket ID bit size.
+	for _, id := range []string{"a", "ab", "abc", "0a1b2c3d"} {
+		kv, err := newKVStore(t.TempDir(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := kv.SaveBucket(kv.root, id, []byte(id), Bytes); err != nil {
+			t.Fatal(err)
+		}
+		got, err := kv.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, []byte(id)) {
+			t.Errorf("bucket %s: want %q, got %q", id, id, got)
+		}
+	}
+}
+
+// TestSaveBucket checks that saving appends to the bucket file and leaves no
+// temporary files behind
+func TestSaveBucket(t *testing.T) {
+	root := t.TempDir() + string(filepath.Separator)
+	id := "0a1b"
+
+	kv, err := newKVStore(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"first", "second"} {
+		if err := kv.SaveBucket(root, id, []byte(entry), Bytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := filepath.Join(root, "0", "a", "1")
+	got, err := kv.LoadBucket(root, id, Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("firstsecond"); !bytes.Equal(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("want 1 file in %s, got %d", dir, len(files))
+	}
+}
+
+// TestSaveBucketZstd checks that zstd buckets are compressed on disk, and
+// that buckets saved uncompressed can still be read and appended to
+func TestSaveBucketZstd(t *testing.T) {
+	root := t.TempDir() + string(filepath.Separator)
+	id := "0a1b"
+	name := filepath.Join(root, "0", "a", "1", id)
+	entry := bytes.Repeat([]byte("entry"), 100)
+
+	kv, err := newKVStore(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.SaveBucket(root, id, entry, Bytes); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.SaveBucket(root, id, entry, Zstd); err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(append([]byte(nil), entry...), entry...)
+	testCases := []struct {
+		fileFormat FileFormat
+		want       []byte
+	}{
+		{Zstd, want},
+		{Bytes, nil},
+	}
+	for i, test := range testCases {
+		kv.fileFormat = test.fileFormat
+		got, err := kv.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.want != nil && !bytes.Equal(got, test.want) {
+			t.Errorf("failed test %d: want %d bytes, got %d", i, len(test.want), len(got))
+		}
+		if test.want == nil && bytes.Equal(got, want) {
+			t.Errorf("failed test %d: want compressed bucket, got plaintext", i)
+		}
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= int64(len(want)) {
+		t.Errorf("want compressed size below %d, got %d", len(want), info.Size())
+	}
+}
+
+// TestLoadBucketZstdMagic checks that an uncompressed bucket starting with
+// the zstd magic bytes is read as is in Zstd mode, and kept when appended to
+func TestLoadBucketZstdMagic(t *testing.T) {
+	root := t.TempDir() + string(filepath.Separator)
+	id := "0a1b"
+	entry := append(append([]byte(nil), zstdMagic...), bytes.Repeat([]byte{0x5a}, 60)...)
+
+	kv, err := newKVStore(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.SaveBucket(root, id, entry, Bytes); err != nil {
+		t.Fatal(err)
+	}
+	got, err := kv.LoadBucket(root, id, Zstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, entry) {
+		t.Errorf("want %x, got %x", entry, got)
+	}
+
+	if err := kv.SaveBucket(root, id, entry, Zstd); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte(nil), entry...), entry...)
+	if got, err = kv.LoadBucket(root, id, Zstd); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("want %x, got %x", want, got)
+	}
+}
+
+// TestSaveBucketFanOut checks that bucket files are laid out according to
+// the configured fan-out
+func TestSaveBucketFanOut(t *testing.T) {
+	id := "0a1b2c"
+	testCases := []struct {
+		depth, width int
+		dirs         []string
+	}{
+		{0, 0, []string{"0", "a", "1", "b", "2"}},
+		{2, 2, []string{"0a", "1b"}},
+		{1, 3, []string{"0a1"}},
+		{4, 2, []string{"0a", "1b", "2c"}},
+	}
+
+	for i, test := range testCases {
+		root := t.TempDir()
+		kv, err := newKVStore(root, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kv.fanOutDepth, kv.fanOutWidth = test.depth, test.width
+		if err := kv.SaveBucket(root, id, []byte("saved"), Bytes); err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(append(append([]string{root}, test.dirs...), id)...)
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("failed test %d: %v", i, err)
+		}
+		got, err := kv.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []byte("saved"); !bytes.Equal(got, want) {
+			t.Errorf("failed test %d: want %q, got %q", i, want, got)
+		}
+	}
+}
+
+// TestMerge checks that merging concatenates buckets held by both stores and
+// copies those held by one
+func TestMerge(t *testing.T) {
+	for _, fileFormat := range []FileFormat{Bytes, Zstd} {
+		dst, err := newKVStore(t.TempDir(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := newKVStore(t.TempDir(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst.fileFormat, src.fileFormat = fileFormat, fileFormat
+		for id, value := range map[string]string{"0a": "dst", "0b": "dst only"} {
+			if err := dst.SaveBucket(dst.root, id, []byte(value), fileFormat); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for id, value := range map[string]string{"0a": "src", "1c": "src only"} {
+			if err := src.SaveBucket(src.root, id, []byte(value), fileFormat); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := dst.Merge(src); err != nil {
+			t.Fatal(err)
+		}
+		for id, want := range map[string]string{"0a": "dstsrc", "0b": "dst only", "1c": "src only"} {
+			got, err := dst.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("format %d, bucket %s: want %q, got %q", fileFormat, id, want, got)
+			}
+		}
+	}
+}
+
+// TestSaveBucketConcurrent checks that concurrent saves of the same bucket do
+// not lose entries
+func TestSaveBucketConcurrent(t *testing.T) {
+	root := t.TempDir() + string(filepath.Separator)
+	id := "0a1b"
+
+	kv, err := newKVStore(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := kv.SaveBucket(root, id, []byte("x"), Bytes); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := kv.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 16 {
+		t.Errorf("want %d bytes, got %d", 16, len(got))
+	}
+}
+
+// TestSaveCredentialsFailure tests that a bucket failing to save is reported
+// and kept in memory for the next save, without affecting other buckets
+func TestSaveCredentialsFailure(t *testing.T) {
+	root := t.TempDir()
+	kv, err := newKVStore(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a file where the directory of bucket 1a belongs makes its save fail
+	blocker := filepath.Join(root, "1")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"0a", "1a"} {
+		if err := kv.Append(id, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kv.saveCredentials(); err == nil {
+		t.Fatal("want error for unwritable bucket")
+	}
+	if _, ok := kv.store["0a"]; ok || !bytes.Equal(kv.store["1a"], []byte("1a")) {
+		t.Fatalf("want only bucket 1a kept in memory, got %v", kv.store)
+	}
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.saveCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"0a", "1a"} {
+		got, err := kv.Get(id)
+		if err != nil || !bytes.Equal(got, []byte(id)) {
+			t.Errorf("bucket %s: want %q, got (%q, %v)", id, id, got, err)
+		}
+	}
+}
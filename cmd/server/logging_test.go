@@ -0,0 +1,47 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestNewLogger checks that loggers drop records below their level and write
+// the requested format
+func TestNewLogger(t *testing.T) {
+	testCases := []struct {
+		level, format string
+		valid         bool
+		// want is a substring of the info record, or empty if it is dropped
+		want string
+	}{
+		{"info", logFormatText, true, "level=INFO msg=hello bucket=0a"},
+		{"debug", logFormatText, true, "level=INFO msg=hello bucket=0a"},
+		{"WARN", logFormatText, true, ""},
+		{"error", logFormatJSON, true, ""},
+		{"info", logFormatJSON, true, `"msg":"hello","bucket":"0a"`},
+		{"verbose", logFormatText, false, ""},
+		{"info", "xml", false, ""},
+	}
+	for i, tc := range testCases {
+		var out bytes.Buffer
+		logger, err := newLogger(&out, tc.level, tc.format)
+		if (err == nil) != tc.valid {
+			t.Errorf("failed test %d: want valid %v, got error %v", i, tc.valid, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		logger.Info("hello", "bucket", "0a")
+		if tc.want == "" && out.Len() != 0 {
+			t.Errorf("failed test %d: want no output, got %q", i, out.String())
+		}
+		if tc.want != "" && !strings.Contains(out.String(), tc.want) {
+			t.Errorf("failed test %d: want output containing %q, got %q", i, tc.want, out.String())
+		}
+	}
+}
@@ -10,15 +10,32 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/cloudflare/migp-go/pkg/migp"
-	"log"
-	"math"
+	"github.com/cloudflare/migp-go/pkg/migppb"
+	"github.com/cloudflare/migp-go/pkg/mutator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -28,190 +45,944 @@ func main() {
 	MEAN[16] = 1431876
 	MEAN[20] = 89492
 
-	var configFile, inputFilename, inputDirname, metadata, listenAddr string
-	var dumpConfig, includeUsernameVariant bool
-	var numVariants int
-	var restore, start, test bool
+	var configFile, initConfigFile, keyFile, mergeDir, exportFile, importFile, tag, variantGenerator, variantRules, query, breachName, breachDate, exposedFields, inputFilename, inputDirname, listenAddr, storeDir, rateLimitTrusted, logLevel, logFormat, manifestFile string
+	var serveOpts serveOptions
+	var dumpConfig, rotateKey, fsync, metrics, dedup, countOccurrences, force bool
+	var ingest ingestOptions
+	var flushInterval time.Duration
+	var rateLimit, targetOccupancy float64
+	var rateBurst, gzipMinSize, indirWorkers, kAnonymity int
+	var maxRequestBytes, bucketCacheSize, suggestEntries int64
+	var start, test, stats, calibrateHasher, validate, deleteMode, printVersion, suggestBits bool
 
 	flag.StringVar(&configFile, "config", "", "Server configuration file")
+	flag.StringVar(&keyFile, "key-file", "", "file holding the OPRF private key, overriding the one in the configuration (created with a new key if absent)")
 	flag.StringVar(&listenAddr, "listen", "localhost:8080", "Server listen address")
+	flag.BoolVar(&printVersion, "version", false, "print the build version and MIGP protocol version, and exit")
+	flag.StringVar(&initConfigFile, "init-config", "", "write a default server configuration with a new OPRF key to this file, which must not exist, and exit")
 	flag.BoolVar(&dumpConfig, "dump-config", false, "Dump the server configuration to stdout and exit")
+	flag.BoolVar(&rotateKey, "rotate-key", false, "Start a new OPRF key epoch, keeping the current key for existing buckets, then dump the configuration to stdout and exit")
 	flag.StringVar(&inputFilename, "infile", "-", "input file of credentials to insert in the format <username>:<password> ('-' for stdin)")
 	flag.StringVar(&inputDirname, "indir", "", "input directory of credentials to insert in the format <username>:<password>")
-	flag.StringVar(&metadata, "metadata", "", "optional metadata string to store alongside breach entries")
-	flag.IntVar(&numVariants, "num-variants", 9, "number of password variants to include")
-	flag.BoolVar(&includeUsernameVariant, "username-variant", true, "include a username-only variant")
+	flag.StringVar(&manifestFile, "manifest", "", fmt.Sprintf("file recording the files of -indir already ingested, which are skipped when ingesting the directory again (default %q under the store directory of the file backend)", manifestName))
+	flag.IntVar(&indirWorkers, "indir-workers", 1, "number of files of -indir ingested at once, each buffering its buckets in memory apart from the others (file backend only)")
+	flag.BoolVar(&force, "force", false, "ingest the files of -indir even if the manifest records them as ingested")
+	flag.StringVar(&tag, "tag", "", "ingest credentials into the breach namespace with this tag (default: from config)")
+	flag.StringVar(&ingest.metadata, "metadata", "", "optional metadata string to store alongside breach entries")
+	flag.BoolVar(&ingest.metadataField, "metadata-field", false, "read per-entry metadata from a third field of each line (<username>:<password>:<metadata>), falling back to -metadata")
+	flag.StringVar(&ingest.delimiter, "delimiter", ":", "delimiter between the fields of an input line")
+	flag.StringVar(&ingest.commentPrefix, "comment-prefix", "#", "skip input lines starting with this prefix, as well as blank lines (empty to only skip blank lines)")
+	flag.StringVar(&breachName, "breach-name", "", "store structured breach metadata with this breach name instead of -metadata")
+	flag.StringVar(&breachDate, "breach-date", "", "date of the breach (YYYY-MM-DD) for structured breach metadata")
+	flag.StringVar(&exposedFields, "exposed-fields", "", "comma-separated fields exposed in the breach for structured breach metadata")
+	flag.StringVar(&ingest.format, "input-format", inputFormatCredentials, fmt.Sprintf("format of input lines, %q for <username>:<password>, %q for <SHA-1 hash of password>:<count>, storing the count as metadata, or %q for JSON objects with username, password and optional structured metadata fields", inputFormatCredentials, inputFormatHIBP, inputFormatJSONL))
+	flag.IntVar(&ingest.numVariants, "num-variants", 9, "number of password variants to include")
+	flag.StringVar(&variantRules, "variant-rules", "", "JSON file of password transformation rules to generate variants with, instead of the variant generator")
+	flag.StringVar(&variantGenerator, "variant-generator", "", fmt.Sprintf("password variant generator, %q or %q (default: from config, or %q)", mutator.VariantGeneratorRDas, mutator.VariantGeneratorNone, mutator.VariantGeneratorRDas))
+	flag.BoolVar(&ingest.includeUsernameVariant, "username-variant", true, "include a username-only variant")
+	flag.BoolVar(&ingest.includePasswordOnly, "password-only", false, "also insert a password-only entry for each credential, found by clients querying the password regardless of username")
+	flag.BoolVar(&dedup, "dedup", false, "skip entries already in their bucket, so that re-ingesting overlapping datasets is idempotent (slower, as buckets are loaded on every insert)")
+	flag.BoolVar(&countOccurrences, "count-occurrences", false, "store the number of times each entry was ingested in its structured metadata, counting entries already in their bucket instead of inserting them again (slower, as buckets are loaded on every insert)")
+	flag.BoolVar(&ingest.gzipStdin, "gzip-stdin", false, "decompress input read from stdin with gzip (input files with a .gz extension or gzip header are always decompressed)")
+	flag.IntVar(&ingest.maxLineSize, "max-line-size", 1024*1024, fmt.Sprintf("maximum length in bytes of an input line; usernames and passwords longer than %d bytes are ingestion failures", migp.MaxCredentialLength))
+	flag.BoolVar(&ingest.verbose, "verbose", false, fmt.Sprintf("log every entry that fails to ingest, not just the first %d per file", maxLoggedFailures))
+	flag.StringVar(&query, "query", "", "query the store for a credential pair in the format <username>:<password> without starting the server, and exit")
 	flag.BoolVar(&start, "start", false, "start MIGP server without loading breach dataset")
-	flag.BoolVar(&test, "test", false, "Get breach dataset info")
+	flag.BoolVar(&test, "test", false, "print breach dataset info and exit (combine with -start to also serve)")
+	flag.BoolVar(&stats, "stats", false, "print the distribution of entries per bucket as JSON, and exit (cannot be combined with -start)")
+	flag.IntVar(&kAnonymity, "k-anonymity", 10, "with -test or -stats, count the buckets with fewer than this many entries, which offer weak anonymity to the queries they serve")
+	flag.BoolVar(&validate, "validate", false, "check that the lines of -infile or -indir parse, reporting invalid lines, without ingesting them, and exit")
+	flag.BoolVar(&deleteMode, "delete", false, "remove the credentials of -infile, and the variants -num-variants generates for them, from the store instead of inserting them, and exit")
+	flag.BoolVar(&calibrateHasher, "calibrate-hasher", false, "Measure the cost of the configured slow hasher and exit")
+	flag.BoolVar(&suggestBits, "suggest-bits", false, "print the bucketIDBitSize giving buckets of -target-occupancy entries on average for -entries entries, and exit")
+	flag.Int64Var(&suggestEntries, "entries", 0, "with -suggest-bits, the number of bucket entries to store (each credential adds one entry, plus one per password variant and one for the username variant)")
+	flag.Float64Var(&targetOccupancy, "target-occupancy", 0, "with -suggest-bits, the average number of entries per bucket to aim for")
+	flag.StringVar(&storeDir, "store-dir", "", fmt.Sprintf("directory to save buckets to and load them from (default %q)", defaultStoreDir))
+	flag.StringVar(&mergeDir, "merge", "", "append the buckets of the store in this directory, produced with the same configuration, to the store, and exit")
+	flag.StringVar(&exportFile, "export", "", "write the whole store to this archive file ('-' for stdout), and exit")
+	flag.StringVar(&importFile, "import", "", "append the buckets of this archive file written by -export ('-' for stdin) to the store, and exit")
+	flag.BoolVar(&fsync, "fsync", false, "fsync each bucket when saving it (durable but slow during bulk loads)")
+	flag.IntVar(&gzipMinSize, "gzip-min-size", defaultGzipMinSize, "compress evaluate responses of at least this many bytes for clients accepting gzip (negative disables)")
+	flag.Int64Var(&maxRequestBytes, "max-request-bytes", defaultMaxRequestBytes, "maximum size in bytes of an evaluate request body, larger requests are rejected with 413")
+	flag.BoolVar(&metrics, "metrics", false, "expose Prometheus metrics on /metrics")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "maximum evaluate requests per second from a single client IP (0 disables)")
+	flag.IntVar(&rateBurst, "rate-burst", 10, "maximum burst of evaluate requests from a single client IP, each query of a batch request counting as one request (batches larger than the burst are rejected)")
+	flag.StringVar(&rateLimitTrusted, "rate-limit-trusted", "", "comma-separated CIDRs exempt from rate limiting")
+	flag.StringVar(&serveOpts.tlsCert, "tls-cert", "", "TLS certificate file; serve HTTPS when set with -tls-key (reloaded on SIGHUP)")
+	flag.StringVar(&serveOpts.tlsKey, "tls-key", "", "TLS private key file")
+	flag.StringVar(&serveOpts.grpcAddr, "grpc-listen", "", "also serve the MIGP protocol over gRPC on this address, with the TLS, API keys and rate limits of HTTP (empty disables)")
+	flag.DurationVar(&serveOpts.drainTimeout, "shutdown-timeout", 30*time.Second, "time to let in-flight requests complete on SIGINT or SIGTERM")
+	flag.Int64Var(&bucketCacheSize, "bucket-cache-size", 0, "keep up to this many bytes of recently loaded buckets in memory, evicting the least recently used first (file backend only, 0 disables)")
+	flag.DurationVar(&flushInterval, "flush-interval", 0, "periodically flush buffered buckets to disk during ingestion (0 disables)")
+	flag.StringVar(&logLevel, "log-level", "info", "minimum level of log records, one of debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", logFormatText, fmt.Sprintf("format of log records, %q or %q", logFormatText, logFormatJSON))
 
 	flag.Parse()
 
+	logger, err := newLogger(os.Stderr, logLevel, logFormat)
+	if err != nil {
+		fatal("invalid logging options", "err", err)
+	}
+	slog.SetDefault(logger)
+
+	if stats && start {
+		fatal("-stats cannot be combined with -start, use -test -start to print dataset info and serve")
+	}
+
+	if printVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if initConfigFile != "" {
+		if err := initConfig(initConfigFile); err != nil {
+			fatal("writing the configuration failed", "err", err)
+		}
+		return
+	}
+
+	if suggestBits {
+		bits, err := migp.SuggestBucketIDBitSize(suggestEntries, targetOccupancy)
+		if err != nil {
+			fatal("invalid -suggest-bits options", "err", err)
+		}
+		fmt.Printf("bucketIDBitSize: %d\n", bits)
+		fmt.Printf("Buckets: %d\n", uint64(1)<<bits)
+		fmt.Printf("Avg occupancy: %.1f\n", float64(suggestEntries)/float64(uint64(1)<<bits))
+		return
+	}
+
+	if ingest.delimiter == "" {
+		fatal("-delimiter must not be empty")
+	}
+	if ingest.format != inputFormatCredentials && ingest.format != inputFormatHIBP && ingest.format != inputFormatJSONL {
+		fatal("unknown input format", "format", ingest.format)
+	}
+
 	var cfg migp.ServerConfig
+	var storeCfg storeConfig
+	var ingestCfg ingestConfig
 	if configFile != "" {
 		data, err := os.ReadFile(configFile)
 		if err != nil {
-			log.Fatal(err)
+			fatal("reading the configuration failed", "err", err)
 		}
 		err = json.Unmarshal(data, &cfg)
 		if err != nil {
-			log.Fatal(err)
+			fatal("invalid config", "file", configFile, "err", err)
+		}
+		if err := cfg.Validate(); err != nil {
+			fatal("invalid config", "file", configFile, "err", err)
+		}
+		err = json.Unmarshal(data, &storeCfg)
+		if err != nil {
+			fatal("invalid config", "file", configFile, "err", err)
+		}
+		err = json.Unmarshal(data, &ingestCfg)
+		if err != nil {
+			fatal("invalid config", "file", configFile, "err", err)
 		}
 	} else {
 		cfg = migp.DefaultServerConfig()
 	}
 
+	if tag != "" {
+		cfg.Tag = tag
+	}
+
+	if breachName != "" || breachDate != "" || exposedFields != "" {
+		if ingest.metadata != "" {
+			fatal("-metadata cannot be combined with structured breach metadata")
+		}
+		metadata, err := breachMetadata(breachName, breachDate, exposedFields)
+		if err != nil {
+			fatal("invalid breach metadata", "err", err)
+		}
+		ingest.metadata = string(metadata)
+	}
+
+	if keyFile != "" {
+		if rotateKey {
+			fatal("-rotate-key cannot be combined with -key-file")
+		}
+		if err := loadOrCreateKeyFile(keyFile, &cfg); err != nil {
+			fatal("loading the key file failed", "file", keyFile, "err", err)
+		}
+	}
+
+	if rotateKey {
+		if err := cfg.RotateKey(); err != nil {
+			fatal("rotating the key failed", "err", err)
+		}
+		dumpConfig = true
+	}
+
 	if dumpConfig {
 		data, err := json.Marshal(&cfg)
 		if err != nil {
-			log.Fatal(err)
+			fatal("encoding the configuration failed", "err", err)
 		}
 		_, err = os.Stdout.Write(data)
 		if err != nil {
-			log.Fatal(err)
+			fatal("writing the configuration failed", "err", err)
 		}
 		return
 	}
 
-	s, err := newServer(cfg)
+	if validate {
+		files := []string{inputFilename}
+		if inputDirname != "" {
+			dirFiles, err := listInputDir(inputDirname)
+			if err != nil {
+				fatal("listing the input directory failed", "dir", inputDirname, "err", err)
+			}
+			files = nil
+			for _, file := range dirFiles {
+				files = append(files, file.path)
+			}
+		}
+		var validCount, invalidCount int64
+		for _, file := range files {
+			valid, invalid, err := validateCredentials(file, ingest)
+			if err != nil {
+				fatal("validating input failed", "file", file, "err", err)
+			}
+			validCount += valid
+			invalidCount += invalid
+		}
+		fmt.Printf("Valid lines: %d\n", validCount)
+		fmt.Printf("Invalid lines: %d\n", invalidCount)
+		if invalidCount > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if calibrateHasher {
+		if err := calibrateSlowHasher(cfg.Config, 10); err != nil {
+			fatal("calibrating the slow hasher failed", "err", err)
+		}
+		return
+	}
+
+	if storeDir != "" {
+		storeCfg.StoreDir = storeDir
+	}
+
+	s, err := newServer(cfg, storeCfg)
 	if err != nil {
-		log.Fatal(err)
+		fatal("creating the server failed", "err", err)
+	}
+	if s.kv != nil {
+		s.kv.fsync = fsync
+	}
+	if bucketCacheSize < 0 {
+		fatal("-bucket-cache-size must not be negative")
+	} else if bucketCacheSize > 0 {
+		if s.kv == nil {
+			fatal("-bucket-cache-size requires the file store backend")
+		}
+		s.kv.cache = newBucketCache(bucketCacheSize)
+	}
+	if variantGenerator == "" {
+		variantGenerator = ingestCfg.VariantGenerator
+	}
+	if variantRules == "" {
+		variantRules = ingestCfg.VariantRules
+	}
+	if variantRules != "" {
+		if variantGenerator != "" && variantGenerator != mutator.VariantGeneratorRDas {
+			fatal("-variant-rules cannot be combined with this variant generator", "generator", variantGenerator)
+		}
+		rules, err := mutator.LoadRules(variantRules)
+		if err != nil {
+			fatal("loading variant rules failed", "file", variantRules, "err", err)
+		}
+		if s.variants, err = mutator.NewRDasMutatorFromRules(rules); err != nil {
+			fatal("invalid variant rules", "file", variantRules, "err", err)
+		}
+	} else if s.variants, err = mutator.NewVariantGenerator(variantGenerator); err != nil {
+		fatal("invalid variant generator", "generator", variantGenerator, "err", err)
+	}
+	s.metrics = metrics
+	s.dedup = dedup
+	if countOccurrences {
+		if ingest.format == inputFormatHIBP {
+			fatal("-count-occurrences cannot be combined with the HIBP input format, as HIBP lines hold their count", "format", ingest.format)
+		}
+		if _, err := migp.AddMetadataCount([]byte(ingest.metadata), 1); err != nil {
+			fatal("-count-occurrences requires structured or empty metadata", "err", err)
+		}
+	}
+	s.countOccurrences = countOccurrences
+	if indirWorkers > 1 {
+		if s.kv == nil {
+			fatal("-indir-workers requires the file store backend")
+		}
+		// files ingested at once do not see the entries the others
+		// buffer, so inserts that read their bucket first would miss them
+		if dedup || countOccurrences || s.maxBucketEntries > 0 {
+			fatal("-indir-workers cannot be combined with -dedup, -count-occurrences or a maximum number of bucket entries")
+		}
+	}
+	s.gzipMinSize = gzipMinSize
+	if maxRequestBytes <= 0 {
+		fatal("-max-request-bytes must be positive")
+	}
+	s.maxRequestBytes = maxRequestBytes
+	if rateLimit > 0 {
+		if s.rateLimiter, err = newRateLimiter(rateLimit, rateBurst, strings.Split(rateLimitTrusted, ",")); err != nil {
+			fatal("invalid rate limit", "err", err)
+		}
 	}
 
-	if start {
-		log.Printf("\nStarting MIGP server")
-		log.Fatal(http.ListenAndServe(listenAddr, s.handler()))
+	if mergeDir != "" {
+		if s.kv == nil {
+			fatal("-merge requires the file store backend")
+		}
+		src, err := newKVStore(mergeDir, true)
+		if err != nil {
+			fatal("opening the store to merge failed", "dir", mergeDir, "err", err)
+		}
+		src.fileFormat, src.fanOutDepth, src.fanOutWidth = s.kv.fileFormat, s.kv.fanOutDepth, s.kv.fanOutWidth
+		if err := s.kv.Merge(src); err != nil {
+			fatal("merging stores failed", "dir", mergeDir, "err", err)
+		}
+		return
+	}
+
+	if exportFile != "" || importFile != "" {
+		if s.kv == nil {
+			fatal("-export and -import require the file store backend")
+		}
+		if exportFile != "" && importFile != "" {
+			fatal("-export cannot be combined with -import")
+		}
+		if exportFile != "" {
+			count, err := exportStore(s.kv, exportFile)
+			if err != nil {
+				fatal("exporting the store failed", "file", exportFile, "err", err)
+			}
+			slog.Info("exported store", "file", exportFile, "buckets", count)
+		} else {
+			count, err := importStore(s.kv, importFile)
+			if err != nil {
+				fatal("importing the store failed", "file", importFile, "err", err)
+			}
+			slog.Info("imported store", "file", importFile, "buckets", count)
+		}
+		return
+	}
+
+	if deleteMode {
+		if ingest.format == inputFormatHIBP {
+			fatal("-delete cannot be combined with the HIBP input format", "format", ingest.format)
+		}
+		if inputDirname != "" {
+			fatal("-delete cannot be combined with -indir")
+		}
+		removed, err := s.deleteCredentials(inputFilename, ingest)
+		if err != nil {
+			fatal("deleting credentials failed", "file", inputFilename, "err", err)
+		}
+		slog.Info("removed entries", "file", inputFilename, "entries", removed)
+		return
+	}
+
+	if storeCfg.BloomFilter && (query != "" || start) {
+		if err := s.enableBloomFilter(storeCfg.BloomCapacity, storeCfg.BloomFalsePositiveRate); err != nil {
+			fatal("building the Bloom filter failed", "err", err)
+		}
+	}
+
+	if query != "" {
+		if err := s.queryLocal(query, ingest.delimiter); err != nil {
+			fatal("query failed", "err", err)
+		}
 		return
 	}
 
 	if test {
-		start := time.Now()
-		numOfBuckets, numOfCredentials, avg, std := avgBucketSize(s, s.kv)
-		t := time.Now()
-		elapsed := t.Sub(start)
+		if s.kv == nil {
+			fatal("-test requires the file store backend")
+		}
+		began := time.Now()
+		report, err := avgBucketSize(s.kv, kAnonymity)
+		if err != nil {
+			fatal("reading buckets failed", "err", err)
+		}
+		elapsed := time.Since(began)
 		fmt.Printf("Operation took %s\n", elapsed)
-		fmt.Printf("#Buckets: %d\n", numOfBuckets)
-		fmt.Printf("#Credentials: %d\n", numOfCredentials)
-		fmt.Printf("Avg: %d\n", avg)
-		fmt.Printf("Std: %d\n", std)
-		log.Printf("\nStarting MIGP server")
-		log.Fatal(http.ListenAndServe(listenAddr, s.handler()))
+		fmt.Printf("#Buckets: %d\n", report.Buckets)
+		fmt.Printf("#Credentials: %d\n", report.Credentials)
+		fmt.Printf("Avg: %.0f\n", report.Mean)
+		fmt.Printf("Std: %.0f\n", report.StdDev)
+		fmt.Printf("Min: %d\n", report.Min)
+		fmt.Printf("#Buckets below k=%d: %d\n", report.K, report.BelowK)
+		if !start {
+			return
+		}
+	}
+
+	if start {
+		slog.Info("starting MIGP server", "addr", listenAddr)
+		serveOpts.grpcService = grpcService{s: s}
+		if err := serve(listenAddr, s.handler(), serveOpts); err != nil {
+			fatal("serving failed", "err", err)
+		}
 		return
 	}
 
-	if inputDirname != "" {
-		var encryptionTime time.Duration = 0
-		var savingTime time.Duration = 0
+	if stats {
+		if s.kv == nil {
+			fatal("-stats requires the file store backend")
+		}
+		report, err := avgBucketSize(s.kv, kAnonymity)
+		if err != nil {
+			fatal("reading buckets failed", "err", err)
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			fatal("writing stats failed", "err", err)
+		}
+		return
+	}
 
-		filepath.Walk(inputDirname, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				log.Fatalf(err.Error())
-			}
+	stopFlusher := func() {}
+	if flushInterval > 0 && s.kv != nil {
+		stopFlusher = s.kv.startFlusher(flushInterval)
+	}
 
-			if !info.IsDir() && info.Name()[0:1] != "." {
-				fmt.Println(path)
-				start := time.Now()
-				s.processCredentials(path, metadata, numVariants, includeUsernameVariant)
-				t := time.Now()
-				//println() ++++++++
-				elapsed := t.Sub(start)
-				encryptionTime = encryptionTime + elapsed
-				//var finished = path + " - " + encryptionTime.String()
-				//fmt.Println(finished)
-				//fmt.Println(strings.Repeat("-", len(finished)))
-				t2 := time.Now()
-				s.kv.saveCredentials()
-				savingTime += time.Now().Sub(t2)
-				kv, err := newKVStore()
-				if err != nil {
-					return err
-				}
-				s.kv = kv
+	if inputDirname != "" {
+		if manifestFile == "" && s.kv != nil {
+			manifestFile = filepath.Join(s.kv.root, manifestName)
+		}
+		dirOpts := dirIngestOptions{workers: indirWorkers, flushInterval: flushInterval, force: force}
+		if manifestFile != "" {
+			if dirOpts.manifest, err = loadIngestManifest(manifestFile); err != nil {
+				fatal("loading the manifest failed", "file", manifestFile, "err", err)
 			}
-			return nil
-		})
-		fmt.Printf("\rEncryption took %s\n", encryptionTime)
-		fmt.Printf("\rSaving took %s\n", savingTime)
+		}
+		encryptionTime, savingTime, unsaved, err := s.ingestDir(inputDirname, ingest, dirOpts)
+		if err != nil {
+			fatal("walking the input directory failed", "dir", inputDirname, "err", err)
+		}
+		stopFlusher()
+		if err := s.flush(); err != nil {
+			fatal("some buckets could not be saved", "err", err)
+		}
+		recordIngested(dirOpts.manifest, unsaved...)
+		slog.Info("ingestion finished", "encryption", encryptionTime, "saving", savingTime)
 	} else if inputFilename != "" {
 		start := time.Now()
-		s.processCredentials(inputFilename, metadata, numVariants, includeUsernameVariant)
+		s.processCredentials(inputFilename, ingest)
 		t := time.Now()
 		elapsed := t.Sub(start)
-		fmt.Printf("\n")
-		s.kv.saveCredentials()
-		for k, v := range s.kv.store {
-			fmt.Printf("KV %s: %d bytes\n", k, len(v))
+		stopFlusher()
+		if s.kv != nil {
+			for k, v := range s.kv.store {
+				slog.Debug("buffered bucket", "bucket", k, "bytes", len(v))
+			}
+		}
+		if err := s.flush(); err != nil {
+			fatal("some buckets could not be saved", "err", err)
 		}
-		fmt.Printf("Encryption took %s\n", elapsed)
+		slog.Info("ingestion finished", "encryption", elapsed)
 	}
 
 }
 
-func avgBucketSize(s *server, kv *kvStore) (int, int, int, int) {
-	var numOfBuckets = 0
-	var sizeOfBuckets []int
-	var numOfCredentials = 0
-	filepath.Walk("./store_test", func(path string, info os.FileInfo, err error) error {
-		fmt.Println(path)
+// serveOptions controls how the server listens for requests
+type serveOptions struct {
+	// drainTimeout is how long in-flight requests may take to complete on
+	// shutdown
+	drainTimeout time.Duration
+	// tlsCert and tlsKey are the certificate and key files to serve HTTPS
+	// with. Plain HTTP is served unless both are set.
+	tlsCert, tlsKey string
+	// grpcAddr, if set, is the address to also serve grpcService on
+	grpcAddr    string
+	grpcService migppb.MIGPServer
+}
+
+// serve serves handler on addr, and opts.grpcService on opts.grpcAddr if set,
+// until SIGINT or SIGTERM is received, then stops accepting connections and
+// waits up to opts.drainTimeout for in-flight requests to complete.
+func serve(addr string, handler http.Handler, opts serveOptions) error {
+	httpServer := &http.Server{Addr: addr, Handler: handler}
+	var grpcOpts []grpc.ServerOption
+
+	useTLS := opts.tlsCert != "" && opts.tlsKey != ""
+	if useTLS {
+		certs, err := newCertReloader(opts.tlsCert, opts.tlsKey)
 		if err != nil {
-			log.Fatalf(err.Error())
+			return err
+		}
+		defer certs.watchSIGHUP()()
+		httpServer.TLSConfig = certs.tlsConfig()
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(certs.tlsConfig())))
+	} else if opts.tlsCert != "" || opts.tlsKey != "" {
+		return errors.New("both -tls-cert and -tls-key are required to serve HTTPS")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 2)
+	var grpcServer *grpc.Server
+	if opts.grpcAddr != "" {
+		listener, err := net.Listen("tcp", opts.grpcAddr)
+		if err != nil {
+			return err
+		}
+		grpcServer = grpc.NewServer(grpcOpts...)
+		migppb.RegisterMIGPServer(grpcServer, opts.grpcService)
+		slog.Info("serving gRPC", "addr", opts.grpcAddr)
+		go func() { errs <- grpcServer.Serve(listener) }()
+	}
+	go func() {
+		if useTLS {
+			// the certificate is provided by TLSConfig.GetCertificate
+			errs <- httpServer.ListenAndServeTLS("", "")
+			return
+		}
+		errs <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("shutting down MIGP server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.drainTimeout)
+	defer cancel()
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		defer func() {
+			select {
+			case <-stopped:
+			case <-shutdownCtx.Done():
+				grpcServer.Stop()
+			}
+		}()
+	}
+	return httpServer.Shutdown(shutdownCtx)
+}
+
+// breachMetadata encodes structured breach metadata from the ingestion flags
+func breachMetadata(name, date, exposedFields string) ([]byte, error) {
+	if date != "" {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return nil, fmt.Errorf("invalid breach date %q: want YYYY-MM-DD", date)
+		}
+	}
+	m := migp.BreachMetadata{Name: name, Date: date}
+	for _, field := range strings.Split(exposedFields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			m.ExposedFields = append(m.ExposedFields, field)
+		}
+	}
+	return m.Marshal()
+}
+
+// calibrateSlowHasher runs the slow hasher of the given configuration over
+// random inputs and reports its throughput and per-hash latency
+func calibrateSlowHasher(cfg migp.Config, iterations int) error {
+	slowHasher, err := migp.NewSlowHasherFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	input := make([]byte, 32)
+	var elapsed time.Duration
+	for i := 0; i < iterations; i++ {
+		if _, err := rand.Read(input); err != nil {
+			return err
+		}
+		start := time.Now()
+		slowHasher.Hash(input)
+		elapsed += time.Now().Sub(start)
+	}
+
+	perOp := elapsed / time.Duration(iterations)
+	fmt.Printf("Slow hasher: %#04x\n", cfg.SlowHasherID)
+	fmt.Printf("Iterations: %d\n", iterations)
+	fmt.Printf("Latency: %s/op\n", perOp)
+	fmt.Printf("Throughput: %.2f ops/s\n", float64(iterations)/elapsed.Seconds())
+	return nil
+}
+
+// ingestConfig holds the ingestion settings read from the server
+// configuration file
+type ingestConfig struct {
+	// VariantGenerator names the password variant generator, see
+	// mutator.NewVariantGenerator
+	VariantGenerator string `json:"variantGenerator,omitempty"`
+	// VariantRules is a file of rules for the variant generator, see
+	// mutator.LoadRules
+	VariantRules string `json:"variantRules,omitempty"`
+}
+
+// ingestOptions controls how breach entries are read and inserted
+type ingestOptions struct {
+	metadata string
+	// metadataField reads per-entry metadata from a third field of each
+	// line, with metadata as the fallback
+	metadataField bool
+	// delimiter separates the fields of a line
+	delimiter              string
+	numVariants            int
+	includeUsernameVariant bool
+	// includePasswordOnly also inserts a password-only entry for each
+	// credential
+	includePasswordOnly bool
+	// maxLineSize is the maximum length in bytes of an input line
+	maxLineSize int
+	// verbose logs every failed entry
+	verbose bool
+	// format is the format of input lines, inputFormatCredentials,
+	// inputFormatHIBP or inputFormatJSONL
+	format string
+	// commentPrefix starts lines that are skipped, if not empty
+	commentPrefix string
+	// gzipStdin decompresses input read from stdin, while files are
+	// decompressed if they look compressed, see openInput
+	gzipStdin bool
+}
+
+const (
+	// inputFormatCredentials lines are <username>:<password>
+	inputFormatCredentials = "credentials"
+	// inputFormatHIBP lines are <SHA-1 hash of password>:<count>, as in the
+	// Have I Been Pwned password dataset
+	inputFormatHIBP = "hibp"
+	// inputFormatJSONL lines are JSON objects with username, password and
+	// optional metadata fields
+	inputFormatJSONL = "jsonl"
+)
+
+// maxLoggedFailures is the number of failed entries per file logged when not
+// in verbose mode
+const maxLoggedFailures = 10
+
+// errCredentialNotFound is reported for credentials to delete that have no
+// entries in the store
+var errCredentialNotFound = errors.New("credential not found")
+
+// errMalformedLine is reported for input lines missing the delimiter
+var errMalformedLine = errors.New("malformed line, missing delimiter between username and password")
+
+// skipLine reports whether an input line is blank or a comment, and holds no
+// entry to ingest
+func skipLine(line []byte, opts ingestOptions) bool {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return true
+	}
+	return opts.commentPrefix != "" && bytes.HasPrefix(line, []byte(opts.commentPrefix))
+}
+
+// parseHIBPLine parses an input line in the HIBP format into the SHA-1 hash
+// of a password and its occurrence count, used as metadata. The count is
+// optional. The returned metadata aliases line.
+func parseHIBPLine(line []byte, opts ingestOptions) (digest, metadata []byte, err error) {
+	fields := bytes.SplitN(line, []byte(opts.delimiter), 2)
+	digest = make([]byte, sha1.Size)
+	if len(fields[0]) != hex.EncodedLen(sha1.Size) {
+		return nil, nil, errors.New("malformed line, expected a hex SHA-1 hash")
+	}
+	if _, err := hex.Decode(digest, fields[0]); err != nil {
+		return nil, nil, errors.New("malformed line, expected a hex SHA-1 hash")
+	}
+	if len(fields) == 2 {
+		if _, err := strconv.ParseUint(string(fields[1]), 10, 64); err != nil {
+			return nil, nil, errors.New("malformed line, invalid occurrence count")
+		}
+		metadata = fields[1]
+	}
+	return digest, metadata, nil
+}
+
+// parseCredentialLine splits an input line into a credential pair and its
+// metadata. The returned slices alias line.
+func parseCredentialLine(line []byte, opts ingestOptions) (username, password, metadata []byte, err error) {
+	n := 2
+	if opts.metadataField {
+		n = 3
+	}
+	fields := bytes.SplitN(line, []byte(opts.delimiter), n)
+	if len(fields) < 2 {
+		return nil, nil, nil, errMalformedLine
+	}
+	metadata = []byte(opts.metadata)
+	if len(fields) == 3 {
+		metadata = fields[2]
+	}
+	return fields[0], fields[1], metadata, nil
+}
+
+// parseJSONLine parses an input line in the JSONL format into a credential
+// pair and its metadata. Metadata given as an object is validated and encoded
+// as structured breach metadata, while a string is used as is. Lines without
+// metadata fall back to the -metadata of opts.
+func parseJSONLine(line []byte, opts ingestOptions) (username, password, metadata []byte, err error) {
+	var fields struct {
+		Username *string         `json:"username"`
+		Password *string         `json:"password"`
+		Metadata json.RawMessage `json:"metadata"`
+	}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, nil, nil, errors.New("malformed line, expected a JSON object")
+	}
+	if fields.Username == nil || fields.Password == nil {
+		return nil, nil, nil, errors.New("malformed line, missing username or password")
+	}
+	metadata = []byte(opts.metadata)
+	switch raw := bytes.TrimSpace(fields.Metadata); {
+	case len(raw) == 0 || bytes.Equal(raw, []byte("null")):
+	case raw[0] == '"':
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, nil, nil, errors.New("malformed line, invalid metadata")
+		}
+		metadata = []byte(s)
+	case raw[0] == '{':
+		var m migp.BreachMetadata
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&m); err != nil {
+			return nil, nil, nil, errors.New("malformed line, invalid structured metadata")
 		}
-		if !info.IsDir() && info.Name()[0:1] != "." {
-			bucket, _ := kv.LoadBucket(path, Bytes)
-			if len(bucket) > 0 {
-				numOfBuckets += 1
-				sizeOfBuckets = append(sizeOfBuckets, len(bucket)/25)
-				numOfCredentials = numOfCredentials + len(bucket)
+		if m.Date != "" {
+			if _, err := time.Parse("2006-01-02", m.Date); err != nil {
+				return nil, nil, nil, errors.New("malformed line, invalid breach date, want YYYY-MM-DD")
 			}
 		}
-		return nil
-	})
-	println()
-	numOfCredentials = numOfCredentials / 25
+		if metadata, err = m.Marshal(); err != nil {
+			return nil, nil, nil, err
+		}
+	default:
+		return nil, nil, nil, errors.New("malformed line, metadata must be an object or a string")
+	}
+	return []byte(*fields.Username), []byte(*fields.Password), metadata, nil
+}
 
-	var numCred = numOfCredentials
+// ingestFailures collects the reasons entries of a file failed to ingest
+type ingestFailures struct {
+	file    string
+	verbose bool
 
-	var avg = numOfCredentials / numOfBuckets
+	lock    sync.Mutex
+	count   int
+	reasons map[string]int
+}
 
-	for i, _ := range sizeOfBuckets {
-		sizeOfBuckets[i] = sizeOfBuckets[i] - avg
-		sizeOfBuckets[i] = sizeOfBuckets[i] * sizeOfBuckets[i]
+// add records that the entry at the given line failed with err, logging it
+// if verbose or among the first failures
+func (f *ingestFailures) add(line int, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.count += 1
+	if f.reasons == nil {
+		f.reasons = make(map[string]int)
 	}
+	f.reasons[err.Error()] += 1
+	if f.verbose || f.count <= maxLoggedFailures {
+		slog.Warn("ingesting entry failed", "file", f.file, "line", line, "err", err)
+	}
+}
 
-	numOfCredentials = 0
-	for i := 0; i < len(sizeOfBuckets); i++ {
-		numOfCredentials = numOfCredentials + sizeOfBuckets[i]
+// summary logs the number of failed entries for each distinct reason, after
+// a record reporting what was done to the file, e.g. "ingested"
+func (f *ingestFailures) summary(done string, successCount int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	slog.Info(done, "file", f.file, "successes", successCount, "failures", f.count)
+	reasons := make([]string, 0, len(f.reasons))
+	for reason := range f.reasons {
+		reasons = append(reasons, reason)
 	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		slog.Info("failure reason", "file", f.file, "reason", reason, "count", f.reasons[reason])
+	}
+}
 
-	var std = math.Sqrt(float64(numOfCredentials) / float64(numOfBuckets))
-	return numOfBuckets, numCred, avg, int(std)
+// ingestEntry is an entry parsed from an input line
+type ingestEntry struct {
+	line                         int
+	username, password, metadata []byte
+	// digest is the SHA-1 hash of the password of HIBP entries, which have
+	// no username or password
+	digest []byte
+}
+
+// parseLine parses an input line in the configured format. The returned entry
+// may alias line.
+func parseLine(line []byte, opts ingestOptions) (ingestEntry, error) {
+	if opts.format == inputFormatHIBP {
+		digest, metadata, err := parseHIBPLine(line, opts)
+		return ingestEntry{digest: digest, metadata: metadata}, err
+	}
+	parse := parseCredentialLine
+	if opts.format == inputFormatJSONL {
+		parse = parseJSONLine
+	}
+	username, password, metadata, err := parse(line, opts)
+	if err == nil && (len(username) > migp.MaxCredentialLength || len(password) > migp.MaxCredentialLength) {
+		err = migp.ErrCredentialTooLong
+	}
+	return ingestEntry{username: username, password: password, metadata: metadata}, err
+}
+
+// validateCredentials parses the lines of file like processCredentials,
+// without inserting them, and returns the numbers of valid and invalid
+// lines. Invalid lines are logged as ingestion failures are.
+func validateCredentials(file string, opts ingestOptions) (int64, int64, error) {
+	inputFile, err := openInput(file, opts.gzipStdin)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer inputFile.Close()
+
+	var validCount int64
+	failures := &ingestFailures{file: file, verbose: opts.verbose}
+	scanner := bufio.NewScanner(inputFile)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), opts.maxLineSize)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		if skipLine(scanner.Bytes(), opts) {
+			continue
+		}
+		if _, err := parseLine(scanner.Bytes(), opts); err != nil {
+			failures.add(line, err)
+			continue
+		}
+		validCount += 1
+	}
+	failures.summary("validated", validCount)
+	if err := scanner.Err(); err != nil {
+		return validCount, int64(failures.count), fmt.Errorf("reading %s failed after line %d: %w", file, line, err)
+	}
+	return validCount, int64(failures.count), nil
 }
 
-func (s *server) processCredentials(file string, metadata string, numVariants int, includeUsernameVariant bool) {
-	var err error
-	inputFile := os.Stdin
-	if file != "-" {
-		if inputFile, err = os.Open(file); err != nil {
-			log.Fatal(err)
+// deleteCredentials removes the credentials read from file from the store,
+// see server.delete, and returns the number of entries removed. Credentials
+// with no entries in the store are reported as failures.
+func (s *server) deleteCredentials(file string, opts ingestOptions) (int64, error) {
+	inputFile, err := openInput(file, opts.gzipStdin)
+	if err != nil {
+		return 0, err
+	}
+	defer inputFile.Close()
+
+	var deletedCount, removedCount int64
+	failures := &ingestFailures{file: file, verbose: opts.verbose}
+	scanner := bufio.NewScanner(inputFile)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), opts.maxLineSize)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		if skipLine(scanner.Bytes(), opts) {
+			continue
+		}
+		entry, err := parseLine(scanner.Bytes(), opts)
+		if err != nil {
+			failures.add(line, err)
+			continue
 		}
-		defer inputFile.Close()
+		removed, err := s.delete(entry.username, entry.password, opts.numVariants)
+		if err != nil {
+			failures.add(line, err)
+			continue
+		}
+		if removed == 0 {
+			failures.add(line, errCredentialNotFound)
+			continue
+		}
+		deletedCount += 1
+		removedCount += int64(removed)
+	}
+	failures.summary("deleted", deletedCount)
+	if err := scanner.Err(); err != nil {
+		return removedCount, fmt.Errorf("reading %s failed after line %d: %w", file, line, err)
+	}
+	return removedCount, nil
+}
+
+// processCredentials inserts the credentials read from file, fanning the
+// inserts out across GOMAXPROCS workers
+func (s *server) processCredentials(file string, opts ingestOptions) {
+	inputFile, err := openInput(file, opts.gzipStdin)
+	if err != nil {
+		fatal("opening input failed", "file", file, "err", err)
 	}
+	defer inputFile.Close()
 
-	successCount, failureCount := 0, 0
+	var successCount, failureCount int64
+	failures := &ingestFailures{file: file, verbose: opts.verbose}
 	//fmt.Println(file)
 	//log.Printf("Encrypting breach entries: %d successes, %d failures", successCount, failureCount)
+
+	jobs := make(chan ingestEntry, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				var err error
+				if job.digest != nil {
+					err = s.insertSHA1Password(job.digest, job.metadata)
+				} else {
+					err = s.insert(job.username, job.password, job.metadata, opts.numVariants, opts.includeUsernameVariant)
+					if err == nil && opts.includePasswordOnly {
+						err = s.insertPassword(job.password, job.metadata)
+					}
+				}
+				if err != nil {
+					atomic.AddInt64(&failureCount, 1)
+					failures.add(job.line, err)
+					continue
+				}
+				atomic.AddInt64(&successCount, 1)
+				//fmt.Printf("\rEncrypting breach entries: %d successes, %d failures", successCount, failureCount) ++++++++
+			}
+		}()
+	}
+
 	scanner := bufio.NewScanner(inputFile)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), opts.maxLineSize)
+	line := 0
 	for scanner.Scan() {
-		fields := bytes.SplitN(scanner.Bytes(), []byte(":"), 2)
-		if len(fields) < 2 {
-			failureCount += 1
+		line += 1
+		if skipLine(scanner.Bytes(), opts) {
 			continue
 		}
-		username, password := fields[0], fields[1]
-		if err := s.insert(username, password, []byte(metadata), numVariants, includeUsernameVariant); err != nil {
-			failureCount += 1
+		entry, err := parseLine(scanner.Bytes(), opts)
+		if err != nil {
+			atomic.AddInt64(&failureCount, 1)
+			failures.add(line, err)
 			continue
 		}
-		successCount += 1
-		//fmt.Printf("\rEncrypting breach entries: %d successes, %d failures", successCount, failureCount) ++++++++
+		// the scanner reuses its buffer, so take a copy of the fields
+		entry.line = line
+		entry.username = append([]byte(nil), entry.username...)
+		entry.password = append([]byte(nil), entry.password...)
+		entry.metadata = append([]byte(nil), entry.metadata...)
+		jobs <- entry
+	}
+	close(jobs)
+	wg.Wait()
+	failures.summary("ingested", successCount)
+	if err := scanner.Err(); err != nil {
+		fatal("reading input failed", "file", file, "entries", successCount+failureCount, "err", err)
 	}
 }
@@ -0,0 +1,235 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+func TestBreachMetadata(t *testing.T) {
+	testCases := []struct {
+		name, date, exposedFields string
+		out                       migp.BreachMetadata
+		valid                     bool
+	}{
+		{"example", "2021-06-01", "email, password", migp.BreachMetadata{Name: "example", Date: "2021-06-01", ExposedFields: []string{"email", "password"}}, true},
+		{"example", "", "", migp.BreachMetadata{Name: "example"}, true},
+		{"example", "06/01/2021", "", migp.BreachMetadata{}, false},
+	}
+
+	for i, test := range testCases {
+		metadata, err := breachMetadata(test.name, test.date, test.exposedFields)
+		if (err == nil) != test.valid {
+			t.Errorf("failed test %d: want valid %v, got error %v", i, test.valid, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		out, err := migp.ParseBreachMetadata(metadata)
+		if err != nil || !reflect.DeepEqual(out, test.out) {
+			t.Errorf("failed test %d: want %v, got (%v, %v)", i, test.out, out, err)
+		}
+	}
+}
+
+func TestParseCredentialLine(t *testing.T) {
+	testCases := []struct {
+		line                         string
+		opts                         ingestOptions
+		username, password, metadata string
+		err                          error
+	}{
+		{"user:pass", ingestOptions{delimiter: ":", metadata: "global"}, "user", "pass", "global", nil},
+		{"user:pa:ss", ingestOptions{delimiter: ":"}, "user", "pa:ss", "", nil},
+		{"user:pass:breach", ingestOptions{delimiter: ":", metadataField: true, metadata: "global"}, "user", "pass", "breach", nil},
+		{"user:pass", ingestOptions{delimiter: ":", metadataField: true, metadata: "global"}, "user", "pass", "global", nil},
+		{"user;pass;breach", ingestOptions{delimiter: ";", metadataField: true}, "user", "pass", "breach", nil},
+		{"user\tpass", ingestOptions{delimiter: "\t"}, "user", "pass", "", nil},
+		{"userpass", ingestOptions{delimiter: ":"}, "", "", "", errMalformedLine},
+	}
+
+	for i, test := range testCases {
+		username, password, metadata, err := parseCredentialLine([]byte(test.line), test.opts)
+		if err != test.err || string(username) != test.username || string(password) != test.password || string(metadata) != test.metadata {
+			t.Errorf("failed test %d: want (%q, %q, %q, %v), got (%q, %q, %q, %v)", i,
+				test.username, test.password, test.metadata, test.err, username, password, metadata, err)
+		}
+	}
+}
+
+func TestParseHIBPLine(t *testing.T) {
+	opts := ingestOptions{delimiter: ":"}
+	digest := "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8"
+	testCases := []struct {
+		line     string
+		metadata string
+		valid    bool
+	}{
+		{digest + ":3730471", "3730471", true},
+		{strings.ToLower(digest) + ":1", "1", true},
+		{digest, "", true},
+		{digest + ":many", "", false},
+		{digest[:39] + ":1", "", false},
+		{digest + "00:1", "", false},
+		{"not a hash", "", false},
+	}
+	for i, test := range testCases {
+		out, metadata, err := parseHIBPLine([]byte(test.line), opts)
+		if (err == nil) != test.valid {
+			t.Errorf("failed test %d: want valid %v, got %v", i, test.valid, err)
+			continue
+		}
+		if test.valid && (strings.ToUpper(hex.EncodeToString(out)) != digest || string(metadata) != test.metadata) {
+			t.Errorf("failed test %d: want (%s, %q), got (%x, %q)", i, digest, test.metadata, out, metadata)
+		}
+	}
+}
+
+func TestParseJSONLine(t *testing.T) {
+	opts := ingestOptions{metadata: "global"}
+	testCases := []struct {
+		line                         string
+		username, password, metadata string
+		valid                        bool
+	}{
+		{`{"username":"user","password":"pa:ss"}`, "user", "pa:ss", "global", true},
+		{`{"username":"user","password":"pass","metadata":null}`, "user", "pass", "global", true},
+		{`{"username":"user","password":"pass","metadata":"breach"}`, "user", "pass", "breach", true},
+		{`{"username":"user","password":"pass","metadata":{"exposedFields":["email"],"name":"example","date":"2021-06-01"}}`, "user", "pass", `{"name":"example","date":"2021-06-01","exposedFields":["email"]}`, true},
+		{`{"username":"","password":""}`, "", "", "global", true},
+		{`{"username":"user","password":"pass","metadata":{"name":"example","source":"dump"}}`, "", "", "", false},
+		{`{"username":"user","password":"pass","metadata":{"date":"06/01/2021"}}`, "", "", "", false},
+		{`{"username":"user","password":"pass","metadata":3}`, "", "", "", false},
+		{`{"username":"user"}`, "", "", "", false},
+		{`{"username":"user","password":1}`, "", "", "", false},
+		{"user:pass", "", "", "", false},
+	}
+	for i, test := range testCases {
+		username, password, metadata, err := parseJSONLine([]byte(test.line), opts)
+		if (err == nil) != test.valid {
+			t.Errorf("failed test %d: want valid %v, got %v", i, test.valid, err)
+			continue
+		}
+		if test.valid && (string(username) != test.username || string(password) != test.password || string(metadata) != test.metadata) {
+			t.Errorf("failed test %d: want (%q, %q, %q), got (%q, %q, %q)", i,
+				test.username, test.password, test.metadata, username, password, metadata)
+		}
+	}
+}
+
+func TestSkipLine(t *testing.T) {
+	testCases := []struct {
+		line          string
+		commentPrefix string
+		skip          bool
+	}{
+		{"", "#", true},
+		{"  \t", "#", true},
+		{"# header", "#", true},
+		{"user:password", "#", false},
+		{"#user:password", "", false},
+		{"// section", "//", true},
+		{" # indented", "#", false},
+	}
+	for i, test := range testCases {
+		opts := ingestOptions{delimiter: ":", commentPrefix: test.commentPrefix}
+		if skip := skipLine([]byte(test.line), opts); skip != test.skip {
+			t.Errorf("failed test %d: want %v, got %v", i, test.skip, skip)
+		}
+	}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	testCases := []struct {
+		input   string
+		format  string
+		valid   int64
+		invalid int64
+	}{
+		{"# header\nuser1:pass1\n\nuser2:pass:2\nmalformed\n", inputFormatCredentials, 2, 1},
+		{"", inputFormatCredentials, 0, 0},
+		{"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3\nuser:pass\n", inputFormatHIBP, 1, 1},
+		{"# header\n{\"username\":\"user\",\"password\":\"pass\"}\nuser:pass\n", inputFormatJSONL, 1, 1},
+	}
+	for i, test := range testCases {
+		file := filepath.Join(t.TempDir(), "input.txt")
+		if err := os.WriteFile(file, []byte(test.input), 0600); err != nil {
+			t.Fatal(err)
+		}
+		opts := ingestOptions{delimiter: ":", commentPrefix: "#", format: test.format, maxLineSize: 1024}
+		valid, invalid, err := validateCredentials(file, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid != test.valid || invalid != test.invalid {
+			t.Errorf("failed test %d: want (%d, %d), got (%d, %d)", i, test.valid, test.invalid, valid, invalid)
+		}
+	}
+}
+
+// TestIngestLongLine checks that credentials too long to be serialized, which
+// fit in a line of -max-line-size, are counted as ingestion failures without
+// stopping the ingestion of the other lines
+func TestIngestLongLine(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	cfg.SlowHasherID = migp.SlowHasherNull
+	s, err := newServer(cfg, storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		"user1:password1",
+		strings.Repeat("u", 70000) + ":password",
+		"user2:" + strings.Repeat("p", migp.MaxCredentialLength+1),
+		"user3:" + strings.Repeat("p", migp.MaxCredentialLength),
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "input.txt"), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := loadIngestManifest(filepath.Join(s.kv.root, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest := ingestOptions{delimiter: ":", maxLineSize: 1024 * 1024, format: inputFormatCredentials}
+	if _, _, unsaved, err := s.ingestDir(dir, ingest, dirIngestOptions{workers: 1, manifest: manifest}); err != nil || len(unsaved) > 0 {
+		t.Fatalf("want (no unsaved files, nil), got (%d, %v)", len(unsaved), err)
+	}
+
+	bucketIDs := make(map[string]bool)
+	for _, username := range []string{"user1", "user2", "user3"} {
+		bucketIDs[migp.BucketIDToHex(s.migpServer.BucketID([]byte(username)))] = true
+	}
+	entries := 0
+	for id := range bucketIDs {
+		bucket, err := s.store.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := migp.CountBucketEntries(bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries += count
+	}
+	if entries != 2 {
+		t.Errorf("want 2 entries, got %d", entries)
+	}
+
+	if _, err := parseLine([]byte(lines[2]), ingest); !errors.Is(err, migp.ErrCredentialTooLong) {
+		t.Errorf("want %v, got %v", migp.ErrCredentialTooLong, err)
+	}
+	if _, err := s.migpServer.EncryptBucketEntry([]byte("user2"), []byte(strings.Repeat("p", 70000)), migp.MetadataBreachedPassword, nil); !errors.Is(err, migp.ErrCredentialTooLong) {
+		t.Errorf("EncryptBucketEntry: want %v, got %v", migp.ErrCredentialTooLong, err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// manifestName is the file the manifest of ingested input files is kept in,
+// under the directory of the file backend. The leading dot keeps it out of
+// the bucket listings.
+const manifestName = ".ingested-files.json"
+
+// ingestedFile identifies the version of an input file that was ingested
+type ingestedFile struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	Ingested time.Time `json:"ingested"`
+}
+
+// ingestManifest records the input files of -indir that were ingested and
+// saved, so that an interrupted ingestion resumes with the files not
+// ingested yet rather than duplicating the entries of the others
+type ingestManifest struct {
+	path  string
+	lock  sync.Mutex
+	files map[string]ingestedFile
+}
+
+// loadIngestManifest reads the manifest saved in the named file, returning
+// an empty manifest if the file does not exist yet
+func loadIngestManifest(path string) (*ingestManifest, error) {
+	m := &ingestManifest{path: path, files: make(map[string]ingestedFile)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m.files); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// done reports whether the named file was ingested, and has not changed
+// since
+func (m *ingestManifest) done(name string, info os.FileInfo) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	f, ok := m.files[name]
+	return ok && f.Size == info.Size() && f.ModTime.Equal(info.ModTime())
+}
+
+// add records the named file as ingested, see save
+func (m *ingestManifest) add(name string, info os.FileInfo) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.files[name] = ingestedFile{Size: info.Size(), ModTime: info.ModTime(), Ingested: time.Now().UTC()}
+}
+
+// save writes the manifest to its file
+func (m *ingestManifest) save() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	data, err := json.MarshalIndent(m.files, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), os.ModePerm); err != nil {
+		return err
+	}
+	// write to a temporary file first, so that a crash while saving does
+	// not lose the manifest
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
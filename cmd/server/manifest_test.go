@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIngestManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, contents string) os.FileInfo {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	ingested := writeFile("a.txt", "user1:pass1\n")
+	changed := writeFile("b.txt", "user2:pass2\n")
+
+	manifest, err := loadIngestManifest(filepath.Join(dir, "store", manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.add("a.txt", ingested)
+	manifest.add("b.txt", changed)
+	if err := manifest.save(); err != nil {
+		t.Fatal(err)
+	}
+	// b.txt is appended to after being ingested
+	changed = writeFile("b.txt", "user2:pass2\nuser3:pass3\n")
+	if err := os.Chtimes(filepath.Join(dir, "b.txt"), time.Now(), changed.ModTime().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err = os.Stat(filepath.Join(dir, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the manifest is read back as an interrupted ingestion resumes
+	if manifest, err = loadIngestManifest(manifest.path); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name string
+		info os.FileInfo
+		done bool
+	}{
+		{"a.txt", ingested, true},
+		{"b.txt", changed, false},
+		{"c.txt", ingested, false},
+	}
+	for i, test := range testCases {
+		if done := manifest.done(test.name, test.info); done != test.done {
+			t.Errorf("failed test %d: want %v, got %v", i, test.done, done)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// metricsRegistry holds the metrics exported on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	evaluateRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "migp_evaluate_requests_total",
+		Help: "Number of /evaluate requests and gRPC Evaluate calls by HTTP status code.",
+	}, []string{"code"})
+	evaluateResponseSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "migp_evaluate_response_size_bytes",
+		Help:    "Size of /evaluate response bodies and gRPC Evaluate responses.",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 10),
+	})
+	bucketLoadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "migp_bucket_load_duration_seconds",
+		Help:    "Time spent loading a bucket from the store.",
+		Buckets: prometheus.DefBuckets,
+	})
+	oprfEvaluateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "migp_oprf_evaluate_duration_seconds",
+		Help:    "Time spent handling an evaluate request, excluding the bucket load.",
+		Buckets: prometheus.DefBuckets,
+	})
+	bloomSkippedBuckets = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "migp_bloom_skipped_buckets_total",
+		Help: "Number of bucket loads skipped because the bloom filter reported the bucket absent.",
+	})
+	bucketCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "migp_bucket_cache_hits_total",
+		Help: "Number of bucket loads served from the bucket cache.",
+	})
+	bucketCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "migp_bucket_cache_misses_total",
+		Help: "Number of bucket loads that missed the bucket cache and read the bucket from disk.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(evaluateRequests, evaluateResponseSize, bucketLoadDuration, oprfEvaluateDuration, bloomSkippedBuckets, bucketCacheHits, bucketCacheMisses)
+}
+
+// metricsHandler serves the registered metrics
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// timedGetter wraps a bucket store, recording how long each Get takes.
+// Implements migp.Getter
+type timedGetter struct {
+	store   migp.Getter
+	elapsed time.Duration
+}
+
+// Get returns the value in the key identified by id.
+func (g *timedGetter) Get(id string) ([]byte, error) {
+	start := time.Now()
+	value, err := g.store.Get(id)
+	elapsed := time.Now().Sub(start)
+	g.elapsed += elapsed
+	bucketLoadDuration.Observe(elapsed.Seconds())
+	return value, err
+}
+
+// statusRecorder records the status code and body size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+// WriteHeader records the status code before writing it.
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the number of bytes written.
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.size += n
+	return n, err
+}
+
+// instrumentEvaluate counts requests to an evaluate handler by status code
+// and records their response sizes
+func instrumentEvaluate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, req)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		evaluateRequests.WithLabelValues(strconv.Itoa(recorder.status)).Inc()
+		evaluateResponseSize.Observe(float64(recorder.size))
+	}
+}
+
+// grpcHTTPStatus maps the status codes of gRPC Evaluate calls to the HTTP
+// status codes /evaluate answers the same requests with
+var grpcHTTPStatus = map[codes.Code]int{
+	codes.OK:                http.StatusOK,
+	codes.InvalidArgument:   http.StatusBadRequest,
+	codes.Unauthenticated:   http.StatusUnauthorized,
+	codes.ResourceExhausted: http.StatusTooManyRequests,
+	codes.Internal:          http.StatusInternalServerError,
+}
+
+// observeGRPCEvaluate counts a gRPC Evaluate call by the HTTP status code of
+// its outcome and records its response size, like instrumentEvaluate
+func observeGRPCEvaluate(response proto.Message, err error) {
+	code, ok := grpcHTTPStatus[status.Code(err)]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	size := 0
+	if err == nil {
+		size = proto.Size(response)
+	}
+	evaluateRequests.WithLabelValues(strconv.Itoa(code)).Inc()
+	evaluateResponseSize.Observe(float64(size))
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitIdleTimeout is how long a client's limiter is kept after its last
+// request
+const rateLimitIdleTimeout = 10 * time.Minute
+
+// rateLimiter limits the request rate of each client IP with a token bucket.
+// Clients in a trusted network are not limited.
+type rateLimiter struct {
+	limit   rate.Limit
+	burst   int
+	trusted []*net.IPNet
+
+	lock      sync.Mutex
+	clients   map[string]*clientLimiter
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// clientLimiter is the token bucket of a single client
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newRateLimiter returns a limiter allowing each client rps requests per
+// second with bursts of up to burst requests. trusted is a list of CIDRs that
+// bypass the limit.
+func newRateLimiter(rps float64, burst int, trusted []string) (*rateLimiter, error) {
+	l := &rateLimiter{
+		limit:   rate.Limit(rps),
+		burst:   burst,
+		clients: make(map[string]*clientLimiter),
+		now:     time.Now,
+	}
+	for _, cidr := range trusted {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		l.trusted = append(l.trusted, network)
+	}
+	return l, nil
+}
+
+// allow reports whether n requests from ip may proceed, charging them all
+// against its token bucket. More requests than the burst are never allowed.
+func (l *rateLimiter) allow(ip net.IP, n int) bool {
+	for _, network := range l.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	if now.Sub(l.lastPrune) > rateLimitIdleTimeout {
+		for key, client := range l.clients {
+			if now.Sub(client.lastSeen) > rateLimitIdleTimeout {
+				delete(l.clients, key)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	key := ip.String()
+	client, ok := l.clients[key]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = client
+	}
+	client.lastSeen = now
+	return client.limiter.AllowN(now, n)
+}
+
+// middleware rejects requests from clients over their limit with 429
+func (l *rateLimiter) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if ip := requestIP(req); ip != nil && !l.allow(ip, 1) {
+			writeRateLimited(w, "rate limit exceeded")
+			return
+		}
+		next(w, req)
+	}
+}
+
+// requestIP returns the IP address of the client of a request, or nil if its
+// remote address has none
+func requestIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// writeRateLimited writes a 429 response asking the client to retry later
+func writeRateLimited(w http.ResponseWriter, detail string) {
+	w.Header().Set("Retry-After", "1")
+	writeProblem(w, problem{
+		Status: http.StatusTooManyRequests,
+		Detail: detail,
+	})
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// TestRateLimiter checks that clients are limited independently and trusted
+// networks bypass the limit
+func TestRateLimiter(t *testing.T) {
+	l, err := newRateLimiter(1, 2, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+
+	testCases := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.1", true},
+		{"192.0.2.1", false},
+		{"192.0.2.2", true},
+		{"10.1.2.3", true},
+		{"10.1.2.3", true},
+		{"10.1.2.3", true},
+	}
+	for i, tc := range testCases {
+		if got := l.allow(net.ParseIP(tc.ip), 1); got != tc.want {
+			t.Errorf("failed test %d: want %t, got %t", i, tc.want, got)
+		}
+	}
+
+	// tokens are replenished over time
+	now = now.Add(time.Second)
+	if !l.allow(net.ParseIP("192.0.2.1"), 1) {
+		t.Errorf("want request allowed after refill")
+	}
+}
+
+// TestRateLimiterInvalidCIDR checks that malformed trusted networks are rejected
+func TestRateLimiterInvalidCIDR(t *testing.T) {
+	if _, err := newRateLimiter(1, 1, []string{"not-a-cidr"}); err == nil {
+		t.Errorf("want error for invalid CIDR")
+	}
+}
+
+// TestRateLimitBatch checks that batch requests are charged by the number of
+// queries they hold
+func TestRateLimitBatch(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.rateLimiter, err = newRateLimiter(0.001, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	client, err := migp.NewClient(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests []migp.ClientRequest
+	for i := 0; i < 5; i++ {
+		request, _, err := client.Request([]byte(fmt.Sprintf("username%d", i)), []byte("password1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, request)
+	}
+	batch := func(n int) []byte {
+		request, err := migp.NewBatchClientRequest(requests[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	single, err := json.Marshal(requests[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		path   string
+		body   []byte
+		status int
+	}{
+		{"/evaluate-batch", batch(3), http.StatusOK},
+		// one token is left of the burst of 4
+		{"/evaluate-batch", batch(3), http.StatusTooManyRequests},
+		{"/evaluate", single, http.StatusOK},
+		{"/evaluate", single, http.StatusTooManyRequests},
+		{"/evaluate-batch", batch(5), http.StatusTooManyRequests},
+	}
+	for i, test := range testCases {
+		resp, err := http.Post(httpServer.URL+test.path, "application/json", bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("failed test %d: want %d, got %d", i, test.status, resp.StatusCode)
+		}
+	}
+}
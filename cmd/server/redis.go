@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisStore keeps buckets in redis, keyed by bucket ID, so that several
+// server replicas can serve the same buckets.
+// Implements migp.Getter
+type redisStore struct {
+	client *redis.Client
+}
+
+// newRedisStore connects to the redis server at the given URL.
+func newRedisStore(url string) (*redisStore, error) {
+	if url == "" {
+		return nil, errors.New("missing redis URL")
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisStore{client: client}, nil
+}
+
+// Get returns the value in the key identified by id. A missing bucket is
+// returned as an empty value.
+func (r *redisStore) Get(id string) ([]byte, error) {
+	value, err := r.client.Get(context.Background(), id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Put a value at key id and replace any existing value.
+func (r *redisStore) Put(id string, value []byte) error {
+	return r.client.Set(context.Background(), id, value, 0).Err()
+}
+
+// Append a value to any existing value at key id. APPEND is atomic, so
+// concurrent inserts into the same bucket do not lose entries.
+func (r *redisStore) Append(id string, value []byte) error {
+	return r.client.Append(context.Background(), id, string(value)).Err()
+}
+
+// AppendWriter returns a writer that appends everything written to it to the
+// value at key id, in a single append when it is closed.
+func (r *redisStore) AppendWriter(id string) (io.WriteCloser, error) {
+	return &bucketWriter{store: r, id: id}, nil
+}
+
+// Ready checks that the redis server is reachable.
+func (r *redisStore) Ready() error {
+	return r.client.Ping(context.Background()).Err()
+}
+
+// Close closes the connection to redis.
+func (r *redisStore) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// TestRedisStore checks Put, Append and Get against an in-process redis server
+func TestRedisStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store, err := newRedisStore("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if got, err := store.Get("missing"); err != nil || got != nil {
+		t.Errorf("missing bucket: want nil, got %q (err %v)", got, err)
+	}
+
+	if err := store.Put("0a", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append("0a", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get("0a"); !bytes.Equal(got, []byte("firstsecond")) {
+		t.Errorf("want %q, got %q", "firstsecond", got)
+	}
+
+	// concurrent appends must not lose entries
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.Append("0b", []byte("x")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, _ := store.Get("0b"); len(got) != 16 {
+		t.Errorf("concurrent appends: want %d bytes, got %d", 16, len(got))
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// errReadOnlyStore is returned when writing to a store opened read-only
+var errReadOnlyStore = errors.New("bucket store is read-only")
+
+// s3Store keeps buckets as objects in an S3 bucket, under
+// <prefix>/<bucketID>, so that stateless servers can serve buckets ingested
+// elsewhere.
+// Implements migp.Getter
+type s3Store struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	readOnly bool
+}
+
+// newS3Store returns a store for the S3 bucket described by cfg. If no access
+// key is configured, credentials are taken from the standard AWS environment
+// variables.
+func newS3Store(cfg storeConfig) (*s3Store, error) {
+	if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+		return nil, errors.New("missing S3 endpoint or bucket")
+	}
+	creds := credentials.NewEnvAWS()
+	if cfg.S3AccessKeyID != "" {
+		creds = credentials.NewStaticV4(cfg.S3AccessKeyID, cfg.S3SecretAccessKey, "")
+	}
+	client, err := minio.New(cfg.S3Endpoint, &minio.Options{
+		Creds:  creds,
+		Region: cfg.S3Region,
+		Secure: !cfg.S3Insecure,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{
+		client:   client,
+		bucket:   cfg.S3Bucket,
+		prefix:   cfg.S3Prefix,
+		readOnly: cfg.S3ReadOnly,
+	}, nil
+}
+
+// objectName returns the name of the object holding the bucket with the
+// given ID
+func (s *s3Store) objectName(id string) string {
+	return path.Join(s.prefix, id)
+}
+
+// Get returns the value in the key identified by id. A missing bucket is
+// returned as an empty value.
+func (s *s3Store) Get(id string) ([]byte, error) {
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.objectName(id), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	value, err := io.ReadAll(object)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Ready checks that a bucket can be read from S3.
+func (s *s3Store) Ready() error {
+	_, err := s.Get(readyBucketID)
+	return err
+}
+
+// Put a value at key id and replace any existing value.
+func (s *s3Store) Put(id string, value []byte) error {
+	if s.readOnly {
+		return errReadOnlyStore
+	}
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.objectName(id),
+		bytes.NewReader(value), int64(len(value)), minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+// Append a value to any existing value at key id. S3 has no append
+// operation, so the object is read and uploaded again. This is not atomic:
+// concurrent appends to the same bucket may lose entries.
+func (s *s3Store) Append(id string, value []byte) error {
+	if s.readOnly {
+		return errReadOnlyStore
+	}
+	existing, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	return s.Put(id, append(existing, value...))
+}
+
+// AppendWriter returns a writer that appends everything written to it to the
+// value at key id when closed, so that the object is read and uploaded again
+// once for all the entries written, rather than once per entry.
+func (s *s3Store) AppendWriter(id string) (io.WriteCloser, error) {
+	if s.readOnly {
+		return nil, errReadOnlyStore
+	}
+	return &bucketWriter{store: s, id: id}, nil
+}
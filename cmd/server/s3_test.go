@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestS3StoreObjectName checks where buckets are stored in the S3 bucket
+func TestS3StoreObjectName(t *testing.T) {
+	testCases := []struct {
+		prefix string
+		want   string
+	}{
+		{"", "0a1b"},
+		{"migp", "migp/0a1b"},
+		{"migp/v1/", "migp/v1/0a1b"},
+	}
+	for i, tc := range testCases {
+		store, err := newS3Store(storeConfig{S3Endpoint: "localhost:9000", S3Bucket: "buckets", S3Prefix: tc.prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := store.objectName("0a1b"); got != tc.want {
+			t.Errorf("failed test %d: want %s, got %s", i, tc.want, got)
+		}
+	}
+}
+
+// TestS3StoreReadOnly checks that a read-only store rejects writes
+func TestS3StoreReadOnly(t *testing.T) {
+	store, err := newS3Store(storeConfig{S3Endpoint: "localhost:9000", S3Bucket: "buckets", S3ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("0a", []byte("entry")); !errors.Is(err, errReadOnlyStore) {
+		t.Errorf("Put: want %v, got %v", errReadOnlyStore, err)
+	}
+	if err := store.Append("0a", []byte("entry")); !errors.Is(err, errReadOnlyStore) {
+		t.Errorf("Append: want %v, got %v", errReadOnlyStore, err)
+	}
+	if _, err := store.AppendWriter("0a"); !errors.Is(err, errReadOnlyStore) {
+		t.Errorf("AppendWriter: want %v, got %v", errReadOnlyStore, err)
+	}
+}
+
+// fakeS3 serves the objects of an S3 bucket from memory, counting requests
+type fakeS3 struct {
+	lock     sync.Mutex
+	objects  map[string][]byte
+	requests map[string]int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests[req.Method]++
+	name := strings.TrimPrefix(req.URL.Path, "/buckets/")
+	switch req.Method {
+	case http.MethodGet:
+		object, ok := f.objects[name]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+			return
+		}
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("ETag", `"etag"`)
+		w.Write(object)
+	case http.MethodPut:
+		object, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[name] = object
+		w.Header().Set("ETag", `"etag"`)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+// TestS3StoreAppendWriter checks that the entries written to an append writer
+// are uploaded with a single read and write of the object
+func TestS3StoreAppendWriter(t *testing.T) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY", "AWS_SESSION_TOKEN"} {
+		t.Setenv(name, "")
+	}
+	fake := &fakeS3{objects: map[string][]byte{"0a": []byte("old")}, requests: make(map[string]int)}
+	httpServer := httptest.NewServer(fake)
+	defer httpServer.Close()
+	store, err := newS3Store(storeConfig{
+		S3Endpoint: strings.TrimPrefix(httpServer.URL, "http://"),
+		S3Region:   "us-east-1",
+		S3Bucket:   "buckets",
+		S3Insecure: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := store.AppendWriter("0a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"entry1", "entry2", "entry3"} {
+		if _, err := writer.Write([]byte(entry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fake.objects["0a"]); got != "oldentry1entry2entry3" {
+		t.Errorf("object: want %q, got %q", "oldentry1entry2entry3", got)
+	}
+	if fake.requests[http.MethodGet] != 1 || fake.requests[http.MethodPut] != 1 {
+		t.Errorf("requests: want 1 GET and 1 PUT, got %v", fake.requests)
+	}
+}
@@ -4,134 +4,784 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/cloudflare/migp-go/pkg/migp"
 	"github.com/cloudflare/migp-go/pkg/mutator"
 )
 
-// newServer returns a new server initialized using the provided configuration
-func newServer(cfg migp.ServerConfig) (*server, error) {
+// newServer returns a new server initialized using the provided configuration,
+// storing buckets in the backend selected by storeCfg
+func newServer(cfg migp.ServerConfig, storeCfg storeConfig) (*server, error) {
 	migpServer, err := migp.NewServer(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	kv, err := newKVStore()
+	store, kv, err := newBucketStore(storeCfg)
 	if err != nil {
 		return nil, err
 	}
 
-	return &server{
-		migpServer: migpServer,
-		kv:         kv,
-	}, nil
+	s := &server{
+		migpServer:      migpServer,
+		store:           store,
+		kv:              kv,
+		variants:        mutator.NewRDasMutator(),
+		gzipMinSize:     defaultGzipMinSize,
+		maxRequestBytes: defaultMaxRequestBytes,
+		// buckets are capped as configured for clients, so that they
+		// fetch the overflow buckets
+		maxBucketEntries: cfg.MaxBucketEntries,
+		started:          time.Now(),
+		bucketLocks:      new(stripedLocks),
+	}
+	if kv != nil {
+		s.StoreDir = kv.root
+	}
+	return s, nil
 }
 
-// server wraps a MIGP server and backing KV store
+// server wraps a MIGP server and backing bucket store
 type server struct {
 	migpServer *migp.Server
-	kv         *kvStore
+	store      bucketStore
+	// kv is the file backend, or nil if buckets are stored elsewhere
+	kv *kvStore
+	// StoreDir is the directory the file backend saves buckets to
+	StoreDir string
+	// metrics enables the Prometheus /metrics endpoint
+	metrics bool
+	// rateLimiter, if set, limits the request rate of each client to the
+	// evaluate endpoints
+	rateLimiter *rateLimiter
+	// variants generates the password variants stored by insert
+	variants mutator.VariantGenerator
+	// gzipMinSize is the size from which evaluate responses are compressed
+	// for clients accepting gzip. A negative value disables compression.
+	gzipMinSize int
+	// maxRequestBytes caps the size of evaluate request bodies
+	maxRequestBytes int64
+	// bloom, if set, filters out loads of buckets that are not populated
+	bloom *bloomFilter
+	// dedup skips inserting entries already in their bucket, so that
+	// re-ingesting overlapping datasets does not duplicate entries
+	dedup bool
+	// countOccurrences stores an occurrence count in the metadata of each
+	// entry, incrementing the count of entries already in their bucket
+	// instead of inserting them again
+	countOccurrences bool
+	// maxBucketEntries, if set, caps the number of entries in a bucket,
+	// with entries past the cap going to the overflow buckets of the bucket
+	maxBucketEntries int
+	// bucketLocks serializes inserts into and deletes from each bucket, so
+	// that reading a bucket and updating it is not interleaved with other
+	// updates. The copies of withBufferedStore share them.
+	bucketLocks *stripedLocks
+	// started is when the server was created, served as the Last-Modified
+	// time of its configuration, which does not change while it runs
+	started time.Time
+}
+
+// withBufferedStore returns a copy of the server inserting into a store of
+// the file backend that buffers entries in memory apart from that of s, and
+// is flushed separately. Inserts reading their bucket, as with dedup, do not
+// see the entries the other store buffers.
+func (s *server) withBufferedStore() *server {
+	c := *s
+	c.kv = s.kv.buffer()
+	c.store = c.kv
+	return &c
+}
+
+// flushBuffered saves the buckets buffered by b, a copy of s returned by
+// withBufferedStore, and empties its store. Buckets that could not be saved
+// are handed over to the store of s, to be retried by its next flush.
+func (s *server) flushBuffered(b *server) error {
+	err := b.flush()
+	if err != nil {
+		s.kv.requeue(b.kv.drain())
+	}
+	return err
+}
+
+// flush saves buckets buffered in memory by the file backend. Other backends
+// write through, so there is nothing to flush.
+func (s *server) flush() error {
+	if s.kv != nil {
+		return s.kv.saveCredentials()
+	}
+	return nil
+}
+
+// endpoints lists the routes served by handler, advertised in 404 responses
+var endpoints = []string{"/", "/config", "/evaluate", "/evaluate-batch", "/health", "/ready"}
+
+// endpoints returns the routes served by handler
+func (s *server) endpoints() []string {
+	if s.metrics {
+		return append(endpoints[:len(endpoints):len(endpoints)], "/metrics")
+	}
+	return endpoints
 }
 
 // handler handles client requests
 func (s *server) handler() http.Handler {
+	// batch requests are rate limited by handleEvaluateBatch, which charges
+	// them by the number of queries they hold
+	evaluate, evaluateBatch := s.requireAPIKey(s.handleEvaluate), s.requireAPIKey(s.handleEvaluateBatch)
+	if s.rateLimiter != nil {
+		evaluate = s.rateLimiter.middleware(evaluate)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleIndex)
-	mux.HandleFunc("/evaluate", s.handleEvaluate)
+	mux.HandleFunc("/evaluate", instrumentEvaluate(evaluate))
+	mux.HandleFunc("/evaluate-batch", instrumentEvaluate(evaluateBatch))
 	mux.HandleFunc("/config", s.handleConfig)
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/ready", s.handleReady)
+	if s.metrics {
+		mux.Handle("/metrics", metricsHandler())
+	}
 	return mux
 }
 
-// insert encrypts a credential pair and stores it in the configured KV store
+// problem is an RFC 7807 problem details object, with extension members for
+// the supported versions and known endpoints
+type problem struct {
+	Type              string   `json:"type"`
+	Title             string   `json:"title"`
+	Status            int      `json:"status"`
+	Detail            string   `json:"detail,omitempty"`
+	SupportedVersions []uint16 `json:"supportedVersions,omitempty"`
+	Endpoints         []string `json:"endpoints,omitempty"`
+}
+
+// writeProblem writes p as an application/problem+json response
+func writeProblem(w http.ResponseWriter, p problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	p.Title = http.StatusText(p.Status)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		slog.Warn("writing response failed", "err", err)
+	}
+}
+
+// limitMetadata applies the metadata size limit of the configuration to the
+// metadata of an entry for the given bucket, logging oversized metadata
+func (s *server) limitMetadata(bucketIDHex string, metadata []byte) ([]byte, error) {
+	limited, oversized, err := s.migpServer.LimitMetadata(metadata)
+	if oversized {
+		if err != nil {
+			slog.Warn("rejecting entry with oversized metadata", "bucket", bucketIDHex, "bytes", len(metadata))
+			return nil, err
+		}
+		slog.Warn("truncating oversized metadata", "bucket", bucketIDHex, "bytes", len(metadata), "limit", len(limited))
+	}
+	return limited, nil
+}
+
+// insert encrypts a credential pair and stores it in the configured bucket store
 func (s *server) insert(username, password, metadata []byte, numVariants int, includeUsernameVariant bool) error {
 
 	bucketIDHex := migp.BucketIDToHex(s.migpServer.BucketID(username))
-	newEntry, err := s.migpServer.EncryptBucketEntry(username, password, migp.MetadataBreachedPassword, metadata)
+
+	metadata, err := s.limitMetadata(bucketIDHex, metadata)
 	if err != nil {
 		return err
 	}
-	err = s.kv.Append(bucketIDHex, newEntry)
+
+	credentials := []flaggedPassword{{password, migp.MetadataBreachedPassword}}
+	for _, variant := range s.variants.Variants(password, numVariants) {
+		credentials = append(credentials, flaggedPassword{variant, migp.MetadataSimilarPassword})
+	}
+	if includeUsernameVariant {
+		credentials = append(credentials, flaggedPassword{nil, migp.MetadataBreachedUsername})
+	}
+	if s.countOccurrences {
+		return s.insertCounted(bucketIDHex, username, metadata, credentials)
+	}
+
+	entries := make([][]byte, len(credentials))
+	for i, c := range credentials {
+		if entries[i], err = s.migpServer.EncryptBucketEntry(username, c.password, c.flag, metadata); err != nil {
+			return err
+		}
+	}
+	return s.appendEntries(bucketIDHex, entries...)
+}
+
+// flaggedPassword is a password to insert an entry for with the given flag
+type flaggedPassword struct {
+	password []byte
+	flag     migp.MetadataType
+}
+
+// insertCounted inserts entries for the username with each of the given
+// passwords, with a count of one added to their metadata. Entries already in
+// the bucket, or its overflow buckets, have their count incremented instead of
+// being inserted again, rewriting the buckets. A nil username inserts
+// password-only entries.
+func (s *server) insertCounted(bucketIDHex string, username, metadata []byte, credentials []flaggedPassword) error {
+	metadata, err := migp.AddMetadataCount(metadata, 1)
 	if err != nil {
 		return err
 	}
 
-	passwordVariants := mutator.NewRDasMutator().Mutate(password, numVariants)
-	for _, variant := range passwordVariants {
-		newEntry, err = s.migpServer.EncryptBucketEntry(username, variant, migp.MetadataSimilarPassword, metadata)
+	lock := s.bucketLocks.get(bucketIDHex)
+	lock.Lock()
+	defer lock.Unlock()
+
+	chain, err := s.loadChain(bucketIDHex)
+	if err != nil {
+		return err
+	}
+	// new entries join the bucket too, so that repeated variants are
+	// counted rather than duplicated
+	bucket := bytes.Join(chain, nil)
+	var entries [][]byte
+	counted := false
+	for _, c := range credentials {
+		var found bool
+		bucket, found, err = s.migpServer.AddBucketEntryCount(bucket, username, c.password, c.flag, 1)
 		if err != nil {
 			return err
 		}
-		err = s.kv.Append(bucketIDHex, newEntry)
+		if found {
+			counted = true
+			continue
+		}
+		entry, err := s.migpServer.EncryptBucketEntry(username, c.password, c.flag, metadata)
 		if err != nil {
 			return err
 		}
+		entries = append(entries, entry)
+		bucket = append(bucket, entry...)
+	}
+	if !counted {
+		return s.appendToChain(bucketIDHex, chain, entries)
 	}
 
-	if includeUsernameVariant {
-		newEntry, err = s.migpServer.EncryptBucketEntry(username, nil, migp.MetadataBreachedUsername, metadata)
-		if err != nil {
+	buckets, err := splitBucket(bucket, s.maxBucketEntries)
+	if err != nil {
+		return err
+	}
+	if len(buckets) > migp.MaxOverflowBuckets+1 {
+		return errBucketFull
+	}
+	for n, contents := range buckets {
+		if err := s.store.Put(migp.OverflowBucketID(bucketIDHex, n), contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendEntries appends encrypted entries to a bucket. With dedup, entries
+// whose header the bucket already holds are skipped. If the number of entries
+// in a bucket is capped, entries past the cap go to the overflow buckets of the
+// bucket, see migp.OverflowBucketID.
+func (s *server) appendEntries(bucketIDHex string, entries ...[]byte) error {
+	lock := s.bucketLocks.get(bucketIDHex)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !s.dedup && s.maxBucketEntries == 0 {
+		return s.writeEntries(bucketIDHex, entries)
+	}
+
+	// every bucket of the chain but the last is full, so the entries go to
+	// the last one, or the next if it is full too
+	chain, err := s.loadChain(bucketIDHex)
+	if err != nil {
+		return err
+	}
+	if s.dedup {
+		existing := bytes.Join(chain, nil)
+		var kept [][]byte
+		for _, entry := range entries {
+			duplicate, err := migp.BucketHasEntry(existing, entry)
+			if err != nil {
+				return err
+			}
+			if !duplicate {
+				kept = append(kept, entry)
+				existing = append(existing, entry...)
+			}
+		}
+		entries = kept
+	}
+	return s.appendToChain(bucketIDHex, chain, entries)
+}
+
+// appendToChain appends entries to the last bucket of a chain returned by
+// loadChain, continuing in the next overflow buckets as each fills up
+func (s *server) appendToChain(bucketIDHex string, chain [][]byte, entries [][]byte) error {
+	n := len(chain) - 1
+	count, err := migp.CountBucketEntries(chain[n])
+	if err != nil {
+		return err
+	}
+	for len(entries) > 0 {
+		if s.maxBucketEntries > 0 && count >= s.maxBucketEntries {
+			if n == migp.MaxOverflowBuckets {
+				return errBucketFull
+			}
+			n, count = n+1, 0
+		}
+		room := len(entries)
+		if s.maxBucketEntries > 0 && s.maxBucketEntries-count < room {
+			room = s.maxBucketEntries - count
+		}
+		if err := s.writeEntries(migp.OverflowBucketID(bucketIDHex, n), entries[:room]); err != nil {
 			return err
 		}
-		err = s.kv.Append(bucketIDHex, newEntry)
+		entries, count = entries[room:], count+room
+	}
+	return nil
+}
+
+// errBucketFull is returned when inserting into a bucket whose overflow
+// buckets are all full
+var errBucketFull = errors.New("bucket and its overflow buckets are full")
+
+// loadChain returns the contents of a bucket followed by those of its
+// overflow buckets, up to the first that is not full. Without a cap on bucket
+// entries, the chain is the bucket alone.
+func (s *server) loadChain(bucketIDHex string) ([][]byte, error) {
+	var chain [][]byte
+	for n := 0; ; n++ {
+		bucket, err := s.store.Get(migp.OverflowBucketID(bucketIDHex, n))
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, bucket)
+		if s.maxBucketEntries == 0 || n == migp.MaxOverflowBuckets {
+			return chain, nil
+		}
+		count, err := migp.CountBucketEntries(bucket)
 		if err != nil {
+			return nil, err
+		}
+		if count < s.maxBucketEntries {
+			return chain, nil
+		}
+	}
+}
+
+// writeEntries appends entries to the bucket with the given ID
+func (s *server) writeEntries(bucketIDHex string, entries [][]byte) error {
+	bucket, err := s.store.AppendWriter(bucketIDHex)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := bucket.Write(entry); err != nil {
+			bucket.Close()
 			return err
 		}
 	}
+	return bucket.Close()
+}
+
+// insertSHA1Password encrypts an entry for the password with the given SHA-1
+// hash, as ingested from the HIBP dataset, and stores it in the configured
+// bucket store
+func (s *server) insertSHA1Password(digest, metadata []byte) error {
+	bucketIDHex := migp.BucketIDToHex(s.migpServer.SHA1PasswordBucketID(digest))
+
+	metadata, err := s.limitMetadata(bucketIDHex, metadata)
+	if err != nil {
+		return err
+	}
+
+	newEntry, err := s.migpServer.EncryptSHA1PasswordEntry(digest, migp.MetadataBreachedPassword, metadata)
+	if err != nil {
+		return err
+	}
+	return s.appendEntries(bucketIDHex, newEntry)
+}
+
+// insertPassword encrypts a password-only entry for password, found by
+// queries for the password regardless of username, and stores it in the
+// configured bucket store
+func (s *server) insertPassword(password, metadata []byte) error {
+	bucketIDHex := migp.BucketIDToHex(s.migpServer.PasswordBucketID(password))
+
+	metadata, err := s.limitMetadata(bucketIDHex, metadata)
+	if err != nil {
+		return err
+	}
+
+	if s.countOccurrences {
+		// password-only entries are those of a nil username
+		return s.insertCounted(bucketIDHex, nil, metadata, []flaggedPassword{{password, migp.MetadataBreachedPassword}})
+	}
+
+	newEntry, err := s.migpServer.EncryptPasswordEntry(password, migp.MetadataBreachedPassword, metadata)
+	if err != nil {
+		return err
+	}
+	return s.appendEntries(bucketIDHex, newEntry)
+}
+
+// delete removes the entries of a credential pair, and those insert added for
+// numVariants variants of its password, from its bucket and the overflow
+// buckets of the bucket, rewriting the buckets without them. Only variant
+// entries flagged as similar passwords are removed, so variants breached
+// themselves are kept, as is the username-only entry, which other passwords
+// of the username share. delete returns the number of entries removed.
+func (s *server) delete(username, password []byte, numVariants int) (int, error) {
+	bucketIDHex := migp.BucketIDToHex(s.migpServer.BucketID(username))
+
+	lock := s.bucketLocks.get(bucketIDHex)
+	lock.Lock()
+	defer lock.Unlock()
+
+	chain, err := s.loadChain(bucketIDHex)
+	if err != nil {
+		return 0, err
+	}
+	bucket, removed, err := s.migpServer.RemoveBucketEntries(bytes.Join(chain, nil), username, password)
+	if err != nil {
+		return 0, err
+	}
+	for _, variant := range s.variants.Variants(password, numVariants) {
+		var count int
+		bucket, count, err = s.migpServer.RemoveBucketEntries(bucket, username, variant, migp.MetadataSimilarPassword)
+		if err != nil {
+			return 0, err
+		}
+		removed += count
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	// pack the remaining entries into the chain again, so that every
+	// bucket of the chain but the last stays full
+	buckets, err := splitBucket(bucket, s.maxBucketEntries)
+	if err != nil {
+		return 0, err
+	}
+	for n := range chain {
+		var contents []byte
+		if n < len(buckets) {
+			contents = buckets[n]
+		}
+		if err := s.store.Put(migp.OverflowBucketID(bucketIDHex, n), contents); err != nil {
+			return 0, err
+		}
+	}
+	return removed, nil
+}
+
+// splitBucket splits bucket contents into buckets of at most maxEntries
+// entries, or returns them whole if maxEntries is zero
+func splitBucket(bucket []byte, maxEntries int) ([][]byte, error) {
+	if maxEntries == 0 {
+		return [][]byte{bucket}, nil
+	}
+	var buckets [][]byte
+	start, count := 0, 0
+	for offset := 0; offset < len(bucket); count++ {
+		if count == maxEntries {
+			buckets = append(buckets, bucket[start:offset])
+			start, count = offset, 0
+		}
+		if offset+migp.HeaderSize > len(bucket) {
+			return nil, errors.New("parsing error in bucket")
+		}
+		bodyLength := int(binary.BigEndian.Uint32(bucket[offset+migp.CtxtKeyCheckSize+1 : offset+migp.HeaderSize]))
+		offset += migp.HeaderSize + bodyLength
+	}
+	if start < len(bucket) {
+		buckets = append(buckets, bucket[start:])
+	}
+	return buckets, nil
+}
 
+// queryLocal queries the store for a credential pair given as
+// <username><delimiter><password> in-process, and prints the result to stdout
+// as JSON
+func (s *server) queryLocal(credential, delimiter string) error {
+	fields := strings.SplitN(credential, delimiter, 2)
+	if len(fields) < 2 {
+		return errMalformedLine
+	}
+	client, err := migp.NewClient(s.migpServer.Config().Config)
+	if err != nil {
+		return err
+	}
+	result, err := client.QueryLocal(s.migpServer, s.getter(), []byte(fields[0]), []byte(fields[1]))
+	if err != nil {
+		return err
+	}
+	out, err := json.Marshal(struct {
+		Username string `json:"username"`
+		Status   string `json:"status"`
+		Match    string `json:"match"`
+		Metadata string `json:"metadata,omitempty"`
+	}{
+		Username: fields[0],
+		Status:   result.Status.String(),
+		Match:    result.Status.Match(),
+		Metadata: string(result.Metadata),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
 	return nil
 }
 
-// handleIndex returns a welcome message
+// requireAPIKey rejects requests without a valid API key in a Bearer
+// Authorization header with 401, if the server is configured with API keys
+func (s *server) requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.migpServer.RequiresAPIKey() {
+			token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if !ok || !s.migpServer.CheckAPIKey(token) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="migp"`)
+				writeProblem(w, problem{
+					Status: http.StatusUnauthorized,
+					Detail: "missing or invalid API key",
+				})
+				return
+			}
+		}
+		next(w, req)
+	}
+}
+
+// handleIndex returns a welcome message, or a 404 listing the known endpoints
+// for any other unmatched path
 func (s *server) handleIndex(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		writeProblem(w, problem{
+			Status:    http.StatusNotFound,
+			Detail:    fmt.Sprintf("no endpoint at %s", req.URL.Path),
+			Endpoints: s.endpoints(),
+		})
+		return
+	}
 	fmt.Fprintf(w, "Welcome to the MIGP demo server\n")
 }
 
-// handleConfig returns the MIGP configuration
+// handleHealth reports that the server process is up
+func (s *server) handleHealth(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintf(w, "OK\n")
+}
+
+// handleReady reports whether the server can serve buckets from its store
+func (s *server) handleReady(w http.ResponseWriter, req *http.Request) {
+	if err := s.store.Ready(); err != nil {
+		slog.Warn("readiness check failed", "err", err)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+}
+
+// handleConfig returns the MIGP configuration. The response carries an ETag
+// derived from the configuration and the time the server started as its
+// Last-Modified time, so that clients caching the configuration can
+// revalidate it with a conditional request.
 func (s *server) handleConfig(w http.ResponseWriter, req *http.Request) {
-	encoder := json.NewEncoder(w)
 	cfg := s.migpServer.Config().Config
-	if err := encoder.Encode(cfg); err != nil {
-		log.Println("Writing response failed:", err)
+	cfg.BinaryRequests = true
+	cfg.OmitBucketRequests = true
+	body, err := json.Marshal(cfg)
+	if err != nil {
+		slog.Warn("encoding the configuration failed", "err", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+	digest := sha256.Sum256(body)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(digest[:16])+`"`)
+	w.Header().Set("Content-Type", "application/json")
+	// ServeContent answers If-None-Match and If-Modified-Since with 304
+	http.ServeContent(w, req, "", s.started, bytes.NewReader(body))
+}
+
+// defaultMaxRequestBytes is the default cap on the size of evaluate request
+// bodies, leaving room for batches of MaxBatchSize queries
+const defaultMaxRequestBytes = 1 << 20
+
+// writeBodyError responds to a request whose body could not be read or
+// parsed, with 413 if it exceeded the size limit and 400 otherwise
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeProblem(w, problem{
+			Status: http.StatusRequestEntityTooLarge,
+			Detail: fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit),
+		})
+		return
 	}
+	writeProblem(w, problem{Status: http.StatusBadRequest, Detail: "malformed request: " + err.Error()})
 }
 
 // handleEvaluate serves a request from a MIGP client
 func (s *server) handleEvaluate(w http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(w, req.Body, s.maxRequestBytes)
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		log.Println("Request body reading failed:", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		slog.Info("reading request body failed", "err", err)
+		writeBodyError(w, err)
 		return
 	}
 
+	// requests are in JSON unless sent in the binary format
 	var request migp.ClientRequest
-	if err := json.Unmarshal(body, &request); err != nil {
-		log.Println("Request body unmarshal failed:", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == migp.BinaryContentType {
+		err = request.UnmarshalBinary(body)
+	} else {
+		err = json.Unmarshal(body, &request)
 	}
+	if err != nil {
+		slog.Info("unmarshaling request body failed", "err", err)
+		writeBodyError(w, err)
+		return
+	}
+	logger := slog.With("bucket", request.BucketID, "key_id", request.KeyID)
 
-	migpResponse, err := s.migpServer.HandleRequest(request, s.kv)
+	start := time.Now()
+	getter := &timedGetter{store: s.getter()}
+	migpResponse, err := s.migpServer.HandleRequest(request, getter)
+	oprfEvaluateDuration.Observe((time.Now().Sub(start) - getter.elapsed).Seconds())
+	if errors.Is(err, migp.ErrUnsupportedVersion) {
+		logger.Info("rejecting request for unsupported version", "version", request.Version)
+		writeProblem(w, problem{
+			Status:            http.StatusBadRequest,
+			Detail:            err.Error(),
+			SupportedVersions: s.migpServer.SupportedVersions(),
+		})
+		return
+	}
+	if errors.Is(err, migp.ErrUnknownKeyID) {
+		logger.Info("rejecting request for unknown key ID")
+		writeProblem(w, problem{Status: http.StatusBadRequest, Detail: err.Error()})
+		return
+	}
+	if errors.Is(err, migp.ErrInvalidRequest) {
+		logger.Info("rejecting malformed request", "err", err)
+		writeProblem(w, problem{Status: http.StatusBadRequest, Detail: err.Error()})
+		return
+	}
 	if err != nil {
-		log.Println("HandleRequest failed:", err)
+		logger.Error("handling request failed", "err", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Type", migp.BinaryContentType)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// responses that cannot be compressed are written straight from the
+	// bucket, without serializing them to an intermediate buffer
+	if s.gzipMinSize < 0 || !acceptsGzip(req) {
+		if _, err := migpResponse.WriteTo(w); err != nil {
+			logger.Warn("writing response failed", "err", err)
+		}
+		logger.Debug("served request", "duration", time.Since(start))
+		return
+	}
 
 	respBody, err := migpResponse.MarshalBinary()
 	if err != nil {
-		log.Println("Response serialization failed:", err)
+		logger.Error("serializing response failed", "err", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(respBody) >= s.gzipMinSize {
+		if respBody, err = gzipBytes(respBody); err != nil {
+			logger.Error("compressing response failed", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
 	}
 	if _, err := w.Write(respBody); err != nil {
-		log.Println("Writing response failed:", err)
+		logger.Warn("writing response failed", "err", err)
+	}
+	logger.Debug("served request", "duration", time.Since(start))
+}
+
+// handleEvaluateBatch serves a batch request from a MIGP client
+func (s *server) handleEvaluateBatch(w http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(w, req.Body, s.maxRequestBytes)
+	var request migp.BatchClientRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		slog.Info("unmarshaling request body failed", "err", err)
+		writeBodyError(w, err)
+		return
+	}
+	logger := slog.With("buckets", len(request.BucketIDs), "key_id", request.KeyID)
+
+	// each query of a batch costs an OPRF evaluation, so it is charged as a
+	// request of its own against the rate limit
+	if s.rateLimiter != nil {
+		if ip := requestIP(req); ip != nil && !s.rateLimiter.allow(ip, len(request.BlindElements)) {
+			logger.Info("rejecting batch request over the rate limit")
+			if len(request.BlindElements) > s.rateLimiter.burst {
+				writeRateLimited(w, fmt.Sprintf("batch of %d queries exceeds the rate limit burst of %d", len(request.BlindElements), s.rateLimiter.burst))
+			} else {
+				writeRateLimited(w, "rate limit exceeded")
+			}
+			return
+		}
+	}
+
+	start := time.Now()
+	getter := &timedGetter{store: s.getter()}
+	migpResponse, err := s.migpServer.HandleBatchRequest(request, getter)
+	oprfEvaluateDuration.Observe((time.Now().Sub(start) - getter.elapsed).Seconds())
+	if errors.Is(err, migp.ErrUnsupportedVersion) {
+		logger.Info("rejecting request for unsupported version", "version", request.Version)
+		writeProblem(w, problem{
+			Status:            http.StatusBadRequest,
+			Detail:            err.Error(),
+			SupportedVersions: s.migpServer.SupportedVersions(),
+		})
+		return
+	}
+	if errors.Is(err, migp.ErrUnknownKeyID) {
+		logger.Info("rejecting request for unknown key ID")
+		writeProblem(w, problem{Status: http.StatusBadRequest, Detail: err.Error()})
+		return
+	}
+	if errors.Is(err, migp.ErrInvalidRequest) {
+		logger.Info("rejecting malformed request", "err", err)
+		writeProblem(w, problem{Status: http.StatusBadRequest, Detail: err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("handling batch request failed", "err", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(migpResponse); err != nil {
+		logger.Warn("writing response failed", "err", err)
 	}
+	logger.Debug("served batch request", "duration", time.Since(start))
 }
@@ -5,8 +5,16 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cloudflare/migp-go/pkg/migp"
 )
@@ -18,7 +26,7 @@ func TestServer(t *testing.T) {
 	testPassword := []byte("password1")
 	testMetadata := []byte("test metadata")
 
-	s, err := newServer(migp.DefaultServerConfig())
+	s, err := newServer(migp.DefaultServerConfig(), storeConfig{StoreDir: t.TempDir()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -28,15 +36,15 @@ func TestServer(t *testing.T) {
 	cfg := migp.DefaultConfig()
 
 	// query test record before insertion
-	status, metadata, err := migp.Query(cfg, httpServer.URL+"/evaluate", testUsername, testPassword)
+	result, err := migp.Query(cfg, httpServer.URL+"/evaluate", testUsername, testPassword)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if status != migp.NotInBreach {
-		t.Fatalf("status: want %s, got %s", migp.NotInBreach, status)
+	if result.Status != migp.NotInBreach {
+		t.Fatalf("status: want %s, got %s", migp.NotInBreach, result.Status)
 	}
-	if len(metadata) != 0 {
-		t.Fatalf("metadata: want %d, got %d", 0, len(metadata))
+	if len(result.Metadata) != 0 {
+		t.Fatalf("metadata: want %d, got %d", 0, len(result.Metadata))
 	}
 
 	// insert test record
@@ -46,14 +54,753 @@ func TestServer(t *testing.T) {
 	}
 
 	// query test record after insertion
-	status, metadata, err = migp.Query(cfg, httpServer.URL+"/evaluate", testUsername, testPassword)
+	result, err = migp.Query(cfg, httpServer.URL+"/evaluate", testUsername, testPassword)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if status != migp.InBreach {
-		t.Fatalf("status: want %s, got %s", migp.InBreach, status)
+	if result.Status != migp.InBreach {
+		t.Fatalf("status: want %s, got %s", migp.InBreach, result.Status)
 	}
-	if !bytes.Equal(metadata, testMetadata) {
-		t.Fatalf("metadata: want %s, got %s", testMetadata, string(metadata))
+	if !bytes.Equal(result.Metadata, testMetadata) {
+		t.Fatalf("metadata: want %s, got %s", testMetadata, string(result.Metadata))
+	}
+}
+
+// TestDedup checks that inserting a credential again with dedup leaves its
+// bucket unchanged
+func TestDedup(t *testing.T) {
+	username, password := []byte("username1"), []byte("password1")
+	for _, dedup := range []bool{false, true} {
+		s, err := newServer(migp.DefaultServerConfig(), storeConfig{StoreDir: t.TempDir()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.dedup = dedup
+		bucketIDHex := migp.BucketIDToHex(s.migpServer.BucketID(username))
+		var counts []int
+		for i := 0; i < 2; i++ {
+			if err := s.insert(username, password, nil, 2, true); err != nil {
+				t.Fatal(err)
+			}
+			bucket, err := s.store.Get(bucketIDHex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			count, err := migp.CountBucketEntries(bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts = append(counts, count)
+		}
+		if dedup && counts[1] != counts[0] {
+			t.Errorf("dedup: want %d entries, got %d", counts[0], counts[1])
+		}
+		if !dedup && counts[1] != 2*counts[0] {
+			t.Errorf("no dedup: want %d entries, got %d", 2*counts[0], counts[1])
+		}
+	}
+}
+
+// TestCountOccurrences checks that inserting a credential again with
+// countOccurrences increments the count of its entries instead of duplicating
+// them
+func TestCountOccurrences(t *testing.T) {
+	username, password := []byte("username1"), []byte("password1")
+	s, err := newServer(migp.DefaultServerConfig(), storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.countOccurrences = true
+	bucketIDHex := migp.BucketIDToHex(s.migpServer.BucketID(username))
+	var counts []int
+	for i := 0; i < 2; i++ {
+		if err := s.insert(username, password, []byte(`{"name":"example"}`), 2, true); err != nil {
+			t.Fatal(err)
+		}
+		bucket, err := s.store.Get(bucketIDHex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := migp.CountBucketEntries(bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts = append(counts, count)
+	}
+	if counts[1] != counts[0] {
+		t.Errorf("entries: want %d, got %d", counts[0], counts[1])
+	}
+
+	client, err := migp.NewClient(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := client.QueryLocal(s.migpServer, s.getter(), username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != migp.InBreach || result.Count() != 2 {
+		t.Errorf("result: want (%s, %d), got (%s, %d)", migp.InBreach, 2, result.Status, result.Count())
+	}
+}
+
+// TestFlushBuffered checks that buckets a buffered store fails to save are
+// handed over to the store of the server
+func TestFlushBuffered(t *testing.T) {
+	// the store directory cannot be created under a file
+	root := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(root, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(migp.DefaultServerConfig(), storeConfig{StoreDir: filepath.Join(root, "store")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := s.withBufferedStore()
+	if err := b.kv.Append("0a", []byte("entry")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.flushBuffered(b); err == nil {
+		t.Fatal("flush: want error, got nil")
+	}
+	if len(b.kv.store) != 0 || !bytes.Equal(s.kv.store["0a"], []byte("entry")) {
+		t.Errorf("buckets: want handed over, got %d buffered and %q in the server store", len(b.kv.store), s.kv.store["0a"])
+	}
+}
+
+// countingStore counts the appends to the buckets of a store
+type countingStore struct {
+	bucketStore
+	appends int
+}
+
+func (c *countingStore) Append(id string, value []byte) error {
+	c.appends++
+	return c.bucketStore.Append(id, value)
+}
+
+func (c *countingStore) AppendWriter(id string) (io.WriteCloser, error) {
+	return &bucketWriter{store: c, id: id}, nil
+}
+
+// TestWriteEntries checks that the entries of an insert are appended to their
+// bucket at once, and that an append writer cannot be used once closed
+func TestWriteEntries(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	cfg.SlowHasherID = migp.SlowHasherNull
+	s, err := newServer(cfg, storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countingStore{bucketStore: s.store}
+	s.store = store
+	if err := s.insert([]byte("username1"), []byte("password1"), nil, 9, true); err != nil {
+		t.Fatal(err)
+	}
+	if store.appends != 1 {
+		t.Errorf("want 1 append, got %d", store.appends)
+	}
+	bucketIDHex := migp.BucketIDToHex(s.migpServer.BucketID([]byte("username1")))
+	if count, err := migp.CountBucketEntries(s.kv.store[bucketIDHex]); err != nil || count != 11 {
+		t.Errorf("want 11 entries, got (%d, %v)", count, err)
+	}
+
+	writer, err := store.AppendWriter("0a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte("entry")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("write: want %v, got %v", os.ErrClosed, err)
+	}
+	if err := writer.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("close: want %v, got %v", os.ErrClosed, err)
+	}
+	if store.appends != 1 {
+		t.Errorf("empty writer: want no append, got %d", store.appends-1)
+	}
+}
+
+// TestDelete checks that deleting a credential removes it, and its variants,
+// from a saved bucket, leaving other credentials of the bucket in place
+func TestDelete(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	// with one-bit bucket IDs, some of the other usernames share the bucket
+	// of the deleted one
+	cfg.BucketIDBitSize = 1
+	s, err := newServer(cfg, storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	usernames := []string{"alice", "bob", "carol", "dave", "eve"}
+	for _, username := range usernames {
+		if err := s.insert([]byte(username), []byte("password1"), nil, 2, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.delete([]byte("alice"), []byte("password1"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("removed entries: want %d, got %d", 3, removed)
+	}
+	if removed, err = s.delete([]byte("alice"), []byte("password1"), 2); err != nil || removed != 0 {
+		t.Errorf("deleting again: want (0, nil), got (%d, %v)", removed, err)
+	}
+
+	client, err := migp.NewClient(cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		username, password string
+		status             migp.BreachStatus
+	}{
+		{"alice", "password1", migp.NotInBreach},
+		// the username-only entry, which other passwords share, is kept
+		{"alice", "", migp.UsernameInBreach},
+		{"bob", "password1", migp.InBreach},
+		{"carol", "password1", migp.InBreach},
+		{"dave", "password1", migp.InBreach},
+		{"eve", "password1", migp.InBreach},
+	}
+	for i, test := range testCases {
+		result, err := client.QueryLocal(s.migpServer, s.getter(), []byte(test.username), []byte(test.password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != test.status {
+			t.Errorf("failed test %d: want %s, got %s", i, test.status, result.Status)
+		}
+	}
+}
+
+// TestMaxBucketEntries checks that inserts overflow full buckets, and that
+// deletes keep every bucket of a chain but the last full
+func TestMaxBucketEntries(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	cfg.BucketIDBitSize = 1
+	cfg.MaxBucketEntries = 3
+	s, err := newServer(cfg, storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dedup = true
+	usernames := []string{"alice", "bob", "carol", "dave", "eve"}
+	for _, username := range usernames {
+		// two entries per credential, inserted twice to check dedup
+		// across the chain
+		for i := 0; i < 2; i++ {
+			if err := s.insert([]byte(username), []byte("password1"), nil, 0, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// checkChains checks the chain of each bucket, returning its number of
+	// entries
+	checkChains := func() int {
+		total := 0
+		for _, id := range []uint32{0, 1} {
+			chain, err := s.loadChain(migp.BucketIDToHex(id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for n, bucket := range chain {
+				count, err := migp.CountBucketEntries(bucket)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count > cfg.MaxBucketEntries || (n < len(chain)-1 && count != cfg.MaxBucketEntries) {
+					t.Errorf("bucket %s: %d entries", migp.OverflowBucketID(migp.BucketIDToHex(id), n), count)
+				}
+				total += count
+			}
+		}
+		return total
+	}
+	if total := checkChains(); total != 2*len(usernames) {
+		t.Errorf("entries: want %d, got %d", 2*len(usernames), total)
+	}
+
+	if _, err := s.delete([]byte("alice"), []byte("password1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if total := checkChains(); total != 2*len(usernames)-1 {
+		t.Errorf("entries after delete: want %d, got %d", 2*len(usernames)-1, total)
+	}
+
+	client, err := migp.NewClient(cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, username := range usernames {
+		want := migp.InBreach
+		if username == "alice" {
+			want = migp.NotInBreach
+		}
+		result, err := client.QueryLocal(s.migpServer, s.getter(), []byte(username), []byte("password1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != want {
+			t.Errorf("failed test %d: want %s, got %s", i, want, result.Status)
+		}
+	}
+}
+
+// TestRequestLimits checks that oversized requests are rejected with 413, and
+// malformed blinded elements with 400
+func TestRequestLimits(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.maxRequestBytes = 256
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	client, err := migp.NewClient(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request([]byte("username1"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.BlindElement = request.BlindElement[1:]
+	truncated, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oversized := append(bytes.Repeat([]byte(" "), 256), valid...)
+
+	testCases := []struct {
+		path   string
+		body   []byte
+		status int
+	}{
+		{"/evaluate", valid, http.StatusOK},
+		{"/evaluate", truncated, http.StatusBadRequest},
+		{"/evaluate", oversized, http.StatusRequestEntityTooLarge},
+		{"/evaluate-batch", oversized, http.StatusRequestEntityTooLarge},
+	}
+	for i, test := range testCases {
+		resp, err := http.Post(httpServer.URL+test.path, "application/json", bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("failed test %d: want %d, got %d", i, test.status, resp.StatusCode)
+		}
+	}
+}
+
+// TestMalformedRequests checks that malformed requests are rejected with 400
+// and a problem describing them
+func TestMalformedRequests(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	client, err := migp.NewClient(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, _, err := client.Request([]byte("username1"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		modify func(*migp.ClientRequest)
+		detail string
+	}{
+		{func(r *migp.ClientRequest) { r.BucketID = "not hex!" }, "bucket ID is not valid hex"},
+		{func(r *migp.ClientRequest) { r.BucketID = "00" }, "bucket ID is 2 characters"},
+		{func(r *migp.ClientRequest) { r.BlindElement = nil }, "blind element is 0 bytes"},
+	}
+	for i, test := range testCases {
+		request := valid
+		test.modify(&request)
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(httpServer.URL+"/evaluate", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p problem
+		err = json.NewDecoder(resp.Body).Decode(&p)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(p.Detail, test.detail) {
+			t.Errorf("failed test %d: want (%d, %q), got (%d, %q)", i, http.StatusBadRequest, test.detail, resp.StatusCode, p.Detail)
+		}
+	}
+}
+
+// failingStore is a bucket store whose buckets fail to load
+type failingStore struct {
+	bucketStore
+}
+
+func (failingStore) Get(id string) ([]byte, error) {
+	return nil, errors.New("store unavailable")
+}
+
+// TestEvaluateBatchErrors checks that malformed batch requests are rejected
+// with 400, and batches failing on the server side with 500, counted in the
+// evaluate metrics
+func TestEvaluateBatchErrors(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.metrics = true
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	client, err := migp.NewClient(migp.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request([]byte("username1"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := migp.NewBatchClientRequest([]migp.ClientRequest{request})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatched := valid
+	mismatched.BucketIDs = append(mismatched.BucketIDs, request.BucketID)
+
+	testCases := []struct {
+		request migp.BatchClientRequest
+		failing bool
+		status  int
+	}{
+		{valid, false, http.StatusOK},
+		{mismatched, false, http.StatusBadRequest},
+		{valid, true, http.StatusInternalServerError},
+	}
+	store := s.store
+	for i, test := range testCases {
+		s.store = store
+		if test.failing {
+			s.store = failingStore{store}
+		}
+		body, err := json.Marshal(test.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(httpServer.URL+"/evaluate-batch", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("failed test %d: want %d, got %d", i, test.status, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(httpServer.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `migp_evaluate_requests_total{code="500"}`; !bytes.Contains(body, []byte(want)) {
+		t.Errorf("metrics: want %s", want)
+	}
+}
+
+// TestConfigETag checks that /config is served with validators, and that
+// conditional requests for an unchanged configuration get 304
+func TestConfigETag(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL + "/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("config: want %d with ETag and Last-Modified, got %d with %q and %q", http.StatusOK, resp.StatusCode, etag, lastModified)
+	}
+
+	testCases := []struct {
+		header, value string
+		status        int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"other"`, http.StatusOK},
+		{"If-Modified-Since", lastModified, http.StatusNotModified},
+		{"If-Modified-Since", time.Unix(0, 0).UTC().Format(http.TimeFormat), http.StatusOK},
+	}
+	for i, test := range testCases {
+		req, err := http.NewRequest(http.MethodGet, httpServer.URL+"/config", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(test.header, test.value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("failed test %d: want %d, got %d", i, test.status, resp.StatusCode)
+		}
+	}
+}
+
+// TestBinaryRequests tests that clients using the configuration served on
+// /config send binary requests the server answers
+func TestBinaryRequests(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	cfg.SlowHasherID = migp.SlowHasherNull
+	s, err := newServer(cfg, storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	response, err := http.Get(httpServer.URL + "/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var clientCfg migp.Config
+	if err := json.NewDecoder(response.Body).Decode(&clientCfg); err != nil {
+		t.Fatal(err)
+	}
+	if !clientCfg.BinaryRequests {
+		t.Fatal("want binary requests advertised in /config")
+	}
+
+	username, password := []byte("username1"), []byte("password1")
+	if err := s.insert(username, password, nil, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	result, err := migp.Query(clientCfg, httpServer.URL+"/evaluate", username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != migp.InBreach {
+		t.Fatalf("status: want %s, got %s", migp.InBreach, result.Status)
+	}
+}
+
+// TestOmitBucketRequests tests that clients caching buckets receive the
+// bucket of a username once, and are answered without it afterwards
+func TestOmitBucketRequests(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	cfg.SlowHasherID = migp.SlowHasherNull
+	s, err := newServer(cfg, storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+	username := []byte("username1")
+	if err := s.insert(username, []byte("password1"), []byte("breach"), 9, true); err != nil {
+		t.Fatal(err)
+	}
+	clientCfg := s.migpServer.Config().Config
+	clientCfg.BinaryRequests = true
+	clientCfg.OmitBucketRequests = true
+	client, err := migp.NewClient(clientCfg, migp.WithBucketCache(migp.NewMemoryBucketCache(1<<20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		password string
+		status   migp.BreachStatus
+	}{
+		{"password2", migp.NotInBreach},
+		{"password1", migp.InBreach},
+		{"password3", migp.NotInBreach},
+	}
+	var bucketBytes float64
+	for i, test := range testCases {
+		result, err := client.QueryOne(httpServer.URL+"/evaluate", username, []byte(test.password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != test.status {
+			t.Errorf("failed test %d: want %s, got %s", i, test.status, result.Status)
+		}
+		// the first query fetches the bucket
+		if i == 0 {
+			bucketBytes = result.BandwidthMB
+		} else if result.BandwidthMB >= bucketBytes {
+			t.Errorf("failed test %d: want less than the %g MB of the bucket, got %g MB", i, bucketBytes, result.BandwidthMB)
+		}
+	}
+}
+
+// TestHealthAndReady checks the liveness and readiness probes
+func TestHealthAndReady(t *testing.T) {
+	storeDir := filepath.Join(t.TempDir(), "store")
+	s, err := newServer(migp.DefaultServerConfig(), storeConfig{StoreDir: storeDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	testCases := []struct {
+		path       string
+		createDir  bool
+		wantStatus int
+	}{
+		{"/health", false, http.StatusOK},
+		{"/ready", false, http.StatusServiceUnavailable},
+		{"/ready", true, http.StatusOK},
+	}
+	for i, tc := range testCases {
+		if tc.createDir {
+			if err := os.MkdirAll(storeDir, os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+		}
+		resp, err := http.Get(httpServer.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("failed test %d: want %d, got %d", i, tc.wantStatus, resp.StatusCode)
+		}
+	}
+}
+
+// TestMetrics checks that /metrics is only served when enabled and counts
+// evaluate requests
+func TestMetrics(t *testing.T) {
+	s, err := newServer(migp.DefaultServerConfig(), storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpServer := httptest.NewServer(s.handler())
+	resp, err := http.Get(httpServer.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	httpServer.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("metrics disabled: want %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	s.metrics = true
+	httpServer = httptest.NewServer(s.handler())
+	defer httpServer.Close()
+	if _, err := migp.Query(migp.DefaultConfig(), httpServer.URL+"/evaluate", []byte("username1"), []byte("password1")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get(httpServer.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`migp_evaluate_requests_total{code="200"}`, "migp_bucket_load_duration_seconds_count", "migp_oprf_evaluate_duration_seconds_count"} {
+		if !bytes.Contains(body, []byte(want)) {
+			t.Errorf("metrics: want %s", want)
+		}
+	}
+}
+
+// TestAPIKey checks that evaluate requests require a configured API key
+func TestAPIKey(t *testing.T) {
+	serverCfg := migp.DefaultServerConfig()
+	serverCfg.APIKeys = []string{"secret1", "secret2"}
+	s, err := newServer(serverCfg, storeConfig{StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s.handler())
+	defer httpServer.Close()
+
+	testCases := []struct {
+		apiKey  string
+		wantErr bool
+	}{
+		{"", true},
+		{"wrong", true},
+		{"secret1", false},
+		{"secret2", false},
+	}
+	for i, tc := range testCases {
+		client, err := migp.NewClient(migp.DefaultConfig(), migp.WithAPIKey(tc.apiKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.QueryOne(httpServer.URL+"/evaluate", []byte("username1"), []byte("password1"))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("failed test %d: want error %t, got %v", i, tc.wantErr, err)
+		}
+	}
+
+	// the key must be sent with the Bearer scheme
+	for i, authorization := range []string{"secret1", "Basic secret1", "Bearer "} {
+		req, err := http.NewRequest(http.MethodPost, httpServer.URL+"/evaluate", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", authorization)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("failed test %d: want %d, got %d", i, http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+
+	// the configuration stays public
+	resp, err := http.Get(httpServer.URL + "/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("config: want %d, got %d", http.StatusOK, resp.StatusCode)
 	}
 }
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// bucketStats describes the distribution of the number of entries per bucket
+// of a store. Empty buckets are not counted.
+type bucketStats struct {
+	Buckets     int     `json:"buckets"`
+	Credentials int     `json:"credentials"`
+	Min         int     `json:"min"`
+	Max         int     `json:"max"`
+	Mean        float64 `json:"mean"`
+	StdDev      float64 `json:"stddev"`
+	P50         int     `json:"p50"`
+	P90         int     `json:"p90"`
+	P99         int     `json:"p99"`
+	// K is the anonymity threshold, and BelowK the number of buckets with
+	// fewer than K entries, whose queries hide among fewer credentials
+	K      int `json:"k"`
+	BelowK int `json:"belowK"`
+}
+
+// avgBucketSize loads every bucket of the store and returns the distribution
+// of the number of entries per bucket, counting the buckets with fewer than k
+// entries. Buckets with a malformed trailing entry are counted up to that
+// entry.
+func avgBucketSize(kv *kvStore, k int) (bucketStats, error) {
+	ids, err := kv.bucketIDs()
+	if err != nil {
+		return bucketStats{}, err
+	}
+	// buckets both saved and held in memory are listed twice
+	sort.Strings(ids)
+
+	var sizes []int
+	for i, id := range ids {
+		if i > 0 && id == ids[i-1] {
+			continue
+		}
+		bucket, err := kv.Get(id)
+		if err != nil {
+			return bucketStats{}, fmt.Errorf("loading bucket %s: %w", id, err)
+		}
+		if len(bucket) == 0 {
+			continue
+		}
+		entries, err := migp.CountBucketEntries(bucket)
+		if err != nil {
+			slog.Warn("counting bucket entries failed", "bucket", id, "err", err)
+		}
+		sizes = append(sizes, entries)
+	}
+	return newBucketStats(sizes, k), nil
+}
+
+// newBucketStats computes the distribution of the given bucket sizes, counting
+// those below the anonymity threshold k
+func newBucketStats(sizes []int, k int) bucketStats {
+	if len(sizes) == 0 {
+		return bucketStats{K: k}
+	}
+	sort.Ints(sizes)
+	stats := bucketStats{
+		Buckets: len(sizes),
+		K:       k,
+		BelowK:  sort.SearchInts(sizes, k),
+		Min:     sizes[0],
+		Max:     sizes[len(sizes)-1],
+		P50:     percentile(sizes, 50),
+		P90:     percentile(sizes, 90),
+		P99:     percentile(sizes, 99),
+	}
+	for _, size := range sizes {
+		stats.Credentials += size
+	}
+	stats.Mean = float64(stats.Credentials) / float64(len(sizes))
+	var variance float64
+	for _, size := range sizes {
+		d := float64(size) - stats.Mean
+		variance += d * d
+	}
+	stats.StdDev = math.Sqrt(variance / float64(len(sizes)))
+	return stats
+}
+
+// percentile returns the p-th percentile of the sorted sizes by the
+// nearest-rank method
+func percentile(sorted []int, p int) int {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNewBucketStats(t *testing.T) {
+	hundred := make([]int, 100)
+	for i := range hundred {
+		hundred[i] = 100 - i
+	}
+
+	testCases := []struct {
+		sizes []int
+		k     int
+		stats bucketStats
+	}{
+		{nil, 10, bucketStats{K: 10}},
+		{[]int{3}, 0, bucketStats{Buckets: 1, Credentials: 3, Min: 3, Max: 3, Mean: 3, P50: 3, P90: 3, P99: 3}},
+		{[]int{4, 2}, 4, bucketStats{Buckets: 2, Credentials: 6, K: 4, BelowK: 1, Min: 2, Max: 4, Mean: 3, StdDev: 1, P50: 2, P90: 4, P99: 4}},
+		{[]int{4, 2}, 5, bucketStats{Buckets: 2, Credentials: 6, K: 5, BelowK: 2, Min: 2, Max: 4, Mean: 3, StdDev: 1, P50: 2, P90: 4, P99: 4}},
+		{hundred, 10, bucketStats{Buckets: 100, Credentials: 5050, K: 10, BelowK: 9, Min: 1, Max: 100, Mean: 50.5, StdDev: math.Sqrt(833.25), P50: 50, P90: 90, P99: 99}},
+	}
+	for i, test := range testCases {
+		stats := newBucketStats(test.sizes, test.k)
+		if math.Abs(stats.StdDev-test.stats.StdDev) < 1e-9 {
+			stats.StdDev = test.stats.StdDev
+		}
+		if stats != test.stats {
+			t.Errorf("failed test %d: want %+v, got %+v", i, test.stats, stats)
+		}
+	}
+}
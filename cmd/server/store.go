@@ -0,0 +1,177 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+)
+
+// bucketStore is a backend that buckets are stored in and served from.
+// Implements migp.Getter
+type bucketStore interface {
+	// Get returns the value in the key identified by id.
+	Get(id string) ([]byte, error)
+	// Put a value at key id and replace any existing value.
+	Put(id string, value []byte) error
+	// Append a value to any existing value at key id.
+	Append(id string, value []byte) error
+	// AppendWriter returns a writer that appends everything written to it
+	// to the value at key id, in a single append when it is closed.
+	AppendWriter(id string) (io.WriteCloser, error)
+	// Ready returns an error if buckets cannot currently be loaded.
+	Ready() error
+}
+
+// defaultFanOutWidth is the number of bucket ID characters each directory
+// level is named after, if a fan-out depth is configured
+const defaultFanOutWidth = 2
+
+// readyBucketID is the bucket read to check that a store is ready
+const readyBucketID = "00"
+
+// bucketLockStripes is the number of locks buckets are striped over
+const bucketLockStripes = 256
+
+// stripedLocks guards buckets with a fixed set of locks. Buckets are mapped to
+// locks by hash, so unrelated buckets rarely contend.
+type stripedLocks [bucketLockStripes]sync.Mutex
+
+// get returns the lock of the bucket with the given ID
+func (l *stripedLocks) get(bucketID string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(bucketID))
+	return &l[h.Sum32()%bucketLockStripes]
+}
+
+// storeConfig selects the backend buckets are stored in. It is read from the
+// server configuration file alongside the MIGP configuration.
+type storeConfig struct {
+	// StoreBackend is one of "file" (the default), "redis", "bolt" or "s3"
+	StoreBackend string `json:"storeBackend,omitempty"`
+	// StoreDir is the directory the file backend saves buckets to
+	StoreDir string `json:"storeDir,omitempty"`
+	// BucketFormat is the format the file backend saves buckets in, "bytes"
+	// (the default) or "zstd" to compress them
+	BucketFormat string `json:"bucketFormat,omitempty"`
+	// FanOutDepth is the number of directory levels the file backend lays
+	// out bucket files under, each named after FanOutWidth (default 2)
+	// characters of the bucket ID. A depth of 0, the default, uses one level
+	// per character but the last. Changing the layout of an existing store
+	// directory makes its buckets unreachable.
+	FanOutDepth int `json:"fanOutDepth,omitempty"`
+	FanOutWidth int `json:"fanOutWidth,omitempty"`
+	// RedisURL is the connection URL of the redis backend, e.g.,
+	// redis://localhost:6379/0
+	RedisURL string `json:"redisURL,omitempty"`
+	// BoltPath is the database file of the bolt backend
+	BoltPath string `json:"boltPath,omitempty"`
+
+	// S3Endpoint, S3Region, S3Bucket and S3Prefix locate the objects of the
+	// s3 backend, stored as <prefix>/<bucketID>
+	S3Endpoint string `json:"s3Endpoint,omitempty"`
+	S3Region   string `json:"s3Region,omitempty"`
+	S3Bucket   string `json:"s3Bucket,omitempty"`
+	S3Prefix   string `json:"s3Prefix,omitempty"`
+	// S3AccessKeyID and S3SecretAccessKey are the credentials of the s3
+	// backend. If unset, they are read from the AWS environment variables.
+	S3AccessKeyID     string `json:"s3AccessKeyID,omitempty"`
+	S3SecretAccessKey string `json:"s3SecretAccessKey,omitempty"`
+	// S3Insecure connects to the s3 endpoint over plain HTTP
+	S3Insecure bool `json:"s3Insecure,omitempty"`
+	// S3ReadOnly disables writes, for serving-only deployments
+	S3ReadOnly bool `json:"s3ReadOnly,omitempty"`
+
+	// BloomFilter keeps a bloom filter of the populated buckets of the file
+	// backend in memory, so that absent buckets are not loaded from disk
+	BloomFilter bool `json:"bloomFilter,omitempty"`
+	// BloomCapacity is the number of buckets the filter is sized for
+	// (default: the number of populated buckets at startup)
+	BloomCapacity int `json:"bloomCapacity,omitempty"`
+	// BloomFalsePositiveRate is the target false-positive rate of the filter
+	// (default 0.01)
+	BloomFalsePositiveRate float64 `json:"bloomFalsePositiveRate,omitempty"`
+}
+
+// newBucketStore returns the backend selected by cfg. The file backend is
+// also returned as a *kvStore, which is nil for other backends.
+func newBucketStore(cfg storeConfig) (bucketStore, *kvStore, error) {
+	switch cfg.StoreBackend {
+	case "", "file":
+		storeDir := cfg.StoreDir
+		if storeDir == "" {
+			storeDir = defaultStoreDir
+		}
+		kv, err := newKVStore(storeDir, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		if kv.fileFormat, err = parseFileFormat(cfg.BucketFormat); err != nil {
+			return nil, nil, err
+		}
+		if cfg.FanOutDepth < 0 || cfg.FanOutWidth < 0 {
+			return nil, nil, errors.New("fan-out depth and width must not be negative")
+		}
+		kv.fanOutDepth, kv.fanOutWidth = cfg.FanOutDepth, cfg.FanOutWidth
+		if kv.fanOutWidth == 0 {
+			kv.fanOutWidth = defaultFanOutWidth
+		}
+		return kv, kv, nil
+	case "redis":
+		store, err := newRedisStore(cfg.RedisURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, nil, nil
+	case "bolt":
+		store, err := newBoltStore(cfg.BoltPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, nil, nil
+	case "s3":
+		store, err := newS3Store(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown store backend %q", cfg.StoreBackend)
+	}
+}
+
+// bucketWriter buffers the entries written to it and appends them to the end
+// of a bucket in a store when closed, so that writing the entries of an
+// insert to a bucket costs a single append however many there are.
+type bucketWriter struct {
+	store  bucketStore
+	id     string
+	buf    bytes.Buffer
+	closed bool
+}
+
+// Write buffers p until the writer is closed.
+func (w *bucketWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	return w.buf.Write(p)
+}
+
+// Close appends the buffered entries to the bucket.
+func (w *bucketWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	return w.store.Append(w.id, w.buf.Bytes())
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// certReloader serves a TLS certificate loaded from disk, reloading it on
+// SIGHUP so that certificates can be rotated without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	lock sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newCertReloader loads the certificate and key from the given files.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate and key again, keeping the previous
+// certificate if loading fails.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	return nil
+}
+
+// getCertificate returns the current certificate. Implements
+// tls.Config.GetCertificate.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// watchSIGHUP reloads the certificate whenever SIGHUP is received. The
+// returned function stops watching.
+func (r *certReloader) watchSIGHUP() func() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-hup:
+				if err := r.reload(); err != nil {
+					slog.Warn("reloading TLS certificate failed", "err", err)
+					continue
+				}
+				slog.Info("reloaded TLS certificate", "file", r.certFile)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		close(done)
+	}
+}
+
+// tlsConfig returns the server TLS configuration, requiring TLS 1.2 or later.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+	}
+}
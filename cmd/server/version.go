@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+)
+
+// version and commit identify the build. They can be set with
+// -ldflags "-X main.version=v1.0.0 -X main.commit=<hash>", and otherwise
+// default to the module version and VCS revision recorded by the go tool.
+var version, commit string
+
+// versionString describes the build of the server and the MIGP protocol version
+// it speaks
+func versionString() string {
+	v, c, dirty := version, commit, false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if c == "" {
+					c = setting.Value
+				}
+			case "vcs.modified":
+				dirty = setting.Value == "true" && commit == ""
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+	if c == "" {
+		c = "unknown"
+	} else if dirty {
+		c += "-dirty"
+	}
+	return fmt.Sprintf("migp server %s (commit %s, protocol version %d)", v, c, migp.DefaultMIGPVersion)
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/circl/oprf"
+)
+
+// MaxBatchSize is the maximum number of queries a server accepts in a single
+// batch request.
+const MaxBatchSize = 1024
+
+// BatchClientRequest carries the information the server needs to evaluate
+// several queries at once. The i-th blinded element is evaluated for the
+// bucket with the i-th bucket ID.
+type BatchClientRequest struct {
+	Version       uint32   `json:"version"`
+	KeyID         uint32   `json:"keyID,omitempty"`
+	Tag           string   `json:"tag,omitempty"`
+	BucketIDs     []string `json:"bucketIDs"`
+	BlindElements [][]byte `json:"blindElements"`
+}
+
+// BatchServerResponse wraps up the server's response to a batch request, with
+// one evaluated element and bucket per query, in request order. In verifiable
+// mode, each evaluation comes with its own proof.
+type BatchServerResponse struct {
+	Version           uint32   `json:"version"`
+	KeyID             uint32   `json:"keyID,omitempty"`
+	EvaluatedElements [][]byte `json:"evaluatedElements"`
+	Proofs            [][]byte `json:"proofs,omitempty"`
+	BucketContents    [][]byte `json:"bucketContents"`
+}
+
+// NewBatchClientRequest combines single-query requests into a batch request.
+// All requests must be for the same version, key ID and tag.
+func NewBatchClientRequest(requests []ClientRequest) (BatchClientRequest, error) {
+	if len(requests) == 0 {
+		return BatchClientRequest{}, errors.New("empty batch")
+	}
+	batch := BatchClientRequest{
+		Version:       requests[0].Version,
+		KeyID:         requests[0].KeyID,
+		Tag:           requests[0].Tag,
+		BucketIDs:     make([]string, len(requests)),
+		BlindElements: make([][]byte, len(requests)),
+	}
+	for i, request := range requests {
+		if request.Version != batch.Version {
+			return BatchClientRequest{}, errors.New("mismatched versions in batch")
+		}
+		if request.KeyID != batch.KeyID {
+			return BatchClientRequest{}, errors.New("mismatched key IDs in batch")
+		}
+		if request.Tag != batch.Tag {
+			return BatchClientRequest{}, errors.New("mismatched tags in batch")
+		}
+		batch.BucketIDs[i] = request.BucketID
+		batch.BlindElements[i] = request.BlindElement
+	}
+	return batch, nil
+}
+
+// Responses splits a batch response into the per-query responses, which can
+// be passed to the Finalize method of the corresponding request context.
+func (r BatchServerResponse) Responses() ([]ServerResponse, error) {
+	if len(r.EvaluatedElements) != len(r.BucketContents) {
+		return nil, errors.New("mismatched batch response lengths")
+	}
+	if r.Proofs != nil && len(r.Proofs) != len(r.EvaluatedElements) {
+		return nil, errors.New("mismatched batch response lengths")
+	}
+	responses := make([]ServerResponse, len(r.EvaluatedElements))
+	for i := range responses {
+		responses[i] = ServerResponse{
+			Version:          r.Version,
+			KeyID:            r.KeyID,
+			EvaluatedElement: r.EvaluatedElements[i],
+			BucketContents:   r.BucketContents[i],
+		}
+		if r.Proofs != nil {
+			responses[i].Proof = r.Proofs[i]
+		}
+	}
+	return responses, nil
+}
+
+// HandleBatchRequest is like HandleRequest, but evaluates all queries of a
+// batch request and returns the bucket contents for each of them.
+func (s *Server) HandleBatchRequest(request BatchClientRequest, kv Getter) (BatchServerResponse, error) {
+	if !s.SupportsVersion(request.Version) {
+		return BatchServerResponse{}, ErrUnsupportedVersion
+	}
+	if len(request.BucketIDs) != len(request.BlindElements) {
+		return BatchServerResponse{}, fmt.Errorf("%w: mismatched batch request lengths", ErrInvalidRequest)
+	}
+	if len(request.BlindElements) == 0 || len(request.BlindElements) > MaxBatchSize {
+		return BatchServerResponse{}, fmt.Errorf("%w: batch size must be between 1 and %d", ErrInvalidRequest, MaxBatchSize)
+	}
+
+	for i, element := range request.BlindElements {
+		if err := s.checkBlindElement(element); err != nil {
+			return BatchServerResponse{}, fmt.Errorf("query %d: %w", i, err)
+		}
+	}
+	for i, bucketID := range request.BucketIDs {
+		if err := checkBucketID(bucketID); err != nil {
+			return BatchServerResponse{}, fmt.Errorf("query %d: %w", i, err)
+		}
+	}
+	oprfServer, err := s.oprfServerForKey(request.KeyID)
+	if err != nil {
+		return BatchServerResponse{}, err
+	}
+
+	response := BatchServerResponse{
+		Version:           request.Version,
+		KeyID:             request.KeyID,
+		EvaluatedElements: make([][]byte, len(request.BlindElements)),
+		BucketContents:    make([][]byte, len(request.BlindElements)),
+	}
+	if s.verifiable {
+		// evaluate elements one at a time, so that each query can be
+		// verified on its own with its proof
+		response.Proofs = make([][]byte, len(request.BlindElements))
+		for i, element := range request.BlindElements {
+			evaluation, err := oprfServer.Evaluate([]oprf.Blinded{element}, oprfInfo(s.oprfInfo, request.Tag))
+			if err != nil {
+				return BatchServerResponse{}, fmt.Errorf("query %d: %w: blind element is not a valid group element: %v", i, ErrInvalidRequest, err)
+			}
+			if len(evaluation.Elements) != 1 {
+				return BatchServerResponse{}, errors.New("invalid Evaluation response")
+			}
+			response.EvaluatedElements[i] = evaluation.Elements[0]
+			response.Proofs[i] = serializeProof(evaluation.Proof)
+		}
+	} else {
+		blinded := make([]oprf.Blinded, len(request.BlindElements))
+		for i, element := range request.BlindElements {
+			blinded[i] = element
+		}
+		evaluation, err := oprfServer.Evaluate(blinded, oprfInfo(s.oprfInfo, request.Tag))
+		if err != nil {
+			return BatchServerResponse{}, fmt.Errorf("%w: blind element is not a valid group element: %v", ErrInvalidRequest, err)
+		}
+		if len(evaluation.Elements) != len(blinded) {
+			return BatchServerResponse{}, errors.New("invalid Evaluation response")
+		}
+		for i := range blinded {
+			response.EvaluatedElements[i] = evaluation.Elements[i]
+		}
+	}
+
+	// queries sharing a bucket, as for several passwords of a username,
+	// load it once
+	loaded := make(map[string][]byte, len(request.BucketIDs))
+	for i, bucketID := range request.BucketIDs {
+		bucketContents, ok := loaded[bucketID]
+		if !ok {
+			var err error
+			if bucketContents, err = kv.Get(bucketID); err != nil {
+				return BatchServerResponse{}, err
+			}
+			if bucketContents, err = s.padBucket(bucketContents); err != nil {
+				return BatchServerResponse{}, err
+			}
+			loaded[bucketID] = bucketContents
+		}
+		response.BucketContents[i] = bucketContents
+	}
+	return response, nil
+}
+
+// QueryBatch submits the given credential pairs to the target MIGP server in
+// a single batch request. The i-th result corresponds to the i-th pair; a
+// failure to finalize one query is reported in that result's Err field.
+// Queries that need to fetch overflow buckets are sent again for those in
+// further batch requests. Like QueryOne, the queries without an exact match
+// with the current key epoch are sent again for each previous epoch.
+func (c *Client) QueryBatch(ctx context.Context, targetURL string, usernames, passwords [][]byte) ([]QueryResult, error) {
+	if len(usernames) != len(passwords) {
+		return nil, errors.New("mismatched number of usernames and passwords")
+	}
+
+	// the inputs are slow hashed once for all key epochs
+	inputs := make([][]byte, len(usernames))
+	bucketIDNums := make([]uint32, len(usernames))
+	results := make([]QueryResult, len(usernames))
+	defer func() {
+		for _, input := range inputs {
+			zeroize(input)
+		}
+	}()
+	pending := make([]int, 0, len(usernames))
+	for i := range usernames {
+		results[i] = QueryResult{Username: usernames[i], Password: passwords[i]}
+		if inputs[i], bucketIDNums[i], results[i].Err = c.credentialsInput(usernames[i], passwords[i]); results[i].Err == nil {
+			pending = append(pending, i)
+		}
+	}
+
+	for _, keyID := range c.keyIDs {
+		if err := c.queryBatchKey(ctx, targetURL, keyID, inputs, bucketIDNums, pending, results); err != nil {
+			return nil, err
+		}
+		var next []int
+		for _, i := range pending {
+			if results[i].Err == nil && results[i].Status != InBreachExact {
+				next = append(next, i)
+			}
+		}
+		if pending = next; len(pending) == 0 {
+			break
+		}
+	}
+	return results, nil
+}
+
+// queryBatchKey queries the given key epoch for the pending queries, walking
+// the overflow buckets of each, and merges the matches found into results.
+// The inputs are left unchanged.
+func (c *Client) queryBatchKey(ctx context.Context, targetURL string, keyID uint32, inputs [][]byte, bucketIDNums []uint32, pending []int, results []QueryResult) error {
+	requests := make(map[int]ClientRequest, len(pending))
+	contexts := make(map[int]ClientRequestContext, len(pending))
+	bucketIDs := make(map[int]string, len(pending))
+	defer func() {
+		for _, requestContext := range contexts {
+			requestContext.Zeroize()
+		}
+	}()
+	for _, i := range pending {
+		// the request context owns, and zeroes, its copy of the input
+		request, requestContext, err := c.requestInput(append([]byte(nil), inputs[i]...), bucketIDNums[i], keyID)
+		if err != nil {
+			return err
+		}
+		requests[i], contexts[i], bucketIDs[i] = request, requestContext, request.BucketID
+	}
+
+	for n := 0; len(pending) > 0; n++ {
+		batchRequests := make([]ClientRequest, len(pending))
+		for j, i := range pending {
+			batchRequests[j] = requests[i]
+			batchRequests[j].BucketID = OverflowBucketID(bucketIDs[i], n)
+		}
+		responses, err := c.postBatch(ctx, targetURL, batchRequests)
+		if err != nil {
+			return err
+		}
+
+		var next []int
+		for j, response := range responses {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			i := pending[j]
+			status, metadata, entries, err := contexts[i].finalize(response)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			results[i].Status, results[i].Metadata = mergeMatch(results[i].Status, results[i].Metadata, status, metadata)
+			if c.needsOverflow(status, entries, n) {
+				next = append(next, i)
+			}
+		}
+		pending = next
+	}
+	return nil
+}
+
+// postBatch sends the requests to the target MIGP server in a single batch
+// request, and returns the response to each of them
+func (c *Client) postBatch(ctx context.Context, targetURL string, requests []ClientRequest) ([]ServerResponse, error) {
+	batch, err := NewBatchClientRequest(requests)
+	if err != nil {
+		return nil, err
+	}
+
+	serializedRequestPayload, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.post(ctx, targetURL, "application/json", serializedRequestPayload)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := readResponseBody(response)
+	if err != nil {
+		return nil, err
+	}
+	var batchResponse BatchServerResponse
+	if err := json.Unmarshal(body, &batchResponse); err != nil {
+		return nil, err
+	}
+	responses, err := batchResponse.Responses()
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) != len(requests) {
+		return nil, errors.New("batch response does not match request")
+	}
+	return responses, nil
+}
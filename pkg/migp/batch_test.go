@@ -0,0 +1,232 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newBatchTestHTTPServer serves the batch requests of clients with server,
+// calling observe, if set, with each request served
+func newBatchTestHTTPServer(server *Server, kv Getter, observe func(BatchClientRequest)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var request BatchClientRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if observe != nil {
+			observe(request)
+		}
+		response, err := server.HandleBatchRequest(request, kv)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+}
+
+// TestQueryBatch tests that a batch of queries is answered with one result
+// per query, in order
+func TestQueryBatch(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv := &KVMock{store: make(map[string][]byte)}
+	usernames := [][]byte{[]byte("user1"), []byte("user2"), []byte("user1")}
+	passwords := [][]byte{[]byte("pass1"), []byte("pass2"), []byte("other")}
+	metadata := []byte("breach")
+	bucketIDHex := BucketIDToHex(server.BucketID(usernames[0]))
+	entry, err := server.EncryptBucketEntry(usernames[0], passwords[0], MetadataBreachedPassword, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.store[bucketIDHex] = entry
+
+	httpServer := newBatchTestHTTPServer(server, kv, nil)
+	defer httpServer.Close()
+
+	client, err := NewClient(cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := client.QueryBatch(context.Background(), httpServer.URL, usernames, passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []BreachStatus{InBreach, NotInBreach, NotInBreach}
+	if len(results) != len(expected) {
+		t.Fatalf("results: want %d, got %d", len(expected), len(results))
+	}
+	for i, result := range results {
+		if result.Err != nil {
+			t.Errorf("result %d: %v", i, result.Err)
+		}
+		if result.Status != expected[i] {
+			t.Errorf("result %d: want %s, got %s", i, expected[i], result.Status)
+		}
+	}
+	if !bytes.Equal(results[0].Metadata, metadata) {
+		t.Errorf("metadata: want %q, got %q", metadata, results[0].Metadata)
+	}
+}
+
+// TestQueryBatchKeyRotation tests that batch queries find entries ingested
+// under a previous key epoch, querying it only for the credentials without an
+// exact match under the current one, which are slow hashed once
+func TestQueryBatchKeyRotation(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	kv := &KVMock{store: make(map[string][]byte)}
+	insert := func(server *Server, username string, flag MetadataType, metadata string) {
+		entry, err := server.EncryptBucketEntry([]byte(username), []byte("password"), flag, []byte(metadata))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucketID := BucketIDToHex(server.BucketID([]byte(username)))
+		kv.store[bucketID] = append(kv.store[bucketID], entry...)
+	}
+	oldServer, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(oldServer, "old", MetadataBreachedPassword, "old")
+	insert(oldServer, "both", MetadataBreachedPassword, "both old")
+	if err := cfg.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(server, "new", MetadataBreachedPassword, "new")
+	insert(server, "both", MetadataSimilarPassword, "both new")
+
+	// queries is the number of queries sent for each key ID
+	queries := make(map[uint32]int)
+	httpServer := newBatchTestHTTPServer(server, kv, func(request BatchClientRequest) {
+		queries[request.KeyID] += len(request.BlindElements)
+	})
+	defer httpServer.Close()
+
+	client, err := NewClient(server.Config().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher := &countingSlowHasher{SlowHasher: client.slowHasher}
+	client.slowHasher = hasher
+	usernames := [][]byte{[]byte("old"), []byte("new"), []byte("both"), []byte("other")}
+	passwords := [][]byte{[]byte("password"), []byte("password"), []byte("password"), []byte("password")}
+	results, err := client.QueryBatch(context.Background(), httpServer.URL, usernames, passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		status   BreachStatus
+		metadata string
+	}{
+		{InBreach, "old"},
+		{InBreach, "new"},
+		{InBreach, "both old"},
+		{NotInBreach, ""},
+	}
+	for i, test := range testCases {
+		if results[i].Err != nil {
+			t.Fatal(results[i].Err)
+		}
+		if results[i].Status != test.status || string(results[i].Metadata) != test.metadata {
+			t.Errorf("failed test %d: want (%s, %q), got (%s, %q)", i, test.status, test.metadata, results[i].Status, results[i].Metadata)
+		}
+	}
+	if queries[1] != 4 || queries[0] != 3 {
+		t.Errorf("queries: want 4 for the current key and 3 for the previous one, got %v", queries)
+	}
+	if hasher.hashes != len(usernames) {
+		t.Errorf("want 1 slow hash per query, got %d for %d queries", hasher.hashes, len(usernames))
+	}
+}
+
+// TestHandleBatchRequestMismatchedLengths tests that malformed batch requests
+// are rejected
+func TestHandleBatchRequestMismatchedLengths(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := BatchClientRequest{
+		Version:       DefaultMIGPVersion,
+		BucketIDs:     []string{"00000001", "00000002"},
+		BlindElements: [][]byte{nil},
+	}
+	if _, err := server.HandleBatchRequest(request, &KVMock{}); err == nil {
+		t.Fatal("expected error for mismatched batch lengths")
+	}
+}
+
+// countingGetter counts the loads of each bucket
+type countingGetter struct {
+	KVMock
+	loads map[string]int
+}
+
+func (kv *countingGetter) Get(key string) ([]byte, error) {
+	kv.loads[key]++
+	return kv.KVMock.Get(key)
+}
+
+// TestHandleBatchRequestSharedBucket tests that queries of a batch sharing a
+// bucket load it once, and are each answered with its contents
+func TestHandleBatchRequestSharedBucket(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := []byte("user1")
+	entry, err := server.EncryptBucketEntry(username, []byte("pass1"), MetadataBreachedPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketIDHex := BucketIDToHex(server.BucketID(username))
+	kv := &countingGetter{KVMock: KVMock{store: map[string][]byte{bucketIDHex: entry}}, loads: make(map[string]int)}
+
+	request := BatchClientRequest{Version: DefaultMIGPVersion}
+	for _, password := range []string{"pass1", "pass2", "pass3"} {
+		clientRequest, _, err := client.Request(username, []byte(password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.BucketIDs = append(request.BucketIDs, clientRequest.BucketID)
+		request.BlindElements = append(request.BlindElements, clientRequest.BlindElement)
+	}
+	response, err := server.HandleBatchRequest(request, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv.loads[bucketIDHex] != 1 {
+		t.Errorf("loads: want 1, got %d", kv.loads[bucketIDHex])
+	}
+	for i, contents := range response.BucketContents {
+		if !bytes.Equal(contents, entry) {
+			t.Errorf("failed test %d: want the bucket contents, got %d bytes", i, len(contents))
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// ResultCache stores query results so that repeated checks of the same
+// credential pair can skip the network. Caching results means a cached answer
+// does not reflect breach data ingested by the server after it was stored.
+type ResultCache interface {
+	Get(key string) (QueryResult, bool)
+	Set(key string, result QueryResult)
+}
+
+// resultCacheSecret is the random key of the MAC deriving result cache keys,
+// generated once per process so that keys cannot be precomputed for guessed
+// credentials or linked across runs
+var resultCacheSecret struct {
+	once sync.Once
+	key  []byte
+	err  error
+}
+
+// ResultCacheKey returns the cache key for a credential pair queried against
+// the server at targetURL. The key is a MAC, under a random per-process
+// secret, of the target, the configuration and the credentials, so that
+// results are not shared across servers, tags or key epochs. It is derived
+// from the deterministic OPRF input rather than the blinded element, which is
+// randomized on every request.
+func ResultCacheKey(cfg Config, targetURL string, username, password []byte) (string, error) {
+	resultCacheSecret.once.Do(func() {
+		resultCacheSecret.key = make([]byte, sha256.Size)
+		_, resultCacheSecret.err = rand.Read(resultCacheSecret.key)
+	})
+	if resultCacheSecret.err != nil {
+		return "", resultCacheSecret.err
+	}
+	cfgJSON, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	if cfg.NormalizeUsernames {
+		username = NormalizeUsername(username)
+	}
+	if err := checkCredentialLength(username, password); err != nil {
+		return "", err
+	}
+	credentials := serializeUsernamePassword(username, password)
+	defer zeroize(credentials)
+
+	mac := hmac.New(sha256.New, resultCacheSecret.key)
+	for _, field := range [][]byte{[]byte(targetURL), cfgJSON, credentials} {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+		mac.Write(length[:])
+		mac.Write(field)
+	}
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// memoryResultCache implements ResultCache with an in-memory map whose
+// entries expire after a fixed TTL. Expired entries are swept at most once
+// per TTL, so the map holds no more than the entries set within two TTLs.
+type memoryResultCache struct {
+	ttl       time.Duration
+	now       func() time.Time
+	lock      sync.Mutex
+	entries   map[string]cacheEntry
+	lastSweep time.Time
+}
+
+// cacheEntry is a cached result along with its expiry time
+type cacheEntry struct {
+	result  QueryResult
+	expires time.Time
+}
+
+// NewMemoryResultCache returns an in-memory ResultCache whose entries expire
+// after ttl
+func NewMemoryResultCache(ttl time.Duration) ResultCache {
+	return &memoryResultCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// Get returns the unexpired result stored under key, if any
+func (c *memoryResultCache) Get(key string) (QueryResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return QueryResult{}, false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return QueryResult{}, false
+	}
+	return entry.result, true
+}
+
+// Set stores result under key until the TTL elapses, sweeping the expired
+// entries if the TTL has elapsed since the last sweep
+func (c *memoryResultCache) Set(key string, result QueryResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	if now.Sub(c.lastSweep) >= c.ttl {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[key] = cacheEntry{result: result, expires: now.Add(c.ttl)}
+}
+
+// BucketCache stores the buckets fetched by a client, keyed by bucket ID, so
+// that queries for a bucket already fetched need not download it again, see
+// WithBucketCache. Cached buckets do not reflect breach data ingested by the
+// server after they were fetched, so a cache is meant to last a single run.
+type BucketCache interface {
+	Get(bucketID string) ([]byte, bool)
+	Set(bucketID string, contents []byte)
+}
+
+// memoryBucketCache implements BucketCache with an in-memory map holding up
+// to a maximum number of bytes of buckets, evicting the oldest first
+type memoryBucketCache struct {
+	maxBytes int64
+	lock     sync.Mutex
+	size     int64
+	buckets  map[string][]byte
+	// order lists the cached bucket IDs from the oldest
+	order []string
+}
+
+// NewMemoryBucketCache returns an in-memory BucketCache holding up to maxBytes
+// bytes of buckets. Buckets larger than maxBytes are not cached.
+func NewMemoryBucketCache(maxBytes int64) BucketCache {
+	return &memoryBucketCache{
+		maxBytes: maxBytes,
+		buckets:  make(map[string][]byte),
+	}
+}
+
+// Get returns the bucket stored under bucketID, if any
+func (c *memoryBucketCache) Get(bucketID string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	contents, ok := c.buckets[bucketID]
+	return contents, ok
+}
+
+// Set stores the contents of a bucket, evicting the oldest buckets to make
+// room for it
+func (c *memoryBucketCache) Set(bucketID string, contents []byte) {
+	size := int64(len(contents))
+	if size > c.maxBytes {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if old, ok := c.buckets[bucketID]; ok {
+		c.size -= int64(len(old))
+	} else {
+		c.order = append(c.order, bucketID)
+	}
+	c.buckets[bucketID] = contents
+	c.size += size
+	for c.size > c.maxBytes && len(c.order) > 0 {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		c.size -= int64(len(c.buckets[oldest]))
+		delete(c.buckets, oldest)
+	}
+}
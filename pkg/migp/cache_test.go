@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMemoryResultCache tests that cached results are returned until they
+// expire
+func TestMemoryResultCache(t *testing.T) {
+	now := time.Now()
+	cache := NewMemoryResultCache(time.Minute).(*memoryResultCache)
+	cache.now = func() time.Time { return now }
+
+	key, err := ResultCacheKey(DefaultConfig(), "http://localhost:8080", []byte("username"), []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ResultCacheKey(DefaultConfig(), "http://localhost:8080", []byte("username"), []byte("password1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key == otherKey {
+		t.Fatal("distinct credentials share a cache key")
+	}
+
+	cache.Set(key, QueryResult{Status: InBreach})
+	if result, ok := cache.Get(key); !ok || result.Status != InBreach {
+		t.Errorf("want cached %s, got %v %s", InBreach, ok, result.Status)
+	}
+	if _, ok := cache.Get(otherKey); ok {
+		t.Error("unexpected cache hit")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := cache.Get(key); ok {
+		t.Error("expired entry returned")
+	}
+}
+
+// TestResultCacheKey tests that results are only shared between queries for
+// the same credentials, server and configuration
+func TestResultCacheKey(t *testing.T) {
+	const target = "http://localhost:8080"
+	cfg := DefaultConfig()
+	want, err := ResultCacheKey(cfg, target, []byte("username"), []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged, rotated, info := cfg, cfg, cfg
+	tagged.Tag = "tag"
+	rotated.KeyID = 1
+	info.OPRFInfo = "other"
+	normalized := cfg
+	normalized.NormalizeUsernames = true
+	wantNormalized, err := ResultCacheKey(normalized, target, []byte("user@example.com"), []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		cfg      Config
+		target   string
+		username string
+		password string
+		want     string
+		same     bool
+	}{
+		{cfg, target, "username", "password", want, true},
+		{cfg, "http://localhost:8081", "username", "password", want, false},
+		{tagged, target, "username", "password", want, false},
+		{rotated, target, "username", "password", want, false},
+		{info, target, "username", "password", want, false},
+		{cfg, target, "usernamepassword", "", want, false},
+		{normalized, target, "USER@example.com", "password", wantNormalized, true},
+	}
+	for i, test := range testCases {
+		got, err := ResultCacheKey(test.cfg, test.target, []byte(test.username), []byte(test.password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == test.want) != test.same {
+			t.Errorf("failed test %d: want same key %t, got %s and %s", i, test.same, test.want, got)
+		}
+	}
+}
+
+// TestMemoryResultCacheSweep tests that expired entries are removed even if
+// their key is never looked up again
+func TestMemoryResultCacheSweep(t *testing.T) {
+	now := time.Now()
+	cache := NewMemoryResultCache(time.Minute).(*memoryResultCache)
+	cache.now = func() time.Time { return now }
+
+	cache.Set("a", QueryResult{Status: InBreach})
+	now = now.Add(30 * time.Second)
+	cache.Set("b", QueryResult{Status: InBreach})
+	now = now.Add(45 * time.Second)
+	cache.Set("c", QueryResult{Status: InBreach})
+	if _, ok := cache.entries["a"]; ok {
+		t.Error("expired entry not swept")
+	}
+	if len(cache.entries) != 2 {
+		t.Errorf("want 2 entries, got %d", len(cache.entries))
+	}
+}
+
+// TestMemoryBucketCache tests that cached buckets are returned until the
+// cache outgrows its size, evicting the oldest first
+func TestMemoryBucketCache(t *testing.T) {
+	cache := NewMemoryBucketCache(10)
+	cache.Set("a", []byte("aaaa"))
+	cache.Set("b", []byte("bbbb"))
+	cache.Set("empty", nil)
+	cache.Set("large", []byte("too large for the cache"))
+	cache.Set("c", []byte("cccc"))
+
+	testCases := []struct {
+		bucketID string
+		contents string
+		ok       bool
+	}{
+		{"a", "", false},
+		{"b", "bbbb", true},
+		{"c", "cccc", true},
+		{"empty", "", true},
+		{"large", "", false},
+	}
+	for i, test := range testCases {
+		contents, ok := cache.Get(test.bucketID)
+		if ok != test.ok || string(contents) != test.contents {
+			t.Errorf("failed test %d: want (%q, %t), got (%q, %t)", i, test.contents, test.ok, contents, ok)
+		}
+	}
+}
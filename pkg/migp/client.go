@@ -5,10 +5,17 @@ package migp
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	mathrand "math/rand"
 	"net/http"
 	"time"
 
@@ -22,16 +29,142 @@ type Client struct {
 	bucketHasher    BucketHasher
 	bucketEncryptor BucketEncryptor
 	slowHasher      SlowHasher
-	oprfClient      *oprf.Client
 	oprfSuite       oprf.SuiteID
+	verifiable      bool
+	tag             string
+	oprfInfo        string
+	binaryRequests  bool
+	httpClient      *http.Client
+	maxRetries      int
+	retryBaseDelay  time.Duration
+	apiKey          string
+	// bucketCache, if set, holds the buckets fetched by earlier queries,
+	// which are not fetched again
+	bucketCache BucketCache
+	// maxBucketEntries is the cap on bucket entries past which the server
+	// stores entries in overflow buckets, or zero if buckets are unbounded
+	maxBucketEntries int
+
+	// keyIDs lists the key epochs queried by QueryOne, the current one
+	// first, and oprfClients holds an OPRF client for each of them
+	keyIDs      []uint32
+	oprfClients map[uint32]*oprf.Client
+
+	// normalizeUsernames applies NormalizeUsername to usernames
+	normalizeUsernames bool
+}
+
+// ClientOption configures optional Client behavior
+type ClientOption func(*Client)
+
+// WithHTTPClient sets the HTTP client used to send queries to the server.
+// By default, http.DefaultClient is used.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithAPIKey sets the API key sent to the server as a bearer token.
+func WithAPIKey(apiKey string) ClientOption {
+	return func(c *Client) {
+		c.apiKey = apiKey
+	}
 }
 
 // ClientRequest carries the information the server needs to perform an
 // evaluation
 type ClientRequest struct {
 	Version      uint32 `json:"version"`
+	KeyID        uint32 `json:"keyID,omitempty"`
+	Tag          string `json:"tag,omitempty"`
 	BucketID     string `json:"bucketID"`
 	BlindElement []byte `json:"blindElement"`
+	// OmitBucket asks the server to leave the bucket out of its response,
+	// as the client already holds it. Servers accepting it advertise
+	// Config.OmitBucketRequests.
+	OmitBucket bool `json:"omitBucket,omitempty"`
+}
+
+// MarshalBinary marshals the client request in the following binary format:
+// <32-bit version>|<32-bit key ID>|<16-bit length>|<bucket ID>|
+// <16-bit length>|<blind-element>|<16-bit length>|<tag>|<8-bit flags>
+// where the flags, with bit 0 set for OmitBucket, are only present if not
+// zero, so that other requests keep the original format.
+func (r *ClientRequest) MarshalBinary() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := binary.Write(buffer, binary.BigEndian, r.Version); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buffer, binary.BigEndian, r.KeyID); err != nil {
+		return nil, err
+	}
+	for _, field := range [][]byte{[]byte(r.BucketID), r.BlindElement, []byte(r.Tag)} {
+		if len(field) > math.MaxUint16 {
+			return nil, errors.New("request field too long")
+		}
+		if err := binary.Write(buffer, binary.BigEndian, uint16(len(field))); err != nil {
+			return nil, err
+		}
+		buffer.Write(field)
+	}
+	if r.OmitBucket {
+		buffer.WriteByte(requestFlagOmitBucket)
+	}
+	return buffer.Bytes(), nil
+}
+
+// requestFlagOmitBucket is the flag of binary requests with OmitBucket set
+const requestFlagOmitBucket = 1
+
+// UnmarshalBinary unmarshals the client request from the format written by
+// MarshalBinary.
+func (r *ClientRequest) UnmarshalBinary(data []byte) error {
+	buffer := bytes.NewBuffer(data)
+	if err := binary.Read(buffer, binary.BigEndian, &r.Version); err != nil {
+		return err
+	}
+	if err := binary.Read(buffer, binary.BigEndian, &r.KeyID); err != nil {
+		return err
+	}
+	var fields [3][]byte
+	for i := range fields {
+		var length uint16
+		if err := binary.Read(buffer, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		if int(length) > buffer.Len() {
+			return errors.New("too few bytes to deserialize request field")
+		}
+		fields[i] = append([]byte(nil), buffer.Next(int(length))...)
+	}
+	r.OmitBucket = false
+	if buffer.Len() == 1 {
+		flags, _ := buffer.ReadByte()
+		// the flags are left out when zero
+		if flags == 0 || flags&^requestFlagOmitBucket != 0 {
+			return errors.New("invalid request flags")
+		}
+		r.OmitBucket = flags&requestFlagOmitBucket != 0
+	}
+	if buffer.Len() != 0 {
+		return errors.New("trailing bytes after request")
+	}
+	r.BucketID, r.BlindElement, r.Tag = string(fields[0]), fields[1], string(fields[2])
+	return nil
+}
+
+// WithBucketCache sets a cache of the buckets fetched by the client's
+// queries. Later queries for a bucket in the cache, such as queries for other
+// passwords of the same username, still need the server to evaluate their
+// blinded element, but are sent with ClientRequest.OmitBucket so that the
+// bucket is not downloaded again. The cache is only used with servers
+// advertising Config.OmitBucketRequests, and applies to QueryOne and the
+// other single queries, not to QueryBatch.
+func WithBucketCache(cache BucketCache) ClientOption {
+	return func(c *Client) {
+		c.bucketCache = cache
+	}
 }
 
 // ClientRequestContext wraps the context needed to process MIGP responses
@@ -39,22 +172,40 @@ type ClientRequest struct {
 // metadata (if available). Not all breach entries will have metadata.
 type ClientRequestContext struct {
 	client      Client
+	keyID       uint32
 	oprfRequest *oprf.ClientRequest
+	// input is the OPRF input of the request, the slow hash of the
+	// credentials, which the OPRF request refers to until finalized
+	input []byte
 }
 
-func NewClient(cfg Config) (*Client, error) {
+// NewClient initializes and returns a new MIGP client from the given
+// configuration and options
+func NewClient(cfg Config, opts ...ClientOption) (*Client, error) {
 	var err error
 
 	c := new(Client)
+	c.httpClient = http.DefaultClient
+	for _, opt := range opts {
+		opt(c)
+	}
 	c.version = cfg.Version
 	c.bucketIDBitSize = cfg.BucketIDBitSize
+	c.maxRetries = cfg.MaxRetries
+	c.retryBaseDelay = cfg.RetryBaseDelay
+	if c.retryBaseDelay <= 0 {
+		c.retryBaseDelay = DefaultRetryBaseDelay
+	}
+	if c.retryBaseDelay > MaxRetryDelay {
+		c.retryBaseDelay = MaxRetryDelay
+	}
 
 	c.bucketHasher, err = NewBucketHasher(cfg.BucketHasherID)
 	if err != nil {
 		return nil, err
 	}
 
-	c.slowHasher, err = NewSlowHasher(cfg.SlowHasherID)
+	c.slowHasher, err = NewSlowHasherFromConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -64,26 +215,118 @@ func NewClient(cfg Config) (*Client, error) {
 		return nil, err
 	}
 
-	c.oprfSuite = cfg.OPRFSuite
-	c.oprfClient, err = oprf.NewClient(c.oprfSuite)
-	if err != nil {
+	if _, err = LookupSuite(cfg.OPRFSuite); err != nil {
 		return nil, err
 	}
+	c.oprfSuite = cfg.OPRFSuite
+	c.verifiable = cfg.Verifiable
+	c.tag = cfg.Tag
+	c.oprfInfo = cfg.OPRFInfo
+	c.binaryRequests = cfg.BinaryRequests
+	if !cfg.OmitBucketRequests {
+		c.bucketCache = nil
+	}
+	c.normalizeUsernames = cfg.NormalizeUsernames
+	c.maxBucketEntries = cfg.MaxBucketEntries
+
+	// query the current epoch first, then the previous ones from the most
+	// recent
+	epochs := []KeyEpoch{{KeyID: cfg.KeyID, PublicKey: cfg.PublicKey}}
+	for i := len(cfg.PreviousKeys) - 1; i >= 0; i-- {
+		epochs = append(epochs, cfg.PreviousKeys[i])
+	}
+	c.oprfClients = make(map[uint32]*oprf.Client)
+	for _, epoch := range epochs {
+		if _, ok := c.oprfClients[epoch.KeyID]; ok {
+			return nil, fmt.Errorf("duplicate key ID %d", epoch.KeyID)
+		}
+		if c.oprfClients[epoch.KeyID], err = c.newOPRFClient(epoch.PublicKey); err != nil {
+			return nil, err
+		}
+		c.keyIDs = append(c.keyIDs, epoch.KeyID)
+	}
 	return c, nil
 }
 
+// newOPRFClient returns an OPRF client in the configured mode, verifying
+// evaluations against the given serialized public key in verifiable mode
+func (c *Client) newOPRFClient(serializedPublicKey []byte) (*oprf.Client, error) {
+	if !c.verifiable {
+		return oprf.NewClient(c.oprfSuite)
+	}
+	if len(serializedPublicKey) == 0 {
+		return nil, errors.New("verifiable mode requires the server public key")
+	}
+	publicKey := new(oprf.PublicKey)
+	if err := publicKey.Deserialize(c.oprfSuite, serializedPublicKey); err != nil {
+		return nil, err
+	}
+	return oprf.NewVerifiableClient(c.oprfSuite, publicKey)
+}
+
 // BucketID returns the bucket ID for the given username
 func (c *Client) BucketID(username []byte) uint32 {
-	return bucketHashToID(c.bucketHasher.Hash(username), c.bucketIDBitSize)
+	return bucketHashToID(c.bucketHasher.Hash(c.normalize(username)), c.bucketIDBitSize)
+}
+
+// normalize returns the username as hashed, normalized if configured
+func (c *Client) normalize(username []byte) []byte {
+	if c.normalizeUsernames {
+		return NormalizeUsername(username)
+	}
+	return username
 }
 
 // Request generates a client request byte string and a ClientRequest struct,
-// given a username and password
+// given a username and password, for the current key epoch of the server
 func (c Client) Request(username, password []byte) (ClientRequest, ClientRequestContext, error) {
-	input := c.slowHasher.Hash(serializeUsernamePassword(username, password))
+	return c.request(username, password, c.keyIDs[0])
+}
+
+// request is like Request, but for the given key epoch
+func (c Client) request(username, password []byte, keyID uint32) (ClientRequest, ClientRequestContext, error) {
+	input, bucketID, err := c.credentialsInput(username, password)
+	if err != nil {
+		return ClientRequest{}, ClientRequestContext{}, err
+	}
+	return c.requestInput(input, bucketID, keyID)
+}
+
+// credentialsInput returns the OPRF input of a credential pair, its slow
+// hash, and the ID of its bucket. The input is the same for every key epoch,
+// so it can be computed once and blinded for each epoch queried.
+func (c Client) credentialsInput(username, password []byte) ([]byte, uint32, error) {
+	normalized := c.normalize(username)
+	if err := checkCredentialLength(normalized, password); err != nil {
+		return nil, 0, err
+	}
+	return hashCredentials(c.slowHasher, normalized, password), c.BucketID(username), nil
+}
+
+// passwordInput is like credentialsInput, but for the password-only entry of
+// password, see Server.EncryptPasswordEntry
+func (c Client) passwordInput(password []byte) ([]byte, uint32, error) {
+	if err := checkCredentialLength(nil, password); err != nil {
+		return nil, 0, err
+	}
+	return hashCredentials(c.slowHasher, nil, password), bucketHashToID(c.bucketHasher.Hash(passwordBucketInput(password)), c.bucketIDBitSize), nil
+}
+
+// sha1PasswordOnlyInput is like credentialsInput, but for the password alone,
+// as ingested from its SHA-1 hash with Server.EncryptSHA1PasswordEntry
+func (c Client) sha1PasswordOnlyInput(password []byte) ([]byte, uint32, error) {
+	digest := sha1.Sum(password)
+	input := sha1PasswordInput(digest[:])
+	zeroize(digest[:])
+	return input, bucketHashToID(c.bucketHasher.Hash(input), c.bucketIDBitSize), nil
+}
 
-	oprfRequest, err := c.oprfClient.Request([][]byte{input})
+// requestInput generates a request for the OPRF evaluation of input and the
+// bucket with the given ID, for the given key epoch
+func (c Client) requestInput(input []byte, bucketID uint32, keyID uint32) (ClientRequest, ClientRequestContext, error) {
+	oprfRequest, err := c.oprfClients[keyID].Request([][]byte{input})
 	if err != nil {
+		zeroize(input)
 		return ClientRequest{}, ClientRequestContext{}, err
 	}
 	blindedElements := oprfRequest.BlindedElements()
@@ -93,12 +336,16 @@ func (c Client) Request(username, password []byte) (ClientRequest, ClientRequest
 
 	request := ClientRequest{
 		Version:      uint32(c.version),
-		BucketID:     BucketIDToHex(c.BucketID(username)),
+		KeyID:        keyID,
+		Tag:          c.tag,
+		BucketID:     BucketIDToHex(bucketID),
 		BlindElement: blindedElements[0],
 	}
 	context := ClientRequestContext{
 		client:      c,
+		keyID:       keyID,
 		oprfRequest: oprfRequest,
+		input:       input,
 	}
 
 	return request, context, nil
@@ -106,79 +353,302 @@ func (c Client) Request(username, password []byte) (ClientRequest, ClientRequest
 
 // Finalize parses a response message from server, completes the computation of
 // the OPRF value, determines if it is in the received bucket, and decrypts the
-// associated ciphertext
+// associated ciphertext. The OPRF value, the secret the entries are encrypted
+// with, is zeroed before returning.
 func (ctx ClientRequestContext) Finalize(response ServerResponse) (BreachStatus, []byte, error) {
+	status, metadata, _, err := ctx.finalize(response)
+	return status, metadata, err
+}
+
+// finalize is like Finalize, but also returns the number of entries scanned,
+// see scanBucket
+func (ctx ClientRequestContext) finalize(response ServerResponse) (BreachStatus, []byte, int, error) {
+	secret, err := ctx.finalizeOPRF(response)
+	if err != nil {
+		return NotInBreach, nil, 0, err
+	}
+	defer zeroize(secret)
+	return ctx.scanBucket(secret, bytes.NewReader(response.BucketContents))
+}
+
+// FinalizeReader is like Finalize, but reads the response from r in the binary
+// format written by ServerResponse.MarshalBinary, decrypting the bucket
+// entries as they are read instead of buffering the whole bucket. Only the
+// body of the matching entry is held in memory. Reading stops at the first
+// exact match, so r may not be read to the end.
+func (ctx ClientRequestContext) FinalizeReader(r io.Reader) (BreachStatus, []byte, error) {
+	status, metadata, _, err := ctx.finalizeReader(r)
+	return status, metadata, err
+}
+
+// finalizeReader is like FinalizeReader, but also returns the number of
+// entries scanned, see scanBucket
+func (ctx ClientRequestContext) finalizeReader(r io.Reader) (BreachStatus, []byte, int, error) {
+	var response ServerResponse
+	if err := response.readHeader(r, ctx.client.oprfSuite, ctx.client.verifiable, ctx.keyID); err != nil {
+		return NotInBreach, nil, 0, err
+	}
+	secret, err := ctx.finalizeOPRF(response)
+	if err != nil {
+		return NotInBreach, nil, 0, err
+	}
+	defer zeroize(secret)
+	return ctx.scanBucket(secret, r)
+}
+
+// Zeroize overwrites the OPRF input held by the context, the slow hash of the
+// queried credentials. Call it once the responses to the request, including
+// those for overflow buckets, have been finalized: the context cannot be
+// finalized afterwards.
+func (ctx ClientRequestContext) Zeroize() {
+	zeroize(ctx.input)
+}
+
+// finalizeOPRF checks the response to the request and completes the
+// computation of the OPRF value, returning the secret the bucket entries for
+// the queried credentials are encrypted with
+func (ctx ClientRequestContext) finalizeOPRF(response ServerResponse) ([]byte, error) {
 	if uint16(response.Version) != ctx.client.version {
-		return NotInBreach, nil, errors.New("wrong version in reply")
+		return nil, errors.New("wrong version in reply")
+	}
+	if response.KeyID != ctx.keyID {
+		return nil, errors.New("wrong key ID in reply")
 	}
 
-	oprfOutput, err := ctx.client.oprfClient.Finalize(ctx.oprfRequest, &oprf.Evaluation{
+	evaluation := &oprf.Evaluation{
 		Elements: []oprf.SerializedElement{response.EvaluatedElement},
-	}, OprfInfo)
+	}
+	if ctx.client.verifiable {
+		proof, err := deserializeProof(ctx.client.oprfSuite, response.Proof)
+		if err != nil {
+			return nil, err
+		}
+		evaluation.Proof = proof
+	}
+	oprfOutput, err := ctx.client.oprfClients[ctx.keyID].Finalize(ctx.oprfRequest, evaluation, oprfInfo(ctx.client.oprfInfo, ctx.client.tag))
 	if err != nil {
-		return NotInBreach, nil, err
+		if ctx.client.verifiable {
+			return nil, fmt.Errorf("OPRF evaluation failed verification: %w", err)
+		}
+		return nil, err
 	}
 	if len(oprfOutput) < 1 {
-		return NotInBreach, nil, errors.New("invalid Finalize response")
+		return nil, errors.New("invalid Finalize response")
 	}
-	secret := oprfOutput[0]
+	return oprfOutput[0], nil
+}
 
-	offset := 0
+// scanBucket reads the bucket entries from r one at a time, and returns the
+// status and decrypted metadata of the entry matching the secret, along with
+// the number of entries read. Reading stops at an exact match.
+func (ctx ClientRequestContext) scanBucket(secret []byte, r io.Reader) (BreachStatus, []byte, int, error) {
+	// an entry for a password variant may come before the exact entry for
+	// the same pair, so keep looking until an exact match is found
+	status, metadata := NotInBreach, []byte(nil)
+	header := make([]byte, HeaderSize)
+	entries := 0
 
 	for {
-		if (offset + HeaderSize) > len(response.BucketContents) {
+		if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
 			// Note(caw): we could return an error here, but bail out to the default case
 			break
+		} else if err != nil {
+			return NotInBreach, nil, 0, err
+		}
+		if !isPaddingEntry(header) {
+			entries += 1
 		}
 
-		valid, flag, bodyLength, err := ctx.client.bucketEncryptor.DecryptHeader(secret, response.BucketContents[offset:])
+		valid, flag, bodyLength, err := ctx.client.bucketEncryptor.DecryptHeader(secret, header)
 		if err != nil {
-			return NotInBreach, nil, err
-		}
-		offset += HeaderSize
-		if offset+bodyLength > len(response.BucketContents) {
-			return NotInBreach, nil, errors.New("parsing error in bucket")
+			return NotInBreach, nil, 0, err
 		}
-		if valid {
-			metadata, err := ctx.client.bucketEncryptor.DecryptBody(secret, response.BucketContents[offset:offset+bodyLength])
+		if valid && (status == NotInBreach || flag.ToBreachStatus() == InBreachExact) {
+			ciphertext, err := ioutil.ReadAll(io.LimitReader(r, int64(bodyLength)))
 			if err != nil {
-				return NotInBreach, nil, err
+				return NotInBreach, nil, 0, err
 			}
-			return flag.ToBreachStatus(), metadata, err
+			if len(ciphertext) != bodyLength {
+				return NotInBreach, nil, 0, errors.New("parsing error in bucket")
+			}
+			body, err := ctx.client.bucketEncryptor.DecryptBody(secret, ciphertext)
+			if err != nil {
+				return NotInBreach, nil, 0, err
+			}
+			// the metadata of an earlier variant match is superseded
+			zeroize(metadata)
+			status, metadata = flag.ToBreachStatus(), body
+			if status == InBreachExact {
+				break
+			}
+			continue
 		}
 
 		// Skip to the next entry
-		offset += bodyLength
+		if n, err := io.CopyN(ioutil.Discard, r, int64(bodyLength)); err != nil && err != io.EOF {
+			return NotInBreach, nil, 0, err
+		} else if n != int64(bodyLength) {
+			return NotInBreach, nil, 0, errors.New("parsing error in bucket")
+		}
 	}
 
-	return NotInBreach, nil, nil
+	return status, metadata, entries, nil
+}
+
+// needsOverflow reports whether the next overflow bucket must be fetched
+// after the n-th bucket of a chain, as the credentials were not found in a
+// bucket of the given number of entries that may be full
+func (c Client) needsOverflow(status BreachStatus, entries, n int) bool {
+	return c.maxBucketEntries > 0 && status != InBreachExact && entries >= c.maxBucketEntries && n < MaxOverflowBuckets
+}
+
+// mergeMatch combines the match found in a bucket of a chain with the match
+// found in the buckets before it, preferring exact matches as scanBucket does
+func mergeMatch(status BreachStatus, metadata []byte, next BreachStatus, nextMetadata []byte) (BreachStatus, []byte) {
+	if next != NotInBreach && (status == NotInBreach || next == InBreachExact) {
+		return next, nextMetadata
+	}
+	return status, metadata
 }
 
 // Query submits a MIGP query to the target MIGP server.
-func Query(cfg Config, targetURL string, username, password []byte) (BreachStatus, []byte, error, map[string]time.Duration, float64) {
-	var duration = make(map[string]time.Duration)
-	var totalTime time.Duration = 0
-	start := time.Now()
+func Query(cfg Config, targetURL string, username, password []byte) (QueryResult, error) {
+	return QueryContext(context.Background(), cfg, targetURL, username, password)
+}
+
+// QueryContext submits a MIGP query to the target MIGP server. The query is
+// abandoned if ctx is cancelled or its deadline passes before it completes.
+func QueryContext(ctx context.Context, cfg Config, targetURL string, username, password []byte) (QueryResult, error) {
 	client, err := NewClient(cfg)
 	if err != nil {
-		return 0, nil, err, nil, 0
+		return QueryResult{}, err
 	}
+	return client.QueryOneContext(ctx, targetURL, username, password)
+}
 
-	migpRequest, context, err := client.Request(username, password)
-	if err != nil {
-		return 0, nil, err, nil, 0
+// QueryOne submits a MIGP query to the target MIGP server using an existing
+// client, avoiding the cost of constructing a new client for each query.
+func (c *Client) QueryOne(targetURL string, username, password []byte) (QueryResult, error) {
+	return c.QueryOneContext(context.Background(), targetURL, username, password)
+}
+
+// QueryOneContext is like QueryOne, but abandons the query if ctx is
+// cancelled or its deadline passes before it completes. Unless an exact
+// match is found with the current key epoch of the server, the previous
+// epochs are queried in turn, as their buckets may hold entries ingested
+// before the key was rotated.
+func (c *Client) QueryOneContext(ctx context.Context, targetURL string, username, password []byte) (QueryResult, error) {
+	return c.queryEpochs(ctx, c.httpKeyQuery(targetURL), username, password, func() ([]byte, uint32, error) {
+		return c.credentialsInput(username, password)
+	})
+}
+
+// QueryPassword submits a MIGP query for the password alone to the target
+// MIGP server, to check whether it appears in a breach with any username. Only
+// passwords the server ingested as password-only entries are found. The
+// Username of the result is nil.
+func (c *Client) QueryPassword(ctx context.Context, targetURL string, password []byte) (QueryResult, error) {
+	return c.queryEpochs(ctx, c.httpKeyQuery(targetURL), nil, password, func() ([]byte, uint32, error) {
+		return c.passwordInput(password)
+	})
+}
+
+// QuerySHA1Password submits a MIGP query for the password alone to the
+// target MIGP server, to check it against passwords ingested from their SHA-1
+// hashes, such as the HIBP dataset. The Username of the result is nil.
+func (c *Client) QuerySHA1Password(ctx context.Context, targetURL string, password []byte) (QueryResult, error) {
+	return c.queryEpochs(ctx, c.httpKeyQuery(targetURL), nil, password, func() ([]byte, uint32, error) {
+		return c.sha1PasswordOnlyInput(password)
+	})
+}
+
+// Evaluator sends a single MIGP request to a server and returns its response,
+// along with the size of the response on the wire in bytes. It carries
+// queries over transports other than HTTP, see QueryEvaluator.
+type Evaluator interface {
+	Evaluate(ctx context.Context, request ClientRequest) (ServerResponse, int, error)
+}
+
+// QueryEvaluator is like QueryOneContext, but sends the requests of the query
+// through evaluator instead of HTTP. Like QueryOneContext, it queries the
+// previous key epochs and the overflow buckets the credentials may be in.
+func (c *Client) QueryEvaluator(ctx context.Context, evaluator Evaluator, username, password []byte) (QueryResult, error) {
+	return c.queryEpochs(ctx, c.evaluatorKeyQuery(evaluator), username, password, func() ([]byte, uint32, error) {
+		return c.credentialsInput(username, password)
+	})
+}
+
+// keyQuery queries a key epoch for an OPRF input and its bucket, leaving the
+// input unchanged
+type keyQuery func(ctx context.Context, username, password, input []byte, bucketIDNum uint32, keyID uint32) (QueryResult, error)
+
+// httpKeyQuery returns a keyQuery sending requests to targetURL over HTTP
+func (c *Client) httpKeyQuery(targetURL string) keyQuery {
+	return func(ctx context.Context, username, password, input []byte, bucketIDNum uint32, keyID uint32) (QueryResult, error) {
+		return c.queryKey(ctx, targetURL, username, password, input, bucketIDNum, keyID)
 	}
+}
 
-	serializedRequestPayload, err := json.Marshal(migpRequest)
+// evaluatorKeyQuery returns a keyQuery sending requests through evaluator
+func (c *Client) evaluatorKeyQuery(evaluator Evaluator) keyQuery {
+	return func(ctx context.Context, username, password, input []byte, bucketIDNum uint32, keyID uint32) (QueryResult, error) {
+		return c.evaluateKey(ctx, evaluator, username, password, input, bucketIDNum, keyID)
+	}
+}
+
+// queryEpochs queries each key epoch in turn for the OPRF input and bucket
+// returned by newInput, combining the matches found in each epoch as those
+// of overflow buckets are, until an exact match is found. The input, whose
+// slow hash is the costliest step of a query, is computed once for all
+// epochs.
+func (c *Client) queryEpochs(ctx context.Context, queryKey keyQuery, username, password []byte, newInput func() ([]byte, uint32, error)) (QueryResult, error) {
+	start := time.Now()
+	input, bucketID, err := newInput()
 	if err != nil {
-		return 0, nil, err, nil, 0
+		return QueryResult{}, err
 	}
-	requestBody := bytes.NewBuffer(serializedRequestPayload)
-	request, err := http.NewRequest("POST", targetURL, requestBody)
+	defer zeroize(input)
+	hashTime := time.Since(start)
+
+	var result QueryResult
+	for i, keyID := range c.keyIDs {
+		keyResult, err := queryKey(ctx, username, password, input, bucketID, keyID)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		if i == 0 {
+			result = keyResult
+		} else {
+			for step, d := range keyResult.Timings {
+				result.Timings[step] += d
+			}
+			result.BandwidthMB += keyResult.BandwidthMB
+			result.Status, result.Metadata = mergeMatch(result.Status, result.Metadata, keyResult.Status, keyResult.Metadata)
+		}
+		if result.Status == InBreachExact {
+			break
+		}
+	}
+	result.Timings["query_prep"] += hashTime
+	result.Timings["total"] += hashTime
+	return result, nil
+}
+
+// queryKey submits the MIGP query for the OPRF input and bucket for the given
+// key epoch, followed by queries for the overflow buckets of the bucket while
+// they may hold the credentials. The input is left unchanged.
+func (c *Client) queryKey(ctx context.Context, targetURL string, username, password, input []byte, bucketIDNum uint32, keyID uint32) (QueryResult, error) {
+	var duration = make(map[string]time.Duration)
+	var totalTime time.Duration = 0
+	start := time.Now()
+
+	// the request context owns, and zeroes, its copy of the input
+	migpRequest, requestContext, err := c.requestInput(append([]byte(nil), input...), bucketIDNum, keyID)
 	if err != nil {
-		return 0, nil, err, nil, 0
+		return QueryResult{}, err
 	}
-	request.Header.Set("Content-Type", "application/json")
+	defer requestContext.Zeroize()
+	bucketID := migpRequest.BucketID
 
 	t := time.Now()
 	query_prep_time := t.Sub(start)
@@ -186,41 +656,252 @@ func Query(cfg Config, targetURL string, username, password []byte) (BreachStatu
 	//fmt.Printf("Query Prep. %s\n", query_prep_time)
 	duration["query_prep"] = query_prep_time
 
-	start = time.Now()
-	response, err := http.DefaultClient.Do(request)
-	t = time.Now()
-	API_call_time := t.Sub(start)
-	totalTime += API_call_time
-	//fmt.Printf("API call %s\n", API_call_time)
-	duration["api_call"] = API_call_time
+	status, content := NotInBreach, []byte(nil)
+	var bw float64
+	for n := 0; ; n++ {
+		// the overflow buckets are queried with the same blinded element,
+		// so the OPRF output, and the secret of the entries, is unchanged
+		migpRequest.BucketID = OverflowBucketID(bucketID, n)
+		var cached []byte
+		if c.bucketCache != nil {
+			cached, migpRequest.OmitBucket = c.bucketCache.Get(migpRequest.BucketID)
+		}
+		contentType := "application/json"
+		var serializedRequestPayload []byte
+		if c.binaryRequests {
+			contentType = BinaryContentType
+			serializedRequestPayload, err = migpRequest.MarshalBinary()
+		} else {
+			serializedRequestPayload, err = json.Marshal(migpRequest)
+		}
+		if err != nil {
+			return QueryResult{}, err
+		}
+
+		start = time.Now()
+		response, err := c.post(ctx, targetURL, contentType, serializedRequestPayload)
+		t = time.Now()
+		API_call_time := t.Sub(start)
+		totalTime += API_call_time
+		//fmt.Printf("API call %s\n", API_call_time)
+		duration["api_call"] += API_call_time
+
+		if err != nil {
+			return QueryResult{}, err
+		}
+
+		// don't spend time finalizing if the caller has already given up
+		if err := ctx.Err(); err != nil {
+			response.Body.Close()
+			return QueryResult{}, err
+		}
+
+		// the bucket is decrypted as it is received, so finalizing
+		// includes reading the response body
+		start = time.Now()
+		bucketStatus, bucketContent, entries, bucketBytes, err := c.finalizeResponse(response, requestContext, migpRequest.BucketID, cached, migpRequest.OmitBucket)
+		t = time.Now()
+		bw += float64(bucketBytes) / (1 << 20)
+		//fmt.Printf("B/w (MB) %.2f\n", bw)
+		Finalize_time := t.Sub(start)
+		totalTime += Finalize_time
+		//fmt.Printf("Finalize %s\n", Finalize_time)
+		duration["finalize"] += Finalize_time
+		if err != nil {
+			return QueryResult{}, err
+		}
+		status, content = mergeMatch(status, content, bucketStatus, bucketContent)
+		if !c.needsOverflow(bucketStatus, entries, n) {
+			break
+		}
+	}
+	//fmt.Printf("Total %s\n", totalTime)
+	duration["total"] = totalTime
+	return QueryResult{
+		Username:    username,
+		Password:    password,
+		Status:      status,
+		Metadata:    content,
+		Timings:     duration,
+		BandwidthMB: bw,
+	}, nil
+}
 
+// evaluateKey is like queryKey, but sends the requests through evaluator.
+// The bucket cache of the client is not used.
+func (c *Client) evaluateKey(ctx context.Context, evaluator Evaluator, username, password, input []byte, bucketIDNum uint32, keyID uint32) (QueryResult, error) {
+	duration := make(map[string]time.Duration)
+	start := time.Now()
+	// the request context owns, and zeroes, its copy of the input
+	request, requestContext, err := c.requestInput(append([]byte(nil), input...), bucketIDNum, keyID)
 	if err != nil {
-		return 0, nil, err, nil, 0
+		return QueryResult{}, err
 	}
+	defer requestContext.Zeroize()
+	bucketID := request.BucketID
+	duration["query_prep"] = time.Since(start)
+
+	status, metadata := NotInBreach, []byte(nil)
+	var bw float64
+	for n := 0; ; n++ {
+		request.BucketID = OverflowBucketID(bucketID, n)
+		start = time.Now()
+		response, size, err := evaluator.Evaluate(ctx, request)
+		duration["api_call"] += time.Since(start)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		bw += float64(size) / (1 << 20)
 
-	if response.StatusCode != http.StatusOK {
-		return 0, nil, fmt.Errorf("Request failed with status code %d", response.StatusCode), nil, 0
+		start = time.Now()
+		bucketStatus, bucketMetadata, entries, err := requestContext.finalize(response)
+		duration["finalize"] += time.Since(start)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		status, metadata = mergeMatch(status, metadata, bucketStatus, bucketMetadata)
+		if !c.needsOverflow(bucketStatus, entries, n) {
+			break
+		}
 	}
+	duration["total"] = duration["query_prep"] + duration["api_call"] + duration["finalize"]
+	return QueryResult{
+		Username:    username,
+		Password:    password,
+		Status:      status,
+		Metadata:    metadata,
+		Timings:     duration,
+		BandwidthMB: bw,
+	}, nil
+}
+
+// finalizeResponse finalizes the request with the response of the server,
+// returning the match found in the bucket, the number of entries it holds,
+// and the number of bytes received. The response body is closed. If the
+// request omitted the bucket, cached is the bucket held for it. Otherwise,
+// the bucket is stored in the bucket cache of the client under bucketID, if
+// it has one.
+func (c *Client) finalizeResponse(response *http.Response, requestContext ClientRequestContext, bucketID string, cached []byte, omitted bool) (BreachStatus, []byte, int, int, error) {
 	defer response.Body.Close()
-	body, err := ioutil.ReadAll(response.Body)
+	wire := &countingReader{r: response.Body}
+	body, err := responseBodyReader(response, wire)
 	if err != nil {
-		return 0, nil, err, nil, 0
-	}
-	var bw = float64(len(body)) / (1 << 20)
-	//fmt.Printf("B/w (MB) %.2f\n", bw)
-	var responsePayload ServerResponse
-	if err := responsePayload.UnmarshalBinary(body); err != nil {
-		return 0, nil, err, nil, 0
-	}
-
-	start = time.Now()
-	status, content, error := context.Finalize(responsePayload)
-	t = time.Now()
-	Finalize_time := t.Sub(start)
-	totalTime += Finalize_time
-	//fmt.Printf("Finalize %s\n", Finalize_time)
-	duration["finalize"] = Finalize_time
-	//fmt.Printf("Total %s\n", totalTime)
-	duration["total"] = totalTime
-	return status, content, error, duration, bw
+		return NotInBreach, nil, 0, 0, err
+	}
+	defer body.Close()
+	if !omitted && c.bucketCache != nil {
+		// the bucket is kept, so it cannot be decrypted as it is received
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return NotInBreach, nil, 0, wire.n, err
+		}
+		var serverResponse ServerResponse
+		if err := serverResponse.unmarshalBinary(data, c.oprfSuite, c.verifiable, requestContext.keyID); err != nil {
+			return NotInBreach, nil, 0, wire.n, err
+		}
+		status, content, entries, err := requestContext.finalize(serverResponse)
+		if err == nil {
+			c.bucketCache.Set(bucketID, serverResponse.BucketContents)
+		}
+		return status, content, entries, wire.n, err
+	}
+	var r io.Reader = body
+	if omitted {
+		// the response ends after the evaluation, where the bucket goes
+		r = io.MultiReader(body, bytes.NewReader(cached))
+	}
+	status, content, entries, err := requestContext.finalizeReader(r)
+	if err == nil {
+		// read the rest of the bucket, so that the bandwidth is measured
+		// and the connection can be reused
+		_, err = io.Copy(ioutil.Discard, body)
+	}
+	return status, content, entries, wire.n, err
+}
+
+// post sends a payload of the given content type to the target URL, retrying
+// with exponential backoff and jitter on network errors, 429, and 5xx
+// responses. Other non-200 responses fail immediately. On success, the caller
+// must close the response body.
+func (c *Client) post(ctx context.Context, targetURL, contentType string, payload []byte) (*http.Response, error) {
+	delay := c.retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, "POST", targetURL, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", contentType)
+		// setting the header disables the transparent decompression of
+		// http.Transport, so that queryKey can measure the size
+		// of the response on the wire
+		request.Header.Set("Accept-Encoding", "gzip")
+		if c.apiKey != "" {
+			request.Header.Set("Authorization", "Bearer "+c.apiKey)
+		}
+
+		response, err := c.httpClient.Do(request)
+		retryable := true
+		if err == nil {
+			if response.StatusCode == http.StatusOK {
+				return response, nil
+			}
+			// include the error body, which lists the supported versions
+			// when the server rejects the requested version
+			reason, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+			response.Body.Close()
+			err = fmt.Errorf("Request failed with status code %d: %s", response.StatusCode, bytes.TrimSpace(reason))
+			retryable = response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+		}
+		if !retryable || attempt >= c.maxRetries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		// full jitter: sleep for a random duration up to the current delay
+		select {
+		case <-time.After(time.Duration(mathrand.Int63n(int64(delay)) + 1)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay = nextRetryDelay(delay)
+	}
+}
+
+// nextRetryDelay doubles the delay between retries, up to MaxRetryDelay
+func nextRetryDelay(delay time.Duration) time.Duration {
+	if delay >= MaxRetryDelay/2 {
+		return MaxRetryDelay
+	}
+	return delay * 2
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// responseBodyReader returns a reader of the body of a response read from r,
+// decompressing it if it is gzip-encoded
+func responseBodyReader(response *http.Response, r io.Reader) (io.ReadCloser, error) {
+	if response.Header.Get("Content-Encoding") != "gzip" {
+		return ioutil.NopCloser(r), nil
+	}
+	return gzip.NewReader(r)
+}
+
+// readResponseBody reads the body of a response, decompressing it if it is
+// gzip-encoded
+func readResponseBody(response *http.Response) ([]byte, error) {
+	body, err := responseBodyReader(response, response.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
 }
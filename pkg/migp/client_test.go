@@ -5,7 +5,14 @@ package migp
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 // KVMock is a simple KV store implementation
@@ -110,3 +117,971 @@ func TestQuery(t *testing.T) {
 			password, result, NotInBreach)
 	}
 }
+
+// TestQueryContextCancelled tests that a query with a cancelled context is
+// not completed
+func TestQueryContextCancelled(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := newTestHTTPServer(t, server, &KVMock{store: make(map[string][]byte)})
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = QueryContext(ctx, DefaultConfig(), httpServer.URL, []byte("username"), []byte("password"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+}
+
+// countingTransport is an http.RoundTripper that counts the requests it sends
+type countingTransport struct {
+	count int
+}
+
+// RoundTrip sends the request with the default transport
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.count++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// TestWithHTTPClient tests that queries are sent with the configured HTTP
+// client
+func TestWithHTTPClient(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := newTestHTTPServer(t, server, &KVMock{store: make(map[string][]byte)})
+	defer httpServer.Close()
+
+	transport := new(countingTransport)
+	client, err := NewClient(DefaultConfig(), WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.QueryOne(httpServer.URL, []byte("username"), []byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	if transport.count != 1 {
+		t.Fatalf("requests sent with custom client: want %d, got %d", 1, transport.count)
+	}
+}
+
+// TestQueryRetries tests that queries are retried on 5xx responses but not on
+// 4xx responses
+func TestQueryRetries(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := newTestHTTPServer(t, server, &KVMock{store: make(map[string][]byte)})
+	defer backend.Close()
+
+	testCases := []struct {
+		failStatus   int
+		failures     int
+		maxRetries   int
+		wantRequests int
+		wantErr      bool
+	}{
+		{http.StatusServiceUnavailable, 2, 2, 3, false},
+		{http.StatusServiceUnavailable, 2, 1, 2, true},
+		{http.StatusTooManyRequests, 1, 1, 2, false},
+		{http.StatusBadRequest, 1, 3, 1, true},
+	}
+
+	for i, test := range testCases {
+		requests := 0
+		httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			requests++
+			if requests <= test.failures {
+				http.Error(w, http.StatusText(test.failStatus), test.failStatus)
+				return
+			}
+			backend.Config.Handler.ServeHTTP(w, req)
+		}))
+
+		cfg := DefaultConfig()
+		cfg.MaxRetries = test.maxRetries
+		cfg.RetryBaseDelay = time.Millisecond
+		_, err := Query(cfg, httpServer.URL, []byte("username"), []byte("password"))
+		httpServer.Close()
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("failed test %d: want error %v, got %v", i, test.wantErr, err)
+		}
+		if requests != test.wantRequests {
+			t.Errorf("failed test %d: want %d requests, got %d", i, test.wantRequests, requests)
+		}
+	}
+}
+
+func TestNextRetryDelay(t *testing.T) {
+	testCases := []struct {
+		delay, want time.Duration
+	}{
+		{time.Millisecond, 2 * time.Millisecond},
+		{DefaultRetryBaseDelay, 2 * DefaultRetryBaseDelay},
+		{MaxRetryDelay / 2, MaxRetryDelay},
+		{MaxRetryDelay - 1, MaxRetryDelay},
+		{MaxRetryDelay, MaxRetryDelay},
+	}
+	for i, test := range testCases {
+		if got := nextRetryDelay(test.delay); got != test.want {
+			t.Errorf("failed test %d: want %s, got %s", i, test.want, got)
+		}
+	}
+
+	// the delay never overflows, however many retries are made
+	delay := DefaultRetryBaseDelay
+	for i := 0; i < 100; i++ {
+		delay = nextRetryDelay(delay)
+	}
+	if delay != MaxRetryDelay {
+		t.Errorf("want %s after 100 retries, got %s", MaxRetryDelay, delay)
+	}
+}
+
+// TestVerifiableQuery tests that a client in verifiable mode accepts proofs
+// from the server it was configured with and rejects those of another server
+func TestVerifiableQuery(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	cfg.Verifiable = true
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg := server.Config().Config
+	if !clientCfg.Verifiable || len(clientCfg.PublicKey) == 0 {
+		t.Fatal("want verifiable config with public key")
+	}
+
+	kv := &KVMock{store: make(map[string][]byte)}
+	username, password := []byte("user1"), []byte("pass1")
+	entry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.store[BucketIDToHex(server.BucketID(username))] = entry
+
+	httpServer := newTestHTTPServer(t, server, kv)
+	defer httpServer.Close()
+	result, err := Query(clientCfg, httpServer.URL, username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != InBreach {
+		t.Errorf("want %s, got %s", InBreach, result.Status)
+	}
+
+	// a server with a different key fails verification
+	otherCfg := DefaultServerConfig()
+	otherCfg.SlowHasherID = SlowHasherNull
+	otherCfg.Verifiable = true
+	other, err := NewServer(otherCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherHTTPServer := newTestHTTPServer(t, other, kv)
+	defer otherHTTPServer.Close()
+	if _, err := Query(clientCfg, otherHTTPServer.URL, username, password); err == nil {
+		t.Errorf("want verification error from server with another key")
+	}
+}
+
+// TestKeyRotation tests that entries ingested before and after a key rotation
+// are both found, with the rotated configuration round-tripping through JSON
+func TestKeyRotation(t *testing.T) {
+	for _, verifiable := range []bool{false, true} {
+		cfg := DefaultServerConfig()
+		cfg.SlowHasherID = SlowHasherNull
+		cfg.Verifiable = verifiable
+		oldServer, err := NewServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kv := &KVMock{store: make(map[string][]byte)}
+		insert := func(server *Server, username, password []byte) {
+			entry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bucketID := BucketIDToHex(server.BucketID(username))
+			kv.store[bucketID] = append(kv.store[bucketID], entry...)
+		}
+		insert(oldServer, []byte("old"), []byte("password"))
+
+		if err := cfg.RotateKey(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rotatedCfg ServerConfig
+		if err := json.Unmarshal(data, &rotatedCfg); err != nil {
+			t.Fatal(err)
+		}
+		server, err := NewServer(rotatedCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		insert(server, []byte("new"), []byte("password"))
+
+		clientCfg := server.Config().Config
+		if clientCfg.KeyID != 1 || len(clientCfg.PreviousKeys) != 1 || clientCfg.PreviousKeys[0].KeyID != 0 {
+			t.Fatalf("want key ID 1 with previous key 0, got %d, %v", clientCfg.KeyID, clientCfg.PreviousKeys)
+		}
+		// public keys are published in both modes
+		oldPublicKey := oldServer.Config().PublicKey
+		if len(oldPublicKey) == 0 || !bytes.Equal(clientCfg.PreviousKeys[0].PublicKey, oldPublicKey) || bytes.Equal(clientCfg.PublicKey, oldPublicKey) {
+			t.Errorf("verifiable %v: want the previous public key %x and a new one, got %x and %x", verifiable, oldPublicKey, clientCfg.PreviousKeys[0].PublicKey, clientCfg.PublicKey)
+		}
+
+		httpServer := newTestHTTPServer(t, server, kv)
+		defer httpServer.Close()
+		testCases := []struct {
+			username []byte
+			status   BreachStatus
+		}{
+			{[]byte("old"), InBreach},
+			{[]byte("new"), InBreach},
+			{[]byte("other"), NotInBreach},
+		}
+		for i, test := range testCases {
+			result, err := Query(clientCfg, httpServer.URL, test.username, []byte("password"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != test.status {
+				t.Errorf("failed test %d (verifiable %v): want %s, got %s", i, verifiable, test.status, result.Status)
+			}
+		}
+	}
+}
+
+// countingSlowHasher counts the slow hashes computed
+type countingSlowHasher struct {
+	SlowHasher
+	hashes int
+}
+
+func (h *countingSlowHasher) Hash(input []byte) []byte {
+	h.hashes++
+	return h.SlowHasher.Hash(input)
+}
+
+// TestKeyRotationMerge tests that an exact match under a previous key epoch is
+// preferred to a variant match under the current one, with the credentials
+// slow hashed once for both epochs
+func TestKeyRotationMerge(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	username, password := []byte("user"), []byte("password")
+	kv := &KVMock{store: make(map[string][]byte)}
+	insert := func(server *Server, flag MetadataType, metadata string) {
+		entry, err := server.EncryptBucketEntry(username, password, flag, []byte(metadata))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucketID := BucketIDToHex(server.BucketID(username))
+		kv.store[bucketID] = append(kv.store[bucketID], entry...)
+	}
+	oldServer, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(oldServer, MetadataBreachedPassword, "old")
+	if err := cfg.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(server, MetadataSimilarPassword, "new")
+	httpServer := newTestHTTPServer(t, server, kv)
+	defer httpServer.Close()
+
+	client, err := NewClient(server.Config().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher := &countingSlowHasher{SlowHasher: client.slowHasher}
+	client.slowHasher = hasher
+	result, err := client.QueryOne(httpServer.URL, username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := client.QueryLocal(server, kv, username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []QueryResult{result, local} {
+		if got.Status != InBreach || string(got.Metadata) != "old" {
+			t.Errorf("want (%s, %q), got (%s, %q)", InBreach, "old", got.Status, got.Metadata)
+		}
+	}
+	if hasher.hashes != 2 {
+		t.Errorf("want 1 slow hash per query, got %d for 2 queries", hasher.hashes)
+	}
+}
+
+// TestTaggedQuery tests that entries ingested under a tag are only found by
+// queries with the same tag
+func TestTaggedQuery(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	kv := &KVMock{store: make(map[string][]byte)}
+	username, password := []byte("user1"), []byte("pass1")
+	for _, tag := range []string{"", "breachA"} {
+		cfg.Tag = tag
+		server, err := NewServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, []byte(tag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucketID := BucketIDToHex(server.BucketID(username))
+		kv.store[bucketID] = append(kv.store[bucketID], entry...)
+	}
+
+	cfg.Tag = ""
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := newTestHTTPServer(t, server, kv)
+	defer httpServer.Close()
+
+	testCases := []struct {
+		tag      string
+		status   BreachStatus
+		metadata []byte
+	}{
+		{"", InBreach, []byte("")},
+		{"breachA", InBreach, []byte("breachA")},
+		{"breachB", NotInBreach, nil},
+	}
+	for i, test := range testCases {
+		clientCfg := server.Config().Config
+		clientCfg.Tag = test.tag
+		result, err := Query(clientCfg, httpServer.URL, username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != test.status || !bytes.Equal(result.Metadata, test.metadata) {
+			t.Errorf("failed test %d: want (%s, %q), got (%s, %q)", i, test.status, test.metadata, result.Status, result.Metadata)
+		}
+	}
+}
+
+// TestOPRFInfo tests that entries ingested under a domain separation string
+// are only found by clients configured with the same one
+func TestOPRFInfo(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	cfg.OPRFInfo = "deployment A"
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := server.Config().OPRFInfo; got != cfg.OPRFInfo {
+		t.Fatalf("config: want %q, got %q", cfg.OPRFInfo, got)
+	}
+	kv := &KVMock{store: make(map[string][]byte)}
+	username, password := []byte("user1"), []byte("pass1")
+	entry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.store[BucketIDToHex(server.BucketID(username))] = entry
+	httpServer := newTestHTTPServer(t, server, kv)
+	defer httpServer.Close()
+
+	testCases := []struct {
+		oprfInfo string
+		status   BreachStatus
+	}{
+		{"deployment A", InBreach},
+		{"", NotInBreach},
+		{"deployment B", NotInBreach},
+	}
+	for i, test := range testCases {
+		clientCfg := server.Config().Config
+		clientCfg.OPRFInfo = test.oprfInfo
+		result, err := Query(clientCfg, httpServer.URL, username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != test.status {
+			t.Errorf("failed test %d: want %s, got %s", i, test.status, result.Status)
+		}
+	}
+}
+
+// TestFinalizePrefersExactMatch tests that an exact entry is reported even if
+// an entry for the same pair as a password variant comes first in the bucket
+func TestFinalizePrefersExactMatch(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, password := []byte("user1"), []byte("pass1")
+	similar, err := server.EncryptBucketEntry(username, password, MetadataSimilarPassword, []byte("variant"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exact, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, []byte("exact"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		bucket   []byte
+		status   BreachStatus
+		metadata []byte
+	}{
+		{similar, InBreachSimilar, []byte("variant")},
+		{append(append([]byte(nil), similar...), exact...), InBreachExact, []byte("exact")},
+		{append(append([]byte(nil), exact...), similar...), InBreachExact, []byte("exact")},
+	}
+	for i, test := range testCases {
+		kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(username)): test.bucket}}
+		httpServer := newTestHTTPServer(t, server, kv)
+		result, err := Query(server.Config().Config, httpServer.URL, username, password)
+		httpServer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != test.status || !bytes.Equal(result.Metadata, test.metadata) {
+			t.Errorf("failed test %d: want (%s, %q), got (%s, %q)", i, test.status, test.metadata, result.Status, result.Metadata)
+		}
+	}
+}
+
+// TestZeroize tests that a request context can still be finalized, for each
+// of its buckets, until its OPRF input is zeroed, and that the input of the
+// null slow hasher does not alias the serialized credentials
+func TestZeroize(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(server.Config().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, password := []byte("user1"), []byte("pass1")
+	entry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(username)): entry}}
+
+	request, requestContext, err := client.Request(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := serializeUsernamePassword(username, password)
+	if !bytes.Equal(requestContext.input, want) {
+		t.Fatalf("want OPRF input %x, got %x", want, requestContext.input)
+	}
+	response, err := server.HandleRequest(request, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		status, metadata, err := requestContext.Finalize(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != InBreachExact || string(metadata) != "metadata" {
+			t.Errorf("finalize %d: want (%s, %q), got (%s, %q)", i, InBreachExact, "metadata", status, metadata)
+		}
+	}
+
+	requestContext.Zeroize()
+	if !bytes.Equal(requestContext.input, make([]byte, len(want))) {
+		t.Errorf("want zeroed OPRF input, got %x", requestContext.input)
+	}
+}
+
+// TestNormalizeUsernames tests that differently cased forms of an email
+// address are found if the configuration normalizes usernames
+func TestNormalizeUsernames(t *testing.T) {
+	testCases := []struct {
+		normalize bool
+		username  string
+		status    BreachStatus
+	}{
+		{true, "User@Example.com", InBreach},
+		{true, "user@example.com", InBreach},
+		{true, "USER@EXAMPLE.COM", InBreach},
+		{false, "User@Example.com", InBreach},
+		{false, "user@example.com", NotInBreach},
+	}
+
+	for i, test := range testCases {
+		cfg := DefaultServerConfig()
+		cfg.SlowHasherID = SlowHasherNull
+		cfg.NormalizeUsernames = test.normalize
+		server, err := NewServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ingested := []byte("User@Example.com")
+		entry, err := server.EncryptBucketEntry(ingested, []byte("password"), MetadataBreachedPassword, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(ingested)): entry}}
+
+		client, err := NewClient(server.Config().Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := client.QueryLocal(server, kv, []byte(test.username), []byte("password"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != test.status {
+			t.Errorf("failed test %d: want %s, got %s", i, test.status, result.Status)
+		}
+	}
+}
+
+// TestQuerySHA1Password tests that passwords ingested from their SHA-1 hashes
+// are found by queries for the password alone, and not by credential pairs
+func TestQuerySHA1Password(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha1.Sum([]byte("password"))
+	entry, err := server.EncryptSHA1PasswordEntry(digest[:], MetadataBreachedPassword, []byte("42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.SHA1PasswordBucketID(digest[:])): entry}}
+	httpServer := newTestHTTPServer(t, server, kv)
+	defer httpServer.Close()
+
+	client, err := NewClient(server.Config().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		password []byte
+		status   BreachStatus
+		metadata []byte
+	}{
+		{[]byte("password"), InBreach, []byte("42")},
+		{[]byte("Password"), NotInBreach, nil},
+	}
+	for i, test := range testCases {
+		result, err := client.QuerySHA1Password(context.Background(), httpServer.URL, test.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != test.status || !bytes.Equal(result.Metadata, test.metadata) {
+			t.Errorf("failed test %d: want (%s, %q), got (%s, %q)", i, test.status, test.metadata, result.Status, result.Metadata)
+		}
+	}
+
+	result, err := client.QueryOne(httpServer.URL, nil, []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != NotInBreach {
+		t.Errorf("credential pair query: want %s, got %s", NotInBreach, result.Status)
+	}
+
+	if _, err := server.EncryptSHA1PasswordEntry(digest[:10], MetadataBreachedPassword, nil); err == nil {
+		t.Error("want error for truncated SHA-1 hash")
+	}
+}
+
+// TestQueryPassword tests that password-only entries are found by password
+// alone, and not by queries for credential pairs with that password
+func TestQueryPassword(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: map[string][]byte{}}
+	for _, password := range []string{"password", "123456"} {
+		entry, err := server.EncryptPasswordEntry([]byte(password), MetadataBreachedPassword, []byte(password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucketID := BucketIDToHex(server.PasswordBucketID([]byte(password)))
+		kv.store[bucketID] = append(kv.store[bucketID], entry...)
+	}
+	httpServer := newTestHTTPServer(t, server, kv)
+	defer httpServer.Close()
+
+	client, err := NewClient(server.Config().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		password []byte
+		status   BreachStatus
+		metadata []byte
+	}{
+		{[]byte("password"), InBreach, []byte("password")},
+		{[]byte("123456"), InBreach, []byte("123456")},
+		{[]byte("Password"), NotInBreach, nil},
+	}
+	for i, test := range testCases {
+		result, err := client.QueryPassword(context.Background(), httpServer.URL, test.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != test.status || !bytes.Equal(result.Metadata, test.metadata) {
+			t.Errorf("failed test %d: want (%s, %q), got (%s, %q)", i, test.status, test.metadata, result.Status, result.Metadata)
+		}
+	}
+
+	result, err := client.QueryOne(httpServer.URL, []byte("user"), []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != NotInBreach {
+		t.Errorf("credential pair query: want %s, got %s", NotInBreach, result.Status)
+	}
+}
+
+// TestOverflowBuckets tests that queries fetch the overflow buckets of a full
+// bucket while the credentials are not found
+func TestOverflowBuckets(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	cfg.MaxBucketEntries = 2
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := []byte("user")
+	bucketIDHex := BucketIDToHex(server.BucketID(username))
+	kv := &KVMock{store: map[string][]byte{}}
+	for i, entry := range []struct {
+		password string
+		flag     MetadataType
+	}{
+		{"pass1", MetadataBreachedPassword},
+		{"pass2", MetadataSimilarPassword},
+		{"pass3", MetadataBreachedPassword},
+		{"pass2", MetadataBreachedPassword},
+	} {
+		encrypted, err := server.EncryptBucketEntry(username, []byte(entry.password), entry.flag, []byte(entry.password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := OverflowBucketID(bucketIDHex, i/cfg.MaxBucketEntries)
+		kv.store[id] = append(kv.store[id], encrypted...)
+	}
+	httpServer := newTestHTTPServer(t, server, kv)
+	defer httpServer.Close()
+	batchServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var request BatchClientRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, err := server.HandleBatchRequest(request, kv)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer batchServer.Close()
+
+	client, err := NewClient(cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwords := [][]byte{[]byte("pass1"), []byte("pass2"), []byte("pass3"), []byte("pass4")}
+	want := []BreachStatus{InBreach, InBreach, InBreach, NotInBreach}
+	batch, err := client.QueryBatch(context.Background(), batchServer.URL, [][]byte{username, username, username, username}, passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, password := range passwords {
+		result, err := client.QueryOne(httpServer.URL, username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local, err := client.QueryLocal(server, kv, username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, got := range []QueryResult{result, local, batch[i]} {
+			if got.Err != nil || got.Status != want[i] {
+				t.Errorf("failed test %d: want %s, got (%s, %v)", i, want[i], got.Status, got.Err)
+			}
+			if want[i] == InBreach && !bytes.Equal(got.Metadata, password) {
+				t.Errorf("failed test %d: want metadata %q, got %q", i, password, got.Metadata)
+			}
+		}
+	}
+
+	// clients unaware of the cap only fetch the bucket
+	cfg.MaxBucketEntries = 0
+	unbounded, err := NewClient(cfg.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := unbounded.QueryOne(httpServer.URL, username, []byte("pass3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != NotInBreach {
+		t.Errorf("unbounded client: want %s, got %s", NotInBreach, result.Status)
+	}
+}
+
+// TestOverflowBucketsPadding tests that the dummy entries of padded buckets
+// are not counted towards the cap, so that buckets below it are not mistaken
+// for full ones and their overflow buckets are only fetched when they exist
+func TestOverflowBucketsPadding(t *testing.T) {
+	testCases := []struct {
+		padding, maxEntries, entries int
+		loads                        int
+	}{
+		{0, 1, 0, 1},
+		{64, 1, 0, 1},
+		{64, 1, 1, 2},
+		{64, 1, 2, 3},
+		{256, 2, 1, 1},
+		{256, 2, 2, 2},
+	}
+	for i, test := range testCases {
+		cfg := DefaultServerConfig()
+		cfg.SlowHasherID = SlowHasherNull
+		cfg.MaxBucketEntries = test.maxEntries
+		cfg.BucketPadding = test.padding
+		server, err := NewServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		username := []byte("user")
+		bucketIDHex := BucketIDToHex(server.BucketID(username))
+		kv := &countingGetter{KVMock: KVMock{store: map[string][]byte{}}, loads: make(map[string]int)}
+		for j := 0; j < test.entries; j++ {
+			entry, err := server.EncryptBucketEntry(username, []byte{byte('a' + j)}, MetadataBreachedPassword, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id := OverflowBucketID(bucketIDHex, j/test.maxEntries)
+			kv.store[id] = append(kv.store[id], entry...)
+		}
+		httpServer := newTestHTTPServer(t, server, kv)
+		client, err := NewClient(server.Config().Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := client.QueryOne(httpServer.URL, username, []byte("missing"))
+		httpServer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loads := 0
+		for _, n := range kv.loads {
+			loads += n
+		}
+		if result.Status != NotInBreach || loads != test.loads {
+			t.Errorf("failed test %d: want (%s, %d loads), got (%s, %d loads)", i, NotInBreach, test.loads, result.Status, loads)
+		}
+	}
+}
+
+// TestFinalizeReader tests that decoding a streamed response gives the same
+// result as decoding a buffered one
+func TestFinalizeReader(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(server.Config().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, password := []byte("user1"), []byte("pass1")
+	var bucket []byte
+	for _, entry := range []struct {
+		password []byte
+		flag     MetadataType
+		metadata string
+	}{
+		{[]byte("other"), MetadataBreachedPassword, "other"},
+		{password, MetadataSimilarPassword, "variant"},
+		{password, MetadataBreachedPassword, "exact"},
+	} {
+		ciphertext, err := server.EncryptBucketEntry(username, entry.password, entry.flag, []byte(entry.metadata))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket = append(bucket, ciphertext...)
+	}
+
+	testCases := []struct {
+		bucket   []byte
+		status   BreachStatus
+		metadata []byte
+		valid    bool
+	}{
+		{nil, NotInBreach, nil, true},
+		{bucket, InBreachExact, []byte("exact"), true},
+		{bucket[:len(bucket)-1], NotInBreach, nil, false},
+		{bucket[:len(bucket)-HeaderSize], InBreachSimilar, []byte("variant"), true},
+	}
+	for i, test := range testCases {
+		kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(username)): test.bucket}}
+		request, requestContext, err := client.Request(username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := server.HandleRequest(request, kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := response.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantStatus, wantMetadata, wantErr := requestContext.Finalize(response)
+		status, metadata, err := requestContext.FinalizeReader(bytes.NewReader(data))
+		if status != wantStatus || !bytes.Equal(metadata, wantMetadata) || (err == nil) != (wantErr == nil) {
+			t.Errorf("failed test %d: streamed (%s, %q, %v) differs from buffered (%s, %q, %v)", i, status, metadata, err, wantStatus, wantMetadata, wantErr)
+		}
+		if status != test.status || !bytes.Equal(metadata, test.metadata) || (err == nil) != test.valid {
+			t.Errorf("failed test %d: want (%s, %q, valid %v), got (%s, %q, %v)", i, test.status, test.metadata, test.valid, status, metadata, err)
+		}
+	}
+}
+
+// TestClientRequestSerialization tests the binary serialization of a MIGP
+// client request
+func TestClientRequestSerialization(t *testing.T) {
+	r1 := ClientRequest{
+		Version:      1,
+		KeyID:        2,
+		BucketID:     "000abcde",
+		BlindElement: []byte{1, 2, 3, 4},
+		Tag:          "breachA",
+	}
+	data, err := r1.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r2 ClientRequest
+	if err := r2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if r1.Version != r2.Version || r1.KeyID != r2.KeyID || r1.BucketID != r2.BucketID || !bytes.Equal(r1.BlindElement, r2.BlindElement) || r1.Tag != r2.Tag {
+		t.Fatalf("want %v, got %v", r1, r2)
+	}
+
+	for _, suffix := range [][]byte{nil, {0}, {2}, {1, 1}} {
+		invalid := append(append([]byte(nil), data...), suffix...)
+		if suffix == nil {
+			invalid = data[:len(data)-1]
+		}
+		if err := new(ClientRequest).UnmarshalBinary(invalid); err == nil {
+			t.Errorf("want error for %d-byte request", len(invalid))
+		}
+	}
+
+	r1.OmitBucket = true
+	flagged, err := r1.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flagged) != len(data)+1 {
+		t.Errorf("length: want %d, got %d", len(data)+1, len(flagged))
+	}
+	var r3 ClientRequest
+	if err := r3.UnmarshalBinary(flagged); err != nil {
+		t.Fatal(err)
+	}
+	if !r3.OmitBucket || r3.BucketID != r1.BucketID {
+		t.Errorf("want %v, got %v", r1, r3)
+	}
+}
+
+// TestBucketCache tests that queries for a bucket in the client's bucket cache
+// are answered without the server loading it again
+func TestBucketCache(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := []byte("user1")
+	entry, err := server.EncryptBucketEntry(username, []byte("pass1"), MetadataBreachedPassword, []byte("breach"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketIDHex := BucketIDToHex(server.BucketID(username))
+	kv := &countingGetter{KVMock: KVMock{store: map[string][]byte{bucketIDHex: entry}}, loads: make(map[string]int)}
+	httpServer := newTestHTTPServer(t, server, kv)
+	defer httpServer.Close()
+
+	for _, advertised := range []bool{false, true} {
+		kv.loads = make(map[string]int)
+		clientCfg := server.Config().Config
+		clientCfg.OmitBucketRequests = advertised
+		client, err := NewClient(clientCfg, WithBucketCache(NewMemoryBucketCache(1<<20)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCases := []struct {
+			password string
+			status   BreachStatus
+			metadata []byte
+		}{
+			{"pass2", NotInBreach, nil},
+			{"pass1", InBreach, []byte("breach")},
+			{"pass3", NotInBreach, nil},
+			{"pass1", InBreach, []byte("breach")},
+		}
+		for i, test := range testCases {
+			result, err := client.QueryOne(httpServer.URL, username, []byte(test.password))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != test.status || !bytes.Equal(result.Metadata, test.metadata) {
+				t.Errorf("failed test %d (advertised %t): want (%s, %q), got (%s, %q)", i, advertised, test.status, test.metadata, result.Status, result.Metadata)
+			}
+		}
+		// the cache is only used with servers advertising it
+		want := len(testCases)
+		if advertised {
+			want = 1
+		}
+		if kv.loads[bucketIDHex] != want {
+			t.Errorf("loads (advertised %t): want %d, got %d", advertised, want, kv.loads[bucketIDHex])
+		}
+	}
+}
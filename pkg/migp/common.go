@@ -4,10 +4,15 @@
 package migp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
 
 	"github.com/cloudflare/circl/oprf"
+	"golang.org/x/text/unicode/norm"
 )
 
 const (
@@ -34,6 +39,21 @@ const (
 	// consists of the key check bytes, 1-byte flag, and 4-byte body
 	// length.
 	HeaderSize = CtxtKeyCheckSize + 5
+
+	// BinaryContentType is the media type of requests and responses in the
+	// binary format
+	BinaryContentType = "application/octet-stream"
+
+	// DefaultRetryBaseDelay is the delay before a client's first retry when
+	// Config.RetryBaseDelay is not set.
+	DefaultRetryBaseDelay = 100 * time.Millisecond
+
+	// MaxRetryDelay caps the delay between a client's retries, which is
+	// otherwise doubled on each retry.
+	MaxRetryDelay = 30 * time.Second
+
+	// MaxRetryLimit is the largest Config.MaxRetries accepted by Validate.
+	MaxRetryLimit = 10
 )
 
 var (
@@ -48,6 +68,71 @@ type Config struct {
 	SlowHasherID      uint16       `json:"slowHasher"`
 	BucketEncryptorID uint16       `json:"bucketEncryptor"`
 	OPRFSuite         oprf.SuiteID `json:"oprfSuite"`
+
+	// Argon2 holds the parameters of the argon2id slow hasher. If nil,
+	// DefaultArgon2Params is used.
+	Argon2 *Argon2Params `json:"argon2,omitempty"`
+
+	// Verifiable selects the verifiable OPRF (VOPRF) mode, in which the
+	// server proves each evaluation against its PublicKey.
+	Verifiable bool `json:"verifiable,omitempty"`
+	// PublicKey is the serialized OPRF public key of the server, used by
+	// clients to verify evaluations in verifiable mode. Servers publish it
+	// in either mode, so that clients can pin it and notice key changes.
+	PublicKey []byte `json:"publicKey,omitempty"`
+
+	// KeyID is the current key epoch of the server, used by clients in
+	// their requests. PreviousKeys lists the earlier epochs the server
+	// still answers queries for, most recent last.
+	KeyID        uint32     `json:"keyID,omitempty"`
+	PreviousKeys []KeyEpoch `json:"previousKeys,omitempty"`
+
+	// Tag is public input to the OPRF, so that entries ingested under one
+	// tag are only found by queries with the same tag. It can be used to
+	// keep separate breach namespaces under a single key.
+	Tag string `json:"tag,omitempty"`
+
+	// OPRFInfo is the domain separation string passed to the OPRF as public
+	// input, so that the outputs of one deployment cannot be used against
+	// another sharing its key. Defaults to OprfInfo.
+	OPRFInfo string `json:"oprfInfo,omitempty"`
+
+	// BinaryRequests reports that the server accepts requests in the
+	// binary format of ClientRequest.MarshalBinary, which clients then use
+	// instead of JSON.
+	BinaryRequests bool `json:"binaryRequests,omitempty"`
+
+	// OmitBucketRequests reports that the server leaves the bucket out of
+	// its responses to requests with ClientRequest.OmitBucket set, which
+	// clients caching buckets then send for buckets they already hold.
+	OmitBucketRequests bool `json:"omitBucketRequests,omitempty"`
+
+	// NormalizeUsernames applies NormalizeUsername to usernames before they
+	// are hashed, on both ingestion and queries, so that differently cased
+	// forms of an email address are found in the same bucket.
+	NormalizeUsernames bool `json:"normalizeUsernames,omitempty"`
+
+	// MaxBucketEntries caps the number of entries in a bucket. Entries past
+	// the cap go to the overflow buckets of the bucket, see OverflowBucketID,
+	// which clients fetch in turn while the credentials are not found and
+	// the bucket fetched last is full. Zero leaves buckets unbounded.
+	MaxBucketEntries int `json:"maxBucketEntries,omitempty"`
+
+	// MaxRetries is the number of times a client retries a query that
+	// failed with a network error, a 429, or a 5xx status code, at most
+	// MaxRetryLimit.
+	MaxRetries int `json:"maxRetries,omitempty"`
+	// RetryBaseDelay is the delay before the first retry, doubled on each
+	// subsequent retry up to MaxRetryDelay. Defaults to
+	// DefaultRetryBaseDelay.
+	RetryBaseDelay time.Duration `json:"retryBaseDelay,omitempty"`
+}
+
+// KeyEpoch describes a key epoch of the server, with its serialized OPRF public
+// key.
+type KeyEpoch struct {
+	KeyID     uint32 `json:"keyID"`
+	PublicKey []byte `json:"publicKey,omitempty"`
 }
 
 // DefaultConfig returns a new default configuration
@@ -62,6 +147,99 @@ func DefaultConfig() Config {
 	}
 }
 
+// Validate checks that the configuration only selects supported algorithms
+// and parameters in range, returning an error naming the offending field
+// otherwise.
+func (c Config) Validate() error {
+	if c.BucketIDBitSize < 1 || c.BucketIDBitSize > 32 {
+		return fmt.Errorf("bucketIDBitSize: %d is not between 1 and 32", c.BucketIDBitSize)
+	}
+	if _, err := NewBucketHasher(c.BucketHasherID); err != nil {
+		return fmt.Errorf("bucketHasher: %w %d", err, c.BucketHasherID)
+	}
+	if _, err := NewSlowHasherFromConfig(c); err != nil {
+		if c.SlowHasherID == SlowHasherArgon2id {
+			return fmt.Errorf("argon2: %w", err)
+		}
+		return fmt.Errorf("slowHasher: %w %d", err, c.SlowHasherID)
+	}
+	if _, err := NewBucketEncryptor(c.BucketEncryptorID); err != nil {
+		return fmt.Errorf("bucketEncryptor: %w %d", err, c.BucketEncryptorID)
+	}
+	if _, err := LookupSuite(c.OPRFSuite); err != nil {
+		return fmt.Errorf("oprfSuite: %w", err)
+	}
+	if c.MaxBucketEntries < 0 {
+		return fmt.Errorf("maxBucketEntries: %d is negative", c.MaxBucketEntries)
+	}
+	if c.MaxRetries < 0 || c.MaxRetries > MaxRetryLimit {
+		return fmt.Errorf("maxRetries: %d is out of range [0, %d]", c.MaxRetries, MaxRetryLimit)
+	}
+	if c.RetryBaseDelay < 0 || c.RetryBaseDelay > MaxRetryDelay {
+		return fmt.Errorf("retryBaseDelay: %s is out of range [0, %s]", c.RetryBaseDelay, MaxRetryDelay)
+	}
+	return nil
+}
+
+// SuggestBucketIDBitSize returns the bucket ID bit size at which a store of
+// the given number of bucket entries has an average bucket occupancy closest
+// to targetOccupancy entries, within the range accepted by Validate. Smaller
+// buckets hide queries among fewer entries, larger ones cost more bandwidth.
+func SuggestBucketIDBitSize(entries int64, targetOccupancy float64) (int, error) {
+	if entries < 1 {
+		return 0, fmt.Errorf("entries: %d is not positive", entries)
+	}
+	if !(targetOccupancy > 0) {
+		return 0, fmt.Errorf("target occupancy: %g is not positive", targetOccupancy)
+	}
+	// the closest occupancy on a log scale, as each bit halves it
+	bits := int(math.Round(math.Log2(float64(entries) / targetOccupancy)))
+	if bits < 1 {
+		bits = 1
+	} else if bits > 32 {
+		bits = 32
+	}
+	return bits, nil
+}
+
+// Mismatches compares the configuration with that of the server it is used to
+// query, returning a description of each setting that differs in how bucket
+// IDs are derived, credentials hashed, or buckets encrypted, in the OPRF domain
+// separation string, or in the public key of the same key epoch. Queries with
+// a mismatched configuration never find the server's entries.
+func (c Config) Mismatches(server Config) []string {
+	var mismatches []string
+	compare := func(field string, value, serverValue interface{}) {
+		if value != serverValue {
+			mismatches = append(mismatches, fmt.Sprintf("%s: %v, server has %v", field, value, serverValue))
+		}
+	}
+	compare("bucketIDBitSize", c.BucketIDBitSize, server.BucketIDBitSize)
+	compare("bucketHasher", c.BucketHasherID, server.BucketHasherID)
+	compare("slowHasher", c.SlowHasherID, server.SlowHasherID)
+	compare("bucketEncryptor", c.BucketEncryptorID, server.BucketEncryptorID)
+	compare("oprfSuite", c.OPRFSuite, server.OPRFSuite)
+	compare("verifiable", c.Verifiable, server.Verifiable)
+	compare("normalizeUsernames", c.NormalizeUsernames, server.NormalizeUsernames)
+	compare("maxBucketEntries", c.MaxBucketEntries, server.MaxBucketEntries)
+	compare("oprfInfo", string(oprfInfo(c.OPRFInfo, "")), string(oprfInfo(server.OPRFInfo, "")))
+	// the keys of different epochs differ, as after a key rotation
+	if c.KeyID == server.KeyID && len(c.PublicKey) > 0 && len(server.PublicKey) > 0 && !bytes.Equal(c.PublicKey, server.PublicKey) {
+		mismatches = append(mismatches, fmt.Sprintf("publicKey: %x, server has %x", c.PublicKey, server.PublicKey))
+	}
+	if c.SlowHasherID == SlowHasherArgon2id && server.SlowHasherID == SlowHasherArgon2id {
+		params, serverParams := DefaultArgon2Params(), DefaultArgon2Params()
+		if c.Argon2 != nil {
+			params = *c.Argon2
+		}
+		if server.Argon2 != nil {
+			serverParams = *server.Argon2
+		}
+		compare("argon2", params, serverParams)
+	}
+	return mismatches
+}
+
 // Flag represents the type of metadata for a breach item.
 type MetadataType uint8
 
@@ -133,6 +311,14 @@ const (
 	UsernameInBreach
 )
 
+const (
+	// InBreachExact is InBreach, for an exact match of the credential pair
+	InBreachExact = InBreach
+	// InBreachSimilar is SimilarInBreach, for a match of a variant of the
+	// password
+	InBreachSimilar = SimilarInBreach
+)
+
 // String returns a string representation of a breach status
 func (bs BreachStatus) String() string {
 	switch bs {
@@ -149,12 +335,77 @@ func (bs BreachStatus) String() string {
 	}
 }
 
+// oprfInfo returns the OPRF public input for the given domain separation
+// string and tag. The empty domain maps to OprfInfo and the empty tag adds
+// nothing, so untagged entries of the default domain are unchanged.
+func oprfInfo(domain, tag string) []byte {
+	base := OprfInfo
+	if domain != "" {
+		base = []byte(domain)
+	}
+	if tag == "" {
+		return base
+	}
+	info := make([]byte, 0, len(base)+1+len(tag))
+	info = append(info, base...)
+	info = append(info, 0)
+	return append(info, tag...)
+}
+
+// Match returns a short, stable name for the kind of match a breach status
+// reports: "exact", "similar", "username", or "none"
+func (bs BreachStatus) Match() string {
+	switch bs {
+	case InBreachExact:
+		return "exact"
+	case InBreachSimilar:
+		return "similar"
+	case UsernameInBreach:
+		return "username"
+	default:
+		return "none"
+	}
+}
+
+// sha1PasswordInputPrefix separates the OPRF inputs of entries for SHA-1
+// password hashes from those of credential pairs
+var sha1PasswordInputPrefix = []byte("MIGP SHA1 password")
+
+// sha1PasswordInput returns the OPRF input of the entry for the password with
+// the given SHA-1 hash. Unlike credential pairs, the input is not slow hashed,
+// as datasets of password hashes such as HIBP only provide the SHA-1 hash.
+func sha1PasswordInput(digest []byte) []byte {
+	return append(sha1PasswordInputPrefix[:len(sha1PasswordInputPrefix):len(sha1PasswordInputPrefix)], digest...)
+}
+
+// passwordBucketInputPrefix separates the bucket hash inputs of password-only
+// entries from usernames, so that they are spread over buckets by password
+var passwordBucketInputPrefix = []byte("MIGP password")
+
+// passwordBucketInput returns the input to the bucket hash of the
+// password-only entry for password
+func passwordBucketInput(password []byte) []byte {
+	return append(passwordBucketInputPrefix[:len(passwordBucketInputPrefix):len(passwordBucketInputPrefix)], password...)
+}
+
+// NormalizeUsername returns the Unicode NFC normalization of the username,
+// lowercased if it looks like an email address
+func NormalizeUsername(username []byte) []byte {
+	username = norm.NFC.Bytes(username)
+	if bytes.IndexByte(username, '@') >= 0 {
+		username = bytes.ToLower(username)
+	}
+	return username
+}
+
 // serializeUsernamePassword generates a byte string consisting of username and
 // password.  We use a simple prefix-free length-based encoding of the username
 // and password, where lengths are encoded as 16-bit big-endian unsigned
-// integers.  Note that metadata is not included in this serialization.
+// integers.  Note that metadata is not included in this serialization. An
+// empty password serializes username-only entries, and an empty username
+// password-only entries.
 func serializeUsernamePassword(username, password []byte) []byte {
-	if len(username) > (1<<16) || len(password) > (1<<16) {
+	if checkCredentialLength(username, password) != nil {
 		panic("Length overflow")
 	}
 	buf := make([]byte, 4+len(username)+len(password))
@@ -165,6 +416,40 @@ func serializeUsernamePassword(username, password []byte) []byte {
 	return buf
 }
 
+// MaxCredentialLength is the maximum length in bytes of a username or
+// password, whose length is serialized in 16 bits
+const MaxCredentialLength = math.MaxUint16
+
+// ErrCredentialTooLong is returned for credentials with a username or
+// password longer than MaxCredentialLength
+var ErrCredentialTooLong = fmt.Errorf("username or password longer than %d bytes", MaxCredentialLength)
+
+// checkCredentialLength returns ErrCredentialTooLong if the credential pair
+// cannot be serialized
+func checkCredentialLength(username, password []byte) error {
+	if len(username) > MaxCredentialLength || len(password) > MaxCredentialLength {
+		return ErrCredentialTooLong
+	}
+	return nil
+}
+
+// hashCredentials returns the slow hash of the serialized credential pair,
+// zeroing the serialization, which holds the password
+func hashCredentials(h SlowHasher, username, password []byte) []byte {
+	buf := serializeUsernamePassword(username, password)
+	defer zeroize(buf)
+	return h.Hash(buf)
+}
+
+// zeroize overwrites b with zeros, so that secrets derived from credentials do
+// not linger in memory once used. It is best effort: copies made elsewhere,
+// e.g., by the garbage collector moving stacks, are not reached.
+func zeroize(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 // bucketHashToID returns a uint32 bucket ID given a bucket hash and the bucket
 // ID bit size
 func bucketHashToID(bucketHash []byte, bitSize int) uint32 {
@@ -182,3 +467,19 @@ func BucketIDToHex(bucketID uint32) string {
 	binary.BigEndian.PutUint32(b[0:], bucketID)
 	return hex.EncodeToString(b)
 }
+
+// MaxOverflowBuckets is the number of overflow buckets a bucket can have
+const MaxOverflowBuckets = 255
+
+// OverflowBucketID returns the ID of the n-th overflow bucket of the bucket
+// with the given hex ID, holding the entries that did not fit in the bucket and
+// its previous overflow buckets. The overflow buckets are named after the
+// bucket ID followed by n as two hex digits, and so are never confused with
+// bucket IDs. The 0-th overflow bucket is the bucket itself, and n must not
+// exceed MaxOverflowBuckets.
+func OverflowBucketID(bucketIDHex string, n int) string {
+	if n == 0 {
+		return bucketIDHex
+	}
+	return fmt.Sprintf("%s%02x", bucketIDHex, n)
+}
@@ -2,6 +2,7 @@ package migp
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -22,6 +23,25 @@ func TestSerializeUsernamePassword(t *testing.T) {
 	}
 }
 
+// TestCheckCredentialLength tests that credentials whose length does not fit
+// in the 16-bit length prefix are rejected
+func TestCheckCredentialLength(t *testing.T) {
+	tests := []struct {
+		username, password int
+		valid              bool
+	}{
+		{MaxCredentialLength, MaxCredentialLength, true},
+		{MaxCredentialLength + 1, 0, false},
+		{0, MaxCredentialLength + 1, false},
+	}
+	for i, test := range tests {
+		err := checkCredentialLength(make([]byte, test.username), make([]byte, test.password))
+		if (err == nil) != test.valid {
+			t.Errorf("failed test %d: want valid %t, got %v", i, test.valid, err)
+		}
+	}
+}
+
 func TestBucketHashToID(t *testing.T) {
 	tests := []struct {
 		hash    []byte
@@ -57,3 +77,163 @@ func TestBucketIDToHex(t *testing.T) {
 		}
 	}
 }
+
+func TestBreachStatusMatch(t *testing.T) {
+	tests := []struct {
+		flag MetadataType
+		out  string
+	}{
+		{MetadataBreachedPassword, "exact"},
+		{MetadataSimilarPassword, "similar"},
+		{MetadataBreachedUsername, "username"},
+		{MetadataDummy, "none"},
+	}
+	for i, test := range tests {
+		if result := test.flag.ToBreachStatus().Match(); result != test.out {
+			t.Errorf("failed test %d: want %v, got %v", i, test.out, result)
+		}
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"", ""},
+		{"User@Example.COM", "user@example.com"},
+		{"UserName", "UserName"},
+		{"José@x.com", "josé@x.com"},
+		{"José", "José"},
+	}
+	for i, test := range tests {
+		if out := NormalizeUsername([]byte(test.in)); !bytes.Equal(out, []byte(test.out)) {
+			t.Errorf("failed test %d: want %q, got %q", i, test.out, out)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		modify func(*Config)
+		field  string
+	}{
+		{func(c *Config) {}, ""},
+		{func(c *Config) { c.BucketIDBitSize = 0 }, "bucketIDBitSize"},
+		{func(c *Config) { c.BucketIDBitSize = 33 }, "bucketIDBitSize"},
+		{func(c *Config) { c.BucketHasherID = 99 }, "bucketHasher"},
+		{func(c *Config) { c.SlowHasherID = 99 }, "slowHasher"},
+		{func(c *Config) { c.SlowHasherID, c.Argon2 = SlowHasherArgon2id, &Argon2Params{} }, "argon2"},
+		{func(c *Config) { c.BucketEncryptorID = 99 }, "bucketEncryptor"},
+		{func(c *Config) { c.OPRFSuite = 99 }, "oprfSuite"},
+		{func(c *Config) { c.MaxRetries = -1 }, "maxRetries"},
+		{func(c *Config) { c.MaxRetries = MaxRetryLimit + 1 }, "maxRetries"},
+		{func(c *Config) { c.RetryBaseDelay = MaxRetryDelay + 1 }, "retryBaseDelay"},
+		{func(c *Config) { c.MaxBucketEntries = -1 }, "maxBucketEntries"},
+	}
+	for i, test := range tests {
+		cfg := DefaultConfig()
+		test.modify(&cfg)
+		err := cfg.Validate()
+		if (err == nil) != (test.field == "") || (err != nil && !strings.HasPrefix(err.Error(), test.field+":")) {
+			t.Errorf("failed test %d: want error for %q, got %v", i, test.field, err)
+		}
+	}
+}
+
+func TestSuggestBucketIDBitSize(t *testing.T) {
+	tests := []struct {
+		entries   int64
+		occupancy float64
+		bits      int
+		wantErr   bool
+	}{
+		{1 << 20, 1, 20, false},
+		{1 << 20, 16, 16, false},
+		{1000000, 100, 13, false},
+		{1500000, 100, 14, false},
+		{10, 100, 1, false},
+		{1 << 62, 1, 32, false},
+		{0, 100, 0, true},
+		{1000, 0, 0, true},
+		{1000, -1, 0, true},
+	}
+	for i, test := range tests {
+		bits, err := SuggestBucketIDBitSize(test.entries, test.occupancy)
+		if (err != nil) != test.wantErr || bits != test.bits {
+			t.Errorf("failed test %d: want (%d, error %t), got (%d, %v)", i, test.bits, test.wantErr, bits, err)
+		}
+	}
+}
+
+func TestConfigMismatches(t *testing.T) {
+	tests := []struct {
+		modify func(*Config)
+		fields []string
+	}{
+		{func(c *Config) {}, nil},
+		{func(c *Config) { c.Tag, c.MaxRetries = "other", 3 }, nil},
+		{func(c *Config) { c.BucketIDBitSize = 16 }, []string{"bucketIDBitSize"}},
+		{func(c *Config) { c.BucketHasherID, c.OPRFSuite = 99, 99 }, []string{"bucketHasher", "oprfSuite"}},
+		{func(c *Config) { c.SlowHasherID = SlowHasherArgon2id }, []string{"slowHasher"}},
+		{func(c *Config) { c.Argon2 = &Argon2Params{Time: 1, Memory: 64, Threads: 1} }, nil},
+		{func(c *Config) { c.NormalizeUsernames = true }, []string{"normalizeUsernames"}},
+		{func(c *Config) { c.MaxBucketEntries = 1000 }, []string{"maxBucketEntries"}},
+		{func(c *Config) { c.OPRFInfo = string(OprfInfo) }, nil},
+		{func(c *Config) { c.OPRFInfo = "other deployment" }, []string{"oprfInfo"}},
+	}
+	for i, test := range tests {
+		cfg := DefaultConfig()
+		test.modify(&cfg)
+		mismatches := cfg.Mismatches(DefaultConfig())
+		ok := len(mismatches) == len(test.fields)
+		for j := 0; ok && j < len(mismatches); j++ {
+			ok = strings.HasPrefix(mismatches[j], test.fields[j]+":")
+		}
+		if !ok {
+			t.Errorf("failed test %d: want mismatches in %v, got %v", i, test.fields, mismatches)
+		}
+	}
+
+	argon2 := DefaultConfig()
+	argon2.SlowHasherID = SlowHasherArgon2id
+	params := DefaultArgon2Params()
+	withParams := argon2
+	withParams.Argon2 = &params
+	if mismatches := withParams.Mismatches(argon2); mismatches != nil {
+		t.Errorf("default argon2 parameters: want no mismatches, got %v", mismatches)
+	}
+	params.Time++
+	if mismatches := withParams.Mismatches(argon2); len(mismatches) != 1 {
+		t.Errorf("argon2 parameters: want a mismatch, got %v", mismatches)
+	}
+
+	keyed := DefaultConfig()
+	keyed.PublicKey = []byte{1}
+	swapped := keyed
+	swapped.PublicKey = []byte{2}
+	if mismatches := keyed.Mismatches(swapped); len(mismatches) != 1 {
+		t.Errorf("public key: want a mismatch, got %v", mismatches)
+	}
+	// the key of another epoch is expected to differ
+	swapped.KeyID++
+	if mismatches := keyed.Mismatches(swapped); mismatches != nil {
+		t.Errorf("public key of another epoch: want no mismatches, got %v", mismatches)
+	}
+}
+
+func TestOverflowBucketID(t *testing.T) {
+	testCases := []struct {
+		n    int
+		want string
+	}{
+		{0, "0001e5d3"},
+		{1, "0001e5d301"},
+		{MaxOverflowBuckets, "0001e5d3ff"},
+	}
+	for i, test := range testCases {
+		if got := OverflowBucketID("0001e5d3", test.n); got != test.want {
+			t.Errorf("failed test %d: want %s, got %s", i, test.want, got)
+		}
+	}
+}
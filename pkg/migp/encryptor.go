@@ -4,21 +4,26 @@
 package migp
 
 import (
+	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
 )
 
 const (
-	BucketEncryptorHKDFSHA256 uint16 = 0x0001
+	BucketEncryptorHKDFSHA256       uint16 = 0x0001
+	BucketEncryptorChaCha20Poly1305 uint16 = 0x0002
 )
 
 var (
 	DerivePadHeaderSalt = []byte("MIGP derive pad header")
 	DerivePadBodySalt   = []byte("MIGP derive pad body")
+	DeriveBodyKeySalt   = []byte("MIGP derive body key")
 )
 
 // BucketEncryptor is a generic interface for a bucket encryption algorithm.
@@ -53,6 +58,7 @@ func (h hkdfSHA256BucketEncryptor) Encrypt(secret []byte, flag MetadataType, bod
 	if err != nil {
 		return nil, err
 	}
+	defer zeroize(headerPad)
 
 	header := make([]byte, CtxtKeyCheckSize+1)
 	header[CtxtKeyCheckSize] = byte(flag)
@@ -62,6 +68,7 @@ func (h hkdfSHA256BucketEncryptor) Encrypt(secret []byte, flag MetadataType, bod
 	if err != nil {
 		return nil, err
 	}
+	defer zeroize(bodyPad)
 
 	encryptedBody := xorBytes(body, bodyPad)
 
@@ -86,6 +93,7 @@ func (h hkdfSHA256BucketEncryptor) DecryptHeader(secret []byte, ciphertext []byt
 	if err != nil {
 		return false, 0, 0, err
 	}
+	defer zeroize(headerPad)
 
 	keyCheck := (subtle.ConstantTimeCompare(headerPad[:CtxtKeyCheckSize], ciphertext[:CtxtKeyCheckSize]) == 1)
 	flag := MetadataType(headerPad[CtxtKeyCheckSize] ^ ciphertext[CtxtKeyCheckSize])
@@ -106,11 +114,93 @@ func (h hkdfSHA256BucketEncryptor) DecryptBody(secret []byte, ciphertext []byte)
 	if err != nil {
 		return nil, err
 	}
+	defer zeroize(bodyPad)
 
 	return xorBytes(ciphertext, bodyPad), nil
 
 }
 
+// chaCha20Poly1305BucketEncryptor implements BucketEncryptor using the same
+// key-committing header as hkdfSHA256BucketEncryptor, with the body sealed
+// using ChaCha20-Poly1305
+type chaCha20Poly1305BucketEncryptor struct{}
+
+// NewChaCha20Poly1305BucketEncryptor returns a new BucketEncryptor that seals
+// entry bodies with ChaCha20-Poly1305, which is fast on hardware without AES
+// instructions
+func NewChaCha20Poly1305BucketEncryptor() chaCha20Poly1305BucketEncryptor {
+	return chaCha20Poly1305BucketEncryptor{}
+}
+
+// ID returns the chaCha20Poly1305BucketEncryptor identifier
+func (h chaCha20Poly1305BucketEncryptor) ID() uint16 {
+	return BucketEncryptorChaCha20Poly1305
+}
+
+// Encrypt encrypts the input (metadataFlag || metadata) using the input secret.
+// Output format:
+//   XOR(<20-byte all-zero key check> | <1-byte flag>, <headerPad>) | <4-byte body length> | <12-byte nonce> | ChaCha20-Poly1305(<body>)
+func (h chaCha20Poly1305BucketEncryptor) Encrypt(secret []byte, flag MetadataType, body []byte) ([]byte, error) {
+	headerPad, err := derivePad(secret, DerivePadHeaderSalt, CtxtKeyCheckSize+1)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroize(headerPad)
+
+	header := make([]byte, CtxtKeyCheckSize+1)
+	header[CtxtKeyCheckSize] = byte(flag)
+	encryptedHeader := xorBytes(header, headerPad)
+
+	aead, err := newBodyAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	encryptedBody := aead.Seal(nonce, nonce, body, nil)
+
+	ciphertext := make([]byte, len(encryptedHeader)+4+len(encryptedBody))
+	copy(ciphertext, encryptedHeader)
+	binary.BigEndian.PutUint32(ciphertext[len(encryptedHeader):], uint32(len(encryptedBody)))
+	copy(ciphertext[len(encryptedHeader)+4:], encryptedBody)
+
+	return ciphertext, nil
+}
+
+// DecryptHeader decrypts the input (key check || metadataFlag) using the input
+// secret. The header is identical to that of hkdfSHA256BucketEncryptor.
+func (h chaCha20Poly1305BucketEncryptor) DecryptHeader(secret []byte, ciphertext []byte) (bool, MetadataType, int, error) {
+	return hkdfSHA256BucketEncryptor{}.DecryptHeader(secret, ciphertext)
+}
+
+// DecryptBody opens the input (nonce || sealed entry metadata) using the input
+// secret
+func (h chaCha20Poly1305BucketEncryptor) DecryptBody(secret []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := newBodyAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("ciphertext of insufficient length to parse body")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+// newBodyAEAD is a helper function that returns a ChaCha20-Poly1305 instance
+// keyed with a key derived from secret
+func newBodyAEAD(secret []byte) (cipher.AEAD, error) {
+	key, err := derivePad(secret, DeriveBodyKeySalt, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	// the AEAD keeps its own copy of the key
+	defer zeroize(key)
+	return chacha20poly1305.New(key)
+}
+
 // xorBytes is a helper function that computes the XOR of two byte slices that
 // must be of the same length.
 func xorBytes(b1, b2 []byte) []byte {
@@ -144,6 +234,8 @@ func NewBucketEncryptor(id uint16) (BucketEncryptor, error) {
 	switch id {
 	case BucketEncryptorHKDFSHA256:
 		return NewHKDFSHA256BucketEncryptor(), nil
+	case BucketEncryptorChaCha20Poly1305:
+		return NewChaCha20Poly1305BucketEncryptor(), nil
 	default:
 		return nil, errors.New("unsupported bucket encryptor")
 	}
@@ -40,78 +40,111 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	bucketEncryptor, err := NewBucketEncryptor(DefaultBucketEncryptor)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	for _, test := range testCases {
-
-		// Client generates blinded element
-		oprfRequest, err := oprfClient.Request([][]byte{test.secret})
+	for _, encryptorID := range []uint16{BucketEncryptorHKDFSHA256, BucketEncryptorChaCha20Poly1305} {
+		bucketEncryptor, err := NewBucketEncryptor(encryptorID)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		// Server evaluates blinded element
-		evaluatedMessage, err := oprfServer.Evaluate(oprfRequest.BlindedElements(), OprfInfo)
-		if err != nil {
-			t.Fatal(err)
+		for _, test := range testCases {
+
+			// Client generates blinded element
+			oprfRequest, err := oprfClient.Request([][]byte{test.secret})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Server evaluates blinded element
+			evaluatedMessage, err := oprfServer.Evaluate(oprfRequest.BlindedElements(), OprfInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Client and server finalize to derive shared secret
+			clientSecrets, err := oprfClient.Finalize(oprfRequest, evaluatedMessage, OprfInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(clientSecrets) < 1 {
+				t.Fatal("invalid Finalize response")
+			}
+			clientSecret := clientSecrets[0]
+			serverSecret, err := oprfServer.FullEvaluate(test.secret, OprfInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Server encrypts bucket using shared secret
+			ciphertext, err := bucketEncryptor.Encrypt(serverSecret, test.metadataFlag, test.metadata)
+			if err != nil {
+				t.Errorf("encryption failed with error %s", err.Error())
+			}
+
+			// Client decrypts header
+			valid, flag, bodyLength, err := bucketEncryptor.DecryptHeader(clientSecret, ciphertext[:HeaderSize])
+			if !valid {
+				t.Errorf("header key check invalid")
+			}
+			if err != nil {
+				t.Errorf("header decryption failed with error %s", err.Error())
+			}
+			if flag != test.metadataFlag {
+				t.Errorf("decryption got mdFlag of %d (expected %d)", flag, test.metadataFlag)
+			}
+			if len(ciphertext)-HeaderSize != bodyLength {
+				t.Errorf("header decryption failed to recover length. got %d, expected %d", bodyLength, len(ciphertext)-HeaderSize)
+			}
+
+			// Client decrypts body
+			metadata, err := bucketEncryptor.DecryptBody(clientSecret, ciphertext[HeaderSize:HeaderSize+bodyLength])
+			if err != nil {
+				t.Errorf("header decryption failed with error %s", err.Error())
+			}
+			if !bytes.Equal(metadata, test.metadata) {
+				t.Errorf("decryption got mdString of '%s' (expected '%s')", metadata, test.metadata)
+			}
 		}
+	}
+}
 
-		// Client and server finalize to derive shared secret
-		clientSecrets, err := oprfClient.Finalize(oprfRequest, evaluatedMessage, OprfInfo)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if len(clientSecrets) < 1 {
-			t.Fatal("invalid Finalize response")
-		}
-		clientSecret := clientSecrets[0]
-		serverSecret, err := oprfServer.FullEvaluate(test.secret, OprfInfo)
-		if err != nil {
-			t.Fatal(err)
-		}
+// TestChaCha20Poly1305Tamper tests that a modified body fails to decrypt
+func TestChaCha20Poly1305Tamper(t *testing.T) {
+	secret := []byte("secret")
+	bucketEncryptor := NewChaCha20Poly1305BucketEncryptor()
 
-		// Server encrypts bucket using shared secret
-		ciphertext, err := bucketEncryptor.Encrypt(serverSecret, test.metadataFlag, test.metadata)
-		if err != nil {
-			t.Errorf("encryption failed with error %s", err.Error())
-		}
+	ciphertext, err := bucketEncryptor.Encrypt(secret, MetadataBreachedPassword, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext[len(ciphertext)-1] ^= 1
+	if _, err := bucketEncryptor.DecryptBody(secret, ciphertext[HeaderSize:]); err == nil {
+		t.Errorf("decryption of tampered body succeeded")
+	}
+}
 
-		// Client decrypts header
-		valid, flag, bodyLength, err := bucketEncryptor.DecryptHeader(clientSecret, ciphertext[:HeaderSize])
-		if !valid {
-			t.Errorf("header key check invalid")
-		}
-		if err != nil {
-			t.Errorf("header decryption failed with error %s", err.Error())
-		}
-		if flag != test.metadataFlag {
-			t.Errorf("decryption got mdFlag of %d (expected %d)", flag, test.metadataFlag)
-		}
-		if len(test.metadata) != bodyLength {
-			t.Errorf("header decryption failed to recover length. got %d, expected %d", bodyLength, len(test.metadata))
-		}
+// BenchmarkHKDFSHA256Encryptor runs benchmark tests for the bucket encryptor
+func BenchmarkHKDFSHA256Encryptor(b *testing.B) {
+	secret := []byte{32}
+	metadataFlag := MetadataDummy
+	metadata := []byte{32}
 
-		// Client decrypts body
-		metadata, err := bucketEncryptor.DecryptBody(clientSecret, ciphertext[HeaderSize:HeaderSize+bodyLength])
+	encryptor := NewHKDFSHA256BucketEncryptor()
+	for i := 0; i < b.N; i++ {
+		_, err := encryptor.Encrypt(secret, metadataFlag, metadata)
 		if err != nil {
-			t.Errorf("header decryption failed with error %s", err.Error())
-		}
-		if !bytes.Equal(metadata, test.metadata) {
-			t.Errorf("decryption got mdString of '%s' (expected '%s')", metadata, test.metadata)
+			b.Fatal(err)
 		}
 	}
 }
 
-// BenchmarkHKDFSHA256Encryptor runs benchmark tests for the bucket encryptor
-func BenchmarkHKDFSHA256Encryptor(b *testing.B) {
+// BenchmarkChaCha20Poly1305Encryptor runs benchmark tests for the
+// ChaCha20-Poly1305 bucket encryptor
+func BenchmarkChaCha20Poly1305Encryptor(b *testing.B) {
 	secret := []byte{32}
 	metadataFlag := MetadataDummy
 	metadata := []byte{32}
 
-	encryptor := NewHKDFSHA256BucketEncryptor()
+	encryptor := NewChaCha20Poly1305BucketEncryptor()
 	for i := 0; i < b.N; i++ {
 		_, err := encryptor.Encrypt(secret, metadataFlag, metadata)
 		if err != nil {
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"math"
 )
 
 const (
@@ -40,7 +41,7 @@ func (h sha256BucketHasher) ID() uint16 {
 
 // Hash implements the Hash function for sha256BucketHasher
 func (h sha256BucketHasher) Hash(buf []byte) []byte {
-	if len(h.salt) > (1<<16) || len(buf) > (1<<16) {
+	if len(h.salt) > math.MaxUint16 || len(buf) > math.MaxUint16 {
 		panic("Invalid input")
 	}
 
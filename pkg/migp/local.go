@@ -0,0 +1,31 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import "context"
+
+// localEvaluator evaluates requests with a server in-process. Implements
+// Evaluator
+type localEvaluator struct {
+	server *Server
+	kv     Getter
+}
+
+// Evaluate handles the request with the server, reporting the size of the
+// bucket returned as that of the response
+func (e localEvaluator) Evaluate(_ context.Context, request ClientRequest) (ServerResponse, int, error) {
+	response, err := e.server.HandleRequest(request, e.kv)
+	if err != nil {
+		return ServerResponse{}, 0, err
+	}
+	return response, len(response.BucketContents), nil
+}
+
+// QueryLocal queries the given server in-process, without going through
+// HTTP, for the buckets in kv. Like QueryOne, it queries the previous key
+// epochs of the server unless an exact match is found with the current one.
+// The client must be configured with the server's configuration.
+func (c *Client) QueryLocal(server *Server, kv Getter, username, password []byte) (QueryResult, error) {
+	return c.QueryEvaluator(context.Background(), localEvaluator{server: server, kv: kv}, username, password)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestQueryLocal(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := []byte("user1")
+	entry, err := server.EncryptBucketEntry(username, []byte("pass1"), MetadataBreachedPassword, []byte("metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(username)): entry}}
+
+	client, err := NewClient(server.Config().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		password []byte
+		status   BreachStatus
+		metadata []byte
+	}{
+		{[]byte("pass1"), InBreach, []byte("metadata")},
+		{[]byte("pass2"), NotInBreach, nil},
+	}
+	for i, test := range testCases {
+		result, err := client.QueryLocal(server, kv, username, test.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != test.status || !bytes.Equal(result.Metadata, test.metadata) {
+			t.Errorf("failed test %d: want (%s, %q), got (%s, %q)", i, test.status, test.metadata, result.Status, result.Metadata)
+		}
+	}
+}
+
+func TestAddBucketEntryCount(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := []byte("user1")
+	var bucket []byte
+	for _, password := range []string{"pass1", "pass2"} {
+		entry, err := server.EncryptBucketEntry(username, []byte(password), MetadataBreachedPassword, []byte(`{"count":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket = append(bucket, entry...)
+	}
+	bucket, found, err := server.AddBucketEntryCount(bucket, username, []byte("pass2"), MetadataBreachedPassword, 2)
+	if err != nil || !found {
+		t.Fatalf("add count: want (true, nil), got (%v, %v)", found, err)
+	}
+	if _, found, err := server.AddBucketEntryCount(bucket, username, []byte("pass3"), MetadataBreachedPassword, 1); err != nil || found {
+		t.Fatalf("add count of missing entry: want (false, nil), got (%v, %v)", found, err)
+	}
+	kv := &KVMock{store: map[string][]byte{BucketIDToHex(server.BucketID(username)): bucket}}
+
+	client, err := NewClient(server.Config().Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		password []byte
+		count    int64
+	}{
+		{[]byte("pass1"), 1},
+		{[]byte("pass2"), 3},
+		{[]byte("pass3"), 0},
+	}
+	for i, test := range testCases {
+		result, err := client.QueryLocal(server, kv, username, test.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Count() != test.count {
+			t.Errorf("failed test %d: want %d, got %d", i, test.count, result.Count())
+		}
+	}
+}
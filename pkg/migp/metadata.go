@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// ErrUnstructuredMetadata is returned when breach entry metadata is not an
+// encoded BreachMetadata, e.g., raw metadata from before it was introduced.
+var ErrUnstructuredMetadata = errors.New("metadata is not structured breach metadata")
+
+// BreachMetadata describes the breach a credential pair was found in. It is
+// stored JSON-encoded as the metadata of a breach entry.
+type BreachMetadata struct {
+	// Name is the name of the breach
+	Name string `json:"name,omitempty"`
+	// Date is the date of the breach, in the format YYYY-MM-DD
+	Date string `json:"date,omitempty"`
+	// ExposedFields lists the fields exposed in the breach, e.g., "email"
+	// or "password"
+	ExposedFields []string `json:"exposedFields,omitempty"`
+	// Count is the number of times the credential pair, or the password of
+	// a password-only entry, was seen in breaches
+	Count int64 `json:"count,omitempty"`
+}
+
+// Marshal encodes the breach metadata for use as breach entry metadata
+func (m BreachMetadata) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// ParseBreachMetadata decodes breach entry metadata written by
+// BreachMetadata.Marshal. Metadata that is not a JSON object, such as raw
+// metadata strings, is reported with ErrUnstructuredMetadata.
+func ParseBreachMetadata(metadata []byte) (BreachMetadata, error) {
+	var m BreachMetadata
+	if !bytes.HasPrefix(bytes.TrimSpace(metadata), []byte("{")) {
+		return m, ErrUnstructuredMetadata
+	}
+	if err := json.Unmarshal(metadata, &m); err != nil {
+		return BreachMetadata{}, ErrUnstructuredMetadata
+	}
+	return m, nil
+}
+
+// MetadataCount returns the occurrence count of breach entry metadata: the
+// Count of structured metadata, or the metadata itself if it is a decimal
+// number, as stored for HIBP entries. Other metadata has a count of zero.
+func MetadataCount(metadata []byte) int64 {
+	if m, err := ParseBreachMetadata(metadata); err == nil {
+		return m.Count
+	}
+	count, err := strconv.ParseInt(string(metadata), 10, 64)
+	if err != nil || count < 0 {
+		return 0
+	}
+	return count
+}
+
+// AddMetadataCount returns breach entry metadata with count added to the
+// occurrence count of metadata, see MetadataCount. Empty metadata becomes
+// structured metadata holding the count alone. Raw metadata strings hold no
+// count, and are reported with ErrUnstructuredMetadata.
+func AddMetadataCount(metadata []byte, count int64) ([]byte, error) {
+	if len(metadata) == 0 {
+		return BreachMetadata{Count: count}.Marshal()
+	}
+	if m, err := ParseBreachMetadata(metadata); err == nil {
+		m.Count += count
+		return m.Marshal()
+	}
+	current, err := strconv.ParseInt(string(metadata), 10, 64)
+	if err != nil {
+		return nil, ErrUnstructuredMetadata
+	}
+	return []byte(strconv.FormatInt(current+count, 10)), nil
+}
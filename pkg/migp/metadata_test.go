@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseBreachMetadata(t *testing.T) {
+	structured, err := BreachMetadata{
+		Name:          "example",
+		Date:          "2021-06-01",
+		ExposedFields: []string{"email", "password"},
+	}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		metadata []byte
+		out      BreachMetadata
+		err      error
+	}{
+		{structured, BreachMetadata{Name: "example", Date: "2021-06-01", ExposedFields: []string{"email", "password"}}, nil},
+		{[]byte(`{"name":"other"}`), BreachMetadata{Name: "other"}, nil},
+		{[]byte("my favorite breach"), BreachMetadata{}, ErrUnstructuredMetadata},
+		{[]byte(`{"name":`), BreachMetadata{}, ErrUnstructuredMetadata},
+		{nil, BreachMetadata{}, ErrUnstructuredMetadata},
+	}
+
+	for i, test := range testCases {
+		out, err := ParseBreachMetadata(test.metadata)
+		if err != test.err || !reflect.DeepEqual(out, test.out) {
+			t.Errorf("failed test %d: want (%v, %v), got (%v, %v)", i, test.out, test.err, out, err)
+		}
+	}
+}
+
+func TestMetadataCount(t *testing.T) {
+	testCases := []struct {
+		metadata []byte
+		count    int64
+	}{
+		{[]byte(`{"name":"example","count":3}`), 3},
+		{[]byte(`{"name":"example"}`), 0},
+		{[]byte("42"), 42},
+		{[]byte("-1"), 0},
+		{[]byte("my favorite breach"), 0},
+		{nil, 0},
+	}
+	for i, test := range testCases {
+		if count := MetadataCount(test.metadata); count != test.count {
+			t.Errorf("failed test %d: want %d, got %d", i, test.count, count)
+		}
+	}
+}
+
+func TestAddMetadataCount(t *testing.T) {
+	testCases := []struct {
+		metadata []byte
+		count    int64
+		out      []byte
+		err      error
+	}{
+		{nil, 1, []byte(`{"count":1}`), nil},
+		{[]byte(`{"name":"example","count":3}`), 2, []byte(`{"name":"example","count":5}`), nil},
+		{[]byte(`{"name":"example"}`), 1, []byte(`{"name":"example","count":1}`), nil},
+		{[]byte("42"), 1, []byte("43"), nil},
+		{[]byte("my favorite breach"), 1, nil, ErrUnstructuredMetadata},
+	}
+	for i, test := range testCases {
+		out, err := AddMetadataCount(test.metadata, test.count)
+		if err != test.err || !bytes.Equal(out, test.out) {
+			t.Errorf("failed test %d: want (%s, %v), got (%s, %v)", i, test.out, test.err, out, err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Querier submits MIGP queries for many credentials to a single target
+// server.
+type Querier struct {
+	cfg       Config
+	targetURL string
+
+	clientOnce sync.Once
+	client     *Client
+	clientErr  error
+
+	// Concurrency is the maximum number of queries in flight at once.
+	// Values less than one are treated as one.
+	Concurrency int
+
+	// Cache, if set, is consulted before querying the server and stores
+	// successful results.
+	Cache ResultCache
+}
+
+// QueryResult holds the outcome of querying a single credential pair.
+type QueryResult struct {
+	Username []byte
+	Password []byte
+	Status   BreachStatus
+	Metadata []byte
+
+	// Timings records the time spent in each phase of the query, under the
+	// keys "query_prep", "api_call", "finalize", and "total".
+	Timings map[string]time.Duration
+	// BandwidthMB is the size of the server response in MiB.
+	BandwidthMB float64
+
+	// Err is set when the result reports a failed query, e.g., on the
+	// channel returned by ScanReader.
+	Err error
+}
+
+// Breach returns the structured breach metadata of the result, or
+// ErrUnstructuredMetadata if the entry was stored with raw metadata.
+func (r QueryResult) Breach() (BreachMetadata, error) {
+	return ParseBreachMetadata(r.Metadata)
+}
+
+// Count returns the number of times the credentials were seen in breaches, or
+// zero if the entry was stored without an occurrence count, see MetadataCount
+func (r QueryResult) Count() int64 {
+	return MetadataCount(r.Metadata)
+}
+
+// NewQuerier returns a Querier that sends requests for the given
+// configuration to targetURL.
+func NewQuerier(cfg Config, targetURL string) *Querier {
+	return &Querier{
+		cfg:         cfg,
+		targetURL:   targetURL,
+		Concurrency: 1,
+	}
+}
+
+// Query submits a single MIGP query for the given credential pair.
+func (q *Querier) Query(ctx context.Context, username, password []byte) (QueryResult, error) {
+	if err := ctx.Err(); err != nil {
+		return QueryResult{}, err
+	}
+
+	var cacheKey string
+	if q.Cache != nil {
+		key, err := ResultCacheKey(q.cfg, q.targetURL, username, password)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		if result, ok := q.Cache.Get(key); ok {
+			return result, nil
+		}
+		cacheKey = key
+	}
+
+	q.clientOnce.Do(func() {
+		q.client, q.clientErr = NewClient(q.cfg)
+	})
+	if q.clientErr != nil {
+		return QueryResult{}, q.clientErr
+	}
+
+	result, err := q.client.QueryOneContext(ctx, q.targetURL, username, password)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	if q.Cache != nil {
+		q.Cache.Set(cacheKey, result)
+	}
+	return result, nil
+}
+
+// ScanReader reads credentials in the format <username><sep><password>, one
+// per line, from r and queries each of them using q. Results are emitted on
+// the returned channel, which is closed once the input is exhausted or ctx is
+// cancelled. Lines that cannot be parsed are skipped. When q.Concurrency is
+// greater than one, results may be emitted out of input order. A failure to
+// read from r is reported as a final result with only Err set.
+func ScanReader(ctx context.Context, q *Querier, r io.Reader, sep byte) (<-chan QueryResult, error) {
+	if q == nil {
+		return nil, errors.New("nil querier")
+	}
+	if r == nil {
+		return nil, errors.New("nil reader")
+	}
+
+	workers := q.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	type credential struct {
+		username, password []byte
+	}
+	jobs := make(chan credential)
+	results := make(chan QueryResult)
+
+	// emit sends a result unless the context has been cancelled
+	emit := func(result QueryResult) bool {
+		select {
+		case results <- result:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				result, err := q.Query(ctx, job.username, job.password)
+				if err != nil {
+					result = QueryResult{Username: job.username, Password: job.password, Err: err}
+				}
+				if !emit(result) {
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(results)
+		defer wg.Wait()
+		defer close(jobs)
+
+		scanner := bufio.NewScanner(r)
+	scan:
+		for scanner.Scan() {
+			fields := bytes.SplitN(scanner.Bytes(), []byte{sep}, 2)
+			if len(fields) < 2 {
+				continue
+			}
+			// the scanner reuses its buffer, so take a copy of the fields
+			job := credential{
+				username: append([]byte(nil), fields[0]...),
+				password: append([]byte(nil), fields[1]...),
+			}
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				break scan
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			emit(QueryResult{Err: err})
+		}
+	}()
+
+	return results, nil
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestHTTPServer returns an HTTP server answering MIGP evaluate requests
+// from the given server and KV store
+func newTestHTTPServer(t *testing.T, server *Server, kv Getter) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var request ClientRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, err := server.HandleRequest(request, kv)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body, err := response.MarshalBinary()
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write(body)
+	}))
+}
+
+// TestScanReader tests that every well-formed line of the input is queried
+// and reported on the result channel
+func TestScanReader(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherNull
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv := &KVMock{store: make(map[string][]byte)}
+	username, password, metadata := []byte("user1"), []byte("pass1"), []byte("breach")
+	bucketIDHex := BucketIDToHex(server.BucketID(username))
+	entry, err := server.EncryptBucketEntry(username, password, MetadataBreachedPassword, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.store[bucketIDHex] = entry
+
+	httpServer := newTestHTTPServer(t, server, kv)
+	defer httpServer.Close()
+
+	querier := NewQuerier(cfg.Config, httpServer.URL)
+	querier.Concurrency = 2
+
+	input := strings.NewReader("user1;pass1\nmalformed\nuser2;pass2\n")
+	results, err := ScanReader(context.Background(), querier, input, ';')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]QueryResult)
+	for result := range results {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		got[string(result.Username)] = result
+	}
+	if len(got) != 2 {
+		t.Fatalf("results: want %d, got %d", 2, len(got))
+	}
+	if result := got["user1"]; result.Status != InBreach || !bytes.Equal(result.Metadata, metadata) {
+		t.Errorf("user1: want %s %q, got %s %q", InBreach, metadata, result.Status, result.Metadata)
+	}
+	if result := got["user2"]; result.Status != NotInBreach {
+		t.Errorf("user2: want %s, got %s", NotInBreach, result.Status)
+	}
+}
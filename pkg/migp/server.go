@@ -6,14 +6,34 @@ package migp
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 
 	"github.com/cloudflare/circl/oprf"
 )
 
+// ErrMetadataTooLarge is returned when breach entry metadata exceeds the
+// configured MaxMetadataBytes and the server is not configured to truncate it.
+var ErrMetadataTooLarge = errors.New("metadata exceeds maximum size")
+
+// ErrUnsupportedVersion is returned when a client request carries a MIGP
+// version the server does not support.
+var ErrUnsupportedVersion = errors.New("requested version doesn't match server version")
+
+// ErrUnknownKeyID is returned when a client request carries a key ID the
+// server holds no OPRF key for.
+var ErrUnknownKeyID = errors.New("unknown key ID")
+
+// ErrInvalidRequest is returned for malformed requests, such as those with a
+// blinded element of the wrong length for the OPRF suite
+var ErrInvalidRequest = errors.New("invalid request")
+
 // Server implements the server-side functionality of MIGP, with
 // two primary functionalities: FullEvaluate, to evaluate a
 // (username, password) tuple and store it in the backing database,
@@ -25,9 +45,28 @@ type Server struct {
 	bucketHasher    BucketHasher
 	bucketEncryptor BucketEncryptor
 	slowHasher      SlowHasher
+	argon2          *Argon2Params
 	oprfServer      *oprf.Server
 	oprfSuite       oprf.SuiteID
 	privateKey      *oprf.PrivateKey
+	verifiable      bool
+	tag             string
+	oprfInfo        string
+	// normalizeUsernames applies NormalizeUsername to usernames
+	normalizeUsernames bool
+
+	// keyID is the epoch of privateKey, used for new bucket entries.
+	// previousKeys are kept to answer queries for buckets ingested before
+	// the key was rotated.
+	keyID        uint32
+	previousKeys []ServerKey
+	oprfServers  map[uint32]*oprf.Server
+
+	maxMetadataBytes int
+	truncateMetadata bool
+	apiKeys          []string
+	bucketPadding    int
+	maxBucketEntries int
 }
 
 // ServerConfig stores all version information associated with a given server.
@@ -35,12 +74,47 @@ type Server struct {
 type ServerConfig struct {
 	Config
 	PrivateKey *oprf.PrivateKey
+
+	// MaxMetadataBytes bounds the length of the metadata stored alongside a
+	// breach entry. A value of zero means no limit.
+	MaxMetadataBytes int
+	// TruncateMetadata selects whether oversized metadata is truncated to
+	// MaxMetadataBytes (true) or the entry is rejected (false).
+	TruncateMetadata bool
+	// APIKeys lists the keys accepted from clients. If empty, no key is
+	// required.
+	APIKeys []string
+	// PreviousKeys holds the keys of earlier epochs, used to answer queries
+	// for entries ingested before the current key (Config.KeyID) was set.
+	PreviousKeys []ServerKey
+	// BucketPadding pads the bucket contents of each response with dummy
+	// entries to a multiple of this many bytes, hiding how many entries a
+	// bucket holds. A value at least the size of the largest bucket pads
+	// all buckets to the same size. Zero disables padding.
+	BucketPadding int
+}
+
+// ServerKey is the OPRF private key of a key epoch
+type ServerKey struct {
+	KeyID      uint32
+	PrivateKey *oprf.PrivateKey
+}
+
+// auxServerKey is used for custom JSON (un)marshaling of ServerKey
+type auxServerKey struct {
+	KeyID      uint32 `json:"keyID"`
+	PrivateKey []byte `json:"privateKey"`
 }
 
 // auxServerConfig is used for custom JSON (un)marshaling of ServerConfig
 type auxServerConfig struct {
 	Config
-	PrivateKey []byte `json:"privateKey"`
+	PrivateKey       []byte         `json:"privateKey"`
+	MaxMetadataBytes int            `json:"maxMetadataBytes,omitempty"`
+	TruncateMetadata bool           `json:"truncateMetadata,omitempty"`
+	APIKeys          []string       `json:"apiKeys,omitempty"`
+	PreviousKeys     []auxServerKey `json:"previousKeys,omitempty"`
+	BucketPadding    int            `json:"bucketPadding,omitempty"`
 }
 
 // MarshalJSON serializes a server configuration to JSON
@@ -49,9 +123,22 @@ func (c *ServerConfig) MarshalJSON() ([]byte, error) {
 	if err != nil {
 		panic(err)
 	}
+	var previousKeys []auxServerKey
+	for _, key := range c.PreviousKeys {
+		serializedKey, err := key.PrivateKey.Serialize()
+		if err != nil {
+			return nil, err
+		}
+		previousKeys = append(previousKeys, auxServerKey{KeyID: key.KeyID, PrivateKey: serializedKey})
+	}
 	return json.Marshal(&auxServerConfig{
-		Config:     c.Config,
-		PrivateKey: serializedPrivateKey,
+		Config:           c.Config,
+		PrivateKey:       serializedPrivateKey,
+		MaxMetadataBytes: c.MaxMetadataBytes,
+		TruncateMetadata: c.TruncateMetadata,
+		APIKeys:          c.APIKeys,
+		PreviousKeys:     previousKeys,
+		BucketPadding:    c.BucketPadding,
 	})
 }
 
@@ -62,26 +149,91 @@ func (c *ServerConfig) UnmarshalJSON(data []byte) error {
 		return err
 	}
 	c.Config = aux.Config
+	c.MaxMetadataBytes = aux.MaxMetadataBytes
+	c.TruncateMetadata = aux.TruncateMetadata
+	c.APIKeys = aux.APIKeys
+	c.BucketPadding = aux.BucketPadding
+	// the keys cannot be read for an unsupported suite
+	if _, err := LookupSuite(aux.OPRFSuite); err != nil {
+		return fmt.Errorf("oprfSuite: %w", err)
+	}
 	c.PrivateKey = new(oprf.PrivateKey)
 	if err := c.PrivateKey.Deserialize(aux.OPRFSuite, aux.PrivateKey); err != nil {
+		return fmt.Errorf("privateKey: %w", err)
+	}
+	c.PreviousKeys = nil
+	for _, key := range aux.PreviousKeys {
+		privateKey := new(oprf.PrivateKey)
+		if err := privateKey.Deserialize(aux.OPRFSuite, key.PrivateKey); err != nil {
+			return fmt.Errorf("previousKeys: key ID %d: %w", key.KeyID, err)
+		}
+		c.PreviousKeys = append(c.PreviousKeys, ServerKey{KeyID: key.KeyID, PrivateKey: privateKey})
+	}
+	return nil
+}
+
+// RotateKey starts a new key epoch: the current key is moved to PreviousKeys
+// and replaced with a freshly generated one. Entries ingested from now on use
+// the new key, while existing buckets stay readable with the old one.
+func (c *ServerConfig) RotateKey() error {
+	privateKey, err := oprf.GenerateKey(c.OPRFSuite, rand.Reader)
+	if err != nil {
 		return err
 	}
+	keyID := c.KeyID + 1
+	for _, key := range c.PreviousKeys {
+		if key.KeyID >= keyID {
+			keyID = key.KeyID + 1
+		}
+	}
+	previousKeys := append([]ServerKey(nil), c.PreviousKeys...)
+	c.PreviousKeys = append(previousKeys, ServerKey{KeyID: c.KeyID, PrivateKey: c.PrivateKey})
+	c.PrivateKey = privateKey
+	c.KeyID = keyID
 	return nil
 }
 
 // Config returns an inspectable ServerConfig associated
 // with the given server.
 func (s *Server) Config() *ServerConfig {
+	// public keys are published in both modes, so that clients can
+	// notice the server changing its key
+	publicKey, err := s.privateKey.Public().Serialize()
+	if err != nil {
+		panic(err)
+	}
+	var previousKeys []KeyEpoch
+	for _, key := range s.previousKeys {
+		epoch := KeyEpoch{KeyID: key.KeyID}
+		if epoch.PublicKey, err = key.PrivateKey.Public().Serialize(); err != nil {
+			panic(err)
+		}
+		previousKeys = append(previousKeys, epoch)
+	}
 	return &ServerConfig{
 		Config: Config{
-			Version:           s.version,
-			BucketIDBitSize:   s.bucketIDBitSize,
-			BucketHasherID:    s.bucketHasher.ID(),
-			SlowHasherID:      s.slowHasher.ID(),
-			BucketEncryptorID: s.bucketEncryptor.ID(),
-			OPRFSuite:         s.oprfSuite,
+			Version:            s.version,
+			BucketIDBitSize:    s.bucketIDBitSize,
+			BucketHasherID:     s.bucketHasher.ID(),
+			SlowHasherID:       s.slowHasher.ID(),
+			BucketEncryptorID:  s.bucketEncryptor.ID(),
+			OPRFSuite:          s.oprfSuite,
+			Argon2:             s.argon2,
+			Verifiable:         s.verifiable,
+			PublicKey:          publicKey,
+			KeyID:              s.keyID,
+			PreviousKeys:       previousKeys,
+			Tag:                s.tag,
+			OPRFInfo:           s.oprfInfo,
+			NormalizeUsernames: s.normalizeUsernames,
+			MaxBucketEntries:   s.maxBucketEntries,
 		},
-		PrivateKey: s.privateKey,
+		PrivateKey:       s.privateKey,
+		MaxMetadataBytes: s.maxMetadataBytes,
+		TruncateMetadata: s.truncateMetadata,
+		APIKeys:          s.apiKeys,
+		PreviousKeys:     s.previousKeys,
+		BucketPadding:    s.bucketPadding,
 	}
 }
 
@@ -100,6 +252,39 @@ func DefaultServerConfig() ServerConfig {
 	}
 }
 
+// Validate checks the shared configuration as Config.Validate does, along with
+// the keys and server-only settings
+func (c ServerConfig) Validate() error {
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	if c.PrivateKey == nil {
+		return errors.New("privateKey: missing")
+	}
+	if c.MaxMetadataBytes < 0 {
+		return fmt.Errorf("maxMetadataBytes: %d is negative", c.MaxMetadataBytes)
+	}
+	if c.BucketPadding < 0 {
+		return fmt.Errorf("bucketPadding: %d is negative", c.BucketPadding)
+	}
+	for i, apiKey := range c.APIKeys {
+		if apiKey == "" {
+			return fmt.Errorf("apiKeys: key %d is empty", i)
+		}
+	}
+	keyIDs := map[uint32]bool{c.KeyID: true}
+	for _, key := range c.PreviousKeys {
+		if key.PrivateKey == nil {
+			return fmt.Errorf("previousKeys: key ID %d has no private key", key.KeyID)
+		}
+		if keyIDs[key.KeyID] {
+			return fmt.Errorf("previousKeys: duplicate key ID %d", key.KeyID)
+		}
+		keyIDs[key.KeyID] = true
+	}
+	return nil
+}
+
 // NewServer initializes and returns a new MIGP server from the given
 // configuration
 func NewServer(cfg ServerConfig) (*Server, error) {
@@ -114,35 +299,160 @@ func NewServer(cfg ServerConfig) (*Server, error) {
 		return nil, err
 	}
 
-	s.slowHasher, err = NewSlowHasher(cfg.SlowHasherID)
+	s.slowHasher, err = NewSlowHasherFromConfig(cfg.Config)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.SlowHasherID == SlowHasherArgon2id {
+		// advertise the parameters in use, so clients hash with the same
+		params := DefaultArgon2Params()
+		if cfg.Argon2 != nil {
+			params = *cfg.Argon2
+		}
+		s.argon2 = &params
+	}
 
 	s.bucketEncryptor, err = NewBucketEncryptor(cfg.BucketEncryptorID)
 	if err != nil {
 		return nil, err
 	}
 
+	if _, err = LookupSuite(cfg.OPRFSuite); err != nil {
+		return nil, err
+	}
 	s.oprfSuite = cfg.OPRFSuite
 	s.privateKey = cfg.PrivateKey
+	s.maxMetadataBytes = cfg.MaxMetadataBytes
+	s.truncateMetadata = cfg.TruncateMetadata
+	for _, apiKey := range cfg.APIKeys {
+		if apiKey == "" {
+			return nil, errors.New("API keys must not be empty")
+		}
+	}
+	s.apiKeys = cfg.APIKeys
+	if cfg.BucketPadding < 0 {
+		return nil, errors.New("bucket padding must not be negative")
+	}
+	s.bucketPadding = cfg.BucketPadding
+	if cfg.MaxBucketEntries < 0 {
+		return nil, errors.New("maximum bucket entries must not be negative")
+	}
+	s.maxBucketEntries = cfg.MaxBucketEntries
 
-	s.oprfServer, err = oprf.NewServer(s.oprfSuite, s.privateKey)
+	s.verifiable = cfg.Verifiable
+	s.tag = cfg.Tag
+	s.oprfInfo = cfg.OPRFInfo
+	s.normalizeUsernames = cfg.NormalizeUsernames
+	s.oprfServer, err = s.newOPRFServer(s.privateKey)
 	if err != nil {
 		return nil, err
 	}
+
+	s.keyID = cfg.KeyID
+	s.previousKeys = cfg.PreviousKeys
+	s.oprfServers = map[uint32]*oprf.Server{s.keyID: s.oprfServer}
+	for _, key := range s.previousKeys {
+		if _, ok := s.oprfServers[key.KeyID]; ok {
+			return nil, fmt.Errorf("duplicate key ID %d", key.KeyID)
+		}
+		if s.oprfServers[key.KeyID], err = s.newOPRFServer(key.PrivateKey); err != nil {
+			return nil, err
+		}
+	}
 	return s, nil
 }
 
-// deriveBucketEntryKey derives a bucket entry key from a credential pair
+// newOPRFServer returns an OPRF server for the given key in the configured mode
+func (s *Server) newOPRFServer(privateKey *oprf.PrivateKey) (*oprf.Server, error) {
+	if s.verifiable {
+		return oprf.NewVerifiableServer(s.oprfSuite, privateKey)
+	}
+	return oprf.NewServer(s.oprfSuite, privateKey)
+}
+
+// oprfServerForKey returns the OPRF server of the given key epoch
+func (s *Server) oprfServerForKey(keyID uint32) (*oprf.Server, error) {
+	oprfServer, ok := s.oprfServers[keyID]
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+	return oprfServer, nil
+}
+
+// RequiresAPIKey reports whether clients must present an API key.
+func (s *Server) RequiresAPIKey() bool {
+	return len(s.apiKeys) > 0
+}
+
+// CheckAPIKey reports whether key is one of the configured API keys, or true
+// if no keys are configured. Keys are compared in constant time, and an empty
+// key never matches.
+func (s *Server) CheckAPIKey(key string) bool {
+	if !s.RequiresAPIKey() {
+		return true
+	}
+	if key == "" {
+		return false
+	}
+	match := 0
+	for _, apiKey := range s.apiKeys {
+		match |= subtle.ConstantTimeCompare([]byte(key), []byte(apiKey))
+	}
+	return match == 1
+}
+
+// LimitMetadata applies the configured metadata size limit. It returns the
+// metadata unchanged if it is within the limit, a truncated copy if the server
+// is configured to truncate, and ErrMetadataTooLarge otherwise. The boolean
+// result reports whether the metadata exceeded the limit.
+func (s *Server) LimitMetadata(metadata []byte) ([]byte, bool, error) {
+	if s.maxMetadataBytes <= 0 || len(metadata) <= s.maxMetadataBytes {
+		return metadata, false, nil
+	}
+	if !s.truncateMetadata {
+		return nil, true, ErrMetadataTooLarge
+	}
+	return metadata[:s.maxMetadataBytes], true, nil
+}
+
+// deriveBucketEntryKey derives a bucket entry key from a credential pair with
+// the current key and the configured tag
 func (s *Server) deriveBucketEntryKey(username []byte, password []byte) ([]byte, error) {
-	input := s.slowHasher.Hash(serializeUsernamePassword(username, password))
-	return s.oprfServer.FullEvaluate(input, OprfInfo)
+	if err := checkCredentialLength(username, password); err != nil {
+		return nil, err
+	}
+	input := hashCredentials(s.slowHasher, username, password)
+	defer zeroize(input)
+	return s.oprfServer.FullEvaluate(input, oprfInfo(s.oprfInfo, s.tag))
+}
+
+// SupportedVersions returns the MIGP versions the server can answer requests for
+func (s *Server) SupportedVersions() []uint16 {
+	return []uint16{s.version}
+}
+
+// SupportsVersion reports whether the server can answer requests for the
+// given MIGP version
+func (s *Server) SupportsVersion(version uint32) bool {
+	for _, v := range s.SupportedVersions() {
+		if uint32(v) == version {
+			return true
+		}
+	}
+	return false
 }
 
 // BucketID returns the bucket ID for the given username
 func (s *Server) BucketID(username []byte) uint32 {
-	return bucketHashToID(s.bucketHasher.Hash(username), s.bucketIDBitSize)
+	return bucketHashToID(s.bucketHasher.Hash(s.normalize(username)), s.bucketIDBitSize)
+}
+
+// normalize returns the username as hashed, normalized if configured
+func (s *Server) normalize(username []byte) []byte {
+	if s.normalizeUsernames {
+		return NormalizeUsername(username)
+	}
+	return username
 }
 
 // EncryptBucketEntry performs the full OPRF and encryption of metadata, without any
@@ -153,55 +463,374 @@ func (s *Server) EncryptBucketEntry(username, password []byte, metadataFlag Meta
 	if !metadataFlag.Valid() {
 		return nil, errors.New("invalid metadata flag value: " + string(metadataFlag))
 	}
-	key, err := s.deriveBucketEntryKey(username, password)
+	key, err := s.deriveBucketEntryKey(s.normalize(username), password)
 	if err != nil {
 		return nil, err
 	}
+	defer zeroize(key)
 
 	return s.bucketEncryptor.Encrypt(key, metadataFlag, metadata)
 }
 
+// PasswordBucketID returns the bucket ID of the password-only entry for
+// password. Unlike credential pairs, these entries are bucketed by password.
+func (s *Server) PasswordBucketID(password []byte) uint32 {
+	return bucketHashToID(s.bucketHasher.Hash(passwordBucketInput(password)), s.bucketIDBitSize)
+}
+
+// EncryptPasswordEntry is like EncryptBucketEntry, but for the password alone,
+// regardless of username. The entry is found by queries for the password
+// alone, see Client.QueryPassword.
+func (s *Server) EncryptPasswordEntry(password []byte, metadataFlag MetadataType, metadata []byte) ([]byte, error) {
+	if !metadataFlag.Valid() {
+		return nil, errors.New("invalid metadata flag value: " + string(metadataFlag))
+	}
+	key, err := s.deriveBucketEntryKey(nil, password)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroize(key)
+	return s.bucketEncryptor.Encrypt(key, metadataFlag, metadata)
+}
+
+// SHA1PasswordBucketID returns the bucket ID for the password with the given
+// SHA-1 hash
+func (s *Server) SHA1PasswordBucketID(digest []byte) uint32 {
+	return bucketHashToID(s.bucketHasher.Hash(sha1PasswordInput(digest)), s.bucketIDBitSize)
+}
+
+// EncryptSHA1PasswordEntry is like EncryptBucketEntry, but for a password
+// known only by its SHA-1 hash, as in the HIBP dataset. The entry is found by
+// queries for the password alone, see Client.QuerySHA1Password.
+func (s *Server) EncryptSHA1PasswordEntry(digest []byte, metadataFlag MetadataType, metadata []byte) ([]byte, error) {
+	if !metadataFlag.Valid() {
+		return nil, errors.New("invalid metadata flag value: " + string(metadataFlag))
+	}
+	if len(digest) != sha1.Size {
+		return nil, fmt.Errorf("SHA-1 hash must be %d bytes", sha1.Size)
+	}
+	input := sha1PasswordInput(digest)
+	defer zeroize(input)
+	key, err := s.oprfServer.FullEvaluate(input, oprfInfo(s.oprfInfo, s.tag))
+	if err != nil {
+		return nil, err
+	}
+	defer zeroize(key)
+	return s.bucketEncryptor.Encrypt(key, metadataFlag, metadata)
+}
+
 // ServerResponse wraps up the server's response state.
 type ServerResponse struct {
-	Version          uint32 `json:"version"`
+	Version uint32 `json:"version"`
+	// KeyID is the key epoch the element was evaluated with
+	KeyID            uint32 `json:"keyID,omitempty"`
 	EvaluatedElement []byte `json:"evaluatedElement"`
-	BucketContents   []byte `json:"bucketContents"`
+	// Proof is the serialized proof of the evaluation in verifiable mode
+	Proof          []byte `json:"proof,omitempty"`
+	BucketContents []byte `json:"bucketContents"`
+}
+
+// serializeProof returns the encoding <C>|<S> of a VOPRF proof, or nil if
+// there is no proof
+func serializeProof(proof *oprf.Proof) []byte {
+	if proof == nil {
+		return nil
+	}
+	return append(append([]byte(nil), proof.C...), proof.S...)
+}
+
+// deserializeProof parses a VOPRF proof serialized by serializeProof for the
+// given suite
+func deserializeProof(suite oprf.SuiteID, data []byte) (*oprf.Proof, error) {
+	sizes, err := oprf.GetSizes(suite)
+	if err != nil {
+		return nil, err
+	}
+	scalarLength := int(sizes.SerializedScalarLength)
+	if len(data) != 2*scalarLength {
+		return nil, errors.New("invalid proof length")
+	}
+	return &oprf.Proof{C: data[:scalarLength], S: data[scalarLength:]}, nil
 }
 
 // MarshalBinary marshals the server response in the following binary format:
-// <32-bit version>|<evaluated-element>|<bucket-contents>
+// <32-bit version>|<32-bit key ID>|<evaluated-element>|<proof>|<bucket-contents>
+// where the key ID is only present if non-zero, so that responses for the
+// initial key epoch keep the original format, and the proof is only present
+// in verifiable mode.
 func (r *ServerResponse) MarshalBinary() ([]byte, error) {
 	buffer := new(bytes.Buffer)
-	if err := binary.Write(buffer, binary.BigEndian, r.Version); err != nil {
+	if _, err := r.WriteTo(buffer); err != nil {
 		return nil, err
 	}
-	if _, err := buffer.Write(r.EvaluatedElement); err != nil {
-		return nil, err
+	return buffer.Bytes(), nil
+}
+
+// WriteTo writes the server response to w in the format of MarshalBinary,
+// without copying the bucket contents into an intermediate buffer.
+func (r *ServerResponse) WriteTo(w io.Writer) (int64, error) {
+	header := new(bytes.Buffer)
+	if err := binary.Write(header, binary.BigEndian, r.Version); err != nil {
+		return 0, err
 	}
-	if _, err := buffer.Write(r.BucketContents); err != nil {
-		return nil, err
+	if r.KeyID != 0 {
+		if err := binary.Write(header, binary.BigEndian, r.KeyID); err != nil {
+			return 0, err
+		}
 	}
-	return buffer.Bytes(), nil
+	header.Write(r.EvaluatedElement)
+	header.Write(r.Proof)
+	n, err := w.Write(header.Bytes())
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(r.BucketContents)
+	return int64(n + m), err
 }
 
 // UnmarshalBinary unmarshals the server response from the following binary format:
 // <32-bit version>|<evaluated-element>|<bucket-contents>
+// for the default OPRF suite in base (non-verifiable) mode.
 func (r *ServerResponse) UnmarshalBinary(data []byte) error {
-	buffer := bytes.NewBuffer(data)
-	if err := binary.Read(buffer, binary.BigEndian, &r.Version); err != nil {
+	return r.unmarshalBinary(data, DefaultOPRFSuite, false, 0)
+}
+
+// unmarshalBinary unmarshals the server response for the given OPRF suite,
+// mode and requested key ID from the format written by MarshalBinary.
+func (r *ServerResponse) unmarshalBinary(data []byte, suite oprf.SuiteID, verifiable bool, keyID uint32) error {
+	reader := bytes.NewReader(data)
+	if err := r.readHeader(reader, suite, verifiable, keyID); err != nil {
 		return err
 	}
-	sizes, err := oprf.GetSizes(DefaultOPRFSuite)
+	r.BucketContents = data[len(data)-reader.Len():]
+	return nil
+}
+
+// readHeader reads the fields preceding the bucket contents in the format
+// written by MarshalBinary from r, leaving the bucket contents to be read.
+func (r *ServerResponse) readHeader(reader io.Reader, suite oprf.SuiteID, verifiable bool, keyID uint32) error {
+	if err := binary.Read(reader, binary.BigEndian, &r.Version); err != nil {
+		return err
+	}
+	r.KeyID = 0
+	if keyID != 0 {
+		if err := binary.Read(reader, binary.BigEndian, &r.KeyID); err != nil {
+			return err
+		}
+	}
+	sizes, err := oprf.GetSizes(suite)
 	if err != nil {
 		return err
 	}
 	r.EvaluatedElement = make([]byte, sizes.SerializedElementLength)
-	if n, err := buffer.Read(r.EvaluatedElement); err != nil {
-		return err
-	} else if n != len(r.EvaluatedElement) {
+	if _, err := io.ReadFull(reader, r.EvaluatedElement); err != nil {
 		return errors.New("too few bytes to deserialize EvaluatedElement")
 	}
-	r.BucketContents = buffer.Bytes()
+	r.Proof = nil
+	if verifiable {
+		r.Proof = make([]byte, 2*int(sizes.SerializedScalarLength))
+		if _, err := io.ReadFull(reader, r.Proof); err != nil {
+			return errors.New("too few bytes to deserialize Proof")
+		}
+	}
+	return nil
+}
+
+// CountBucketEntries returns the number of entries in the given bucket
+// contents, walking the entry headers the way Finalize does. If the last entry
+// is truncated, the number of complete entries is returned with an error.
+func CountBucketEntries(bucketContents []byte) (int, error) {
+	count := 0
+	for offset := 0; offset < len(bucketContents); count++ {
+		if offset+HeaderSize > len(bucketContents) {
+			return count, errors.New("parsing error in bucket")
+		}
+		bodyLength := int(binary.BigEndian.Uint32(bucketContents[offset+CtxtKeyCheckSize+1 : offset+HeaderSize]))
+		offset += HeaderSize + bodyLength
+		if offset > len(bucketContents) {
+			return count, errors.New("parsing error in bucket")
+		}
+	}
+	return count, nil
+}
+
+// BucketHasEntry reports whether the bucket holds an entry with the same header
+// as entry. Headers are derived from the OPRF output of the credential, so an
+// entry for the same credential, with the same metadata flag and metadata
+// length, is found without decrypting the bucket.
+func BucketHasEntry(bucketContents, entry []byte) (bool, error) {
+	if len(entry) < HeaderSize {
+		return false, errors.New("entry too short")
+	}
+	for offset := 0; offset < len(bucketContents); {
+		if offset+HeaderSize > len(bucketContents) {
+			return false, errors.New("parsing error in bucket")
+		}
+		if bytes.Equal(bucketContents[offset:offset+HeaderSize], entry[:HeaderSize]) {
+			return true, nil
+		}
+		bodyLength := int(binary.BigEndian.Uint32(bucketContents[offset+CtxtKeyCheckSize+1 : offset+HeaderSize]))
+		offset += HeaderSize + bodyLength
+	}
+	return false, nil
+}
+
+// RemoveBucketEntries returns a copy of the bucket contents without the
+// entries for the credential pair, along with the number of entries removed.
+// Entries are matched by the key check in their header, derived from the OPRF
+// output of the credential, so only those with one of the given flags are
+// removed, or entries with any flag if none are given.
+func (s *Server) RemoveBucketEntries(bucketContents, username, password []byte, flags ...MetadataType) ([]byte, int, error) {
+	key, err := s.deriveBucketEntryKey(s.normalize(username), password)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer zeroize(key)
+	remaining := make([]byte, 0, len(bucketContents))
+	removed := 0
+	for offset := 0; offset < len(bucketContents); {
+		keyCheck, flag, bodyLength, err := s.bucketEncryptor.DecryptHeader(key, bucketContents[offset:])
+		if err != nil {
+			return nil, 0, err
+		}
+		end := offset + HeaderSize + bodyLength
+		if end > len(bucketContents) {
+			return nil, 0, errors.New("parsing error in bucket")
+		}
+		if keyCheck && hasFlag(flags, flag) {
+			removed += 1
+		} else {
+			remaining = append(remaining, bucketContents[offset:end]...)
+		}
+		offset = end
+	}
+	return remaining, removed, nil
+}
+
+// AddBucketEntryCount adds count to the occurrence count of the entry for the
+// credential pair with the given flag, see AddMetadataCount, returning a copy
+// of the bucket contents with the entry re-encrypted in place. It reports
+// whether the bucket holds such an entry, returning the contents unchanged if
+// not. Password-only entries are matched with a nil username.
+func (s *Server) AddBucketEntryCount(bucketContents, username, password []byte, flag MetadataType, count int64) ([]byte, bool, error) {
+	key, err := s.deriveBucketEntryKey(s.normalize(username), password)
+	if err != nil {
+		return nil, false, err
+	}
+	defer zeroize(key)
+	for offset := 0; offset < len(bucketContents); {
+		keyCheck, entryFlag, bodyLength, err := s.bucketEncryptor.DecryptHeader(key, bucketContents[offset:])
+		if err != nil {
+			return nil, false, err
+		}
+		end := offset + HeaderSize + bodyLength
+		if end > len(bucketContents) {
+			return nil, false, errors.New("parsing error in bucket")
+		}
+		if !keyCheck || entryFlag != flag {
+			offset = end
+			continue
+		}
+		metadata, err := s.bucketEncryptor.DecryptBody(key, bucketContents[offset+HeaderSize:end])
+		if err != nil {
+			return nil, false, err
+		}
+		if metadata, err = AddMetadataCount(metadata, count); err != nil {
+			return nil, false, err
+		}
+		entry, err := s.bucketEncryptor.Encrypt(key, flag, metadata)
+		if err != nil {
+			return nil, false, err
+		}
+		updated := make([]byte, 0, len(bucketContents)-(end-offset)+len(entry))
+		updated = append(updated, bucketContents[:offset]...)
+		updated = append(updated, entry...)
+		return append(updated, bucketContents[end:]...), true, nil
+	}
+	return bucketContents, false, nil
+}
+
+// hasFlag reports whether flag is one of flags, or flags is empty
+func hasFlag(flags []MetadataType, flag MetadataType) bool {
+	if len(flags) == 0 {
+		return true
+	}
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// padBucket returns a copy of the bucket contents followed by a dummy entry
+// bringing its length to the next multiple of the configured padding, or the
+// contents unchanged if padding is disabled. Empty buckets are padded too.
+// The dummy entry has an all-zero key check and flag, see isPaddingEntry, and
+// a random body, so that compressing the response does not reveal the size
+// of the bucket.
+func (s *Server) padBucket(bucketContents []byte) ([]byte, error) {
+	if s.bucketPadding == 0 {
+		return bucketContents, nil
+	}
+	if len(bucketContents) > 0 && len(bucketContents)%s.bucketPadding == 0 {
+		return bucketContents, nil
+	}
+	// the dummy entry needs room for at least a header
+	size := (len(bucketContents)/s.bucketPadding + 1) * s.bucketPadding
+	for size-len(bucketContents) < HeaderSize {
+		size += s.bucketPadding
+	}
+
+	padded := make([]byte, size)
+	copy(padded, bucketContents)
+	dummy := padded[len(bucketContents):]
+	if _, err := rand.Read(dummy[HeaderSize:]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(dummy[CtxtKeyCheckSize+1:HeaderSize], uint32(len(dummy)-HeaderSize))
+	return padded, nil
+}
+
+// isPaddingEntry reports whether an entry header is that of a dummy entry
+// added by padBucket. Padding entries are not counted as entries of the
+// bucket, so that a padded bucket is not mistaken for a full one. The key
+// check of a real entry is all zero with negligible probability.
+func isPaddingEntry(header []byte) bool {
+	for _, b := range header[:CtxtKeyCheckSize+1] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkBlindElement returns an error wrapping ErrInvalidRequest if the blinded
+// element is not the length of a serialized element of the OPRF suite, so
+// that malformed requests are rejected before any evaluation
+func (s *Server) checkBlindElement(element []byte) error {
+	sizes, err := oprf.GetSizes(s.oprfSuite)
+	if err != nil {
+		return err
+	}
+	if len(element) != int(sizes.SerializedElementLength) {
+		return fmt.Errorf("%w: blind element is %d bytes, want %d", ErrInvalidRequest, len(element), sizes.SerializedElementLength)
+	}
+	return nil
+}
+
+// bucketIDHexLength is the length of the hex bucket IDs of BucketIDToHex
+const bucketIDHexLength = 8
+
+// checkBucketID returns an error wrapping ErrInvalidRequest if the bucket ID
+// is not the hex ID of a bucket or of one of its overflow buckets
+func checkBucketID(bucketID string) error {
+	if _, err := hex.DecodeString(bucketID); err != nil {
+		return fmt.Errorf("%w: bucket ID is not valid hex", ErrInvalidRequest)
+	}
+	if len(bucketID) != bucketIDHexLength && len(bucketID) != bucketIDHexLength+2 {
+		return fmt.Errorf("%w: bucket ID is %d characters, want %d, or %d for an overflow bucket", ErrInvalidRequest, len(bucketID), bucketIDHexLength, bucketIDHexLength+2)
+	}
 	return nil
 }
 
@@ -220,31 +849,45 @@ type Getter interface {
 // that is a protobuf encoding of an oprf.IntValue (the Eval'd blinded value)
 // plus the associated bucket
 func (s *Server) HandleRequest(request ClientRequest, kv Getter) (ServerResponse, error) {
-	if uint16(request.Version) != s.version {
-		return ServerResponse{}, errors.New("requested version doesn't match server version")
+	if !s.SupportsVersion(request.Version) {
+		return ServerResponse{}, ErrUnsupportedVersion
 	}
 
-	evaluation, err := s.oprfServer.Evaluate([]oprf.Blinded{request.BlindElement}, OprfInfo)
+	oprfServer, err := s.oprfServerForKey(request.KeyID)
 	if err != nil {
 		return ServerResponse{}, err
 	}
-	if len(evaluation.Elements) < 1 {
-		return ServerResponse{}, errors.New("invalid Evaluation response")
+	if err := s.checkBlindElement(request.BlindElement); err != nil {
+		return ServerResponse{}, err
 	}
-
-	_, err = hex.DecodeString(request.BucketID)
+	if err := checkBucketID(request.BucketID); err != nil {
+		return ServerResponse{}, err
+	}
+	evaluation, err := oprfServer.Evaluate([]oprf.Blinded{request.BlindElement}, oprfInfo(s.oprfInfo, request.Tag))
 	if err != nil {
-		return ServerResponse{}, errors.New("bucket ID not valid hex")
+		// the element has the right length, so it failed to decode
+		return ServerResponse{}, fmt.Errorf("%w: blind element is not a valid group element: %v", ErrInvalidRequest, err)
+	}
+	if len(evaluation.Elements) < 1 {
+		return ServerResponse{}, errors.New("invalid Evaluation response")
 	}
 
-	bucketContents, err := kv.Get(request.BucketID)
-	if err != nil {
-		return ServerResponse{}, err
+	// clients already holding the bucket only need the evaluation
+	var bucketContents []byte
+	if !request.OmitBucket {
+		if bucketContents, err = kv.Get(request.BucketID); err != nil {
+			return ServerResponse{}, err
+		}
+		if bucketContents, err = s.padBucket(bucketContents); err != nil {
+			return ServerResponse{}, err
+		}
 	}
 
 	return ServerResponse{
 		Version:          request.Version,
+		KeyID:            request.KeyID,
 		EvaluatedElement: evaluation.Elements[0],
+		Proof:            serializeProof(evaluation.Proof),
 		BucketContents:   bucketContents,
 	}, nil
 }
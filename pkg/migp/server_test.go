@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"testing"
 
 	"github.com/cloudflare/circl/oprf"
@@ -66,9 +67,9 @@ func TestServerResponseSerialization(t *testing.T) {
 		t.Fatal(err)
 	}
 	r1 := ServerResponse{
-		123,
-		make([]byte, sizes.SerializedElementLength),
-		[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9},
+		Version:          123,
+		EvaluatedElement: make([]byte, sizes.SerializedElementLength),
+		BucketContents:   []byte{1, 2, 3, 4, 5, 6, 7, 8, 9},
 	}
 	if _, err := rand.Read(r1.EvaluatedElement); err != nil {
 		t.Fatal(err)
@@ -92,3 +93,397 @@ func TestServerResponseSerialization(t *testing.T) {
 		t.Fatal("mismatch")
 	}
 }
+
+// TestServerResponseSerializationKeyID tests that the key ID of responses for
+// a rotated key survives serialization
+func TestServerResponseSerializationKeyID(t *testing.T) {
+	sizes, err := oprf.GetSizes(DefaultOPRFSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1 := ServerResponse{
+		Version:          1,
+		KeyID:            7,
+		EvaluatedElement: make([]byte, sizes.SerializedElementLength),
+		BucketContents:   []byte{1, 2, 3},
+	}
+	data, err := r1.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r2 ServerResponse
+	if err = r2.unmarshalBinary(data, DefaultOPRFSuite, false, r1.KeyID); err != nil {
+		t.Fatal(err)
+	}
+	if r2.KeyID != r1.KeyID || !bytes.Equal(r1.BucketContents, r2.BucketContents) {
+		t.Fatalf("want key ID %d and bucket %v, got %d and %v", r1.KeyID, r1.BucketContents, r2.KeyID, r2.BucketContents)
+	}
+}
+
+// TestLimitMetadata tests that oversized metadata is rejected or truncated
+// according to the server configuration
+func TestLimitMetadata(t *testing.T) {
+	metadata := []byte("0123456789")
+
+	testCases := []struct {
+		maxMetadataBytes int
+		truncate         bool
+		out              []byte
+		oversized        bool
+		err              error
+	}{
+		{0, false, metadata, false, nil},
+		{10, false, metadata, false, nil},
+		{4, false, nil, true, ErrMetadataTooLarge},
+		{4, true, []byte("0123"), true, nil},
+	}
+
+	for i, test := range testCases {
+		cfg := DefaultServerConfig()
+		cfg.MaxMetadataBytes = test.maxMetadataBytes
+		cfg.TruncateMetadata = test.truncate
+		server, err := NewServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, oversized, err := server.LimitMetadata(metadata)
+		if err != test.err || oversized != test.oversized || !bytes.Equal(out, test.out) {
+			t.Errorf("failed test %d: want (%q, %v, %v), got (%q, %v, %v)",
+				i, test.out, test.oversized, test.err, out, oversized, err)
+		}
+	}
+}
+
+// TestHandleRequestUnsupportedVersion tests that requests for a version the
+// server does not support are rejected
+func TestHandleRequestUnsupportedVersion(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions := server.SupportedVersions(); len(versions) != 1 || versions[0] != DefaultMIGPVersion {
+		t.Fatalf("supported versions: want [%d], got %v", DefaultMIGPVersion, versions)
+	}
+
+	request := ClientRequest{Version: DefaultMIGPVersion + 1}
+	if _, err := server.HandleRequest(request, &KVMock{}); err != ErrUnsupportedVersion {
+		t.Fatalf("want %v, got %v", ErrUnsupportedVersion, err)
+	}
+}
+
+// TestHandleRequestUnknownKeyID tests that requests for a key epoch the server
+// does not hold are rejected
+func TestHandleRequestUnknownKeyID(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := ClientRequest{Version: DefaultMIGPVersion, KeyID: 1, BucketID: "00"}
+	if _, err := server.HandleRequest(request, &KVMock{}); err != ErrUnknownKeyID {
+		t.Fatalf("want %v, got %v", ErrUnknownKeyID, err)
+	}
+}
+
+// TestHandleRequestInvalidBlindElement tests that requests with a blinded
+// element of the wrong length are rejected before evaluation
+func TestHandleRequestInvalidBlindElement(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _, err := client.Request([]byte("user"), []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := [][]byte{nil, request.BlindElement[1:], append(request.BlindElement, 0)}
+	for i, element := range testCases {
+		invalid := request
+		invalid.BlindElement = element
+		if _, err := server.HandleRequest(invalid, &KVMock{}); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("failed test %d: want %v, got %v", i, ErrInvalidRequest, err)
+		}
+		batch, err := NewBatchClientRequest([]ClientRequest{request, invalid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.HandleBatchRequest(batch, &KVMock{}); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("failed test %d: batch: want %v, got %v", i, ErrInvalidRequest, err)
+		}
+	}
+}
+
+func TestCheckBucketID(t *testing.T) {
+	testCases := []struct {
+		bucketID string
+		valid    bool
+	}{
+		{BucketIDToHex(0x1e5d3), true},
+		{OverflowBucketID(BucketIDToHex(0x1e5d3), 1), true},
+		{"", false},
+		{"00", false},
+		{"0001e5d", false},
+		{"0001e5dz", false},
+		{"0001e5d30001", false},
+	}
+	for i, test := range testCases {
+		err := checkBucketID(test.bucketID)
+		if (err == nil) != test.valid || (err != nil && !errors.Is(err, ErrInvalidRequest)) {
+			t.Errorf("failed test %d: want valid %v, got %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestCheckAPIKey(t *testing.T) {
+	testCases := []struct {
+		apiKeys []string
+		key     string
+		ok      bool
+	}{
+		{nil, "", true},
+		{nil, "anything", true},
+		{[]string{"secret"}, "", false},
+		{[]string{"secret"}, "secre", false},
+		{[]string{"secret"}, "secret", true},
+		{[]string{"first", "second"}, "second", true},
+	}
+
+	for i, test := range testCases {
+		cfg := DefaultServerConfig()
+		cfg.APIKeys = test.apiKeys
+		server, err := NewServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := server.CheckAPIKey(test.key); ok != test.ok {
+			t.Errorf("failed test %d: want %v, got %v", i, test.ok, ok)
+		}
+	}
+
+	cfg := DefaultServerConfig()
+	cfg.APIKeys = []string{""}
+	if _, err := NewServer(cfg); err == nil {
+		t.Error("want error for an empty API key")
+	}
+}
+
+// TestBucketPadding tests that padded buckets have a length that is a multiple
+// of the padding, and that padding does not affect query results
+func TestBucketPadding(t *testing.T) {
+	entrySize := HeaderSize + len("metadata")
+	testCases := []struct {
+		padding int
+		entries int
+		size    int
+	}{
+		{0, 0, 0},
+		{0, 3, 3 * entrySize},
+		{100, 0, 100},
+		{100, 2, 100},
+		{100, 3, 200}, // 1 byte left is too little for a dummy entry
+		{entrySize, 2, 2 * entrySize},
+		{10, 1, 60},
+	}
+
+	for i, test := range testCases {
+		cfg := DefaultServerConfig()
+		cfg.SlowHasherID = SlowHasherNull
+		cfg.BucketPadding = test.padding
+		server, err := NewServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		username := []byte("user")
+		bucketID := BucketIDToHex(server.BucketID(username))
+		kv := &KVMock{store: map[string][]byte{}}
+		for j := 0; j < test.entries; j++ {
+			entry, err := server.EncryptBucketEntry(username, []byte{byte('a' + j)}, MetadataBreachedPassword, []byte("metadata"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			kv.store[bucketID] = append(kv.store[bucketID], entry...)
+		}
+		stored := len(kv.store[bucketID])
+
+		httpServer := newTestHTTPServer(t, server, kv)
+		client, err := NewClient(server.Config().Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j <= test.entries; j++ {
+			want := NotInBreach
+			if j < test.entries {
+				want = InBreach
+			}
+			result, err := client.QueryOne(httpServer.URL, username, []byte{byte('a' + j)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != want {
+				t.Errorf("failed test %d: password %d: want %s, got %s", i, j, want, result.Status)
+			}
+		}
+		httpServer.Close()
+
+		response, err := server.HandleRequest(ClientRequest{Version: DefaultMIGPVersion, BucketID: bucketID, BlindElement: make([]byte, 32)}, kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.BucketContents) != test.size || len(kv.store[bucketID]) != stored {
+			t.Errorf("failed test %d: want size %d, got %d", i, test.size, len(response.BucketContents))
+		}
+	}
+}
+
+func TestCountBucketEntries(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bucket []byte
+	for _, metadata := range []string{"", "metadata", "longer metadata for the third entry"} {
+		entry, err := server.EncryptBucketEntry([]byte("user"), []byte(metadata), MetadataBreachedPassword, []byte(metadata))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket = append(bucket, entry...)
+	}
+
+	testCases := []struct {
+		bucket []byte
+		count  int
+		valid  bool
+	}{
+		{nil, 0, true},
+		{bucket, 3, true},
+		{bucket[:len(bucket)-1], 2, false},
+		{bucket[:HeaderSize-1], 0, false},
+	}
+	for i, test := range testCases {
+		count, err := CountBucketEntries(test.bucket)
+		if count != test.count || (err == nil) != test.valid {
+			t.Errorf("failed test %d: want (%d, valid %v), got (%d, %v)", i, test.count, test.valid, count, err)
+		}
+	}
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	testCases := []struct {
+		modify func(*ServerConfig)
+		valid  bool
+	}{
+		{func(c *ServerConfig) {}, true},
+		{func(c *ServerConfig) { c.BucketIDBitSize = 0 }, false},
+		{func(c *ServerConfig) { c.PrivateKey = nil }, false},
+		{func(c *ServerConfig) { c.MaxMetadataBytes = -1 }, false},
+		{func(c *ServerConfig) { c.BucketPadding = -1 }, false},
+		{func(c *ServerConfig) { c.APIKeys = []string{"secret"} }, true},
+		{func(c *ServerConfig) { c.APIKeys = []string{"secret", ""} }, false},
+		{func(c *ServerConfig) {
+			if err := c.RotateKey(); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{func(c *ServerConfig) {
+			c.PreviousKeys = []ServerKey{{KeyID: c.KeyID, PrivateKey: c.PrivateKey}}
+		}, false},
+	}
+	for i, test := range testCases {
+		cfg := DefaultServerConfig()
+		test.modify(&cfg)
+		if err := cfg.Validate(); (err == nil) != test.valid {
+			t.Errorf("failed test %d: want valid %v, got %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestBucketHasEntry(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(username, password string, flag MetadataType) []byte {
+		entry, err := server.EncryptBucketEntry([]byte(username), []byte(password), flag, []byte("metadata"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+	entry := encrypt("user", "password", MetadataBreachedPassword)
+	bucket := append(encrypt("other", "password", MetadataBreachedPassword), entry...)
+
+	testCases := []struct {
+		bucket, entry []byte
+		found, valid  bool
+	}{
+		{nil, entry, false, true},
+		{bucket, entry, true, true},
+		{bucket, encrypt("user", "password", MetadataBreachedPassword), true, true},
+		{bucket, encrypt("user", "password", MetadataSimilarPassword), false, true},
+		{bucket, encrypt("user", "other", MetadataBreachedPassword), false, true},
+		{bucket[:len(bucket)-len(entry)], entry, false, true},
+		{bucket, entry[:HeaderSize-1], false, false},
+		{bucket[:HeaderSize-1], entry, false, false},
+	}
+	for i, test := range testCases {
+		found, err := BucketHasEntry(test.bucket, test.entry)
+		if found != test.found || (err == nil) != test.valid {
+			t.Errorf("failed test %d: want (%v, valid %v), got (%v, %v)", i, test.found, test.valid, found, err)
+		}
+	}
+}
+
+func TestRemoveBucketEntries(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bucket []byte
+	for _, entry := range []struct {
+		username, password string
+		flag               MetadataType
+	}{
+		{"user", "password", MetadataBreachedPassword},
+		{"other", "password", MetadataBreachedPassword},
+		{"user", "password", MetadataSimilarPassword},
+		{"user", "", MetadataBreachedUsername},
+	} {
+		encrypted, err := server.EncryptBucketEntry([]byte(entry.username), []byte(entry.password), entry.flag, []byte("metadata"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket = append(bucket, encrypted...)
+	}
+
+	testCases := []struct {
+		username, password string
+		flags              []MetadataType
+		removed, remaining int
+	}{
+		{"user", "password", nil, 2, 2},
+		{"user", "password", []MetadataType{MetadataSimilarPassword}, 1, 3},
+		{"user", "other", nil, 0, 4},
+		{"other", "password", nil, 1, 3},
+		{"user", "", nil, 1, 3},
+	}
+	for i, test := range testCases {
+		remaining, removed, err := server.RemoveBucketEntries(bucket, []byte(test.username), []byte(test.password), test.flags...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := CountBucketEntries(remaining)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != test.removed || count != test.remaining {
+			t.Errorf("failed test %d: want (%d removed, %d remaining), got (%d, %d)", i, test.removed, test.remaining, removed, count)
+		}
+	}
+
+	if _, _, err := server.RemoveBucketEntries(bucket[:len(bucket)-1], []byte("user"), []byte("password")); err == nil {
+		t.Error("truncated bucket: want error, got nil")
+	}
+}
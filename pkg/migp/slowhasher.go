@@ -6,12 +6,14 @@ package migp
 import (
 	"errors"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/scrypt"
 )
 
 const (
-	SlowHasherNull   uint16 = 0x0000
-	SlowHasherScrypt uint16 = 0x0001
+	SlowHasherNull     uint16 = 0x0000
+	SlowHasherScrypt   uint16 = 0x0001
+	SlowHasherArgon2id uint16 = 0x0002
 )
 
 const (
@@ -20,8 +22,29 @@ const (
 	ScryptN      = 16384 // scrypt N
 	Scryptr      = 8     // scrypt r
 	Scryptp      = 1     // scrypt p
+
+	Argon2Time    = 3         // argon2id number of passes
+	Argon2Memory  = 64 * 1024 // argon2id memory in KiB
+	Argon2Threads = 4         // argon2id degree of parallelism
 )
 
+// Argon2Params are the cost parameters of the argon2id slow hasher
+type Argon2Params struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+// DefaultArgon2Params returns the argon2id parameters recommended by RFC 9106
+// for memory-constrained environments
+func DefaultArgon2Params() Argon2Params {
+	return Argon2Params{
+		Time:    Argon2Time,
+		Memory:  Argon2Memory,
+		Threads: Argon2Threads,
+	}
+}
+
 // SlowHasher is a generic interface for a slow (memory hard) hash algorithm
 type SlowHasher interface {
 	ID() uint16
@@ -70,6 +93,36 @@ func (h scryptSlowHasher) Hash(buf []byte) []byte {
 	return temp[:]
 }
 
+// argon2idSlowHasher implements SlowHasher using argon2id
+type argon2idSlowHasher struct {
+	salt   string
+	params Argon2Params
+	L      uint32
+}
+
+// NewArgon2idSlowHasher returns a SlowHasher instance using argon2id with the
+// given parameters
+func NewArgon2idSlowHasher(params Argon2Params) (argon2idSlowHasher, error) {
+	if params.Time < 1 || params.Threads < 1 || params.Memory < 8*uint32(params.Threads) {
+		return argon2idSlowHasher{}, errors.New("invalid argon2id parameters")
+	}
+	return argon2idSlowHasher{
+		salt:   SlowHashSalt,
+		params: params,
+		L:      SlowHashLen,
+	}, nil
+}
+
+// ID returns the identifier of this particular hash function
+func (h argon2idSlowHasher) ID() uint16 {
+	return SlowHasherArgon2id
+}
+
+// Hash applies argon2id, with the corresponding parameters, to the input buf
+func (h argon2idSlowHasher) Hash(buf []byte) []byte {
+	return argon2.IDKey(buf, []byte(h.salt), h.params.Time, h.params.Memory, h.params.Threads, h.L)
+}
+
 // nullSlowHasher implements SlowHasher using a no-op
 type nullSlowHasher struct{}
 
@@ -83,19 +136,32 @@ func (h nullSlowHasher) ID() uint16 {
 	return SlowHasherNull
 }
 
-// Hash is a no-op, returning the input buf unmodified
+// Hash is a no-op, returning a copy of the input buf unmodified, which the
+// caller may zero independently of buf
 func (h nullSlowHasher) Hash(buf []byte) []byte {
-	return buf
+	return append([]byte(nil), buf...)
 }
 
-// NewHasher returns an slow hasher given its ID
+// NewHasher returns an slow hasher given its ID, using the default
+// parameters
 func NewSlowHasher(id uint16) (SlowHasher, error) {
 	switch id {
 	case SlowHasherNull:
 		return NewNullSlowHasher(), nil
 	case SlowHasherScrypt:
 		return NewScryptSlowHasher(), nil
+	case SlowHasherArgon2id:
+		return NewArgon2idSlowHasher(DefaultArgon2Params())
 	default:
-		return nil, errors.New("Unsupported slow hasher")
+		return nil, errors.New("unsupported slow hasher")
+	}
+}
+
+// NewSlowHasherFromConfig returns the slow hasher selected by the given
+// configuration, using its parameters if set
+func NewSlowHasherFromConfig(cfg Config) (SlowHasher, error) {
+	if cfg.SlowHasherID == SlowHasherArgon2id && cfg.Argon2 != nil {
+		return NewArgon2idSlowHasher(*cfg.Argon2)
 	}
+	return NewSlowHasher(cfg.SlowHasherID)
 }
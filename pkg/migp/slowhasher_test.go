@@ -3,7 +3,10 @@
 
 package migp
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+)
 
 // BenchmarkScryptSlowHasher runs benchmark tests for the scrypt slow hasher
 func BenchmarkScryptSlowHasher(b *testing.B) {
@@ -14,3 +17,65 @@ func BenchmarkScryptSlowHasher(b *testing.B) {
 		_ = slowHasher.Hash(input)
 	}
 }
+
+// BenchmarkArgon2idSlowHasher runs benchmark tests for the argon2id slow
+// hasher with the default parameters
+func BenchmarkArgon2idSlowHasher(b *testing.B) {
+	input := []byte{32}
+
+	slowHasher, err := NewArgon2idSlowHasher(DefaultArgon2Params())
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		_ = slowHasher.Hash(input)
+	}
+}
+
+func TestNewSlowHasherFromConfig(t *testing.T) {
+	input := []byte("input")
+	cheap := &Argon2Params{Time: 1, Memory: 64, Threads: 1}
+
+	cfg := DefaultConfig()
+	cfg.SlowHasherID = SlowHasherArgon2id
+	cfg.Argon2 = cheap
+	hasher, err := NewSlowHasherFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasher.ID() != SlowHasherArgon2id {
+		t.Errorf("want ID %#04x, got %#04x", SlowHasherArgon2id, hasher.ID())
+	}
+	out := hasher.Hash(input)
+	if len(out) != SlowHashLen {
+		t.Errorf("want %d bytes, got %d", SlowHashLen, len(out))
+	}
+
+	// different parameters produce a different hash
+	cfg.Argon2 = &Argon2Params{Time: 2, Memory: 64, Threads: 1}
+	other, err := NewSlowHasherFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(out, other.Hash(input)) {
+		t.Errorf("want different hashes for different parameters")
+	}
+
+	cfg.Argon2 = &Argon2Params{Time: 0, Memory: 64, Threads: 1}
+	if _, err := NewSlowHasherFromConfig(cfg); err == nil {
+		t.Errorf("want error for invalid parameters")
+	}
+}
+
+func TestServerAdvertisesArgon2Params(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SlowHasherID = SlowHasherArgon2id
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := server.Config().Argon2
+	if params == nil || *params != DefaultArgon2Params() {
+		t.Errorf("want %v, got %v", DefaultArgon2Params(), params)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/circl/oprf"
+)
+
+// knownSuites lists the OPRF suites of the circl oprf package, in order of
+// preference, along with their names.
+var knownSuites = []struct {
+	id   oprf.SuiteID
+	name string
+}{
+	{oprf.OPRFP256, "OPRF(P-256, SHA-256)"},
+	{oprf.OPRFP384, "OPRF(P-384, SHA-384)"},
+	{oprf.OPRFP521, "OPRF(P-521, SHA-512)"},
+}
+
+// SuiteInfo describes an OPRF suite supported by the linked oprf library.
+type SuiteInfo struct {
+	ID   oprf.SuiteID `json:"id"`
+	Name string       `json:"name"`
+	// ElementLength is the size in bytes of a serialized group element,
+	// i.e., of blinded and evaluated elements on the wire.
+	ElementLength int `json:"elementLength"`
+	// Verifiable indicates whether the suite can be used in verifiable
+	// (VOPRF) mode.
+	Verifiable bool `json:"verifiable"`
+}
+
+// supportedSuites caches the result of probing the linked oprf library,
+// which does not change while the process runs
+var supportedSuites struct {
+	once   sync.Once
+	suites []SuiteInfo
+}
+
+// SupportedSuites returns the OPRF suites supported by the linked oprf
+// library.
+func SupportedSuites() []SuiteInfo {
+	supportedSuites.once.Do(func() {
+		for _, suite := range knownSuites {
+			sizes, err := oprf.GetSizes(suite.id)
+			if err != nil {
+				continue
+			}
+			supportedSuites.suites = append(supportedSuites.suites, SuiteInfo{
+				ID:            suite.id,
+				Name:          suite.name,
+				ElementLength: int(sizes.SerializedElementLength),
+				Verifiable:    supportsVerifiable(suite.id),
+			})
+		}
+	})
+	return append([]SuiteInfo(nil), supportedSuites.suites...)
+}
+
+// supportsVerifiable reports whether a verifiable server and client can be
+// built for the given suite
+func supportsVerifiable(id oprf.SuiteID) bool {
+	privateKey, err := oprf.GenerateKey(id, rand.Reader)
+	if err != nil {
+		return false
+	}
+	if _, err := oprf.NewVerifiableServer(id, privateKey); err != nil {
+		return false
+	}
+	_, err = oprf.NewVerifiableClient(id, privateKey.Public())
+	return err == nil
+}
+
+// LookupSuite returns information on the OPRF suite with the given ID, or an
+// error listing the supported suites if it is not supported.
+func LookupSuite(id oprf.SuiteID) (SuiteInfo, error) {
+	suites := SupportedSuites()
+	names := make([]string, len(suites))
+	for i, suite := range suites {
+		if suite.ID == id {
+			return suite, nil
+		}
+		names[i] = fmt.Sprintf("%#04x %s", suite.ID, suite.Name)
+	}
+	return SuiteInfo{}, fmt.Errorf("unsupported OPRF suite %#04x (supported: %s)", id, strings.Join(names, ", "))
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migp
+
+import (
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+)
+
+// TestSupportedSuites tests that the default suite is reported as supported,
+// in verifiable mode too, and that unknown suites are rejected
+func TestSupportedSuites(t *testing.T) {
+	if len(SupportedSuites()) == 0 {
+		t.Fatal("no supported suites")
+	}
+
+	suite, err := LookupSuite(DefaultOPRFSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes, err := oprf.GetSizes(DefaultOPRFSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite.ElementLength != int(sizes.SerializedElementLength) {
+		t.Errorf("element length: want %d, got %d", sizes.SerializedElementLength, suite.ElementLength)
+	}
+
+	if !suite.Verifiable {
+		t.Error("default suite not reported as verifiable")
+	}
+
+	if _, err := LookupSuite(0xffff); err == nil {
+		t.Error("expected error for unsupported suite")
+	}
+}
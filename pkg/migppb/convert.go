@@ -0,0 +1,151 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package migppb holds the gRPC interface of MIGP servers, generated from
+// migp.proto, and converts its messages to and from the types of package
+// migp.
+package migppb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative migp.proto
+
+import (
+	"context"
+	"time"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/migp-go/pkg/migp"
+	"google.golang.org/protobuf/proto"
+)
+
+// NewEvaluateRequest returns the message of a client request
+func NewEvaluateRequest(r migp.ClientRequest) *EvaluateRequest {
+	return &EvaluateRequest{
+		Version:      r.Version,
+		KeyId:        r.KeyID,
+		Tag:          r.Tag,
+		BucketId:     r.BucketID,
+		BlindElement: r.BlindElement,
+		OmitBucket:   r.OmitBucket,
+	}
+}
+
+// ClientRequest returns the client request of the message
+func (r *EvaluateRequest) ClientRequest() migp.ClientRequest {
+	return migp.ClientRequest{
+		Version:      r.GetVersion(),
+		KeyID:        r.GetKeyId(),
+		Tag:          r.GetTag(),
+		BucketID:     r.GetBucketId(),
+		BlindElement: r.GetBlindElement(),
+		OmitBucket:   r.GetOmitBucket(),
+	}
+}
+
+// NewEvaluateResponse returns the message of a server response
+func NewEvaluateResponse(r migp.ServerResponse) *EvaluateResponse {
+	return &EvaluateResponse{
+		Version:          r.Version,
+		KeyId:            r.KeyID,
+		EvaluatedElement: r.EvaluatedElement,
+		Proof:            r.Proof,
+		BucketContents:   r.BucketContents,
+	}
+}
+
+// ServerResponse returns the server response of the message
+func (r *EvaluateResponse) ServerResponse() migp.ServerResponse {
+	return migp.ServerResponse{
+		Version:          r.GetVersion(),
+		KeyID:            r.GetKeyId(),
+		EvaluatedElement: r.GetEvaluatedElement(),
+		Proof:            r.GetProof(),
+		BucketContents:   r.GetBucketContents(),
+	}
+}
+
+// NewConfig returns the message of a client configuration
+func NewConfig(cfg migp.Config) *Config {
+	m := &Config{
+		Version:            uint32(cfg.Version),
+		BucketIdBitSize:    int32(cfg.BucketIDBitSize),
+		BucketHasher:       uint32(cfg.BucketHasherID),
+		SlowHasher:         uint32(cfg.SlowHasherID),
+		BucketEncryptor:    uint32(cfg.BucketEncryptorID),
+		OprfSuite:          uint32(cfg.OPRFSuite),
+		Verifiable:         cfg.Verifiable,
+		PublicKey:          cfg.PublicKey,
+		KeyId:              cfg.KeyID,
+		Tag:                cfg.Tag,
+		OprfInfo:           cfg.OPRFInfo,
+		OmitBucketRequests: cfg.OmitBucketRequests,
+		NormalizeUsernames: cfg.NormalizeUsernames,
+		MaxBucketEntries:   int32(cfg.MaxBucketEntries),
+		MaxRetries:         int32(cfg.MaxRetries),
+		RetryBaseDelay:     int64(cfg.RetryBaseDelay),
+	}
+	if cfg.Argon2 != nil {
+		m.Argon2 = &Argon2Params{Time: cfg.Argon2.Time, Memory: cfg.Argon2.Memory, Threads: uint32(cfg.Argon2.Threads)}
+	}
+	for _, epoch := range cfg.PreviousKeys {
+		m.PreviousKeys = append(m.PreviousKeys, &KeyEpoch{KeyId: epoch.KeyID, PublicKey: epoch.PublicKey})
+	}
+	return m
+}
+
+// Config returns the client configuration of the message. Binary requests
+// are an HTTP encoding, and are left disabled.
+func (m *Config) Config() migp.Config {
+	cfg := migp.Config{
+		Version:            uint16(m.GetVersion()),
+		BucketIDBitSize:    int(m.GetBucketIdBitSize()),
+		BucketHasherID:     uint16(m.GetBucketHasher()),
+		SlowHasherID:       uint16(m.GetSlowHasher()),
+		BucketEncryptorID:  uint16(m.GetBucketEncryptor()),
+		OPRFSuite:          oprf.SuiteID(m.GetOprfSuite()),
+		Verifiable:         m.GetVerifiable(),
+		PublicKey:          m.GetPublicKey(),
+		KeyID:              m.GetKeyId(),
+		Tag:                m.GetTag(),
+		OPRFInfo:           m.GetOprfInfo(),
+		OmitBucketRequests: m.GetOmitBucketRequests(),
+		NormalizeUsernames: m.GetNormalizeUsernames(),
+		MaxBucketEntries:   int(m.GetMaxBucketEntries()),
+		MaxRetries:         int(m.GetMaxRetries()),
+		RetryBaseDelay:     time.Duration(m.GetRetryBaseDelay()),
+	}
+	if a := m.GetArgon2(); a != nil {
+		cfg.Argon2 = &migp.Argon2Params{Time: a.GetTime(), Memory: a.GetMemory(), Threads: uint8(a.GetThreads())}
+	}
+	for _, epoch := range m.GetPreviousKeys() {
+		cfg.PreviousKeys = append(cfg.PreviousKeys, migp.KeyEpoch{KeyID: epoch.GetKeyId(), PublicKey: epoch.GetPublicKey()})
+	}
+	return cfg
+}
+
+// Evaluator sends the requests of migp.Client queries to the server behind
+// a gRPC connection. Implements migp.Evaluator
+type Evaluator struct {
+	Client MIGPClient
+}
+
+// Evaluate sends the request in an Evaluate call, reporting the size of the
+// response message
+func (e Evaluator) Evaluate(ctx context.Context, request migp.ClientRequest) (migp.ServerResponse, int, error) {
+	response, err := e.Client.Evaluate(ctx, NewEvaluateRequest(request))
+	if err != nil {
+		return migp.ServerResponse{}, 0, err
+	}
+	return response.ServerResponse(), proto.Size(response), nil
+}
+
+// Query looks up a credential pair with the server behind conn, returning its
+// breach status and metadata. Like the HTTP queries of migp.Client, it
+// queries the previous key epochs and overflow buckets of the client
+// configuration, with an Evaluate call for each request.
+func Query(ctx context.Context, client *migp.Client, conn MIGPClient, username, password []byte) (migp.BreachStatus, []byte, error) {
+	result, err := client.QueryEvaluator(ctx, Evaluator{Client: conn}, username, password)
+	if err != nil {
+		return migp.NotInBreach, nil, err
+	}
+	return result.Status, result.Metadata, nil
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package migppb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/migp-go/pkg/migp"
+	"google.golang.org/grpc"
+)
+
+// TestConvert checks that requests, responses and configurations are
+// unchanged by a round trip through their messages
+func TestConvert(t *testing.T) {
+	request := migp.ClientRequest{Version: 1, KeyID: 2, Tag: "tag", BucketID: "03", BlindElement: []byte("element"), OmitBucket: true}
+	if got := NewEvaluateRequest(request).ClientRequest(); !reflect.DeepEqual(got, request) {
+		t.Errorf("request: want %+v, got %+v", request, got)
+	}
+
+	response := migp.ServerResponse{Version: 1, KeyID: 2, EvaluatedElement: []byte("element"), Proof: []byte("proof"), BucketContents: []byte("contents")}
+	if got := NewEvaluateResponse(response).ServerResponse(); !reflect.DeepEqual(got, response) {
+		t.Errorf("response: want %+v, got %+v", response, got)
+	}
+
+	withKeys := migp.DefaultConfig()
+	withKeys.PublicKey = []byte("key2")
+	withKeys.KeyID = 2
+	withKeys.PreviousKeys = []migp.KeyEpoch{{KeyID: 1, PublicKey: []byte("key1")}}
+	withKeys.Argon2 = &migp.Argon2Params{Time: 1, Memory: 64 * 1024, Threads: 4}
+	withKeys.MaxBucketEntries = 100
+	withKeys.MaxRetries = 3
+	withKeys.RetryBaseDelay = time.Second
+	withKeys.OPRFInfo = "deployment"
+	withKeys.OmitBucketRequests = true
+
+	testCases := []migp.Config{migp.DefaultConfig(), withKeys}
+	for i, cfg := range testCases {
+		if got := NewConfig(cfg).Config(); !reflect.DeepEqual(got, cfg) {
+			t.Errorf("failed test %d: want %+v, got %+v", i, cfg, got)
+		}
+	}
+}
+
+// localClient serves the calls of a MIGP client with a server in-process.
+// Implements MIGPClient
+type localClient struct {
+	server *migp.Server
+	kv     mapGetter
+	calls  int
+}
+
+func (c *localClient) Evaluate(ctx context.Context, in *EvaluateRequest, opts ...grpc.CallOption) (*EvaluateResponse, error) {
+	c.calls++
+	response, err := c.server.HandleRequest(in.ClientRequest(), c.kv)
+	if err != nil {
+		return nil, err
+	}
+	return NewEvaluateResponse(response), nil
+}
+
+func (c *localClient) GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*Config, error) {
+	return NewConfig(c.server.Config().Config), nil
+}
+
+// mapGetter serves buckets from a map. Implements migp.Getter
+type mapGetter map[string][]byte
+
+func (g mapGetter) Get(id string) ([]byte, error) {
+	return g[id], nil
+}
+
+// TestQuery checks that queries find entries ingested under a previous key
+// epoch and in overflow buckets, with an Evaluate call for each bucket
+func TestQuery(t *testing.T) {
+	cfg := migp.DefaultServerConfig()
+	cfg.SlowHasherID = migp.SlowHasherNull
+	cfg.MaxBucketEntries = 1
+	kv := mapGetter{}
+	// insert adds the entry of a credential pair to the n-th bucket of the
+	// chain of its username
+	insert := func(server *migp.Server, username, password string, n int) {
+		entry, err := server.EncryptBucketEntry([]byte(username), []byte(password), migp.MetadataBreachedPassword, []byte(password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucketID := migp.OverflowBucketID(migp.BucketIDToHex(server.BucketID([]byte(username))), n)
+		kv[bucketID] = append(kv[bucketID], entry...)
+	}
+	oldServer, err := migp.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(oldServer, "old", "password", 0)
+	if err := cfg.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	server, err := migp.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(server, "overflow", "filler", 0)
+	insert(server, "overflow", "password", 1)
+
+	conn := &localClient{server: server, kv: kv}
+	m, err := conn.GetConfig(context.Background(), &GetConfigRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := migp.NewClient(m.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		username string
+		status   migp.BreachStatus
+		calls    int
+	}{
+		// the full bucket of the current epoch is followed by its
+		// overflow bucket, then the previous epoch
+		{"old", migp.InBreach, 3},
+		{"overflow", migp.InBreach, 2},
+	}
+	for i, test := range testCases {
+		conn.calls = 0
+		status, metadata, err := Query(context.Background(), client, conn, []byte(test.username), []byte("password"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != test.status || string(metadata) != "password" {
+			t.Errorf("failed test %d: want (%s, %q), got (%s, %q)", i, test.status, "password", status, metadata)
+		}
+		if conn.calls != test.calls {
+			t.Errorf("failed test %d: want %d calls, got %d", i, test.calls, conn.calls)
+		}
+	}
+}
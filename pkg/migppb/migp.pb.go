@@ -0,0 +1,637 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: migp.proto
+
+package migppb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// EvaluateRequest is a ClientRequest
+type EvaluateRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Version       uint32                 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	KeyId         uint32                 `protobuf:"varint,2,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	Tag           string                 `protobuf:"bytes,3,opt,name=tag,proto3" json:"tag,omitempty"`
+	BucketId      string                 `protobuf:"bytes,4,opt,name=bucket_id,json=bucketId,proto3" json:"bucket_id,omitempty"`
+	BlindElement  []byte                 `protobuf:"bytes,5,opt,name=blind_element,json=blindElement,proto3" json:"blind_element,omitempty"`
+	OmitBucket    bool                   `protobuf:"varint,6,opt,name=omit_bucket,json=omitBucket,proto3" json:"omit_bucket,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EvaluateRequest) Reset() {
+	*x = EvaluateRequest{}
+	mi := &file_migp_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EvaluateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EvaluateRequest) ProtoMessage() {}
+
+func (x *EvaluateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_migp_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EvaluateRequest.ProtoReflect.Descriptor instead.
+func (*EvaluateRequest) Descriptor() ([]byte, []int) {
+	return file_migp_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *EvaluateRequest) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *EvaluateRequest) GetKeyId() uint32 {
+	if x != nil {
+		return x.KeyId
+	}
+	return 0
+}
+
+func (x *EvaluateRequest) GetTag() string {
+	if x != nil {
+		return x.Tag
+	}
+	return ""
+}
+
+func (x *EvaluateRequest) GetBucketId() string {
+	if x != nil {
+		return x.BucketId
+	}
+	return ""
+}
+
+func (x *EvaluateRequest) GetBlindElement() []byte {
+	if x != nil {
+		return x.BlindElement
+	}
+	return nil
+}
+
+func (x *EvaluateRequest) GetOmitBucket() bool {
+	if x != nil {
+		return x.OmitBucket
+	}
+	return false
+}
+
+// EvaluateResponse is a ServerResponse
+type EvaluateResponse struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	Version          uint32                 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	KeyId            uint32                 `protobuf:"varint,2,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	EvaluatedElement []byte                 `protobuf:"bytes,3,opt,name=evaluated_element,json=evaluatedElement,proto3" json:"evaluated_element,omitempty"`
+	Proof            []byte                 `protobuf:"bytes,4,opt,name=proof,proto3" json:"proof,omitempty"`
+	BucketContents   []byte                 `protobuf:"bytes,5,opt,name=bucket_contents,json=bucketContents,proto3" json:"bucket_contents,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *EvaluateResponse) Reset() {
+	*x = EvaluateResponse{}
+	mi := &file_migp_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EvaluateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EvaluateResponse) ProtoMessage() {}
+
+func (x *EvaluateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_migp_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EvaluateResponse.ProtoReflect.Descriptor instead.
+func (*EvaluateResponse) Descriptor() ([]byte, []int) {
+	return file_migp_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *EvaluateResponse) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *EvaluateResponse) GetKeyId() uint32 {
+	if x != nil {
+		return x.KeyId
+	}
+	return 0
+}
+
+func (x *EvaluateResponse) GetEvaluatedElement() []byte {
+	if x != nil {
+		return x.EvaluatedElement
+	}
+	return nil
+}
+
+func (x *EvaluateResponse) GetProof() []byte {
+	if x != nil {
+		return x.Proof
+	}
+	return nil
+}
+
+func (x *EvaluateResponse) GetBucketContents() []byte {
+	if x != nil {
+		return x.BucketContents
+	}
+	return nil
+}
+
+type GetConfigRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetConfigRequest) Reset() {
+	*x = GetConfigRequest{}
+	mi := &file_migp_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetConfigRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetConfigRequest) ProtoMessage() {}
+
+func (x *GetConfigRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_migp_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetConfigRequest.ProtoReflect.Descriptor instead.
+func (*GetConfigRequest) Descriptor() ([]byte, []int) {
+	return file_migp_proto_rawDescGZIP(), []int{2}
+}
+
+// Argon2Params are the parameters of the argon2id slow hasher
+type Argon2Params struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Time          uint32                 `protobuf:"varint,1,opt,name=time,proto3" json:"time,omitempty"`
+	Memory        uint32                 `protobuf:"varint,2,opt,name=memory,proto3" json:"memory,omitempty"`
+	Threads       uint32                 `protobuf:"varint,3,opt,name=threads,proto3" json:"threads,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Argon2Params) Reset() {
+	*x = Argon2Params{}
+	mi := &file_migp_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Argon2Params) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Argon2Params) ProtoMessage() {}
+
+func (x *Argon2Params) ProtoReflect() protoreflect.Message {
+	mi := &file_migp_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Argon2Params.ProtoReflect.Descriptor instead.
+func (*Argon2Params) Descriptor() ([]byte, []int) {
+	return file_migp_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Argon2Params) GetTime() uint32 {
+	if x != nil {
+		return x.Time
+	}
+	return 0
+}
+
+func (x *Argon2Params) GetMemory() uint32 {
+	if x != nil {
+		return x.Memory
+	}
+	return 0
+}
+
+func (x *Argon2Params) GetThreads() uint32 {
+	if x != nil {
+		return x.Threads
+	}
+	return 0
+}
+
+// KeyEpoch is a key epoch of the server with its OPRF public key
+type KeyEpoch struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	KeyId         uint32                 `protobuf:"varint,1,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	PublicKey     []byte                 `protobuf:"bytes,2,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *KeyEpoch) Reset() {
+	*x = KeyEpoch{}
+	mi := &file_migp_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *KeyEpoch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*KeyEpoch) ProtoMessage() {}
+
+func (x *KeyEpoch) ProtoReflect() protoreflect.Message {
+	mi := &file_migp_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use KeyEpoch.ProtoReflect.Descriptor instead.
+func (*KeyEpoch) Descriptor() ([]byte, []int) {
+	return file_migp_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *KeyEpoch) GetKeyId() uint32 {
+	if x != nil {
+		return x.KeyId
+	}
+	return 0
+}
+
+func (x *KeyEpoch) GetPublicKey() []byte {
+	if x != nil {
+		return x.PublicKey
+	}
+	return nil
+}
+
+// Config is the client configuration of a MIGP server
+type Config struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	Version            uint32                 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	BucketIdBitSize    int32                  `protobuf:"varint,2,opt,name=bucket_id_bit_size,json=bucketIdBitSize,proto3" json:"bucket_id_bit_size,omitempty"`
+	BucketHasher       uint32                 `protobuf:"varint,3,opt,name=bucket_hasher,json=bucketHasher,proto3" json:"bucket_hasher,omitempty"`
+	SlowHasher         uint32                 `protobuf:"varint,4,opt,name=slow_hasher,json=slowHasher,proto3" json:"slow_hasher,omitempty"`
+	BucketEncryptor    uint32                 `protobuf:"varint,5,opt,name=bucket_encryptor,json=bucketEncryptor,proto3" json:"bucket_encryptor,omitempty"`
+	OprfSuite          uint32                 `protobuf:"varint,6,opt,name=oprf_suite,json=oprfSuite,proto3" json:"oprf_suite,omitempty"`
+	Argon2             *Argon2Params          `protobuf:"bytes,7,opt,name=argon2,proto3" json:"argon2,omitempty"`
+	Verifiable         bool                   `protobuf:"varint,8,opt,name=verifiable,proto3" json:"verifiable,omitempty"`
+	PublicKey          []byte                 `protobuf:"bytes,9,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	KeyId              uint32                 `protobuf:"varint,10,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	PreviousKeys       []*KeyEpoch            `protobuf:"bytes,11,rep,name=previous_keys,json=previousKeys,proto3" json:"previous_keys,omitempty"`
+	Tag                string                 `protobuf:"bytes,12,opt,name=tag,proto3" json:"tag,omitempty"`
+	NormalizeUsernames bool                   `protobuf:"varint,13,opt,name=normalize_usernames,json=normalizeUsernames,proto3" json:"normalize_usernames,omitempty"`
+	MaxBucketEntries   int32                  `protobuf:"varint,14,opt,name=max_bucket_entries,json=maxBucketEntries,proto3" json:"max_bucket_entries,omitempty"`
+	MaxRetries         int32                  `protobuf:"varint,15,opt,name=max_retries,json=maxRetries,proto3" json:"max_retries,omitempty"`
+	// retry_base_delay is in nanoseconds
+	RetryBaseDelay     int64  `protobuf:"varint,16,opt,name=retry_base_delay,json=retryBaseDelay,proto3" json:"retry_base_delay,omitempty"`
+	OprfInfo           string `protobuf:"bytes,17,opt,name=oprf_info,json=oprfInfo,proto3" json:"oprf_info,omitempty"`
+	OmitBucketRequests bool   `protobuf:"varint,18,opt,name=omit_bucket_requests,json=omitBucketRequests,proto3" json:"omit_bucket_requests,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *Config) Reset() {
+	*x = Config{}
+	mi := &file_migp_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Config) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Config) ProtoMessage() {}
+
+func (x *Config) ProtoReflect() protoreflect.Message {
+	mi := &file_migp_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Config.ProtoReflect.Descriptor instead.
+func (*Config) Descriptor() ([]byte, []int) {
+	return file_migp_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Config) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Config) GetBucketIdBitSize() int32 {
+	if x != nil {
+		return x.BucketIdBitSize
+	}
+	return 0
+}
+
+func (x *Config) GetBucketHasher() uint32 {
+	if x != nil {
+		return x.BucketHasher
+	}
+	return 0
+}
+
+func (x *Config) GetSlowHasher() uint32 {
+	if x != nil {
+		return x.SlowHasher
+	}
+	return 0
+}
+
+func (x *Config) GetBucketEncryptor() uint32 {
+	if x != nil {
+		return x.BucketEncryptor
+	}
+	return 0
+}
+
+func (x *Config) GetOprfSuite() uint32 {
+	if x != nil {
+		return x.OprfSuite
+	}
+	return 0
+}
+
+func (x *Config) GetArgon2() *Argon2Params {
+	if x != nil {
+		return x.Argon2
+	}
+	return nil
+}
+
+func (x *Config) GetVerifiable() bool {
+	if x != nil {
+		return x.Verifiable
+	}
+	return false
+}
+
+func (x *Config) GetPublicKey() []byte {
+	if x != nil {
+		return x.PublicKey
+	}
+	return nil
+}
+
+func (x *Config) GetKeyId() uint32 {
+	if x != nil {
+		return x.KeyId
+	}
+	return 0
+}
+
+func (x *Config) GetPreviousKeys() []*KeyEpoch {
+	if x != nil {
+		return x.PreviousKeys
+	}
+	return nil
+}
+
+func (x *Config) GetTag() string {
+	if x != nil {
+		return x.Tag
+	}
+	return ""
+}
+
+func (x *Config) GetNormalizeUsernames() bool {
+	if x != nil {
+		return x.NormalizeUsernames
+	}
+	return false
+}
+
+func (x *Config) GetMaxBucketEntries() int32 {
+	if x != nil {
+		return x.MaxBucketEntries
+	}
+	return 0
+}
+
+func (x *Config) GetMaxRetries() int32 {
+	if x != nil {
+		return x.MaxRetries
+	}
+	return 0
+}
+
+func (x *Config) GetRetryBaseDelay() int64 {
+	if x != nil {
+		return x.RetryBaseDelay
+	}
+	return 0
+}
+
+func (x *Config) GetOprfInfo() string {
+	if x != nil {
+		return x.OprfInfo
+	}
+	return ""
+}
+
+func (x *Config) GetOmitBucketRequests() bool {
+	if x != nil {
+		return x.OmitBucketRequests
+	}
+	return false
+}
+
+var File_migp_proto protoreflect.FileDescriptor
+
+const file_migp_proto_rawDesc = "" +
+	"\n" +
+	"\n" +
+	"migp.proto\x12\x04migp\"\xb7\x01\n" +
+	"\x0fEvaluateRequest\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\rR\aversion\x12\x15\n" +
+	"\x06key_id\x18\x02 \x01(\rR\x05keyId\x12\x10\n" +
+	"\x03tag\x18\x03 \x01(\tR\x03tag\x12\x1b\n" +
+	"\tbucket_id\x18\x04 \x01(\tR\bbucketId\x12#\n" +
+	"\rblind_element\x18\x05 \x01(\fR\fblindElement\x12\x1f\n" +
+	"\vomit_bucket\x18\x06 \x01(\bR\n" +
+	"omitBucket\"\xaf\x01\n" +
+	"\x10EvaluateResponse\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\rR\aversion\x12\x15\n" +
+	"\x06key_id\x18\x02 \x01(\rR\x05keyId\x12+\n" +
+	"\x11evaluated_element\x18\x03 \x01(\fR\x10evaluatedElement\x12\x14\n" +
+	"\x05proof\x18\x04 \x01(\fR\x05proof\x12'\n" +
+	"\x0fbucket_contents\x18\x05 \x01(\fR\x0ebucketContents\"\x12\n" +
+	"\x10GetConfigRequest\"T\n" +
+	"\fArgon2Params\x12\x12\n" +
+	"\x04time\x18\x01 \x01(\rR\x04time\x12\x16\n" +
+	"\x06memory\x18\x02 \x01(\rR\x06memory\x12\x18\n" +
+	"\athreads\x18\x03 \x01(\rR\athreads\"@\n" +
+	"\bKeyEpoch\x12\x15\n" +
+	"\x06key_id\x18\x01 \x01(\rR\x05keyId\x12\x1d\n" +
+	"\n" +
+	"public_key\x18\x02 \x01(\fR\tpublicKey\"\xa1\x05\n" +
+	"\x06Config\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\rR\aversion\x12+\n" +
+	"\x12bucket_id_bit_size\x18\x02 \x01(\x05R\x0fbucketIdBitSize\x12#\n" +
+	"\rbucket_hasher\x18\x03 \x01(\rR\fbucketHasher\x12\x1f\n" +
+	"\vslow_hasher\x18\x04 \x01(\rR\n" +
+	"slowHasher\x12)\n" +
+	"\x10bucket_encryptor\x18\x05 \x01(\rR\x0fbucketEncryptor\x12\x1d\n" +
+	"\n" +
+	"oprf_suite\x18\x06 \x01(\rR\toprfSuite\x12*\n" +
+	"\x06argon2\x18\a \x01(\v2\x12.migp.Argon2ParamsR\x06argon2\x12\x1e\n" +
+	"\n" +
+	"verifiable\x18\b \x01(\bR\n" +
+	"verifiable\x12\x1d\n" +
+	"\n" +
+	"public_key\x18\t \x01(\fR\tpublicKey\x12\x15\n" +
+	"\x06key_id\x18\n" +
+	" \x01(\rR\x05keyId\x123\n" +
+	"\rprevious_keys\x18\v \x03(\v2\x0e.migp.KeyEpochR\fpreviousKeys\x12\x10\n" +
+	"\x03tag\x18\f \x01(\tR\x03tag\x12/\n" +
+	"\x13normalize_usernames\x18\r \x01(\bR\x12normalizeUsernames\x12,\n" +
+	"\x12max_bucket_entries\x18\x0e \x01(\x05R\x10maxBucketEntries\x12\x1f\n" +
+	"\vmax_retries\x18\x0f \x01(\x05R\n" +
+	"maxRetries\x12(\n" +
+	"\x10retry_base_delay\x18\x10 \x01(\x03R\x0eretryBaseDelay\x12\x1b\n" +
+	"\toprf_info\x18\x11 \x01(\tR\boprfInfo\x120\n" +
+	"\x14omit_bucket_requests\x18\x12 \x01(\bR\x12omitBucketRequests2t\n" +
+	"\x04MIGP\x129\n" +
+	"\bEvaluate\x12\x15.migp.EvaluateRequest\x1a\x16.migp.EvaluateResponse\x121\n" +
+	"\tGetConfig\x12\x16.migp.GetConfigRequest\x1a\f.migp.ConfigB*Z(github.com/cloudflare/migp-go/pkg/migppbb\x06proto3"
+
+var (
+	file_migp_proto_rawDescOnce sync.Once
+	file_migp_proto_rawDescData []byte
+)
+
+func file_migp_proto_rawDescGZIP() []byte {
+	file_migp_proto_rawDescOnce.Do(func() {
+		file_migp_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_migp_proto_rawDesc), len(file_migp_proto_rawDesc)))
+	})
+	return file_migp_proto_rawDescData
+}
+
+var file_migp_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_migp_proto_goTypes = []any{
+	(*EvaluateRequest)(nil),  // 0: migp.EvaluateRequest
+	(*EvaluateResponse)(nil), // 1: migp.EvaluateResponse
+	(*GetConfigRequest)(nil), // 2: migp.GetConfigRequest
+	(*Argon2Params)(nil),     // 3: migp.Argon2Params
+	(*KeyEpoch)(nil),         // 4: migp.KeyEpoch
+	(*Config)(nil),           // 5: migp.Config
+}
+var file_migp_proto_depIdxs = []int32{
+	3, // 0: migp.Config.argon2:type_name -> migp.Argon2Params
+	4, // 1: migp.Config.previous_keys:type_name -> migp.KeyEpoch
+	0, // 2: migp.MIGP.Evaluate:input_type -> migp.EvaluateRequest
+	2, // 3: migp.MIGP.GetConfig:input_type -> migp.GetConfigRequest
+	1, // 4: migp.MIGP.Evaluate:output_type -> migp.EvaluateResponse
+	5, // 5: migp.MIGP.GetConfig:output_type -> migp.Config
+	4, // [4:6] is the sub-list for method output_type
+	2, // [2:4] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_migp_proto_init() }
+func file_migp_proto_init() {
+	if File_migp_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_migp_proto_rawDesc), len(file_migp_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_migp_proto_goTypes,
+		DependencyIndexes: file_migp_proto_depIdxs,
+		MessageInfos:      file_migp_proto_msgTypes,
+	}.Build()
+	File_migp_proto = out.File
+	file_migp_proto_goTypes = nil
+	file_migp_proto_depIdxs = nil
+}
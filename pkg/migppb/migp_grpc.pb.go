@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: migp.proto
+
+package migppb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	MIGP_Evaluate_FullMethodName  = "/migp.MIGP/Evaluate"
+	MIGP_GetConfig_FullMethodName = "/migp.MIGP/GetConfig"
+)
+
+// MIGPClient is the client API for MIGP service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// MIGP serves the MIGP protocol over gRPC, mirroring the /evaluate and
+// /config endpoints of the HTTP interface
+type MIGPClient interface {
+	// Evaluate blinds the element of a request with the server's OPRF key and
+	// returns it along with the contents of the requested bucket
+	Evaluate(ctx context.Context, in *EvaluateRequest, opts ...grpc.CallOption) (*EvaluateResponse, error)
+	// GetConfig returns the configuration clients query the server with
+	GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*Config, error)
+}
+
+type mIGPClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMIGPClient(cc grpc.ClientConnInterface) MIGPClient {
+	return &mIGPClient{cc}
+}
+
+func (c *mIGPClient) Evaluate(ctx context.Context, in *EvaluateRequest, opts ...grpc.CallOption) (*EvaluateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(EvaluateResponse)
+	err := c.cc.Invoke(ctx, MIGP_Evaluate_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mIGPClient) GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*Config, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Config)
+	err := c.cc.Invoke(ctx, MIGP_GetConfig_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MIGPServer is the server API for MIGP service.
+// All implementations must embed UnimplementedMIGPServer
+// for forward compatibility.
+//
+// MIGP serves the MIGP protocol over gRPC, mirroring the /evaluate and
+// /config endpoints of the HTTP interface
+type MIGPServer interface {
+	// Evaluate blinds the element of a request with the server's OPRF key and
+	// returns it along with the contents of the requested bucket
+	Evaluate(context.Context, *EvaluateRequest) (*EvaluateResponse, error)
+	// GetConfig returns the configuration clients query the server with
+	GetConfig(context.Context, *GetConfigRequest) (*Config, error)
+	mustEmbedUnimplementedMIGPServer()
+}
+
+// UnimplementedMIGPServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedMIGPServer struct{}
+
+func (UnimplementedMIGPServer) Evaluate(context.Context, *EvaluateRequest) (*EvaluateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Evaluate not implemented")
+}
+func (UnimplementedMIGPServer) GetConfig(context.Context, *GetConfigRequest) (*Config, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetConfig not implemented")
+}
+func (UnimplementedMIGPServer) mustEmbedUnimplementedMIGPServer() {}
+func (UnimplementedMIGPServer) testEmbeddedByValue()              {}
+
+// UnsafeMIGPServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MIGPServer will
+// result in compilation errors.
+type UnsafeMIGPServer interface {
+	mustEmbedUnimplementedMIGPServer()
+}
+
+func RegisterMIGPServer(s grpc.ServiceRegistrar, srv MIGPServer) {
+	// If the following call pancis, it indicates UnimplementedMIGPServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&MIGP_ServiceDesc, srv)
+}
+
+func _MIGP_Evaluate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EvaluateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MIGPServer).Evaluate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MIGP_Evaluate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MIGPServer).Evaluate(ctx, req.(*EvaluateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MIGP_GetConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MIGPServer).GetConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MIGP_GetConfig_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MIGPServer).GetConfig(ctx, req.(*GetConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// MIGP_ServiceDesc is the grpc.ServiceDesc for MIGP service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MIGP_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "migp.MIGP",
+	HandlerType: (*MIGPServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Evaluate",
+			Handler:    _MIGP_Evaluate_Handler,
+		},
+		{
+			MethodName: "GetConfig",
+			Handler:    _MIGP_GetConfig_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "migp.proto",
+}
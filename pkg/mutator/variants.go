@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	// VariantGeneratorRDas generates variants with the ordered Das et al.
+	// mangling rules. This is the default.
+	VariantGeneratorRDas = "rdas"
+	// VariantGeneratorNone generates no variants
+	VariantGeneratorNone = "none"
+)
+
+// VariantGenerator returns up to num variants of a breached password, which
+// are stored as similar passwords alongside the breach entry
+type VariantGenerator interface {
+	Variants(password []byte, num int) [][]byte
+}
+
+// Variants implements VariantGenerator with the ordered Das rules
+func (m *RDasMutator) Variants(password []byte, num int) [][]byte {
+	return m.Mutate(password, num)
+}
+
+// noVariants is a VariantGenerator that generates no variants
+type noVariants struct{}
+
+// Variants returns no variants
+func (noVariants) Variants([]byte, int) [][]byte {
+	return nil
+}
+
+// NewVariantGenerator returns the variant generator with the given name. The
+// empty name selects VariantGeneratorRDas.
+func NewVariantGenerator(name string) (VariantGenerator, error) {
+	switch name {
+	case "", VariantGeneratorRDas:
+		return NewRDasMutator(), nil
+	case VariantGeneratorNone:
+		return noVariants{}, nil
+	default:
+		return nil, errors.New("unsupported variant generator: " + name)
+	}
+}
+
+// NewRDasMutatorFromRules returns an RDasMutator applying the given rules, in
+// order, instead of the Das rules
+func NewRDasMutatorFromRules(rules []RDasRule) (*RDasMutator, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("no variant rules")
+	}
+	for i, rule := range rules {
+		switch rule.RuleType {
+		case "c", "d", "i", "s":
+		default:
+			return nil, fmt.Errorf("rule %d: unsupported rule type %q", i, rule.RuleType)
+		}
+	}
+	return &RDasMutator{dasRules: rules}, nil
+}
+
+// LoadRules reads variant rules from a JSON file holding an array of RDasRule,
+// in the format of the Das rules, e.g.,
+//
+//	[{"ruletype": "i", "position": -1, "string1": "1"}]
+func LoadRules(file string) ([]RDasRule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []RDasRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid variant rules in %s: %w", file, err)
+	}
+	return rules, nil
+}
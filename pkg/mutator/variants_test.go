@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Cloudflare, Inc. All rights reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mutator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewVariantGenerator(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+		some  bool
+	}{
+		{"", true, true},
+		{VariantGeneratorRDas, true, true},
+		{VariantGeneratorNone, true, false},
+		{"unknown", false, false},
+	}
+
+	for i, test := range tests {
+		generator, err := NewVariantGenerator(test.name)
+		if (err == nil) != test.valid {
+			t.Errorf("failed test %d: want valid %v, got error %v", i, test.valid, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if variants := generator.Variants([]byte("hello"), 10); (len(variants) > 0) != test.some {
+			t.Errorf("failed test %d: want variants %v, got %d", i, test.some, len(variants))
+		}
+	}
+}
+
+// TestLoadRules tests that variants are generated from the rules of a file,
+// in order
+func TestLoadRules(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+		{"ruletype": "i", "position": -1, "string1": "1"},
+		{"ruletype": "c", "position": 0},
+		{"ruletype": "d", "position": -1}
+	]`
+	if err := os.WriteFile(file, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadRules(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generator, err := NewRDasMutatorFromRules(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		num int
+		out []string
+	}{
+		{10, []string{"hello!1", "Hello!", "hello"}},
+		{2, []string{"hello!1", "Hello!"}},
+	}
+	for i, test := range tests {
+		variants := generator.Variants([]byte("hello!"), test.num)
+		if len(variants) != len(test.out) {
+			t.Errorf("failed test %d: want %q, got %q", i, test.out, variants)
+			continue
+		}
+		for j := range variants {
+			if string(variants[j]) != test.out[j] {
+				t.Errorf("failed test %d: want %q, got %q", i, test.out, variants)
+				break
+			}
+		}
+	}
+
+	if _, err := NewRDasMutatorFromRules([]RDasRule{{RuleType: "x"}}); err == nil {
+		t.Error("want error for unsupported rule type")
+	}
+}